@@ -0,0 +1,411 @@
+package iex
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+)
+
+// Maximum number of payloads read ahead from each source
+// of an ArbitratedDataSource.
+const arbitrationReadAhead = 1024
+
+// Default amount of time to wait for a gap on one source
+// of an ArbitratedDataSource to be filled by another.
+const defaultGapTimeout = 5 * time.Second
+
+// Maximum number of segments held for each session of an
+// ArbitratedDataSource while waiting for a gap to be filled.
+const maxPendingSegments = 4 * arbitrationReadAhead
+
+// A payload received from one of the sources of an ArbitratedDataSource.
+type sourcedPayload struct {
+	source  int
+	payload []byte
+	err     error
+}
+
+// A segment waiting for the gap preceding it to be filled.
+type pendingSegment struct {
+	header   iextp.SegmentHeader
+	payload  []byte
+	received time.Time
+}
+
+// Arbitration state for a single IEX-TP session.
+type arbitratedSession struct {
+	// Sequence number of the next message to emit.
+	nextSeq int64
+	// Sequence number of the last heartbeat emitted.
+	lastHeartbeat int64
+	// SendTime of the most recent (re)start of the session, and of the
+	// latest segment received. Segments sent before the session restarted
+	// are stale and dropped.
+	startTime time.Time
+	lastSent  time.Time
+	// Segments received ahead of nextSeq, sorted by sequence number.
+	pending []pendingSegment
+	// When the gap before the first pending segment opened, which is
+	// when the earliest of the pending segments was received.
+	gapOpened time.Time
+	// The end sequence number of the latest segment from each source.
+	reached []int64
+}
+
+// ArbitratedDataSource implements PacketDataSource by combining redundant
+// sources of the same IEX-TP channels, such as the A and B multicast
+// feeds, or pcap dumps captured from each of them.
+//
+// Segments are emitted in sequence order for each session, starting from
+// the first segment received for the session from any source. Segments
+// already emitted from one source are dropped when received from another.
+// A segment missing from one source is filled from the others. If all
+// sources have skipped past a gap (or reached the end of their data),
+// or if the gap timeout expires, or if too many segments are waiting for
+// it to be filled, the arbiter gives up on filling the gap and emits the
+// following segments, so that the gap can be detected downstream by the
+// PcapScanner.
+//
+// Payloads that cannot be decoded as an IEX-TP segment are passed through
+// in the order they are received.
+type ArbitratedDataSource struct {
+	payloads   chan sourcedPayload
+	done       chan struct{}
+	closeOnce  sync.Once
+	nSources   int
+	gapTimeout time.Duration
+
+	sessions map[sessionKey]*arbitratedSession
+	ready    [][]byte
+	finished []bool
+	nActive  int
+	err      error
+}
+
+// NewArbitratedDataSource creates a new ArbitratedDataSource that reads
+// concurrently from all of the given sources.
+func NewArbitratedDataSource(sources ...PacketDataSource) *ArbitratedDataSource {
+	ads := &ArbitratedDataSource{
+		payloads:   make(chan sourcedPayload, arbitrationReadAhead*len(sources)),
+		done:       make(chan struct{}),
+		nSources:   len(sources),
+		gapTimeout: defaultGapTimeout,
+		sessions:   make(map[sessionKey]*arbitratedSession),
+		finished:   make([]bool, len(sources)),
+		nActive:    len(sources),
+	}
+
+	for i, source := range sources {
+		go ads.readSource(i, source)
+	}
+
+	return ads
+}
+
+// SetGapTimeout sets the maximum amount of time to wait for a gap on one
+// source to be filled by another (5s by default). This is primarily useful
+// for live sources, where a source that has stopped receiving data would
+// otherwise hold up all other sources. A timeout of 0 waits until every
+// source has skipped past the gap, or until too many segments are waiting
+// for it to be filled, so it should only be used with sources that end,
+// such as pcap dumps.
+func (ads *ArbitratedDataSource) SetGapTimeout(d time.Duration) {
+	ads.gapTimeout = d
+}
+
+// Close stops reading from the underlying sources.
+//
+// NOTE: Close does not interrupt a source that is blocked in NextPayload;
+// live sources should be closed separately.
+func (ads *ArbitratedDataSource) Close() error {
+	ads.closeOnce.Do(func() { close(ads.done) })
+	return nil
+}
+
+func (ads *ArbitratedDataSource) readSource(i int, source PacketDataSource) {
+	for {
+		payload, err := source.NextPayload()
+		var buf []byte
+		if len(payload) > 0 {
+			buf = make([]byte, len(payload))
+			copy(buf, payload)
+		}
+
+		select {
+		case ads.payloads <- sourcedPayload{i, buf, err}:
+		case <-ads.done:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// NextPayload implements PacketDataSource.
+//
+// Returns io.EOF once all sources have returned io.EOF, or the first
+// other error returned by any of the sources once all sources are done.
+func (ads *ArbitratedDataSource) NextPayload() ([]byte, error) {
+	for len(ads.ready) == 0 {
+		if ads.nActive == 0 {
+			ads.flushAll()
+			if len(ads.ready) == 0 {
+				return nil, ads.finalError()
+			}
+			break
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if deadline, ok := ads.nextDeadline(); ok {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		select {
+		case p := <-ads.payloads:
+			ads.handle(p)
+		case <-timeout:
+			ads.expireGaps(time.Now())
+		case <-ads.done:
+			return nil, io.EOF
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+
+	payload := ads.ready[0]
+	ads.ready[0] = nil
+	ads.ready = ads.ready[1:]
+	return payload, nil
+}
+
+func (ads *ArbitratedDataSource) finalError() error {
+	if ads.err != nil {
+		return ads.err
+	}
+	return io.EOF
+}
+
+func (ads *ArbitratedDataSource) handle(p sourcedPayload) {
+	if p.err != nil {
+		if p.err != io.EOF && ads.err == nil {
+			ads.err = p.err
+		}
+		ads.finished[p.source] = true
+		ads.nActive--
+		// The finished source can no longer fill any gaps.
+		for _, session := range ads.sortedSessions() {
+			ads.skipUnfillableGap(session)
+		}
+		return
+	}
+
+	var header iextp.SegmentHeader
+	if err := header.Unmarshal(p.payload); err != nil {
+		ads.ready = append(ads.ready, p.payload)
+		return
+	}
+
+	key := sessionKeyOf(&header)
+	session, ok := ads.sessions[key]
+	first := header.FirstMessageSequenceNumber
+	isRestart := ok && first == 1 && header.StreamOffset == 0 &&
+		header.SendTime.After(session.lastSent)
+	if isRestart {
+		ads.flush(session)
+	}
+	if !ok || isRestart {
+		session = &arbitratedSession{
+			nextSeq:   first,
+			startTime: header.SendTime,
+			reached:   make([]int64, ads.nSources),
+		}
+		ads.sessions[key] = session
+	}
+
+	if header.SendTime.Before(session.startTime) {
+		return // Stale segment from before the session restarted.
+	}
+	if header.SendTime.After(session.lastSent) {
+		session.lastSent = header.SendTime
+	}
+
+	end := first + int64(header.MessageCount)
+	if end > session.reached[p.source] {
+		session.reached[p.source] = end
+	}
+
+	switch {
+	case header.MessageCount == 0:
+		if first == session.nextSeq && first != session.lastHeartbeat {
+			session.lastHeartbeat = first
+			ads.ready = append(ads.ready, p.payload)
+		}
+	case end <= session.nextSeq:
+		// Duplicate of a segment that has already been emitted.
+	case first <= session.nextSeq:
+		ads.emit(session, header, p.payload)
+		ads.drain(session)
+	default:
+		ads.addPending(session, pendingSegment{header, p.payload, time.Now()})
+	}
+
+	ads.skipUnfillableGap(session)
+}
+
+func (ads *ArbitratedDataSource) emit(session *arbitratedSession, header iextp.SegmentHeader, payload []byte) {
+	ads.ready = append(ads.ready, payload)
+	session.nextSeq = header.FirstMessageSequenceNumber + int64(header.MessageCount)
+}
+
+func (ads *ArbitratedDataSource) addPending(session *arbitratedSession, ps pendingSegment) {
+	first := ps.header.FirstMessageSequenceNumber
+	i := sort.Search(len(session.pending), func(i int) bool {
+		return session.pending[i].header.FirstMessageSequenceNumber >= first
+	})
+
+	if i < len(session.pending) && session.pending[i].header.FirstMessageSequenceNumber == first {
+		return // Already received from another source.
+	}
+
+	if len(session.pending) == 0 {
+		session.gapOpened = ps.received
+	}
+	session.pending = append(session.pending, pendingSegment{})
+	copy(session.pending[i+1:], session.pending[i:])
+	session.pending[i] = ps
+
+	for len(session.pending) > maxPendingSegments {
+		ads.skipGap(session)
+	}
+}
+
+// Emit all pending segments that are now contiguous with nextSeq.
+func (ads *ArbitratedDataSource) drain(session *arbitratedSession) {
+	defer session.updateGapOpened()
+	for len(session.pending) > 0 {
+		ps := session.pending[0]
+		first := ps.header.FirstMessageSequenceNumber
+		if first > session.nextSeq {
+			return
+		}
+
+		session.pending = session.pending[1:]
+		end := first + int64(ps.header.MessageCount)
+		if end > session.nextSeq {
+			ads.emit(session, ps.header, ps.payload)
+		}
+	}
+}
+
+// Set the time at which the gap before the remaining pending segments
+// opened, since the segments that were received earliest may have been
+// emitted.
+func (session *arbitratedSession) updateGapOpened() {
+	session.gapOpened = time.Time{}
+	for _, ps := range session.pending {
+		if session.gapOpened.IsZero() || ps.received.Before(session.gapOpened) {
+			session.gapOpened = ps.received
+		}
+	}
+}
+
+// Skip the gap before the first pending segment and emit the following
+// segments.
+func (ads *ArbitratedDataSource) skipGap(session *arbitratedSession) {
+	if len(session.pending) == 0 {
+		return
+	}
+
+	session.nextSeq = session.pending[0].header.FirstMessageSequenceNumber
+	ads.drain(session)
+}
+
+// Skip the current gap if none of the sources can fill it, because they
+// have all either finished or already moved past it.
+func (ads *ArbitratedDataSource) skipUnfillableGap(session *arbitratedSession) {
+	for len(session.pending) > 0 {
+		for i, reached := range session.reached {
+			if !ads.finished[i] && reached <= session.nextSeq {
+				return
+			}
+		}
+
+		ads.skipGap(session)
+	}
+}
+
+func (ads *ArbitratedDataSource) flush(session *arbitratedSession) {
+	for len(session.pending) > 0 {
+		ads.skipGap(session)
+	}
+}
+
+func (ads *ArbitratedDataSource) flushAll() {
+	for _, session := range ads.sortedSessions() {
+		ads.flush(session)
+	}
+}
+
+// Returns the sessions in order of their keys, so that segments
+// of different sessions are emitted in a deterministic order.
+func (ads *ArbitratedDataSource) sortedSessions() []*arbitratedSession {
+	keys := make([]sessionKey, 0, len(ads.sessions))
+	for key := range ads.sessions {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.messageProtocolID != b.messageProtocolID {
+			return a.messageProtocolID < b.messageProtocolID
+		}
+		if a.channelID != b.channelID {
+			return a.channelID < b.channelID
+		}
+		return a.sessionID < b.sessionID
+	})
+
+	sessions := make([]*arbitratedSession, len(keys))
+	for i, key := range keys {
+		sessions[i] = ads.sessions[key]
+	}
+	return sessions
+}
+
+// Returns the earliest time at which a pending gap will expire.
+func (ads *ArbitratedDataSource) nextDeadline() (time.Time, bool) {
+	if ads.gapTimeout <= 0 {
+		return time.Time{}, false
+	}
+
+	var deadline time.Time
+	for _, session := range ads.sessions {
+		if len(session.pending) == 0 {
+			continue
+		}
+
+		d := session.gapOpened.Add(ads.gapTimeout)
+		if deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+
+	return deadline, !deadline.IsZero()
+}
+
+func (ads *ArbitratedDataSource) expireGaps(now time.Time) {
+	for _, session := range ads.sortedSessions() {
+		for len(session.pending) > 0 &&
+			!now.Before(session.gapOpened.Add(ads.gapTimeout)) {
+			ads.skipGap(session)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package iex
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp/deep"
+)
+
+// Create a payloadSource with one segment per message in [1, n],
+// excluding the given sequence numbers.
+func makeLineSource(t *testing.T, n int64, missing ...int64) *payloadSource {
+	isMissing := make(map[int64]bool)
+	for _, seq := range missing {
+		isMissing[seq] = true
+	}
+
+	source := &payloadSource{}
+	for seq := int64(1); seq <= n; seq++ {
+		if !isMissing[seq] {
+			source.payloads = append(source.payloads, makeTestSegment(t, seq, 1))
+		}
+	}
+
+	return source
+}
+
+// blockingSource returns payloads sent on a channel, and io.EOF
+// once the channel is closed.
+type blockingSource chan []byte
+
+func (bs blockingSource) NextPayload() ([]byte, error) {
+	payload, ok := <-bs
+	if !ok {
+		return nil, io.EOF
+	}
+	return payload, nil
+}
+
+func TestArbitratedDataSource(t *testing.T) {
+	lineA := makeLineSource(t, 20, 3, 4, 10, 20)
+	lineB := makeLineSource(t, 20, 2, 5, 11, 12, 13)
+	source := NewArbitratedDataSource(lineA, lineB)
+	defer source.Close()
+
+	scanner := NewPcapScanner(source)
+	scanner.SetGapHandler(func(gap Gap) {
+		t.Fatalf("unexpected gap: %v", gap)
+	})
+
+	tradeIDs := scanTradeIDs(t, scanner)
+	var expected []int64
+	for seq := int64(1); seq <= 20; seq++ {
+		expected = append(expected, seq)
+	}
+
+	if !reflect.DeepEqual(tradeIDs, expected) {
+		t.Fatalf("scanned: %v, expected: %v", tradeIDs, expected)
+	}
+
+	if dups := scanner.Stats().DuplicateMessages; dups != 0 {
+		t.Fatalf("arbitrated source emitted %v duplicate messages", dups)
+	}
+}
+
+func TestArbitratedDataSource_UnfillableGap(t *testing.T) {
+	lineA := makeLineSource(t, 10, 4, 5, 6)
+	lineB := makeLineSource(t, 10, 2, 5)
+	source := NewArbitratedDataSource(lineA, lineB)
+	defer source.Close()
+
+	scanner := NewPcapScanner(source)
+	var gaps []Gap
+	scanner.SetGapHandler(func(gap Gap) {
+		gaps = append(gaps, gap)
+	})
+
+	tradeIDs := scanTradeIDs(t, scanner)
+	expected := []int64{1, 2, 3, 4, 6, 7, 8, 9, 10}
+	if !reflect.DeepEqual(tradeIDs, expected) {
+		t.Fatalf("scanned: %v, expected: %v", tradeIDs, expected)
+	}
+
+	if len(gaps) != 1 || gaps[0].FirstSequenceNumber != 5 || gaps[0].Count != 1 {
+		t.Fatalf("expected gap at sequence number 5, got: %v", gaps)
+	}
+}
+
+func TestArbitratedDataSource_GapTimeout(t *testing.T) {
+	lineA := makeLineSource(t, 5, 3)
+	lineB := make(blockingSource)
+	defer close(lineB)
+
+	source := NewArbitratedDataSource(lineA, lineB)
+	source.SetGapTimeout(50 * time.Millisecond)
+	defer source.Close()
+
+	// Line B never sends anything, so the gap at sequence number 3 should
+	// be skipped once the timeout expires.
+	start := time.Now()
+	scanner := NewPcapScanner(source)
+	var tradeIDs []int64
+	for i := 0; i < 4; i++ {
+		msg, err := scanner.NextMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tradeIDs = append(tradeIDs, msg.(*deep.TradeReportMessage).TradeID)
+	}
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("gap should not have been skipped before the timeout (%v)", elapsed)
+	}
+
+	expected := []int64{1, 2, 4, 5}
+	if !reflect.DeepEqual(tradeIDs, expected) {
+		t.Fatalf("scanned: %v, expected: %v", tradeIDs, expected)
+	}
+
+	if stats := scanner.Stats(); stats.Gaps != 1 || stats.MissingMessages != 1 {
+		t.Fatalf("expected 1 missing message, got: %+v", stats)
+	}
+}
+
+func TestArbitratedDataSource_GapDeadline(t *testing.T) {
+	lineA, lineB := make(blockingSource), make(blockingSource)
+	defer close(lineA)
+	defer close(lineB)
+
+	ads := NewArbitratedDataSource(lineA, lineB)
+	defer ads.Close()
+
+	ads.handle(sourcedPayload{source: 0, payload: makeTestSegment(t, 1, 1)})
+	ads.handle(sourcedPayload{source: 0, payload: makeTestSegment(t, 5, 1)})
+	deadline, ok := ads.nextDeadline()
+	if !ok {
+		t.Fatal("expected a pending gap")
+	}
+
+	// A segment received later inside the gap does not extend it.
+	time.Sleep(10 * time.Millisecond)
+	ads.handle(sourcedPayload{source: 0, payload: makeTestSegment(t, 3, 1)})
+	if d, ok := ads.nextDeadline(); !ok || !d.Equal(deadline) {
+		t.Fatalf("gap deadline: %v, expected: %v", d, deadline)
+	}
+}
+
+func TestArbitratedDataSource_MaxPending(t *testing.T) {
+	n := int64(maxPendingSegments + 10)
+	lineA := makeLineSource(t, n, 2)
+	lineB := make(blockingSource)
+	defer close(lineB)
+
+	source := NewArbitratedDataSource(lineA, lineB)
+	source.SetGapTimeout(0)
+	defer source.Close()
+
+	// Line B never sends anything, so the gap at sequence number 2
+	// should be skipped once too many segments are pending.
+	scanner := NewPcapScanner(source)
+	for i := int64(0); i < n-1; i++ {
+		if _, err := scanner.NextMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stats := scanner.Stats(); stats.Gaps != 1 || stats.MissingMessages != 1 {
+		t.Fatalf("expected 1 missing message, got: %+v", stats)
+	}
+}
+
+func TestArbitratedDataSource_DEEP10(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping pcap test in short mode.")
+	}
+
+	testFilename := filepath.Join("testdata", "DEEP10.pcap.gz")
+	var sources []PacketDataSource
+	for i := 0; i < 2; i++ {
+		f, err := os.Open(testFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		packetDataSource, err := NewPcapDataSource(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, packetDataSource)
+	}
+
+	source := NewArbitratedDataSource(sources...)
+	defer source.Close()
+
+	scanner := NewPcapScanner(source)
+	count := 0
+	for {
+		_, err := scanner.NextMessage()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+
+	if count != 391999 {
+		t.Fatalf("expected to process 391999 messages, got: %v", count)
+	}
+
+	if stats := scanner.Stats(); stats.Gaps != 0 || stats.DuplicateMessages != 0 {
+		t.Fatalf("unexpected gaps or duplicates: %+v", stats)
+	}
+}
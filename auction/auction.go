@@ -0,0 +1,273 @@
+// Package auction tracks the IEX opening, closing, IPO, halt and
+// volatility auctions of each symbol from the auction information
+// messages of the TOPS, DEEP and DEEP+ feeds, along with their results.
+package auction
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+	"github.com/xuforr/go-iex/iextp/tops"
+)
+
+// TypeName returns the name of the given auction type
+// (e.g. "Opening" for tops.OpeningAuction).
+func TypeName(auctionType uint8) string {
+	switch auctionType {
+	case tops.OpeningAuction:
+		return "Opening"
+	case tops.ClosingAuction:
+		return "Closing"
+	case tops.IPOAuction:
+		return "IPO"
+	case tops.HaltAuction:
+		return "Halt"
+	case tops.VolatilityAuction:
+		return "Volatility"
+	default:
+		return fmt.Sprintf("%#02x", auctionType)
+	}
+}
+
+// Update is the state of an auction as of a single
+// auction information message.
+type Update struct {
+	// The time of the update.
+	Timestamp time.Time
+	// Number of shares paired at the reference price.
+	PairedShares uint32
+	// Clearing price at or within the reference price range.
+	ReferencePrice float64
+	// Clearing price using eligible auction orders.
+	IndicativeClearingPrice float64
+	// Number of unpaired shares at the reference price,
+	// and the side of the imbalance (e.g. tops.BuySideImbalance).
+	ImbalanceShares uint32
+	ImbalanceSide   uint8
+	// Number of automatic extensions the auction has received.
+	ExtensionNumber uint8
+	// Projected time of the auction match.
+	ScheduledAuctionTime time.Time
+	// Clearing price using orders on the auction book.
+	AuctionBookClearingPrice float64
+	// Reference price of the auction collar, and its lower
+	// and upper thresholds, if any.
+	CollarReferencePrice float64
+	LowerAuctionCollar   float64
+	UpperAuctionCollar   float64
+}
+
+// UpdateFromMessage returns the Update described by
+// the given AuctionInformationMessage.
+func UpdateFromMessage(msg *tops.AuctionInformationMessage) Update {
+	return Update{
+		Timestamp:                msg.Timestamp,
+		PairedShares:             msg.PairedShares,
+		ReferencePrice:           msg.ReferencePrice,
+		IndicativeClearingPrice:  msg.IndicativeClearingPrice,
+		ImbalanceShares:          msg.ImbalanceShares,
+		ImbalanceSide:            msg.ImbalanceSide,
+		ExtensionNumber:          msg.ExtensionNumber,
+		ScheduledAuctionTime:     msg.ScheduledAuctionTime,
+		AuctionBookClearingPrice: msg.AuctionBookClearingPrice,
+		CollarReferencePrice:     msg.CollarReferencePrice,
+		LowerAuctionCollar:       msg.LowerAuctionCollar,
+		UpperAuctionCollar:       msg.UpperAuctionCollar,
+	}
+}
+
+// Auction is a single auction in a symbol.
+type Auction struct {
+	Symbol string
+	// The type of the auction (e.g. tops.ClosingAuction).
+	Type uint8
+	// The time series of auction information updates, in order.
+	Updates []Update
+	// Whether the auction has completed, and the time at which
+	// its completion was indicated by the feed.
+	Completed     bool
+	CompletedTime time.Time
+	// The official price resulting from an opening or closing auction,
+	// or 0 if no official price has been received.
+	OfficialPrice float64
+}
+
+// Start returns the time of the first update of the auction.
+func (a *Auction) Start() time.Time {
+	return a.Updates[0].Timestamp
+}
+
+// Last returns the latest update of the auction.
+func (a *Auction) Last() Update {
+	return a.Updates[len(a.Updates)-1]
+}
+
+// Extensions returns the number of extensions the auction received.
+func (a *Auction) Extensions() int {
+	return int(a.Last().ExtensionNumber)
+}
+
+// MaxImbalanceShares returns the largest imbalance of the auction.
+func (a *Auction) MaxImbalanceShares() uint32 {
+	var max uint32
+	for _, u := range a.Updates {
+		if u.ImbalanceShares > max {
+			max = u.ImbalanceShares
+		}
+	}
+	return max
+}
+
+// Whether the given update is part of the auction. An extension
+// may be announced after the previous scheduled time has passed.
+func (a *Auction) includes(u Update) bool {
+	if a.Completed {
+		return false
+	}
+	last := a.Last()
+	return u.ExtensionNumber > last.ExtensionNumber || !u.Timestamp.After(last.ScheduledAuctionTime)
+}
+
+// CompleteFunc is called when an auction completes.
+type CompleteFunc func(a *Auction)
+
+// Tracker maintains the auctions of every symbol in a feed.
+//
+// An auction starts with its first auction information message, and
+// completes when its result is indicated by the feed: by the official
+// price of an opening or closing auction, the opening or closing process
+// completing (in DEEP), or trading resuming after an IPO, halt or
+// volatility auction. An update received after the scheduled time of
+// an incomplete auction starts a new auction, unless it extends it.
+type Tracker struct {
+	auctions []*Auction
+	// The latest auction of each symbol and type.
+	current map[auctionKey]*Auction
+
+	onComplete []CompleteFunc
+}
+
+type auctionKey struct {
+	symbol      string
+	auctionType uint8
+}
+
+// NewTracker creates a Tracker with no auctions.
+func NewTracker() *Tracker {
+	return &Tracker{
+		current: make(map[auctionKey]*Auction),
+	}
+}
+
+// OnComplete registers f to be called each time an auction completes.
+// Callbacks are invoked synchronously from Process, in the order
+// they were registered.
+func (t *Tracker) OnComplete(f CompleteFunc) {
+	t.onComplete = append(t.onComplete, f)
+}
+
+// Process updates the tracked auctions with the given message. Messages
+// other than auction information, official price, trading status and
+// security event messages are ignored.
+//
+// Returns true if an auction was updated or completed.
+func (t *Tracker) Process(msg iextp.Message) bool {
+	switch msg := msg.(type) {
+	case *tops.AuctionInformationMessage:
+		t.update(msg)
+		return true
+	case *tops.OfficialPriceMessage:
+		auctionType := tops.OpeningAuction
+		if msg.PriceType == tops.ClosingPrice {
+			auctionType = tops.ClosingAuction
+		}
+
+		a := t.incomplete(msg.Symbol, auctionType)
+		if a == nil {
+			return false
+		}
+
+		a.OfficialPrice = msg.OfficialPrice
+		t.complete(a, msg.Timestamp)
+		return true
+	case *deep.SecurityEventMessage:
+		switch msg.SecurityEvent {
+		case deep.OpeningProcessComplete:
+			return t.completeIncomplete(msg.Timestamp, msg.Symbol, tops.OpeningAuction)
+		case deep.ClosingProcessComplete:
+			return t.completeIncomplete(msg.Timestamp, msg.Symbol, tops.ClosingAuction)
+		default:
+			return false
+		}
+	case *tops.TradingStatusMessage:
+		if msg.TradingStatus != tops.Trading {
+			return false
+		}
+
+		return t.completeIncomplete(msg.Timestamp, msg.Symbol,
+			tops.IPOAuction, tops.HaltAuction, tops.VolatilityAuction)
+	default:
+		return false
+	}
+}
+
+func (t *Tracker) update(msg *tops.AuctionInformationMessage) {
+	u := UpdateFromMessage(msg)
+	key := auctionKey{msg.Symbol, msg.AuctionType}
+	a := t.current[key]
+	if a == nil || !a.includes(u) {
+		a = &Auction{Symbol: msg.Symbol, Type: msg.AuctionType}
+		t.auctions = append(t.auctions, a)
+		t.current[key] = a
+	}
+
+	a.Updates = append(a.Updates, u)
+}
+
+// Get the incomplete auction of the given symbol and type, if any.
+func (t *Tracker) incomplete(symbol string, auctionType uint8) *Auction {
+	a := t.current[auctionKey{symbol, auctionType}]
+	if a == nil || a.Completed {
+		return nil
+	}
+	return a
+}
+
+// Complete the incomplete auctions of the given symbol and types.
+func (t *Tracker) completeIncomplete(ts time.Time, symbol string, auctionTypes ...uint8) bool {
+	completed := false
+	for _, auctionType := range auctionTypes {
+		if a := t.incomplete(symbol, auctionType); a != nil {
+			t.complete(a, ts)
+			completed = true
+		}
+	}
+	return completed
+}
+
+func (t *Tracker) complete(a *Auction, ts time.Time) {
+	a.Completed = true
+	a.CompletedTime = ts
+	for _, f := range t.onComplete {
+		f(a)
+	}
+}
+
+// Auctions returns all of the auctions, in the order they started.
+func (t *Tracker) Auctions() []*Auction {
+	return append([]*Auction(nil), t.auctions...)
+}
+
+// AuctionsOf returns the auctions of the given symbol,
+// in the order they started.
+func (t *Tracker) AuctionsOf(symbol string) []*Auction {
+	var result []*Auction
+	for _, a := range t.auctions {
+		if a.Symbol == symbol {
+			result = append(result, a)
+		}
+	}
+	return result
+}
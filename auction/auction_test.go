@@ -0,0 +1,233 @@
+package auction
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+	"github.com/xuforr/go-iex/iextp/tops"
+	"github.com/xuforr/go-iex/internal/testpcap"
+)
+
+var auctionTime = time.Date(2017, time.July, 10, 20, 0, 0, 0, time.UTC)
+
+func at(seconds int) time.Time {
+	return auctionTime.Add(time.Duration(seconds) * time.Second)
+}
+
+func auctionInformation(auctionType uint8, seconds int, imbalance uint32, scheduled time.Time) *tops.AuctionInformationMessage {
+	return &tops.AuctionInformationMessage{
+		MessageType:             tops.AuctionInformation,
+		AuctionType:             auctionType,
+		Timestamp:               at(seconds),
+		Symbol:                  "ZIEXT",
+		PairedShares:            1000,
+		ReferencePrice:          20,
+		IndicativeClearingPrice: 19.99,
+		ImbalanceShares:         imbalance,
+		ImbalanceSide:           tops.BuySideImbalance,
+		ScheduledAuctionTime:    scheduled,
+		CollarReferencePrice:    20,
+		LowerAuctionCollar:      18,
+		UpperAuctionCollar:      22,
+	}
+}
+
+func TestTracker_ClosingAuction(t *testing.T) {
+	tracker := NewTracker()
+	var completed []*Auction
+	tracker.OnComplete(func(a *Auction) {
+		completed = append(completed, a)
+	})
+
+	for i, imbalance := range []uint32{500, 1500, 200} {
+		msg := auctionInformation(tops.ClosingAuction, i, imbalance, at(60))
+		if !tracker.Process(msg) {
+			t.Fatal("auction information should update an auction")
+		}
+	}
+
+	official := &tops.OfficialPriceMessage{
+		MessageType:   tops.OfficialPrice,
+		PriceType:     tops.ClosingPrice,
+		Timestamp:     at(60),
+		Symbol:        "ZIEXT",
+		OfficialPrice: 20.01,
+	}
+	if !tracker.Process(official) {
+		t.Fatal("official price should complete the auction")
+	}
+	// There is no auction to complete for another symbol.
+	other := *official
+	other.Symbol = "ZXIET"
+	if tracker.Process(&other) {
+		t.Fatal("official price of another symbol should be ignored")
+	}
+
+	auctions := tracker.Auctions()
+	if len(auctions) != 1 || len(completed) != 1 || completed[0] != auctions[0] {
+		t.Fatalf("expected 1 completed auction, got: %v (%v completed)", len(auctions), len(completed))
+	}
+
+	a := auctions[0]
+	if a.Type != tops.ClosingAuction || len(a.Updates) != 3 || a.MaxImbalanceShares() != 1500 {
+		t.Fatalf("unexpected auction: %+v", a)
+	}
+	if !a.Completed || !a.CompletedTime.Equal(at(60)) || a.OfficialPrice != 20.01 {
+		t.Fatalf("unexpected auction result: %+v", a)
+	}
+
+	// The next closing auction in the symbol is a new auction.
+	tracker.Process(auctionInformation(tops.ClosingAuction, 86400, 100, at(86460)))
+	if auctions := tracker.AuctionsOf("ZIEXT"); len(auctions) != 2 || auctions[1].Completed {
+		t.Fatalf("expected a new auction, got: %v", auctions)
+	}
+}
+
+func TestTracker_HaltAuction(t *testing.T) {
+	tracker := NewTracker()
+	tracker.Process(auctionInformation(tops.HaltAuction, 0, 100, at(300)))
+	// Extended by five minutes.
+	extended := auctionInformation(tops.HaltAuction, 299, 300, at(600))
+	extended.ExtensionNumber = 1
+	tracker.Process(extended)
+	tracker.Process(auctionInformation(tops.OpeningAuction, 400, 100, at(3600)))
+
+	resumed := &tops.TradingStatusMessage{
+		MessageType:   tops.TradingStatus,
+		TradingStatus: tops.Trading,
+		Timestamp:     at(600),
+		Symbol:        "ZIEXT",
+	}
+	if !tracker.Process(resumed) {
+		t.Fatal("trading should complete the halt auction")
+	}
+	if tracker.Process(resumed) {
+		t.Fatal("halt auction should only be completed once")
+	}
+
+	auctions := tracker.AuctionsOf("ZIEXT")
+	if len(auctions) != 2 {
+		t.Fatalf("expected 2 auctions, got: %v", len(auctions))
+	}
+
+	halt, opening := auctions[0], auctions[1]
+	if !halt.Completed || halt.Extensions() != 1 || !halt.Last().ScheduledAuctionTime.Equal(at(600)) {
+		t.Fatalf("unexpected halt auction: %+v", halt)
+	}
+	if opening.Completed {
+		t.Fatal("opening auction should not be completed by trading")
+	}
+
+	// Completed by the opening process (DEEP only).
+	tracker.Process(&deep.SecurityEventMessage{
+		MessageType:   deep.SecurityEvent,
+		SecurityEvent: deep.OpeningProcessComplete,
+		Timestamp:     at(3600),
+		Symbol:        "ZIEXT",
+	})
+	if !opening.Completed || opening.OfficialPrice != 0 {
+		t.Fatalf("unexpected opening auction: %+v", opening)
+	}
+}
+
+func TestTracker_LateExtension(t *testing.T) {
+	tracker := NewTracker()
+	tracker.Process(auctionInformation(tops.HaltAuction, 0, 100, at(300)))
+	// Extended after the originally scheduled time.
+	extended := auctionInformation(tops.HaltAuction, 301, 300, at(600))
+	extended.ExtensionNumber = 1
+	tracker.Process(extended)
+
+	auctions := tracker.Auctions()
+	if len(auctions) != 1 || len(auctions[0].Updates) != 2 || auctions[0].Extensions() != 1 {
+		t.Fatalf("expected 1 extended auction, got: %v", auctions)
+	}
+	if !auctions[0].Last().ScheduledAuctionTime.Equal(at(600)) {
+		t.Fatalf("unexpected scheduled time: %v", auctions[0].Last().ScheduledAuctionTime)
+	}
+}
+
+func TestTracker_MissedCompletion(t *testing.T) {
+	tracker := NewTracker()
+	tracker.Process(auctionInformation(tops.VolatilityAuction, 0, 100, at(300)))
+	tracker.Process(auctionInformation(tops.VolatilityAuction, 1000, 100, at(1300)))
+
+	auctions := tracker.Auctions()
+	if len(auctions) != 2 || auctions[0].Completed || len(auctions[1].Updates) != 1 {
+		t.Fatalf("expected a new auction after the scheduled time, got: %v", auctions)
+	}
+}
+
+func TestWriteSummaryCSV(t *testing.T) {
+	tracker := NewTracker()
+	tracker.Process(auctionInformation(tops.ClosingAuction, 0, 500, at(60)))
+	tracker.Process(auctionInformation(tops.ClosingAuction, 1, 200, at(60)))
+	tracker.Process(&tops.OfficialPriceMessage{
+		MessageType:   tops.OfficialPrice,
+		PriceType:     tops.ClosingPrice,
+		Timestamp:     at(60),
+		Symbol:        "ZIEXT",
+		OfficialPrice: 20.01,
+	})
+	tracker.Process(auctionInformation(tops.IPOAuction, 2, 0, at(60)))
+
+	var buf bytes.Buffer
+	if err := WriteSummaryCSV(&buf, tracker.Auctions()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "symbol,type,first_update,last_update,updates,scheduled_auction_time,extensions," +
+		"paired_shares,imbalance_shares,imbalance_side,reference_price,indicative_clearing_price," +
+		"lower_auction_collar,upper_auction_collar,max_imbalance_shares,completed,completed_time,official_price\n" +
+		"ZIEXT,Closing,2017-07-10T20:00:00Z,2017-07-10T20:00:01Z,2,2017-07-10T20:01:00Z,0," +
+		"1000,200,B,20.0000,19.9900,18.0000,22.0000,500,true,2017-07-10T20:01:00Z,20.0100\n" +
+		"ZIEXT,IPO,2017-07-10T20:00:02Z,2017-07-10T20:00:02Z,1,2017-07-10T20:01:00Z,0," +
+		"1000,0,B,20.0000,19.9900,18.0000,22.0000,0,false,,0.0000\n"
+	if buf.String() != expected {
+		t.Fatalf("summary:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestTypeName(t *testing.T) {
+	for auctionType, expected := range map[uint8]string{
+		tops.OpeningAuction:    "Opening",
+		tops.ClosingAuction:    "Closing",
+		tops.IPOAuction:        "IPO",
+		tops.HaltAuction:       "Halt",
+		tops.VolatilityAuction: "Volatility",
+		0x5a:                   "0x5a",
+	} {
+		if name := TypeName(auctionType); name != expected {
+			t.Errorf("TypeName(%#x) = %v, expected: %v", auctionType, name, expected)
+		}
+	}
+}
+
+func TestTracker_TOPS16(t *testing.T) {
+	tracker := NewTracker()
+	testpcap.Scan(t, "TOPS16.pcapng.gz", func(msg iextp.Message) {
+		tracker.Process(msg)
+	})
+
+	// Opening and closing auctions in each of the 10 test securities.
+	counts := make(map[uint8]int)
+	nUpdates := 0
+	for _, a := range tracker.Auctions() {
+		counts[a.Type]++
+		nUpdates += len(a.Updates)
+	}
+	if counts[tops.OpeningAuction] != 10 || counts[tops.ClosingAuction] != 10 || len(counts) != 2 {
+		t.Fatalf("unexpected auctions: %v", counts)
+	}
+	if nUpdates != 642 {
+		t.Fatalf("expected 642 auction updates, got %v", nUpdates)
+	}
+
+	ziext := tracker.AuctionsOf("ZIEXT")
+	if len(ziext) != 2 || ziext[0].MaxImbalanceShares() != 2536 {
+		t.Fatalf("unexpected ZIEXT auctions: %v", ziext)
+	}
+}
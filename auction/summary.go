@@ -0,0 +1,140 @@
+package auction
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Summary summarizes a single auction, for export as a table.
+type Summary struct {
+	Symbol string
+	// Name of the auction type (see TypeName).
+	Type string
+	// The times of the first and last updates of the auction.
+	FirstUpdate time.Time
+	LastUpdate  time.Time
+	Updates     int
+	// The scheduled time of the auction match, including any extensions.
+	ScheduledAuctionTime time.Time
+	Extensions           int
+	// The state of the auction as of its last update.
+	PairedShares            uint32
+	ImbalanceShares         uint32
+	ImbalanceSide           uint8
+	ReferencePrice          float64
+	IndicativeClearingPrice float64
+	LowerAuctionCollar      float64
+	UpperAuctionCollar      float64
+	// The largest imbalance over the course of the auction.
+	MaxImbalanceShares uint32
+	// The result of the auction, if it has completed.
+	Completed     bool
+	CompletedTime time.Time
+	OfficialPrice float64
+}
+
+// Summary returns the summary of the auction.
+func (a *Auction) Summary() Summary {
+	last := a.Last()
+	return Summary{
+		Symbol:                  a.Symbol,
+		Type:                    TypeName(a.Type),
+		FirstUpdate:             a.Start(),
+		LastUpdate:              last.Timestamp,
+		Updates:                 len(a.Updates),
+		ScheduledAuctionTime:    last.ScheduledAuctionTime,
+		Extensions:              a.Extensions(),
+		PairedShares:            last.PairedShares,
+		ImbalanceShares:         last.ImbalanceShares,
+		ImbalanceSide:           last.ImbalanceSide,
+		ReferencePrice:          last.ReferencePrice,
+		IndicativeClearingPrice: last.IndicativeClearingPrice,
+		LowerAuctionCollar:      last.LowerAuctionCollar,
+		UpperAuctionCollar:      last.UpperAuctionCollar,
+		MaxImbalanceShares:      a.MaxImbalanceShares(),
+		Completed:               a.Completed,
+		CompletedTime:           a.CompletedTime,
+		OfficialPrice:           a.OfficialPrice,
+	}
+}
+
+var summaryHeader = []string{
+	"symbol",
+	"type",
+	"first_update",
+	"last_update",
+	"updates",
+	"scheduled_auction_time",
+	"extensions",
+	"paired_shares",
+	"imbalance_shares",
+	"imbalance_side",
+	"reference_price",
+	"indicative_clearing_price",
+	"lower_auction_collar",
+	"upper_auction_collar",
+	"max_imbalance_shares",
+	"completed",
+	"completed_time",
+	"official_price",
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func formatPrice(price float64) string {
+	return strconv.FormatFloat(price, 'f', 4, 64)
+}
+
+func (s Summary) csvRecord() []string {
+	side := ""
+	if s.ImbalanceSide != 0 {
+		side = string(rune(s.ImbalanceSide))
+	}
+
+	return []string{
+		s.Symbol,
+		s.Type,
+		formatTime(s.FirstUpdate),
+		formatTime(s.LastUpdate),
+		strconv.Itoa(s.Updates),
+		formatTime(s.ScheduledAuctionTime),
+		strconv.Itoa(s.Extensions),
+		strconv.FormatUint(uint64(s.PairedShares), 10),
+		strconv.FormatUint(uint64(s.ImbalanceShares), 10),
+		side,
+		formatPrice(s.ReferencePrice),
+		formatPrice(s.IndicativeClearingPrice),
+		formatPrice(s.LowerAuctionCollar),
+		formatPrice(s.UpperAuctionCollar),
+		strconv.FormatUint(uint64(s.MaxImbalanceShares), 10),
+		strconv.FormatBool(s.Completed),
+		formatTime(s.CompletedTime),
+		formatPrice(s.OfficialPrice),
+	}
+}
+
+// WriteSummaryCSV writes a summary table of the given auctions to w in
+// CSV format, with a header row followed by a row per auction. The side
+// of the imbalance is written as its identifier, e.g. "B" for buy side.
+func WriteSummaryCSV(w io.Writer, auctions []*Auction) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(summaryHeader); err != nil {
+		return err
+	}
+
+	for _, a := range auctions {
+		if err := writer.Write(a.Summary().csvRecord()); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,156 @@
+// Package bbo tracks IEX's best bid and offer for each symbol
+// from the TOPS quote update messages.
+package bbo
+
+import (
+	"sort"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/tops"
+)
+
+// Quote is the best bid and offer for a symbol on IEX.
+type Quote struct {
+	Symbol string
+	// Size of the quote at the bid, in number of shares.
+	BidSize uint32
+	// Price of the quote at the bid.
+	BidPrice float64
+	// Price of the quote at the ask.
+	AskPrice float64
+	// Size of the quote at the ask, in number of shares.
+	AskSize uint32
+	// Whether the symbol is available for trading on IEX.
+	Active bool
+	// Whether the quote was updated during the regular market session.
+	RegularMarketSession bool
+	// The time of the last quote update for the symbol.
+	Timestamp time.Time
+}
+
+// HasBid returns true if there is a bid for the symbol.
+func (q Quote) HasBid() bool {
+	return q.BidSize != 0
+}
+
+// HasAsk returns true if there is an offer for the symbol.
+func (q Quote) HasAsk() bool {
+	return q.AskSize != 0
+}
+
+// IsTwoSided returns true if there is both a bid and an offer.
+func (q Quote) IsTwoSided() bool {
+	return q.HasBid() && q.HasAsk()
+}
+
+// Spread returns the difference between the ask and bid prices,
+// or 0 if the quote is not two-sided.
+func (q Quote) Spread() float64 {
+	if !q.IsTwoSided() {
+		return 0
+	}
+
+	return q.AskPrice - q.BidPrice
+}
+
+// Midpoint returns the average of the bid and ask prices,
+// or 0 if the quote is not two-sided.
+func (q Quote) Midpoint() float64 {
+	if !q.IsTwoSided() {
+		return 0
+	}
+
+	return (q.BidPrice + q.AskPrice) / 2
+}
+
+// Equal returns true if the two quotes have the same prices, sizes
+// and flags. Timestamps are not compared.
+func (q Quote) Equal(other Quote) bool {
+	return q.Symbol == other.Symbol &&
+		q.BidSize == other.BidSize &&
+		q.BidPrice == other.BidPrice &&
+		q.AskPrice == other.AskPrice &&
+		q.AskSize == other.AskSize &&
+		q.Active == other.Active &&
+		q.RegularMarketSession == other.RegularMarketSession
+}
+
+// FromMessage returns the Quote described by the given QuoteUpdateMessage.
+func FromMessage(msg *tops.QuoteUpdateMessage) Quote {
+	return Quote{
+		Symbol:               msg.Symbol,
+		BidSize:              msg.BidSize,
+		BidPrice:             msg.BidPrice,
+		AskPrice:             msg.AskPrice,
+		AskSize:              msg.AskSize,
+		Active:               msg.IsActive(),
+		RegularMarketSession: msg.IsRegularMarketSession(),
+		Timestamp:            msg.Timestamp,
+	}
+}
+
+// ChangeFunc is called when the quote for a symbol changes.
+// prev is the zero Quote if this is the first quote for the symbol.
+type ChangeFunc func(prev, cur Quote)
+
+// Tracker maintains the latest Quote for every symbol in a TOPS feed.
+type Tracker struct {
+	quotes   map[string]Quote
+	onChange []ChangeFunc
+}
+
+// NewTracker creates a Tracker with no quotes.
+func NewTracker() *Tracker {
+	return &Tracker{
+		quotes: make(map[string]Quote),
+	}
+}
+
+// OnChange registers f to be called each time a quote changes.
+// Callbacks are invoked synchronously from Process, in the order
+// they were registered.
+func (t *Tracker) OnChange(f ChangeFunc) {
+	t.onChange = append(t.onChange, f)
+}
+
+// Process updates the tracked quotes with the given message.
+// Messages other than QuoteUpdateMessages are ignored.
+//
+// Returns true if the quote for the message's symbol changed.
+func (t *Tracker) Process(msg iextp.Message) bool {
+	qu, ok := msg.(*tops.QuoteUpdateMessage)
+	if !ok {
+		return false
+	}
+
+	cur := FromMessage(qu)
+	prev, exists := t.quotes[qu.Symbol]
+	t.quotes[qu.Symbol] = cur
+	if exists && prev.Equal(cur) {
+		return false
+	}
+
+	for _, f := range t.onChange {
+		f(prev, cur)
+	}
+
+	return true
+}
+
+// Quote returns the current quote for the given symbol.
+// Returns false if no quote has been received for the symbol.
+func (t *Tracker) Quote(symbol string) (Quote, bool) {
+	q, ok := t.quotes[symbol]
+	return q, ok
+}
+
+// Symbols returns the sorted list of symbols with a quote.
+func (t *Tracker) Symbols() []string {
+	symbols := make([]string, 0, len(t.quotes))
+	for symbol := range t.quotes {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
@@ -0,0 +1,139 @@
+package bbo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/tops"
+	"github.com/xuforr/go-iex/internal/testpcap"
+)
+
+var quoteTime = time.Date(2016, time.August, 23, 19, 30, 32, 572715948, time.UTC)
+
+func TestQuote(t *testing.T) {
+	q := FromMessage(&tops.QuoteUpdateMessage{
+		MessageType: tops.QuoteUpdate,
+		Flags:       0x40,
+		Timestamp:   quoteTime,
+		Symbol:      "ZIEXT",
+		BidSize:     9700,
+		BidPrice:    99.05,
+		AskPrice:    99.07,
+		AskSize:     1000,
+	})
+
+	expected := Quote{
+		Symbol:               "ZIEXT",
+		BidSize:              9700,
+		BidPrice:             99.05,
+		AskPrice:             99.07,
+		AskSize:              1000,
+		Active:               true,
+		RegularMarketSession: false,
+		Timestamp:            quoteTime,
+	}
+	if q != expected {
+		t.Fatalf("quote: %v, expected: %v", q, expected)
+	}
+
+	if !q.IsTwoSided() {
+		t.Fatal("quote should be two-sided")
+	}
+	if spread := q.Spread(); spread < 0.0199 || spread > 0.0201 {
+		t.Fatalf("expected spread of 0.02, got %v", spread)
+	}
+	if mid := q.Midpoint(); mid < 99.0599 || mid > 99.0601 {
+		t.Fatalf("expected midpoint of 99.06, got %v", mid)
+	}
+}
+
+func TestQuote_OneSided(t *testing.T) {
+	q := Quote{Symbol: "ZIEXT", BidSize: 100, BidPrice: 99.05}
+	if !q.HasBid() || q.HasAsk() {
+		t.Fatal("quote should only have a bid")
+	}
+	if q.Spread() != 0 || q.Midpoint() != 0 {
+		t.Fatal("one-sided quote should not have a spread or midpoint")
+	}
+}
+
+func TestTracker(t *testing.T) {
+	tracker := NewTracker()
+	var changes [][2]Quote
+	tracker.OnChange(func(prev, cur Quote) {
+		changes = append(changes, [2]Quote{prev, cur})
+	})
+
+	msg := &tops.QuoteUpdateMessage{
+		MessageType: tops.QuoteUpdate,
+		Timestamp:   quoteTime,
+		Symbol:      "ZIEXT",
+		BidSize:     100,
+		BidPrice:    99.05,
+	}
+	if !tracker.Process(msg) {
+		t.Fatal("first quote should be a change")
+	}
+
+	// An identical quote is not a change.
+	repeat := *msg
+	repeat.Timestamp = quoteTime.Add(time.Second)
+	if tracker.Process(&repeat) {
+		t.Fatal("identical quote should not be a change")
+	}
+
+	update := repeat
+	update.AskSize = 200
+	update.AskPrice = 99.10
+	if !tracker.Process(&update) {
+		t.Fatal("expected quote change")
+	}
+
+	if tracker.Process(&tops.TradeReportMessage{Symbol: "ZIEXT"}) {
+		t.Fatal("trade reports should be ignored")
+	}
+
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %v", len(changes))
+	}
+	if changes[0][0] != (Quote{}) {
+		t.Fatalf("first change should have a zero previous quote, got %v", changes[0][0])
+	}
+	if changes[1][0] != FromMessage(&repeat) || changes[1][1] != FromMessage(&update) {
+		t.Fatalf("unexpected change: %v", changes[1])
+	}
+
+	q, ok := tracker.Quote("ZIEXT")
+	if !ok || q != FromMessage(&update) {
+		t.Fatalf("unexpected current quote: %v", q)
+	}
+	if _, ok := tracker.Quote("SPY"); ok {
+		t.Fatal("should not have a quote for SPY")
+	}
+}
+
+func TestTracker_TOPS16(t *testing.T) {
+	tracker := NewTracker()
+	nChanges := 0
+	tracker.OnChange(func(prev, cur Quote) {
+		nChanges++
+		if cur.Timestamp.Before(prev.Timestamp) {
+			t.Fatalf("%v: quote went back in time: %v -> %v", cur.Symbol, prev, cur)
+		}
+		if cur.IsTwoSided() && cur.Spread() <= 0 {
+			t.Fatalf("%v: crossed or locked quote: %v", cur.Symbol, cur)
+		}
+	})
+
+	testpcap.Scan(t, "TOPS16.pcapng.gz", func(msg iextp.Message) {
+		tracker.Process(msg)
+	})
+
+	if nChanges != 26822 {
+		t.Fatalf("expected 26822 quote changes, got %v", nChanges)
+	}
+	if nSymbols := len(tracker.Symbols()); nSymbols != 7799 {
+		t.Fatalf("expected quotes for 7799 symbols, got %v", nSymbols)
+	}
+}
@@ -0,0 +1,242 @@
+// Package book reconstructs the IEX order book for each symbol
+// from the DEEP price level update messages, or order by order
+// from the DEEP+ feed.
+package book
+
+import (
+	"sort"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+)
+
+// PriceLevel is the aggregated quoted size at a single price.
+type PriceLevel struct {
+	Price float64
+	Size  uint32
+}
+
+// Snapshot is a copy of the top levels of a Book at a point in time.
+type Snapshot struct {
+	Symbol    string
+	Timestamp time.Time
+	// Bid levels, best (highest) price first.
+	Bids []PriceLevel
+	// Ask levels, best (lowest) price first.
+	Asks []PriceLevel
+}
+
+// Book is the price level order book for a single symbol.
+type Book struct {
+	Symbol string
+	// The time of the last event applied to the book.
+	LastUpdated time.Time
+
+	bids []PriceLevel // Sorted by descending price.
+	asks []PriceLevel // Sorted by ascending price.
+}
+
+// NewBook creates an empty Book for the given symbol.
+func NewBook(symbol string) *Book {
+	return &Book{Symbol: symbol}
+}
+
+// BestBid returns the highest bid price level.
+// Returns false if there are no bids in the book.
+func (b *Book) BestBid() (PriceLevel, bool) {
+	if len(b.bids) == 0 {
+		return PriceLevel{}, false
+	}
+
+	return b.bids[0], true
+}
+
+// BestAsk returns the lowest ask price level.
+// Returns false if there are no asks in the book.
+func (b *Book) BestAsk() (PriceLevel, bool) {
+	if len(b.asks) == 0 {
+		return PriceLevel{}, false
+	}
+
+	return b.asks[0], true
+}
+
+// Bids returns a copy of the top n bid levels, best price first.
+// If n <= 0, all levels are returned.
+func (b *Book) Bids(n int) []PriceLevel {
+	return topLevels(b.bids, n)
+}
+
+// Asks returns a copy of the top n ask levels, best price first.
+// If n <= 0, all levels are returned.
+func (b *Book) Asks(n int) []PriceLevel {
+	return topLevels(b.asks, n)
+}
+
+// BidSize returns the aggregated size bid at the given price,
+// or 0 if there is no bid at that price.
+func (b *Book) BidSize(price float64) uint32 {
+	i, ok := findLevel(b.bids, price, true)
+	if !ok {
+		return 0
+	}
+
+	return b.bids[i].Size
+}
+
+// AskSize returns the aggregated size offered at the given price,
+// or 0 if there is no ask at that price.
+func (b *Book) AskSize(price float64) uint32 {
+	i, ok := findLevel(b.asks, price, false)
+	if !ok {
+		return 0
+	}
+
+	return b.asks[i].Size
+}
+
+// Snapshot returns a copy of the top depth levels on each side of the book.
+// If depth <= 0, all levels are included.
+func (b *Book) Snapshot(depth int) Snapshot {
+	return Snapshot{
+		Symbol:    b.Symbol,
+		Timestamp: b.LastUpdated,
+		Bids:      b.Bids(depth),
+		Asks:      b.Asks(depth),
+	}
+}
+
+// Update sets the size of the given price level, removing
+// the level if size is zero.
+func (b *Book) Update(buySide bool, price float64, size uint32) {
+	if buySide {
+		b.bids = updateLevel(b.bids, price, size, true)
+	} else {
+		b.asks = updateLevel(b.asks, price, size, false)
+	}
+}
+
+func topLevels(levels []PriceLevel, n int) []PriceLevel {
+	if n <= 0 || n > len(levels) {
+		n = len(levels)
+	}
+
+	result := make([]PriceLevel, n)
+	copy(result, levels)
+	return result
+}
+
+// Find the index of the given price in levels, or the index
+// at which it should be inserted if it is not present.
+func findLevel(levels []PriceLevel, price float64, descending bool) (int, bool) {
+	i := sort.Search(len(levels), func(i int) bool {
+		if descending {
+			return levels[i].Price <= price
+		}
+		return levels[i].Price >= price
+	})
+
+	return i, i < len(levels) && levels[i].Price == price
+}
+
+func updateLevel(levels []PriceLevel, price float64, size uint32, descending bool) []PriceLevel {
+	i, ok := findLevel(levels, price, descending)
+	switch {
+	case ok && size == 0:
+		return append(levels[:i], levels[i+1:]...)
+	case ok:
+		levels[i].Size = size
+	case size != 0:
+		levels = append(levels, PriceLevel{})
+		copy(levels[i+1:], levels[i:])
+		levels[i] = PriceLevel{price, size}
+	}
+
+	return levels
+}
+
+type update struct {
+	buySide bool
+	price   float64
+	size    uint32
+}
+
+// OrderBooks maintains the Book for every symbol in a DEEP feed.
+//
+// A DEEP event (such as an order execution) may generate several
+// PriceLevelUpdateMessages, and the book is only consistent once the
+// last of them has been received. OrderBooks buffers the updates for an
+// event until one with EventProcessingComplete() is seen, and then
+// applies them all at once, so the Books it exposes are never in a
+// transitional state.
+type OrderBooks struct {
+	books   map[string]*Book
+	pending map[string][]update
+}
+
+// NewOrderBooks creates an empty set of OrderBooks.
+func NewOrderBooks() *OrderBooks {
+	return &OrderBooks{
+		books:   make(map[string]*Book),
+		pending: make(map[string][]update),
+	}
+}
+
+// Process updates the books with the given message.
+// Messages other than PriceLevelUpdateMessages are ignored.
+//
+// Returns the Book that was updated, or nil if the message did
+// not complete an event.
+func (ob *OrderBooks) Process(msg iextp.Message) *Book {
+	plu, ok := msg.(*deep.PriceLevelUpdateMessage)
+	if !ok {
+		return nil
+	}
+
+	u := update{plu.IsBuySide(), plu.Price, plu.Size}
+	pending := append(ob.pending[plu.Symbol], u)
+	if !plu.EventProcessingComplete() {
+		ob.pending[plu.Symbol] = pending
+		return nil
+	}
+
+	book, ok := ob.books[plu.Symbol]
+	if !ok {
+		book = NewBook(plu.Symbol)
+		ob.books[plu.Symbol] = book
+	}
+
+	for _, u := range pending {
+		book.Update(u.buySide, u.price, u.size)
+	}
+	book.LastUpdated = plu.Timestamp
+	ob.pending[plu.Symbol] = pending[:0]
+
+	return book
+}
+
+// Book returns the current Book for the given symbol,
+// or nil if no updates have been received for it.
+//
+// NOTE: The returned Book is updated in place by subsequent
+// calls to Process.
+func (ob *OrderBooks) Book(symbol string) *Book {
+	return ob.books[symbol]
+}
+
+// Symbols returns the sorted list of symbols with a Book.
+func (ob *OrderBooks) Symbols() []string {
+	symbols := make([]string, 0, len(ob.books))
+	for symbol := range ob.books {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// IsPending returns true if an event for the given symbol
+// has been partially received and not yet applied.
+func (ob *OrderBooks) IsPending(symbol string) bool {
+	return len(ob.pending[symbol]) > 0
+}
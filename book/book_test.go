@@ -0,0 +1,241 @@
+package book
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex"
+	"github.com/xuforr/go-iex/iextp/deep"
+	"github.com/xuforr/go-iex/iextp/tops"
+)
+
+func priceLevelUpdate(side uint8, complete bool, symbol string, price float64, size uint32) *deep.PriceLevelUpdateMessage {
+	var flags uint8
+	if complete {
+		flags = 0x1
+	}
+
+	return &deep.PriceLevelUpdateMessage{
+		MessageType: side,
+		EventFlags:  flags,
+		Timestamp:   time.Date(2017, time.April, 17, 9, 30, 0, 0, time.UTC),
+		Symbol:      symbol,
+		Size:        size,
+		Price:       price,
+	}
+}
+
+func TestBook_Update(t *testing.T) {
+	b := NewBook("ZIEXT")
+	b.Update(true, 99.05, 100)
+	b.Update(true, 99.10, 200)
+	b.Update(true, 99.00, 300)
+	b.Update(false, 99.20, 400)
+	b.Update(false, 99.15, 500)
+
+	if bid, ok := b.BestBid(); !ok || bid != (PriceLevel{99.10, 200}) {
+		t.Fatalf("unexpected best bid: %v", bid)
+	}
+	if ask, ok := b.BestAsk(); !ok || ask != (PriceLevel{99.15, 500}) {
+		t.Fatalf("unexpected best ask: %v", ask)
+	}
+
+	expected := []PriceLevel{{99.10, 200}, {99.05, 100}}
+	if bids := b.Bids(2); !reflect.DeepEqual(bids, expected) {
+		t.Fatalf("bids: %v, expected: %v", bids, expected)
+	}
+
+	// Remove a level and update another.
+	b.Update(true, 99.10, 0)
+	b.Update(false, 99.20, 50)
+	if bid, _ := b.BestBid(); bid != (PriceLevel{99.05, 100}) {
+		t.Fatalf("unexpected best bid: %v", bid)
+	}
+	if size := b.AskSize(99.20); size != 50 {
+		t.Fatalf("expected 50 shares at 99.20, got %v", size)
+	}
+	if size := b.BidSize(99.10); size != 0 {
+		t.Fatalf("expected no bid at 99.10, got %v", size)
+	}
+
+	snapshot := b.Snapshot(0)
+	expected = []PriceLevel{{99.15, 500}, {99.20, 50}}
+	if !reflect.DeepEqual(snapshot.Asks, expected) {
+		t.Fatalf("asks: %v, expected: %v", snapshot.Asks, expected)
+	}
+	if len(snapshot.Bids) != 2 {
+		t.Fatalf("expected 2 bid levels, got %v", snapshot.Bids)
+	}
+}
+
+func TestBook_Empty(t *testing.T) {
+	b := NewBook("ZIEXT")
+	if _, ok := b.BestBid(); ok {
+		t.Fatal("empty book should not have a bid")
+	}
+	if _, ok := b.BestAsk(); ok {
+		t.Fatal("empty book should not have an ask")
+	}
+
+	// Removing a level that does not exist is a no-op.
+	b.Update(true, 99.05, 0)
+	if len(b.Bids(0)) != 0 {
+		t.Fatal("expected no bid levels")
+	}
+}
+
+func TestOrderBooks_EventProcessing(t *testing.T) {
+	ob := NewOrderBooks()
+	if book := ob.Process(&tops.TradeReportMessage{Symbol: "ZIEXT"}); book != nil {
+		t.Fatal("trade reports should not update the book")
+	}
+
+	// The first two updates are part of the same event
+	// and should not be visible until it is complete.
+	msgs := []*deep.PriceLevelUpdateMessage{
+		priceLevelUpdate(deep.PriceLevelUpdateSellSide, false, "ZIEXT", 99.10, 0),
+		priceLevelUpdate(deep.PriceLevelUpdateBuySide, false, "ZIEXT", 99.05, 100),
+	}
+	for _, msg := range msgs {
+		if book := ob.Process(msg); book != nil {
+			t.Fatal("book should not be updated until event processing is complete")
+		}
+	}
+
+	if ob.Book("ZIEXT") != nil {
+		t.Fatal("book should not exist before the event is complete")
+	}
+	if !ob.IsPending("ZIEXT") {
+		t.Fatal("expected pending event")
+	}
+
+	book := ob.Process(priceLevelUpdate(deep.PriceLevelUpdateSellSide, true, "ZIEXT", 99.15, 200))
+	if book == nil || book != ob.Book("ZIEXT") {
+		t.Fatal("expected updated book")
+	}
+	if ob.IsPending("ZIEXT") {
+		t.Fatal("event should have been applied")
+	}
+
+	expected := Snapshot{
+		Symbol:    "ZIEXT",
+		Timestamp: time.Date(2017, time.April, 17, 9, 30, 0, 0, time.UTC),
+		Bids:      []PriceLevel{{99.05, 100}},
+		Asks:      []PriceLevel{{99.15, 200}},
+	}
+	if snapshot := book.Snapshot(10); !reflect.DeepEqual(snapshot, expected) {
+		t.Fatalf("snapshot: %v, expected: %v", snapshot, expected)
+	}
+
+	if symbols := ob.Symbols(); !reflect.DeepEqual(symbols, []string{"ZIEXT"}) {
+		t.Fatalf("unexpected symbols: %v", symbols)
+	}
+}
+
+func TestOrderBooks_DEEP10(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping pcap test in short mode.")
+	}
+
+	f, err := os.Open(filepath.Join("..", "testdata", "DEEP10.pcap.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	packetDataSource, err := iex.NewPcapDataSource(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := iex.NewPcapScanner(packetDataSource)
+
+	// Replay every update naively as a reference.
+	type level struct {
+		buySide bool
+		price   float64
+	}
+	reference := make(map[string]map[level]uint32)
+
+	ob := NewOrderBooks()
+	nEvents := 0
+	for {
+		msg, err := scanner.NextMessage()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		if plu, ok := msg.(*deep.PriceLevelUpdateMessage); ok {
+			if reference[plu.Symbol] == nil {
+				reference[plu.Symbol] = make(map[level]uint32)
+			}
+			l := level{plu.IsBuySide(), plu.Price}
+			if plu.Size == 0 {
+				delete(reference[plu.Symbol], l)
+			} else {
+				reference[plu.Symbol][l] = plu.Size
+			}
+		}
+
+		book := ob.Process(msg)
+		if book == nil {
+			continue
+		}
+
+		nEvents++
+		checkSorted(t, book)
+	}
+
+	if nEvents != 26426 {
+		t.Fatalf("expected 26426 completed events, got %v", nEvents)
+	}
+
+	for symbol, levels := range reference {
+		if ob.IsPending(symbol) {
+			// The sample pcap is truncated, and may end mid-event.
+			continue
+		}
+
+		book := ob.Book(symbol)
+		if nLevels := len(book.Bids(0)) + len(book.Asks(0)); nLevels != len(levels) {
+			t.Fatalf("%v: expected %v levels, got %v", symbol, len(levels), nLevels)
+		}
+
+		for l, size := range levels {
+			got := book.AskSize(l.price)
+			if l.buySide {
+				got = book.BidSize(l.price)
+			}
+
+			if got != size {
+				t.Fatalf("%v: expected %v shares at %v, got %v", symbol, size, l.price, got)
+			}
+		}
+	}
+}
+
+func checkSorted(t *testing.T, book *Book) {
+	bids, asks := book.Bids(0), book.Asks(0)
+	for i, level := range bids {
+		if level.Size == 0 {
+			t.Fatalf("%v: zero-size bid level at %v", book.Symbol, level.Price)
+		}
+		if i > 0 && level.Price >= bids[i-1].Price {
+			t.Fatalf("%v: bids are not sorted: %v", book.Symbol, bids)
+		}
+	}
+
+	for i, level := range asks {
+		if level.Size == 0 {
+			t.Fatalf("%v: zero-size ask level at %v", book.Symbol, level.Price)
+		}
+		if i > 0 && level.Price <= asks[i-1].Price {
+			t.Fatalf("%v: asks are not sorted: %v", book.Symbol, asks)
+		}
+	}
+}
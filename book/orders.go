@@ -0,0 +1,388 @@
+package book
+
+import (
+	"container/list"
+	"sort"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deepplus"
+)
+
+// Order is a single displayed order resting on the IEX Order Book.
+type Order struct {
+	OrderID int64
+	Symbol  string
+	BuySide bool
+	Price   float64
+	Size    uint32
+	// The time the order was added, or last lost its priority.
+	Timestamp time.Time
+}
+
+// A price level of the OrderLevelBook, with its orders in time priority.
+type orderLevel struct {
+	price  float64
+	size   uint32
+	orders *list.List // Of *Order.
+}
+
+// OrderLevelBook is the order-by-order book for a single symbol,
+// as reconstructed from the DEEP+ feed. In addition to the aggregated
+// price levels of a Book, it tracks each individual resting order
+// and its position in the queue at its price.
+type OrderLevelBook struct {
+	Symbol string
+	// The time of the last event applied to the book.
+	LastUpdated time.Time
+
+	orders map[int64]*list.Element
+	bids   []*orderLevel // Sorted by descending price.
+	asks   []*orderLevel // Sorted by ascending price.
+}
+
+// NewOrderLevelBook creates an empty OrderLevelBook for the given symbol.
+func NewOrderLevelBook(symbol string) *OrderLevelBook {
+	return &OrderLevelBook{
+		Symbol: symbol,
+		orders: make(map[int64]*list.Element),
+	}
+}
+
+// Len returns the number of orders in the book.
+func (b *OrderLevelBook) Len() int {
+	return len(b.orders)
+}
+
+// Order returns the resting order with the given ID.
+// Returns false if the order is not in the book.
+func (b *OrderLevelBook) Order(orderID int64) (Order, bool) {
+	e, ok := b.orders[orderID]
+	if !ok {
+		return Order{}, false
+	}
+
+	return *e.Value.(*Order), true
+}
+
+// Add inserts the order at the back of the queue at its price.
+// If an order with the same ID is already in the book, it is replaced.
+func (b *OrderLevelBook) Add(order Order) {
+	b.Delete(order.OrderID)
+	if order.Size == 0 {
+		return
+	}
+
+	o := order
+	level := b.level(o.BuySide, o.Price)
+	level.size += o.Size
+	b.orders[o.OrderID] = level.orders.PushBack(&o)
+}
+
+// Modify changes the price and size of the given order. The order
+// loses its time priority if its price changes or resetPriority is true,
+// in which case its Timestamp is set to the given time.
+//
+// Returns false if the order is not in the book.
+func (b *OrderLevelBook) Modify(orderID int64, price float64, size uint32, resetPriority bool, timestamp time.Time) bool {
+	e, ok := b.orders[orderID]
+	if !ok {
+		return false
+	}
+
+	o := e.Value.(*Order)
+	if size == 0 {
+		b.Delete(orderID)
+		return true
+	}
+
+	if resetPriority || price != o.Price {
+		order := *o
+		order.Price = price
+		order.Size = size
+		order.Timestamp = timestamp
+		b.Add(order)
+		return true
+	}
+
+	level := b.level(o.BuySide, o.Price)
+	level.size = level.size - o.Size + size
+	o.Size = size
+	return true
+}
+
+// Execute reduces the size of the given order by the executed size,
+// removing it from the book if it is fully filled.
+//
+// Returns false if the order is not in the book.
+func (b *OrderLevelBook) Execute(orderID int64, size uint32) bool {
+	e, ok := b.orders[orderID]
+	if !ok {
+		return false
+	}
+
+	o := e.Value.(*Order)
+	if size >= o.Size {
+		b.Delete(orderID)
+		return true
+	}
+
+	level := b.level(o.BuySide, o.Price)
+	level.size -= size
+	o.Size -= size
+	return true
+}
+
+// Delete removes the given order from the book.
+// Returns false if the order is not in the book.
+func (b *OrderLevelBook) Delete(orderID int64) bool {
+	e, ok := b.orders[orderID]
+	if !ok {
+		return false
+	}
+
+	o := e.Value.(*Order)
+	level := b.level(o.BuySide, o.Price)
+	level.orders.Remove(e)
+	level.size -= o.Size
+	delete(b.orders, orderID)
+	if level.orders.Len() == 0 {
+		if o.BuySide {
+			b.bids = removeOrderLevel(b.bids, o.Price, true)
+		} else {
+			b.asks = removeOrderLevel(b.asks, o.Price, false)
+		}
+	}
+
+	return true
+}
+
+// Clear removes all orders from the book.
+func (b *OrderLevelBook) Clear() {
+	b.orders = make(map[int64]*list.Element)
+	b.bids = nil
+	b.asks = nil
+}
+
+// BestBid returns the highest bid price level.
+// Returns false if there are no bids in the book.
+func (b *OrderLevelBook) BestBid() (PriceLevel, bool) {
+	if len(b.bids) == 0 {
+		return PriceLevel{}, false
+	}
+
+	return PriceLevel{b.bids[0].price, b.bids[0].size}, true
+}
+
+// BestAsk returns the lowest ask price level.
+// Returns false if there are no asks in the book.
+func (b *OrderLevelBook) BestAsk() (PriceLevel, bool) {
+	if len(b.asks) == 0 {
+		return PriceLevel{}, false
+	}
+
+	return PriceLevel{b.asks[0].price, b.asks[0].size}, true
+}
+
+// Bids returns the top n aggregated bid levels, best price first.
+// If n <= 0, all levels are returned.
+func (b *OrderLevelBook) Bids(n int) []PriceLevel {
+	return aggregateLevels(b.bids, n)
+}
+
+// Asks returns the top n aggregated ask levels, best price first.
+// If n <= 0, all levels are returned.
+func (b *OrderLevelBook) Asks(n int) []PriceLevel {
+	return aggregateLevels(b.asks, n)
+}
+
+// Snapshot returns a copy of the top depth aggregated levels on each
+// side of the book. If depth <= 0, all levels are included.
+func (b *OrderLevelBook) Snapshot(depth int) Snapshot {
+	return Snapshot{
+		Symbol:    b.Symbol,
+		Timestamp: b.LastUpdated,
+		Bids:      b.Bids(depth),
+		Asks:      b.Asks(depth),
+	}
+}
+
+// OrdersAt returns a copy of the orders resting at the given price,
+// in time priority.
+func (b *OrderLevelBook) OrdersAt(buySide bool, price float64) []Order {
+	levels := b.asks
+	if buySide {
+		levels = b.bids
+	}
+
+	i, ok := findOrderLevel(levels, price, buySide)
+	if !ok {
+		return nil
+	}
+
+	orders := make([]Order, 0, levels[i].orders.Len())
+	for e := levels[i].orders.Front(); e != nil; e = e.Next() {
+		orders = append(orders, *e.Value.(*Order))
+	}
+	return orders
+}
+
+// QueuePosition returns the number of orders, and their total size,
+// ahead of the given order at its price. Returns false if the order
+// is not in the book.
+func (b *OrderLevelBook) QueuePosition(orderID int64) (ordersAhead int, sizeAhead uint32, ok bool) {
+	e, ok := b.orders[orderID]
+	if !ok {
+		return 0, 0, false
+	}
+
+	for e = e.Prev(); e != nil; e = e.Prev() {
+		ordersAhead++
+		sizeAhead += e.Value.(*Order).Size
+	}
+	return ordersAhead, sizeAhead, true
+}
+
+// Get the level at the given price, creating it if necessary.
+func (b *OrderLevelBook) level(buySide bool, price float64) *orderLevel {
+	levels := &b.asks
+	if buySide {
+		levels = &b.bids
+	}
+
+	i, ok := findOrderLevel(*levels, price, buySide)
+	if ok {
+		return (*levels)[i]
+	}
+
+	level := &orderLevel{price: price, orders: list.New()}
+	*levels = append(*levels, nil)
+	copy((*levels)[i+1:], (*levels)[i:])
+	(*levels)[i] = level
+	return level
+}
+
+func findOrderLevel(levels []*orderLevel, price float64, descending bool) (int, bool) {
+	i := sort.Search(len(levels), func(i int) bool {
+		if descending {
+			return levels[i].price <= price
+		}
+		return levels[i].price >= price
+	})
+
+	return i, i < len(levels) && levels[i].price == price
+}
+
+func removeOrderLevel(levels []*orderLevel, price float64, descending bool) []*orderLevel {
+	i, ok := findOrderLevel(levels, price, descending)
+	if !ok {
+		return levels
+	}
+
+	copy(levels[i:], levels[i+1:])
+	levels[len(levels)-1] = nil
+	return levels[:len(levels)-1]
+}
+
+func aggregateLevels(levels []*orderLevel, n int) []PriceLevel {
+	if n <= 0 || n > len(levels) {
+		n = len(levels)
+	}
+
+	result := make([]PriceLevel, n)
+	for i, level := range levels[:n] {
+		result[i] = PriceLevel{level.price, level.size}
+	}
+	return result
+}
+
+// OrderLevelBooks maintains the OrderLevelBook for every symbol
+// in a DEEP+ feed.
+type OrderLevelBooks struct {
+	books map[string]*OrderLevelBook
+}
+
+// NewOrderLevelBooks creates an empty set of OrderLevelBooks.
+func NewOrderLevelBooks() *OrderLevelBooks {
+	return &OrderLevelBooks{
+		books: make(map[string]*OrderLevelBook),
+	}
+}
+
+// Process updates the books with the given message. Messages other
+// than the DEEP+ order book messages are ignored.
+//
+// Returns the OrderLevelBook that was updated, or nil if the message
+// did not apply to a book.
+func (ob *OrderLevelBooks) Process(msg iextp.Message) *OrderLevelBook {
+	switch msg := msg.(type) {
+	case *deepplus.AddOrderMessage:
+		book := ob.getOrCreate(msg.Symbol)
+		book.Add(Order{
+			OrderID:   msg.OrderID,
+			Symbol:    msg.Symbol,
+			BuySide:   msg.IsBuySide(),
+			Price:     msg.Price,
+			Size:      msg.Size,
+			Timestamp: msg.Timestamp,
+		})
+		book.LastUpdated = msg.Timestamp
+		return book
+	case *deepplus.OrderModifyMessage:
+		book := ob.books[msg.Symbol]
+		if book == nil || !book.Modify(msg.OrderID, msg.Price, msg.Size, msg.ResetsPriority(), msg.Timestamp) {
+			return nil
+		}
+		book.LastUpdated = msg.Timestamp
+		return book
+	case *deepplus.OrderDeleteMessage:
+		book := ob.books[msg.Symbol]
+		if book == nil || !book.Delete(msg.OrderID) {
+			return nil
+		}
+		book.LastUpdated = msg.Timestamp
+		return book
+	case *deepplus.OrderExecutedMessage:
+		book := ob.books[msg.Symbol]
+		if book == nil || !book.Execute(msg.OrderID, msg.Size) {
+			return nil
+		}
+		book.LastUpdated = msg.Timestamp
+		return book
+	case *deepplus.ClearBookMessage:
+		book := ob.getOrCreate(msg.Symbol)
+		book.Clear()
+		book.LastUpdated = msg.Timestamp
+		return book
+	}
+
+	return nil
+}
+
+func (ob *OrderLevelBooks) getOrCreate(symbol string) *OrderLevelBook {
+	book, ok := ob.books[symbol]
+	if !ok {
+		book = NewOrderLevelBook(symbol)
+		ob.books[symbol] = book
+	}
+	return book
+}
+
+// Book returns the current OrderLevelBook for the given symbol,
+// or nil if no orders have been received for it.
+//
+// NOTE: The returned OrderLevelBook is updated in place by subsequent
+// calls to Process.
+func (ob *OrderLevelBooks) Book(symbol string) *OrderLevelBook {
+	return ob.books[symbol]
+}
+
+// Symbols returns the sorted list of symbols with an OrderLevelBook.
+func (ob *OrderLevelBooks) Symbols() []string {
+	symbols := make([]string, 0, len(ob.books))
+	for symbol := range ob.books {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
@@ -0,0 +1,172 @@
+package book
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp/deepplus"
+)
+
+var testTime = time.Date(2017, time.April, 17, 9, 30, 0, 0, time.UTC)
+
+func addOrder(side uint8, orderID int64, price float64, size uint32) *deepplus.AddOrderMessage {
+	return &deepplus.AddOrderMessage{
+		MessageType: deepplus.AddOrder,
+		Side:        side,
+		Timestamp:   testTime,
+		Symbol:      "ZIEXT",
+		OrderID:     orderID,
+		Size:        size,
+		Price:       price,
+	}
+}
+
+func orderIDs(orders []Order) []int64 {
+	ids := make([]int64, len(orders))
+	for i, o := range orders {
+		ids[i] = o.OrderID
+	}
+	return ids
+}
+
+func TestOrderLevelBook(t *testing.T) {
+	b := NewOrderLevelBook("ZIEXT")
+	b.Add(Order{OrderID: 1, BuySide: true, Price: 99.05, Size: 100})
+	b.Add(Order{OrderID: 2, BuySide: true, Price: 99.05, Size: 200})
+	b.Add(Order{OrderID: 3, BuySide: true, Price: 99.10, Size: 300})
+	b.Add(Order{OrderID: 4, BuySide: false, Price: 99.20, Size: 400})
+	b.Add(Order{OrderID: 5, BuySide: true, Price: 99.05, Size: 50})
+
+	if b.Len() != 5 {
+		t.Fatalf("expected 5 orders, got %v", b.Len())
+	}
+	if bid, ok := b.BestBid(); !ok || bid != (PriceLevel{99.10, 300}) {
+		t.Fatalf("unexpected best bid: %v", bid)
+	}
+	if ask, ok := b.BestAsk(); !ok || ask != (PriceLevel{99.20, 400}) {
+		t.Fatalf("unexpected best ask: %v", ask)
+	}
+	expected := []PriceLevel{{99.10, 300}, {99.05, 350}}
+	if bids := b.Bids(0); !reflect.DeepEqual(bids, expected) {
+		t.Fatalf("bids: %v, expected: %v", bids, expected)
+	}
+
+	if ahead, size, ok := b.QueuePosition(5); !ok || ahead != 2 || size != 300 {
+		t.Fatalf("unexpected queue position: %v orders, %v shares", ahead, size)
+	}
+
+	// Partial execution keeps priority; full execution removes the order.
+	b.Execute(1, 40)
+	if o, _ := b.Order(1); o.Size != 60 {
+		t.Fatalf("expected 60 shares remaining, got %v", o.Size)
+	}
+	b.Execute(1, 60)
+	if _, ok := b.Order(1); ok {
+		t.Fatal("fully executed order should be removed")
+	}
+	if ahead, size, _ := b.QueuePosition(5); ahead != 1 || size != 200 {
+		t.Fatalf("unexpected queue position: %v orders, %v shares", ahead, size)
+	}
+
+	// Size decrease without a priority reset keeps the queue position.
+	b.Modify(2, 99.05, 150, false, testTime)
+	if ids := orderIDs(b.OrdersAt(true, 99.05)); !reflect.DeepEqual(ids, []int64{2, 5}) {
+		t.Fatalf("unexpected queue: %v", ids)
+	}
+	// A priority reset moves the order to the back of the queue.
+	b.Modify(2, 99.05, 250, true, testTime)
+	if ids := orderIDs(b.OrdersAt(true, 99.05)); !reflect.DeepEqual(ids, []int64{5, 2}) {
+		t.Fatalf("unexpected queue: %v", ids)
+	}
+	// As does a price change.
+	b.Modify(5, 99.10, 50, false, testTime)
+	if ids := orderIDs(b.OrdersAt(true, 99.10)); !reflect.DeepEqual(ids, []int64{3, 5}) {
+		t.Fatalf("unexpected queue: %v", ids)
+	}
+	expected = []PriceLevel{{99.10, 350}, {99.05, 250}}
+	if bids := b.Bids(0); !reflect.DeepEqual(bids, expected) {
+		t.Fatalf("bids: %v, expected: %v", bids, expected)
+	}
+
+	b.Delete(4)
+	if _, ok := b.BestAsk(); ok {
+		t.Fatal("expected no asks")
+	}
+	if b.Delete(4) || b.Execute(4, 1) || b.Modify(4, 99.0, 1, false, testTime) {
+		t.Fatal("order 4 should no longer be in the book")
+	}
+
+	b.Clear()
+	if b.Len() != 0 || len(b.Bids(0)) != 0 {
+		t.Fatal("expected empty book after clear")
+	}
+}
+
+func TestOrderLevelBooks_Process(t *testing.T) {
+	books := NewOrderLevelBooks()
+	books.Process(addOrder(deepplus.BuySide, 1, 99.05, 100))
+	books.Process(addOrder(deepplus.BuySide, 2, 99.05, 200))
+	books.Process(addOrder(deepplus.SellSide, 3, 99.10, 300))
+
+	book := books.Process(&deepplus.OrderExecutedMessage{
+		MessageType: deepplus.OrderExecuted,
+		Timestamp:   testTime.Add(time.Second),
+		Symbol:      "ZIEXT",
+		OrderID:     1,
+		Size:        100,
+		Price:       99.05,
+		TradeID:     1,
+	})
+	if book == nil {
+		t.Fatal("expected execution to update the book")
+	}
+	if !book.LastUpdated.Equal(testTime.Add(time.Second)) {
+		t.Fatalf("unexpected last updated time: %v", book.LastUpdated)
+	}
+
+	books.Process(&deepplus.OrderModifyMessage{
+		MessageType: deepplus.OrderModify,
+		Timestamp:   testTime,
+		Symbol:      "ZIEXT",
+		OrderID:     2,
+		Size:        150,
+		Price:       99.05,
+	})
+	books.Process(&deepplus.OrderDeleteMessage{
+		MessageType: deepplus.OrderDelete,
+		Timestamp:   testTime,
+		Symbol:      "ZIEXT",
+		OrderID:     3,
+	})
+
+	expected := Snapshot{
+		Symbol:    "ZIEXT",
+		Timestamp: testTime,
+		Bids:      []PriceLevel{{99.05, 150}},
+		Asks:      []PriceLevel{},
+	}
+	if snapshot := books.Book("ZIEXT").Snapshot(5); !reflect.DeepEqual(snapshot, expected) {
+		t.Fatalf("snapshot: %+v, expected: %+v", snapshot, expected)
+	}
+
+	// Updates to unknown orders are ignored.
+	if books.Process(&deepplus.OrderDeleteMessage{Symbol: "ZIEXT", OrderID: 3}) != nil {
+		t.Fatal("expected delete of unknown order to be ignored")
+	}
+	if books.Process(&deepplus.OrderDeleteMessage{Symbol: "ZXIET", OrderID: 3}) != nil {
+		t.Fatal("expected delete for unknown symbol to be ignored")
+	}
+
+	books.Process(&deepplus.ClearBookMessage{
+		MessageType: deepplus.ClearBook,
+		Timestamp:   testTime,
+		Symbol:      "ZIEXT",
+	})
+	if books.Book("ZIEXT").Len() != 0 {
+		t.Fatal("expected empty book after clear")
+	}
+	if symbols := books.Symbols(); !reflect.DeepEqual(symbols, []string{"ZIEXT"}) {
+		t.Fatalf("unexpected symbols: %v", symbols)
+	}
+}
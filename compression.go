@@ -0,0 +1,206 @@
+package iex
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression is a compression format of pcap dumps and derived files.
+type Compression int
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+	Zstd
+	Bzip2
+	Xz
+)
+
+var (
+	magicZstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicBzip2 = []byte("BZh")
+	magicXz    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+var errBzip2Output = errors.New("bzip2 compression is only supported for input")
+
+func (c Compression) String() string {
+	switch c {
+	case Uncompressed:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	case Bzip2:
+		return "bzip2"
+	case Xz:
+		return "xz"
+	default:
+		return fmt.Sprintf("Compression(%d)", int(c))
+	}
+}
+
+// Extension returns the conventional filename extension of
+// the compression format, e.g. ".gz", or "" if uncompressed.
+func (c Compression) Extension() string {
+	switch c {
+	case Gzip:
+		return ".gz"
+	case Zstd:
+		return ".zst"
+	case Bzip2:
+		return ".bz2"
+	case Xz:
+		return ".xz"
+	default:
+		return ""
+	}
+}
+
+// ParseCompression parses the name of a compression format,
+// as returned by Compression.String.
+func ParseCompression(name string) (Compression, error) {
+	for c := Uncompressed; c <= Xz; c++ {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return Uncompressed, fmt.Errorf("unknown compression format: %q", name)
+}
+
+// CompressionOf returns the compression format indicated by
+// the extension of the given filename, e.g. Zstd for "tops.pcap.zst".
+func CompressionOf(filename string) Compression {
+	ext := filepath.Ext(filename)
+	for c := Gzip; c <= Xz; c++ {
+		if ext == c.Extension() {
+			return c
+		}
+	}
+	return Uncompressed
+}
+
+// Detect the compression format of the data in input from its magic
+// number, and return a reader of the decompressed data.
+func decompress(input *bufio.Reader) (*bufio.Reader, Compression, error) {
+	magic, err := input.Peek(len(magicXz))
+	if err != nil && len(magic) < 2 {
+		return nil, Uncompressed, err
+	}
+
+	var r io.Reader
+	c := Uncompressed
+	switch {
+	case magic[0] == magicGzip1 && magic[1] == magicGzip2:
+		c = Gzip
+		r, err = gzip.NewReader(input)
+	case bytes.HasPrefix(magic, magicZstd):
+		c = Zstd
+		// A single decoder decodes synchronously,
+		// so the decoder need not be closed.
+		r, err = zstd.NewReader(input, zstd.WithDecoderConcurrency(1))
+	case bytes.HasPrefix(magic, magicBzip2) && len(magic) > 3 &&
+		magic[3] >= '1' && magic[3] <= '9':
+		c = Bzip2
+		r = bzip2.NewReader(input)
+	case bytes.HasPrefix(magic, magicXz):
+		c = Xz
+		r, err = xz.NewReader(input)
+	default:
+		return input, Uncompressed, nil
+	}
+
+	if err != nil {
+		return nil, c, err
+	}
+	return bufio.NewReader(r), c, nil
+}
+
+// NewDecompressingReader returns a reader of the data in r, decompressing
+// it if it is compressed in any of the supported formats, which are
+// detected from their magic numbers. Also returns the detected format.
+func NewDecompressingReader(r io.Reader) (io.Reader, Compression, error) {
+	return decompress(bufio.NewReader(r))
+}
+
+// NewCompressedWriter returns a writer that compresses the data written
+// to it in the given format, and writes it to w. Close must be called to
+// flush the compressed data; it does not close w.
+//
+// Bzip2 is only supported for input, since there is no bzip2 encoder
+// in the Go standard library.
+func NewCompressedWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case Uncompressed:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	case Xz:
+		return xz.NewWriter(w)
+	case Bzip2:
+		return nil, errBzip2Output
+	default:
+		return nil, fmt.Errorf("unknown compression format: %v", c)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// CreateCompressed creates the named file, compressing the data written
+// to it in the format indicated by the extension of the filename
+// (see CompressionOf). Closing the returned writer flushes the
+// compressed data and closes the file.
+func CreateCompressed(filename string) (io.WriteCloser, error) {
+	c := CompressionOf(filename)
+	if c == Bzip2 {
+		return nil, errBzip2Output
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	bufw := bufio.NewWriter(f)
+	compressor, err := NewCompressedWriter(bufw, c)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &compressedFile{compressor, bufw, f}, nil
+}
+
+type compressedFile struct {
+	io.WriteCloser
+	bufw *bufio.Writer
+	file *os.File
+}
+
+func (cf *compressedFile) Close() error {
+	err := cf.WriteCloser.Close()
+	if flushErr := cf.bufw.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := cf.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,172 @@
+package iex
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// "IEX-TP segment\n" x 4, compressed with bzip2.
+const testBzip2Data = "425a6839314159265359e90d1800000009d780001040020220444002830c0020" +
+	"0031000002aa9a30d4cc94648345c83441449c24b1251d177245385090e90d1800"
+
+// Compress data in the given format.
+func compressTestData(t *testing.T, c Compression, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := NewCompressedWriter(&buf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNewDecompressingReader(t *testing.T) {
+	data := makeInflateTestData(1 << 18)
+	for _, c := range []Compression{Uncompressed, Gzip, Zstd, Xz} {
+		r, detected, err := NewDecompressingReader(bytes.NewReader(compressTestData(t, c, data)))
+		if err != nil {
+			t.Fatalf("%v: %v", c, err)
+		}
+		if detected != c {
+			t.Fatalf("detected %v, expected: %v", detected, c)
+		}
+
+		decompressed, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%v: %v", c, err)
+		} else if !bytes.Equal(decompressed, data) {
+			t.Fatalf("%v: decompressed data does not match", c)
+		}
+	}
+}
+
+func TestNewDecompressingReader_Bzip2(t *testing.T) {
+	compressed, err := hex.DecodeString(testBzip2Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, detected, err := NewDecompressingReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detected != Bzip2 {
+		t.Fatalf("detected %v, expected: bzip2", detected)
+	}
+
+	decompressed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := bytes.Repeat([]byte("IEX-TP segment\n"), 4); !bytes.Equal(decompressed, expected) {
+		t.Fatalf("decompressed %q, expected: %q", decompressed, expected)
+	}
+
+	if _, err := NewCompressedWriter(io.Discard, Bzip2); err != errBzip2Output {
+		t.Fatalf("expected bzip2 output error, got: %v", err)
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for _, c := range []Compression{Uncompressed, Gzip, Zstd, Bzip2, Xz} {
+		if parsed, err := ParseCompression(c.String()); err != nil || parsed != c {
+			t.Fatalf("parsed %q as %v (%v), expected: %v", c.String(), parsed, err, c)
+		}
+	}
+
+	if _, err := ParseCompression("lz4"); err == nil {
+		t.Fatal("expected error parsing unknown format")
+	}
+}
+
+func TestCompressionOf(t *testing.T) {
+	for filename, expected := range map[string]Compression{
+		"DEEP10.pcap":         Uncompressed,
+		"DEEP10.pcap.gz":      Gzip,
+		"TOPS16.pcapng.zst":   Zstd,
+		"/data/day.pcap.bz2":  Bzip2,
+		"trades.csv.xz":       Xz,
+		"directory.gz/trades": Uncompressed,
+	} {
+		if c := CompressionOf(filename); c != expected {
+			t.Errorf("CompressionOf(%q) = %v, expected: %v", filename, c, expected)
+		}
+	}
+}
+
+func TestPcapScanner_Compressed(t *testing.T) {
+	const n = 100
+	data := makeIndexTestDump(t, FormatPcapNG, false, n)
+	for _, c := range []Compression{Zstd, Xz} {
+		source, err := NewPcapDataSource(bytes.NewReader(compressTestData(t, c, data)))
+		if err != nil {
+			t.Fatalf("%v: %v", c, err)
+		}
+
+		scanner := NewPcapScanner(source)
+		if tradeIDs := scanTradeIDs(t, scanner); !reflect.DeepEqual(tradeIDs, indexTestTradeIDs(1, n)) {
+			t.Fatalf("%v: unexpected messages: %v", c, tradeIDs)
+		}
+
+		pipeline, err := NewPcapPipeline(bytes.NewReader(compressTestData(t, c, data)))
+		if err != nil {
+			t.Fatalf("%v: %v", c, err)
+		}
+		defer pipeline.Close()
+
+		scanner = NewPcapScanner(pipeline)
+		if tradeIDs := scanTradeIDs(t, scanner); !reflect.DeepEqual(tradeIDs, indexTestTradeIDs(1, n)) {
+			t.Fatalf("%v: unexpected pipelined messages: %v", c, tradeIDs)
+		}
+	}
+}
+
+func TestCreateCompressed(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("symbol,price,size\nZIEXT,99.05,100\n")
+	for _, name := range []string{"trades.csv", "trades.csv.gz", "trades.csv.zst", "trades.csv.xz"} {
+		filename := filepath.Join(dir, name)
+		w, err := CreateCompressed(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, detected, err := NewDecompressingReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written, err := io.ReadAll(r)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if detected != CompressionOf(name) || !bytes.Equal(written, data) {
+			t.Fatalf("%v: read %q (%v), expected: %q", name, written, detected, data)
+		}
+	}
+
+	if _, err := CreateCompressed(filepath.Join(dir, "trades.csv.bz2")); err != errBzip2Output {
+		t.Fatalf("expected bzip2 output error, got: %v", err)
+	}
+}
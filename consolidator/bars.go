@@ -1,7 +1,6 @@
 package consolidator
 
 import (
-	"sort"
 	"time"
 
 	"github.com/xuforr/go-iex/iextp/tops"
@@ -31,16 +30,13 @@ func MakeBars(trades []*tops.TradeReportMessage) []*Bar {
 	return result
 }
 
-// Construct a Bar from the given list of trades.
+// Construct a Bar from the given list of trades, which need not be
+// ordered. The OpenTime and CloseTime of the bar are the times of
+// its first and last trades.
 // NOTE: Assumes all ticks are from the same symbol.
 func MakeBar(trades []*tops.TradeReportMessage) *Bar {
-	sort.Slice(trades, func(i, j int) bool {
-		return trades[i].Timestamp.Before(trades[j].Timestamp)
-	})
-
 	bar := &Bar{
-		Symbol:   trades[0].Symbol,
-		OpenTime: trades[0].Timestamp,
+		Symbol: trades[0].Symbol,
 	}
 
 	for _, trade := range trades {
@@ -50,6 +46,20 @@ func MakeBar(trades []*tops.TradeReportMessage) *Bar {
 	return bar
 }
 
+// Return the trades in the given list that are not trades of test
+// securities, as reported by isTest (e.g. the IsTestSecurity method
+// of a refdata.Directory).
+func DropTestSecurities(trades []*tops.TradeReportMessage, isTest func(symbol string) bool) []*tops.TradeReportMessage {
+	result := make([]*tops.TradeReportMessage, 0, len(trades))
+	for _, trade := range trades {
+		if !isTest(trade.Symbol) {
+			result = append(result, trade)
+		}
+	}
+
+	return result
+}
+
 func groupTradesBySymbol(trades []*tops.TradeReportMessage) map[string][]*tops.TradeReportMessage {
 	bySymbol := make(map[string][]*tops.TradeReportMessage)
 	for _, trade := range trades {
@@ -59,9 +69,12 @@ func groupTradesBySymbol(trades []*tops.TradeReportMessage) map[string][]*tops.T
 	return bySymbol
 }
 
-// Update the given bar to incorporate the trade.
+// Update the given bar to incorporate the trade. The OpenTime and
+// CloseTime of the bar are the times of its first and last trades,
+// so trades may be incorporated in any order.
 // Note this function assumes the security and times are compatible.
 func updateBar(bar *Bar, trade *tops.TradeReportMessage) {
+	empty := bar.Volume == 0
 	price := trade.Price
 	if price > bar.High {
 		bar.High = price
@@ -71,11 +84,15 @@ func updateBar(bar *Bar, trade *tops.TradeReportMessage) {
 		bar.Low = price
 	}
 
-	if bar.Open == 0 {
+	if empty || trade.Timestamp.Before(bar.OpenTime) {
+		bar.OpenTime = trade.Timestamp
 		bar.Open = price
 	}
 
-	bar.CloseTime = trade.Timestamp
-	bar.Close = price
+	if empty || !trade.Timestamp.Before(bar.CloseTime) {
+		bar.CloseTime = trade.Timestamp
+		bar.Close = price
+	}
+
 	bar.Volume += int64(trade.Size)
 }
@@ -0,0 +1,25 @@
+package consolidator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/xuforr/go-iex/iextp/tops"
+)
+
+func TestDropTestSecurities(t *testing.T) {
+	trades := []*tops.TradeReportMessage{
+		makeTrade(1, "ZIEXT", 1, 100, 20.00),
+		makeTrade(2, "AAPL", 2, 100, 150.00),
+		makeTrade(3, "ZXIET", 3, 100, 30.00),
+		makeTrade(4, "AAPL", 4, 100, 150.10),
+	}
+	isTest := func(symbol string) bool {
+		return symbol == "ZIEXT" || symbol == "ZXIET"
+	}
+
+	remaining := DropTestSecurities(trades, isTest)
+	if !reflect.DeepEqual(remaining, []*tops.TradeReportMessage{trades[1], trades[3]}) {
+		t.Fatalf("unexpected remaining trades: %v", remaining)
+	}
+}
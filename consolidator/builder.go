@@ -0,0 +1,284 @@
+package consolidator
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+	"github.com/xuforr/go-iex/iextp/deepplus"
+	"github.com/xuforr/go-iex/iextp/tops"
+)
+
+// FillMode determines the bars that a BarBuilder emits for
+// intervals in which a symbol did not trade.
+type FillMode int
+
+const (
+	// No bars are emitted for intervals without trades.
+	NoFill FillMode = iota
+	// Empty bars, with zero prices and volume, are emitted.
+	EmptyFill
+	// Bars at the close of the previous bar, with zero
+	// volume, are emitted.
+	ForwardFill
+)
+
+// BarFunc is called with each bar emitted by a BarBuilder.
+type BarFunc func(bar *Bar)
+
+// BarBuilder builds bars incrementally from a stream of trades.
+//
+// Trades are aggregated into intervals of a fixed length. When the stream
+// advances past the end of an interval, the bars of that interval are
+// emitted in order of symbol, so each symbol's bar is completed as soon as
+// its interval ends, whether or not that symbol trades again. The OpenTime
+// and CloseTime of emitted bars are the bounds of their interval.
+//
+// Only the trades of the current interval are kept, so that they
+// can be retracted if they are broken before the interval ends.
+type BarBuilder struct {
+	interval time.Duration
+	offset   time.Duration
+	fill     FillMode
+	onBar    BarFunc
+
+	// Bounds of the current interval, which are zero
+	// until the builder is first advanced.
+	openTime  time.Time
+	closeTime time.Time
+	// Trades and bars of each symbol in the current interval.
+	trades map[string][]*tops.TradeReportMessage
+	bars   map[string]*Bar
+	// The last bar emitted for each symbol with trades,
+	// from which empty intervals are filled.
+	last map[string]*Bar
+}
+
+// NewBarBuilder creates a BarBuilder of bars of the given interval,
+// e.g. time.Minute. By default, intervals are aligned to multiples of
+// their length since the zero time (so minute bars start on the minute),
+// and no bars are emitted for intervals without trades. Panics if the
+// interval is not positive.
+func NewBarBuilder(interval time.Duration) *BarBuilder {
+	if interval <= 0 {
+		panic(fmt.Sprintf("consolidator: non-positive bar interval %v", interval))
+	}
+
+	return &BarBuilder{
+		interval: interval,
+		trades:   make(map[string][]*tops.TradeReportMessage),
+		bars:     make(map[string]*Bar),
+		last:     make(map[string]*Bar),
+	}
+}
+
+// SetAlignment offsets the start of each interval by the given duration.
+// For example, an offset of 30 minutes aligns hourly bars to the half
+// hour, so that the first bar of the trading session starts at 9:30.
+// Must be called before the builder is first advanced.
+func (bb *BarBuilder) SetAlignment(offset time.Duration) {
+	bb.offset = offset % bb.interval
+}
+
+// SetFillMode sets the bars that are emitted for intervals in which a
+// symbol did not trade. Intervals are only filled after the first trade
+// of each symbol.
+func (bb *BarBuilder) SetFillMode(fill FillMode) {
+	bb.fill = fill
+}
+
+// OnBar registers a callback that is called with each completed bar.
+func (bb *BarBuilder) OnBar(f BarFunc) {
+	bb.onBar = f
+}
+
+// Interval returns the bounds of the interval that contains t.
+func (bb *BarBuilder) Interval(t time.Time) (time.Time, time.Time) {
+	return alignedInterval(t, bb.interval, bb.offset)
+}
+
+// Return the bounds of the interval of the given length, offset
+// from the zero time by the given duration, that contains t.
+func alignedInterval(t time.Time, interval, offset time.Duration) (time.Time, time.Time) {
+	openTime := t.Add(-offset).Truncate(interval).Add(offset)
+	return openTime, openTime.Add(interval)
+}
+
+// Process updates the builder with the given message. Trade reports are
+// added, and trade breaks retract the trade that they reference if it is
+// in the current interval. Every other message of the TOPS, DEEP and DEEP+
+// feeds advances the builder to its timestamp, so that bars are emitted
+// once their interval ends even if no symbol trades again. Returns true
+// if the current bars were changed.
+func (bb *BarBuilder) Process(msg iextp.Message) bool {
+	switch msg := msg.(type) {
+	case *tops.TradeReportMessage:
+		trade := *msg
+		return bb.Add(&trade)
+	case *tops.TradeBreakMessage:
+		bb.Advance(msg.Timestamp)
+		return bb.Retract(msg.Symbol, msg.TradeID)
+	}
+
+	if t, ok := messageTime(msg); ok {
+		bb.Advance(t)
+	}
+	return false
+}
+
+// Return the timestamp of the given message, if it has one.
+func messageTime(msg iextp.Message) (time.Time, bool) {
+	switch msg := msg.(type) {
+	case *tops.SystemEventMessage:
+		return msg.Timestamp, true
+	case *tops.SecurityDirectoryMessage:
+		return msg.Timestamp, true
+	case *tops.TradingStatusMessage:
+		return msg.Timestamp, true
+	case *tops.OperationalHaltStatusMessage:
+		return msg.Timestamp, true
+	case *tops.ShortSalePriceTestStatusMessage:
+		return msg.Timestamp, true
+	case *tops.QuoteUpdateMessage:
+		return msg.Timestamp, true
+	case *tops.OfficialPriceMessage:
+		return msg.Timestamp, true
+	case *tops.AuctionInformationMessage:
+		return msg.Timestamp, true
+	case *tops.RetailLiquidityIndicatorMessage:
+		return msg.Timestamp, true
+	case *deep.SecurityEventMessage:
+		return msg.Timestamp, true
+	case *deep.PriceLevelUpdateMessage:
+		return msg.Timestamp, true
+	case *deepplus.AddOrderMessage:
+		return msg.Timestamp, true
+	case *deepplus.OrderModifyMessage:
+		return msg.Timestamp, true
+	case *deepplus.OrderDeleteMessage:
+		return msg.Timestamp, true
+	case *deepplus.OrderExecutedMessage:
+		return msg.Timestamp, true
+	case *deepplus.ClearBookMessage:
+		return msg.Timestamp, true
+	}
+
+	return time.Time{}, false
+}
+
+// Add adds the given trade to the bar of its symbol, first advancing the
+// builder to the time of the trade. Trades in intervals that have already
+// been emitted are dropped, and false is returned.
+func (bb *BarBuilder) Add(trade *tops.TradeReportMessage) bool {
+	bb.Advance(trade.Timestamp)
+	if trade.Timestamp.Before(bb.openTime) {
+		return false
+	}
+
+	bb.trades[trade.Symbol] = append(bb.trades[trade.Symbol], trade)
+	bar, ok := bb.bars[trade.Symbol]
+	if !ok {
+		bar = &Bar{Symbol: trade.Symbol}
+		bb.bars[trade.Symbol] = bar
+	}
+	updateBar(bar, trade)
+	return true
+}
+
+// Retract removes the trade with the given TradeID from the bar of the
+// given symbol. Returns false if the trade is not in the current interval,
+// such as if its bar has already been emitted.
+func (bb *BarBuilder) Retract(symbol string, tradeID int64) bool {
+	trades := bb.trades[symbol]
+	for i, trade := range trades {
+		if trade.TradeID != tradeID {
+			continue
+		}
+
+		trades = append(trades[:i], trades[i+1:]...)
+		if len(trades) == 0 {
+			delete(bb.trades, symbol)
+			delete(bb.bars, symbol)
+		} else {
+			bb.trades[symbol] = trades
+			bb.bars[symbol] = MakeBar(trades)
+		}
+		return true
+	}
+
+	return false
+}
+
+// Advance advances the builder to time t, emitting the bars of all
+// intervals that end at or before t. Earlier times are ignored.
+func (bb *BarBuilder) Advance(t time.Time) {
+	if bb.closeTime.IsZero() {
+		bb.openTime, bb.closeTime = bb.Interval(t)
+		return
+	}
+
+	for !t.Before(bb.closeTime) {
+		bb.emit()
+		if len(bb.last) == 0 || bb.fill == NoFill {
+			// There are no bars to fill until the interval of t.
+			bb.openTime, bb.closeTime = bb.Interval(t)
+		} else {
+			bb.openTime, bb.closeTime = bb.closeTime, bb.closeTime.Add(bb.interval)
+		}
+	}
+}
+
+// Flush emits the bars of the current interval, which is then
+// considered to have ended.
+func (bb *BarBuilder) Flush() {
+	if !bb.closeTime.IsZero() {
+		bb.Advance(bb.closeTime)
+	}
+}
+
+// Emit the bars of the current interval, in order of symbol.
+func (bb *BarBuilder) emit() {
+	symbols := make([]string, 0, len(bb.bars))
+	for symbol := range bb.bars {
+		symbols = append(symbols, symbol)
+	}
+	if bb.fill != NoFill {
+		for symbol := range bb.last {
+			if _, ok := bb.bars[symbol]; !ok {
+				symbols = append(symbols, symbol)
+			}
+		}
+	}
+	sort.Strings(symbols)
+
+	for _, symbol := range symbols {
+		bar, ok := bb.bars[symbol]
+		if ok {
+			bb.last[symbol] = bar
+		} else {
+			bar = bb.fillBar(symbol)
+		}
+
+		bar.OpenTime = bb.openTime
+		bar.CloseTime = bb.closeTime
+		if bb.onBar != nil {
+			bb.onBar(bar)
+		}
+	}
+
+	bb.trades = make(map[string][]*tops.TradeReportMessage)
+	bb.bars = make(map[string]*Bar)
+}
+
+// Make the bar of an interval in which the given symbol did not trade.
+func (bb *BarBuilder) fillBar(symbol string) *Bar {
+	bar := &Bar{Symbol: symbol}
+	if bb.fill == ForwardFill {
+		price := bb.last[symbol].Close
+		bar.Open, bar.High, bar.Low, bar.Close = price, price, price, price
+	}
+
+	return bar
+}
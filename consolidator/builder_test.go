@@ -0,0 +1,237 @@
+package consolidator
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/tops"
+	"github.com/xuforr/go-iex/internal/testpcap"
+)
+
+func collectBars(bb *BarBuilder) *[]*Bar {
+	var bars []*Bar
+	bb.OnBar(func(bar *Bar) {
+		bars = append(bars, bar)
+	})
+	return &bars
+}
+
+func minute(n int) time.Time {
+	return tapeTime.Add(time.Duration(n) * time.Minute)
+}
+
+func TestBarBuilder(t *testing.T) {
+	bb := NewBarBuilder(time.Minute)
+	bars := collectBars(bb)
+
+	for _, trade := range []*tops.TradeReportMessage{
+		makeTrade(1, "ZXIET", 1, 100, 30.00),
+		makeTrade(2, "ZIEXT", 2, 100, 20.00),
+		makeTrade(4, "ZIEXT", 50, 200, 20.10),
+		makeTrade(3, "ZIEXT", 40, 100, 19.90), // Reported out of order.
+	} {
+		if !bb.Add(trade) {
+			t.Fatalf("trade %v should be added", trade.TradeID)
+		}
+	}
+	if len(*bars) != 0 {
+		t.Fatalf("unexpected bars: %v", *bars)
+	}
+
+	// The bars of each symbol are emitted at the end
+	// of the interval, whether or not it trades again.
+	bb.Advance(minute(1))
+	expected := []*Bar{
+		{"ZIEXT", minute(0), minute(1), 20.00, 20.10, 19.90, 20.10, 400},
+		{"ZXIET", minute(0), minute(1), 30.00, 30.00, 30.00, 30.00, 100},
+	}
+	if !reflect.DeepEqual(*bars, expected) {
+		t.Fatalf("bars: %v, expected: %v", *bars, expected)
+	}
+
+	// Trades in emitted intervals are dropped.
+	if bb.Add(makeTrade(5, "ZIEXT", 59, 100, 20)) {
+		t.Fatal("late trade should be dropped")
+	}
+
+	// Intervals without trades are skipped.
+	bb.Add(makeTrade(6, "ZIEXT", 200, 100, 20.20))
+	bb.Flush()
+	expected = append(expected, &Bar{"ZIEXT", minute(3), minute(4), 20.20, 20.20, 20.20, 20.20, 100})
+	if !reflect.DeepEqual(*bars, expected) {
+		t.Fatalf("bars: %v, expected: %v", *bars, expected)
+	}
+}
+
+func TestBarBuilder_ProcessAdvances(t *testing.T) {
+	bb := NewBarBuilder(time.Minute)
+	bars := collectBars(bb)
+	bb.Process(makeTrade(1, "ZIEXT", 1, 100, 20.00))
+
+	// Messages other than trades advance the builder.
+	quote := &tops.QuoteUpdateMessage{
+		MessageType: tops.QuoteUpdate,
+		Timestamp:   minute(0).Add(59 * time.Second),
+		Symbol:      "ZXIET",
+	}
+	if bb.Process(quote) || len(*bars) != 0 {
+		t.Fatalf("unexpected bars: %v", *bars)
+	}
+	quote.Timestamp = minute(1)
+	bb.Process(quote)
+	expected := []*Bar{
+		{"ZIEXT", minute(0), minute(1), 20.00, 20.00, 20.00, 20.00, 100},
+	}
+	if !reflect.DeepEqual(*bars, expected) {
+		t.Fatalf("bars: %v, expected: %v", *bars, expected)
+	}
+
+	bb.Process(makeTrade(2, "ZIEXT", 70, 200, 20.10))
+	bb.Process(&tops.SystemEventMessage{
+		MessageType: tops.SystemEvent,
+		SystemEvent: tops.EndOfRegularMarketHours,
+		Timestamp:   minute(2),
+	})
+	expected = append(expected, &Bar{"ZIEXT", minute(1), minute(2), 20.10, 20.10, 20.10, 20.10, 200})
+	if !reflect.DeepEqual(*bars, expected) {
+		t.Fatalf("bars: %v, expected: %v", *bars, expected)
+	}
+}
+
+func TestBarBuilder_Fill(t *testing.T) {
+	for _, tc := range []struct {
+		fill     FillMode
+		expected []*Bar
+	}{
+		{EmptyFill, []*Bar{
+			{"ZIEXT", minute(0), minute(5), 20.00, 20.00, 20.00, 20.00, 100},
+			{"ZIEXT", minute(5), minute(10), 0, 0, 0, 0, 0},
+			{"ZXIET", minute(5), minute(10), 30.00, 30.00, 30.00, 30.00, 100},
+			{"ZIEXT", minute(10), minute(15), 0, 0, 0, 0, 0},
+			{"ZXIET", minute(10), minute(15), 0, 0, 0, 0, 0},
+			{"ZIEXT", minute(15), minute(20), 20.10, 20.10, 20.10, 20.10, 100},
+			{"ZXIET", minute(15), minute(20), 0, 0, 0, 0, 0},
+		}},
+		{ForwardFill, []*Bar{
+			{"ZIEXT", minute(0), minute(5), 20.00, 20.00, 20.00, 20.00, 100},
+			{"ZIEXT", minute(5), minute(10), 20.00, 20.00, 20.00, 20.00, 0},
+			{"ZXIET", minute(5), minute(10), 30.00, 30.00, 30.00, 30.00, 100},
+			{"ZIEXT", minute(10), minute(15), 20.00, 20.00, 20.00, 20.00, 0},
+			{"ZXIET", minute(10), minute(15), 30.00, 30.00, 30.00, 30.00, 0},
+			{"ZIEXT", minute(15), minute(20), 20.10, 20.10, 20.10, 20.10, 100},
+			{"ZXIET", minute(15), minute(20), 30.00, 30.00, 30.00, 30.00, 0},
+		}},
+	} {
+		bb := NewBarBuilder(5 * time.Minute)
+		bb.SetFillMode(tc.fill)
+		bars := collectBars(bb)
+
+		bb.Add(makeTrade(1, "ZIEXT", 60, 100, 20.00))
+		bb.Add(makeTrade(2, "ZXIET", 360, 100, 30.00))
+		bb.Add(makeTrade(3, "ZIEXT", 960, 100, 20.10))
+		bb.Advance(minute(20))
+
+		if !reflect.DeepEqual(*bars, tc.expected) {
+			t.Fatalf("fill mode %v bars: %v, expected: %v", tc.fill, *bars, tc.expected)
+		}
+	}
+}
+
+func TestBarBuilder_Alignment(t *testing.T) {
+	bb := NewBarBuilder(time.Hour)
+	bb.SetAlignment(30 * time.Minute)
+	bars := collectBars(bb)
+
+	// The session opens at 9:30 ET (13:30 UTC).
+	open := time.Date(2017, time.July, 10, 13, 30, 0, 0, time.UTC)
+	if openTime, closeTime := bb.Interval(open.Add(59 * time.Minute)); !openTime.Equal(open) || !closeTime.Equal(open.Add(time.Hour)) {
+		t.Fatalf("unexpected interval: %v - %v", openTime, closeTime)
+	}
+
+	bb.Add(makeTrade(1, "ZIEXT", -3599, 100, 20))
+	bb.Add(makeTrade(2, "ZIEXT", 0, 100, 20))
+	bb.Flush()
+	if len(*bars) != 2 || !(*bars)[0].OpenTime.Equal(open) || !(*bars)[1].OpenTime.Equal(open.Add(time.Hour)) {
+		t.Fatalf("unexpected bars: %v", *bars)
+	}
+}
+
+func TestBarBuilder_InvalidInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Minute} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected panic for interval %v", interval)
+				}
+			}()
+			NewBarBuilder(interval)
+		}()
+	}
+}
+
+func TestBarBuilder_Retract(t *testing.T) {
+	bb := NewBarBuilder(time.Minute)
+	bars := collectBars(bb)
+
+	trades := []*tops.TradeReportMessage{
+		makeTrade(1, "ZIEXT", 1, 100, 20.00),
+		makeTrade(2, "ZIEXT", 2, 200, 20.50),
+		makeTrade(3, "ZXIET", 3, 100, 30.00),
+	}
+	for _, trade := range trades {
+		bb.Process(trade)
+	}
+
+	if !bb.Process(makeBreak(trades[1], 4)) || !bb.Process(makeBreak(trades[2], 5)) {
+		t.Fatal("breaks should retract trades")
+	}
+	if bb.Retract("ZIEXT", 2) {
+		t.Fatal("trade should only be retracted once")
+	}
+
+	bb.Add(makeTrade(4, "ZIEXT", 70, 100, 20.10))
+	if bb.Process(makeBreak(trades[0], 71)) {
+		t.Fatal("trade of an emitted bar cannot be retracted")
+	}
+
+	expected := []*Bar{{"ZIEXT", minute(0), minute(1), 20.00, 20.00, 20.00, 20.00, 100}}
+	if !reflect.DeepEqual(*bars, expected) {
+		t.Fatalf("bars: %v, expected: %v", *bars, expected)
+	}
+}
+
+func TestBarBuilder_TOPS16(t *testing.T) {
+	bb := NewBarBuilder(time.Minute)
+	tape := NewTape()
+	var bars []*Bar
+	bb.OnBar(func(bar *Bar) {
+		bars = append(bars, bar)
+		tape.Publish(bar)
+	})
+	// Apply the corrections of bars whose trades are broken after they
+	// are emitted, which is the case for all three breaks, since the
+	// quotes that follow each trade advance the builder.
+	tape.OnCorrection(func(c Correction) {
+		for i, bar := range bars {
+			if bar == c.Published {
+				bars[i] = c.Corrected
+			}
+		}
+	})
+
+	testpcap.Scan(t, "TOPS16.pcapng.gz", func(msg iextp.Message) {
+		bb.Process(msg)
+		tape.Process(msg)
+	})
+	bb.Flush()
+
+	if len(tape.Corrections()) != 3 {
+		t.Fatalf("expected 3 corrections, got: %v", len(tape.Corrections()))
+	}
+	// The streamed bars match the bars of the complete tape.
+	if expected := tape.Bars(time.Minute, 0); !reflect.DeepEqual(bars, expected) {
+		t.Fatalf("built %v bars, expected %v", len(bars), len(expected))
+	}
+}
@@ -0,0 +1,313 @@
+package consolidator
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/tops"
+)
+
+// Correction records a bar that was corrected after it was
+// published, because one of its trades was broken.
+type Correction struct {
+	// The break of the trade.
+	Break tops.TradeBreakMessage
+	// The bar as it was published (or last corrected), and the corrected
+	// bar, which is nil if no unbroken trades remain in its interval.
+	Published *Bar
+	Corrected *Bar
+}
+
+// CorrectionCSVHeader is the header row of a CSV log of corrections,
+// whose rows are given by Correction.CSVRecord.
+var CorrectionCSVHeader = []string{
+	"symbol",
+	"time",
+	"trade_id",
+	"break_time",
+	"published_open",
+	"published_high",
+	"published_low",
+	"published_close",
+	"published_volume",
+	"corrected_open",
+	"corrected_high",
+	"corrected_low",
+	"corrected_close",
+	"corrected_volume",
+}
+
+// Return the price and volume columns of the given bar,
+// which are empty if the bar is nil.
+func barCSVColumns(bar *Bar) []string {
+	if bar == nil {
+		return []string{"", "", "", "", ""}
+	}
+
+	return []string{
+		strconv.FormatFloat(bar.Open, 'f', 4, 64),
+		strconv.FormatFloat(bar.High, 'f', 4, 64),
+		strconv.FormatFloat(bar.Low, 'f', 4, 64),
+		strconv.FormatFloat(bar.Close, 'f', 4, 64),
+		strconv.FormatInt(bar.Volume, 10),
+	}
+}
+
+// CSVRecord returns the correction as a row of a CSV log of corrections
+// (see CorrectionCSVHeader). The columns of the corrected bar are empty
+// if no unbroken trades remain in its interval.
+func (c Correction) CSVRecord() []string {
+	row := []string{
+		c.Published.Symbol,
+		c.Published.OpenTime.Format(time.RFC3339),
+		strconv.FormatInt(c.Break.TradeID, 10),
+		c.Break.Timestamp.Format(time.RFC3339Nano),
+	}
+	row = append(row, barCSVColumns(c.Published)...)
+	return append(row, barCSVColumns(c.Corrected)...)
+}
+
+// CorrectionFunc is called with each correction of a published bar.
+type CorrectionFunc func(c Correction)
+
+// Tape is the tape of the trades of a day, indexed by TradeID.
+// Trades are retracted from the tape when they are broken, and
+// bars of the trades on the tape that were already published are
+// corrected accordingly.
+//
+// The tape keeps every trade that it is given, since any trade
+// of the day may be broken. For the same reason, it keeps every
+// published bar (or its latest correction), so its memory grows
+// with the trades and published bars of the day.
+type Tape struct {
+	trades map[int64]*tops.TradeReportMessage
+	// Trades of each symbol, ordered by timestamp.
+	bySymbol map[string][]*tops.TradeReportMessage
+	// Breaks, by TradeID of the broken trade.
+	broken map[int64]*tops.TradeBreakMessage
+	// Published bars of each symbol.
+	published    map[string][]*Bar
+	corrections  []Correction
+	onCorrection []CorrectionFunc
+}
+
+// NewTape creates an empty trade tape.
+func NewTape() *Tape {
+	return &Tape{
+		trades:    make(map[int64]*tops.TradeReportMessage),
+		bySymbol:  make(map[string][]*tops.TradeReportMessage),
+		broken:    make(map[int64]*tops.TradeBreakMessage),
+		published: make(map[string][]*Bar),
+	}
+}
+
+// OnCorrection registers f to be called each time a published bar
+// is corrected. Callbacks are invoked synchronously from Break, in
+// the order they were registered.
+func (t *Tape) OnCorrection(f CorrectionFunc) {
+	t.onCorrection = append(t.onCorrection, f)
+}
+
+// Process updates the tape with the given message. Trade reports are
+// added to the tape, and trade breaks retract the trade that they
+// reference. Messages are copied, so reusable messages may be processed.
+// Returns true if the tape was changed.
+func (t *Tape) Process(msg iextp.Message) bool {
+	switch msg := msg.(type) {
+	case *tops.TradeReportMessage:
+		trade := *msg
+		return t.Add(&trade)
+	case *tops.TradeBreakMessage:
+		brk := *msg
+		return t.Break(&brk)
+	}
+
+	return false
+}
+
+// Add adds the given trade to the tape. Trades that are already on the
+// tape, or that were broken before they were added, are ignored.
+// Returns true if the trade was added.
+func (t *Tape) Add(trade *tops.TradeReportMessage) bool {
+	if _, ok := t.trades[trade.TradeID]; ok {
+		return false
+	}
+	if _, ok := t.broken[trade.TradeID]; ok {
+		return false
+	}
+
+	t.trades[trade.TradeID] = trade
+	trades := t.bySymbol[trade.Symbol]
+	i := len(trades)
+	// Trades are usually reported in order.
+	if i > 0 && trade.Timestamp.Before(trades[i-1].Timestamp) {
+		i = sort.Search(len(trades), func(j int) bool {
+			return trades[j].Timestamp.After(trade.Timestamp)
+		})
+	}
+	trades = append(trades, nil)
+	copy(trades[i+1:], trades[i:])
+	trades[i] = trade
+	t.bySymbol[trade.Symbol] = trades
+	return true
+}
+
+// Break retracts the trade referenced by the given trade break from the
+// tape, and corrects any published bar that includes the trade. Returns
+// true if the trade was on the tape.
+func (t *Tape) Break(brk *tops.TradeBreakMessage) bool {
+	if _, ok := t.broken[brk.TradeID]; ok {
+		return false
+	}
+	t.broken[brk.TradeID] = brk
+
+	trade, ok := t.trades[brk.TradeID]
+	if !ok {
+		return false
+	}
+	delete(t.trades, brk.TradeID)
+
+	trades := t.bySymbol[trade.Symbol]
+	for i := range trades {
+		if trades[i] == trade {
+			t.bySymbol[trade.Symbol] = append(trades[:i], trades[i+1:]...)
+			break
+		}
+	}
+
+	published := t.published[trade.Symbol][:0]
+	for _, bar := range t.published[trade.Symbol] {
+		if trade.Timestamp.Before(bar.OpenTime) || !trade.Timestamp.Before(bar.CloseTime) {
+			published = append(published, bar)
+			continue
+		}
+
+		corrected := t.Bar(bar.Symbol, bar.OpenTime, bar.CloseTime)
+		c := Correction{Break: *brk, Published: bar, Corrected: corrected}
+		t.corrections = append(t.corrections, c)
+		for _, f := range t.onCorrection {
+			f(c)
+		}
+
+		// An empty interval cannot be corrected again.
+		if corrected != nil {
+			published = append(published, corrected)
+		}
+	}
+	t.published[trade.Symbol] = published
+
+	return true
+}
+
+// Trade returns the trade with the given TradeID, if it is on the tape.
+func (t *Tape) Trade(tradeID int64) (*tops.TradeReportMessage, bool) {
+	trade, ok := t.trades[tradeID]
+	return trade, ok
+}
+
+// IsBroken returns true if the trade with the given TradeID was broken.
+func (t *Tape) IsBroken(tradeID int64) bool {
+	_, ok := t.broken[tradeID]
+	return ok
+}
+
+// Len returns the number of (unbroken) trades on the tape.
+func (t *Tape) Len() int {
+	return len(t.trades)
+}
+
+// Trades returns the unbroken trades of the given symbol
+// in the interval [openTime, closeTime), ordered by timestamp.
+func (t *Tape) Trades(symbol string, openTime, closeTime time.Time) []*tops.TradeReportMessage {
+	trades := t.bySymbol[symbol]
+	start := sort.Search(len(trades), func(i int) bool {
+		return !trades[i].Timestamp.Before(openTime)
+	})
+	end := sort.Search(len(trades), func(i int) bool {
+		return !trades[i].Timestamp.Before(closeTime)
+	})
+	if start >= end {
+		return nil
+	}
+
+	return append([]*tops.TradeReportMessage(nil), trades[start:end]...)
+}
+
+// Bar returns the bar of the unbroken trades of the given symbol in
+// the interval [openTime, closeTime), or nil if there are none.
+func (t *Tape) Bar(symbol string, openTime, closeTime time.Time) *Bar {
+	trades := t.Trades(symbol, openTime, closeTime)
+	if len(trades) == 0 {
+		return nil
+	}
+
+	bar := MakeBar(trades)
+	bar.OpenTime = openTime
+	bar.CloseTime = closeTime
+	return bar
+}
+
+// Bars returns the bars of the unbroken trades on the tape in each
+// interval of the given length, ordered by time and then by symbol.
+// The start of each interval is offset by the given alignment, as
+// with BarBuilder.SetAlignment.
+func (t *Tape) Bars(interval, alignment time.Duration) []*Bar {
+	alignment %= interval
+	var result []*Bar
+	for symbol, trades := range t.bySymbol {
+		for len(trades) > 0 {
+			openTime, closeTime := alignedInterval(trades[0].Timestamp, interval, alignment)
+			n := sort.Search(len(trades), func(i int) bool {
+				return !trades[i].Timestamp.Before(closeTime)
+			})
+
+			bar := &Bar{Symbol: symbol}
+			for _, trade := range trades[:n] {
+				updateBar(bar, trade)
+			}
+			bar.OpenTime = openTime
+			bar.CloseTime = closeTime
+			result = append(result, bar)
+			trades = trades[n:]
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].OpenTime.Equal(result[j].OpenTime) {
+			return result[i].OpenTime.Before(result[j].OpenTime)
+		}
+		return result[i].Symbol < result[j].Symbol
+	})
+
+	return result
+}
+
+// Publish records that the given bars, whose OpenTime and CloseTime are
+// the bounds of their interval, were published. Subsequent breaks of the
+// trades in their intervals are recorded as corrections of the bars.
+func (t *Tape) Publish(bars ...*Bar) {
+	for _, bar := range bars {
+		t.published[bar.Symbol] = append(t.published[bar.Symbol], bar)
+	}
+}
+
+// Corrections returns the log of the corrections of published bars,
+// in the order of the trade breaks.
+func (t *Tape) Corrections() []Correction {
+	return append([]Correction(nil), t.corrections...)
+}
+
+// Return the trades in the given list that are not
+// broken trades on the given tape.
+func DropBrokenTrades(trades []*tops.TradeReportMessage, tape *Tape) []*tops.TradeReportMessage {
+	result := make([]*tops.TradeReportMessage, 0, len(trades))
+	for _, trade := range trades {
+		if !tape.IsBroken(trade.TradeID) {
+			result = append(result, trade)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,207 @@
+package consolidator
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/tops"
+	"github.com/xuforr/go-iex/internal/testpcap"
+)
+
+var tapeTime = time.Date(2017, time.July, 10, 14, 30, 0, 0, time.UTC)
+
+func makeTrade(tradeID int64, symbol string, seconds int, size uint32, price float64) *tops.TradeReportMessage {
+	return &tops.TradeReportMessage{
+		MessageType: tops.TradeReport,
+		Timestamp:   tapeTime.Add(time.Duration(seconds) * time.Second),
+		Symbol:      symbol,
+		Size:        size,
+		Price:       price,
+		TradeID:     tradeID,
+	}
+}
+
+func makeBreak(trade *tops.TradeReportMessage, seconds int) *tops.TradeBreakMessage {
+	return &tops.TradeBreakMessage{
+		MessageType: tops.TradeBreak,
+		Timestamp:   tapeTime.Add(time.Duration(seconds) * time.Second),
+		Symbol:      trade.Symbol,
+		Size:        trade.Size,
+		Price:       trade.Price,
+		TradeID:     trade.TradeID,
+	}
+}
+
+func TestTape(t *testing.T) {
+	trades := []*tops.TradeReportMessage{
+		makeTrade(1, "ZIEXT", 1, 100, 20.00),
+		makeTrade(2, "ZIEXT", 30, 200, 20.10),
+		makeTrade(4, "ZIEXT", 50, 100, 19.90),
+		makeTrade(3, "ZIEXT", 40, 300, 20.05), // Reported out of order.
+		makeTrade(5, "ZXIET", 10, 100, 30.00),
+		makeTrade(6, "ZIEXT", 70, 100, 20.00),
+	}
+
+	tape := NewTape()
+	for _, trade := range trades {
+		if !tape.Process(trade) {
+			t.Fatalf("trade %v should be added", trade.TradeID)
+		}
+	}
+	if tape.Process(trades[0]) {
+		t.Fatal("trade should only be added once")
+	}
+	if tape.Len() != 6 {
+		t.Fatalf("expected 6 trades, got: %v", tape.Len())
+	}
+
+	var tradeIDs []int64
+	for _, trade := range tape.Trades("ZIEXT", tapeTime, tapeTime.Add(time.Minute)) {
+		tradeIDs = append(tradeIDs, trade.TradeID)
+	}
+	if expected := []int64{1, 2, 3, 4}; !reflect.DeepEqual(tradeIDs, expected) {
+		t.Fatalf("trades: %v, expected: %v", tradeIDs, expected)
+	}
+
+	bars := tape.Bars(time.Minute, 0)
+	expected := []*Bar{
+		{"ZIEXT", tapeTime, tapeTime.Add(time.Minute), 20.00, 20.10, 19.90, 19.90, 700},
+		{"ZXIET", tapeTime, tapeTime.Add(time.Minute), 30.00, 30.00, 30.00, 30.00, 100},
+		{"ZIEXT", tapeTime.Add(time.Minute), tapeTime.Add(2 * time.Minute), 20.00, 20.00, 20.00, 20.00, 100},
+	}
+	if !reflect.DeepEqual(bars, expected) {
+		t.Fatalf("bars: %v, expected: %v", bars, expected)
+	}
+
+	// Aligned to the half minute.
+	aligned := tape.Bars(time.Minute, 90*time.Second)
+	expected = []*Bar{
+		{"ZIEXT", tapeTime.Add(-30 * time.Second), tapeTime.Add(30 * time.Second), 20.00, 20.00, 20.00, 20.00, 100},
+		{"ZXIET", tapeTime.Add(-30 * time.Second), tapeTime.Add(30 * time.Second), 30.00, 30.00, 30.00, 30.00, 100},
+		{"ZIEXT", tapeTime.Add(30 * time.Second), tapeTime.Add(90 * time.Second), 20.10, 20.10, 19.90, 20.00, 700},
+	}
+	if !reflect.DeepEqual(aligned, expected) {
+		t.Fatalf("aligned bars: %v, expected: %v", aligned, expected)
+	}
+
+	var corrections []Correction
+	tape.OnCorrection(func(c Correction) {
+		corrections = append(corrections, c)
+	})
+	nCorrections := 0
+	tape.OnCorrection(func(c Correction) {
+		nCorrections++
+	})
+	tape.Publish(bars[0], bars[1])
+
+	// Break the high of a published bar.
+	if !tape.Process(makeBreak(trades[1], 90)) {
+		t.Fatal("break should retract the trade")
+	}
+	if _, ok := tape.Trade(2); ok || !tape.IsBroken(2) || tape.Len() != 5 {
+		t.Fatal("trade should be retracted")
+	}
+
+	corrected := &Bar{"ZIEXT", tapeTime, tapeTime.Add(time.Minute), 20.00, 20.05, 19.90, 19.90, 500}
+	if len(corrections) != 1 || corrections[0].Published != bars[0] ||
+		!reflect.DeepEqual(corrections[0].Corrected, corrected) || corrections[0].Break.TradeID != 2 {
+		t.Fatalf("unexpected corrections: %+v", corrections)
+	}
+
+	// Break the only trade of a published bar.
+	tape.Process(makeBreak(trades[4], 95))
+	if len(corrections) != 2 || corrections[1].Published != bars[1] || corrections[1].Corrected != nil {
+		t.Fatalf("unexpected correction: %+v", corrections[1])
+	}
+
+	// Breaks of trades in unpublished bars, unknown trades,
+	// or trades that were already broken are not corrections.
+	tape.Process(makeBreak(trades[5], 100))
+	if tape.Process(makeBreak(trades[5], 101)) {
+		t.Fatal("trade should only be broken once")
+	}
+	if tape.Process(makeBreak(makeTrade(7, "ZIEXT", 80, 100, 20), 102)) {
+		t.Fatal("unknown trade should not be retracted")
+	}
+	if tape.Process(makeTrade(7, "ZIEXT", 80, 100, 20)) {
+		t.Fatal("trade should not be added after its break")
+	}
+	if !reflect.DeepEqual(tape.Corrections(), corrections) {
+		t.Fatalf("corrections: %v, expected: %v", tape.Corrections(), corrections)
+	}
+	if nCorrections != len(corrections) {
+		t.Fatalf("second callback called %v times, expected: %v", nCorrections, len(corrections))
+	}
+	tape.Corrections()[0].Corrected = nil
+	if tape.Corrections()[0].Corrected == nil {
+		t.Fatal("corrections should be copied")
+	}
+
+	// The published bar is replaced by its correction.
+	tape.Process(makeBreak(trades[0], 110))
+	if len(corrections) != 3 || corrections[2].Published != corrections[0].Corrected {
+		t.Fatalf("unexpected correction: %+v", corrections[2])
+	}
+
+	if bars := tape.Bars(time.Minute, 0); len(bars) != 1 || bars[0].Volume != 400 {
+		t.Fatalf("unexpected bars: %v", bars)
+	}
+
+	remaining := DropBrokenTrades(trades, tape)
+	if len(remaining) != 2 || remaining[0].TradeID != 4 || remaining[1].TradeID != 3 {
+		t.Fatalf("unexpected remaining trades: %v", remaining)
+	}
+}
+
+func TestCorrection_CSVRecord(t *testing.T) {
+	trade := makeTrade(2, "ZIEXT", 30, 200, 20.10)
+	c := Correction{
+		Break:     *makeBreak(trade, 90),
+		Published: &Bar{"ZIEXT", tapeTime, tapeTime.Add(time.Minute), 20.00, 20.10, 19.90, 19.90, 700},
+		Corrected: &Bar{"ZIEXT", tapeTime, tapeTime.Add(time.Minute), 20.00, 20.05, 19.90, 19.90, 500},
+	}
+
+	expected := []string{
+		"ZIEXT", "2017-07-10T14:30:00Z", "2", "2017-07-10T14:31:30Z",
+		"20.0000", "20.1000", "19.9000", "19.9000", "700",
+		"20.0000", "20.0500", "19.9000", "19.9000", "500",
+	}
+	if record := c.CSVRecord(); !reflect.DeepEqual(record, expected) {
+		t.Fatalf("record: %v, expected: %v", record, expected)
+	}
+	if len(expected) != len(CorrectionCSVHeader) {
+		t.Fatalf("record has %v columns, header has %v", len(expected), len(CorrectionCSVHeader))
+	}
+
+	// No unbroken trades remain in the interval.
+	c.Corrected = nil
+	expected = append(expected[:9], "", "", "", "", "")
+	if record := c.CSVRecord(); !reflect.DeepEqual(record, expected) {
+		t.Fatalf("record: %v, expected: %v", record, expected)
+	}
+}
+
+func TestTape_TOPS16(t *testing.T) {
+	tape := NewTape()
+	testpcap.Scan(t, "TOPS16.pcapng.gz", func(msg iextp.Message) {
+		tape.Process(msg)
+	})
+
+	// 6390 trades, of which 3 were broken.
+	if tape.Len() != 6387 {
+		t.Fatalf("expected 6387 trades, got: %v", tape.Len())
+	}
+	for _, tradeID := range []int64{171918, 171978, 283798} {
+		if !tape.IsBroken(tradeID) {
+			t.Fatalf("trade %v should be broken", tradeID)
+		}
+	}
+
+	openTime := time.Date(2017, time.July, 10, 14, 34, 0, 0, time.UTC)
+	bar := tape.Bar("ZXIET", openTime, openTime.Add(time.Minute))
+	if bar == nil || bar.Volume != 7362 {
+		t.Fatalf("unexpected bar: %+v", bar)
+	}
+}
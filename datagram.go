@@ -0,0 +1,98 @@
+package iex
+
+import (
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+)
+
+// Link types of raw IP captures that gopacket does not decode itself.
+const (
+	linkTypeIPv4 layers.LinkType = 228
+	linkTypeIPv6 layers.LinkType = 229
+)
+
+// Incomplete fragmented datagrams are discarded once no fragment of them
+// has been captured for this long. They are purged at this interval of
+// capture time, so may be kept for up to twice as long.
+const fragmentTimeout = 30 * time.Second
+
+// linkTypeDecoder returns the decoder of packets captured with the given
+// link type. In addition to the link types supported by gopacket, such
+// as Ethernet (with or without VLAN or QinQ tags), Linux cooked captures
+// and raw IP, the IPv4- and IPv6-only raw IP link types are supported.
+func linkTypeDecoder(linkType layers.LinkType) gopacket.Decoder {
+	switch linkType {
+	case linkTypeIPv4:
+		return layers.LayerTypeIPv4
+	case linkTypeIPv6:
+		return layers.LayerTypeIPv6
+	default:
+		return linkType
+	}
+}
+
+// Whether the given IPv4 packet is a fragment of a larger datagram.
+func isIPv4Fragment(ip *layers.IPv4) bool {
+	return ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0
+}
+
+// datagramReassembler extracts the UDP payloads of captured packets,
+// reassembling datagrams that were fragmented at the IPv4 layer.
+type datagramReassembler struct {
+	defragmenter *ip4defrag.IPv4Defragmenter
+	// Capture time at which incomplete datagrams were last discarded.
+	lastDiscard time.Time
+}
+
+func newDatagramReassembler() *datagramReassembler {
+	return &datagramReassembler{
+		defragmenter: ip4defrag.NewIPv4Defragmenter(),
+	}
+}
+
+// Get the UDP payload of the given packet, and its metadata. Returns false
+// if the packet has no payload, or if it is a fragment of a datagram that
+// has not yet been completely captured.
+func (dr *datagramReassembler) datagram(packet gopacket.Packet) ([]byte, PacketMetadata, bool) {
+	if ip, ok := packet.NetworkLayer().(*layers.IPv4); ok && isIPv4Fragment(ip) {
+		return dr.reassemble(ip, packet.Metadata().Timestamp)
+	}
+
+	app := packet.ApplicationLayer()
+	if app == nil {
+		return nil, PacketMetadata{}, false
+	}
+
+	return app.Payload(), packetMetadataOf(packet), true
+}
+
+// Add the given fragment to the datagram that it is part of. If the
+// datagram is complete, returns its UDP payload and the metadata of
+// its last fragment. Invalid fragments are dropped.
+func (dr *datagramReassembler) reassemble(fragment *layers.IPv4, timestamp time.Time) ([]byte, PacketMetadata, bool) {
+	if timestamp.Sub(dr.lastDiscard) >= fragmentTimeout {
+		dr.defragmenter.DiscardOlderThan(timestamp.Add(-fragmentTimeout))
+		dr.lastDiscard = timestamp
+	}
+
+	ip, err := dr.defragmenter.DefragIPv4WithTimestamp(fragment, timestamp)
+	if err != nil || ip == nil || ip.Protocol != layers.IPProtocolUDP {
+		return nil, PacketMetadata{}, false
+	}
+
+	var udp layers.UDP
+	if err := udp.DecodeFromBytes(ip.Payload, gopacket.NilDecodeFeedback); err != nil {
+		return nil, PacketMetadata{}, false
+	}
+
+	metadata := PacketMetadata{
+		Timestamp: timestamp,
+		Src:       &net.UDPAddr{IP: ip.SrcIP, Port: int(udp.SrcPort)},
+		Dst:       &net.UDPAddr{IP: ip.DstIP, Port: int(udp.DstPort)},
+	}
+	return udp.Payload, metadata, true
+}
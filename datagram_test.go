@@ -0,0 +1,261 @@
+package iex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Serialize an IPv4/UDP datagram with the given payload, split into IPv4
+// fragments carrying at most fragmentSize bytes of the datagram each.
+func makeTestFragments(t *testing.T, id uint16, payload []byte, fragmentSize int) [][]byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    testSrcAddr.IP.To4(),
+		DstIP:    testDstAddr.IP.To4(),
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(testSrcAddr.Port),
+		DstPort: layers.UDPPort(testDstAddr.Port),
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, opts, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	datagram := buf.Bytes()
+
+	var fragments [][]byte
+	for offset := 0; offset < len(datagram); offset += fragmentSize {
+		end := offset + fragmentSize
+		fragment := *ip
+		fragment.Id = id
+		fragment.FragOffset = uint16(offset / 8)
+		if end < len(datagram) {
+			fragment.Flags = layers.IPv4MoreFragments
+		} else {
+			end = len(datagram)
+		}
+
+		buf := gopacket.NewSerializeBuffer()
+		err := gopacket.SerializeLayers(buf, opts, &fragment, gopacket.Payload(datagram[offset:end]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fragments = append(fragments, append([]byte(nil), buf.Bytes()...))
+	}
+
+	return fragments
+}
+
+// Encapsulate an IP packet for capture with the given link type,
+// optionally tagged with the given (Ethernet) VLAN IDs.
+func encapsulateTestPacket(t *testing.T, linkType layers.LinkType, vlans []uint16, packet []byte) []byte {
+	switch linkType {
+	case layers.LinkTypeRaw, linkTypeIPv4:
+		return packet
+	case layers.LinkTypeLinuxSLL:
+		header := make([]byte, 16)
+		binary.BigEndian.PutUint16(header[2:4], 1) // ARPHRD_ETHER
+		binary.BigEndian.PutUint16(header[4:6], 6)
+		copy(header[6:], net.HardwareAddr{0x00, 0x1b, 0x21, 0x3c, 0x4d, 0x5e})
+		binary.BigEndian.PutUint16(header[14:16], uint16(layers.EthernetTypeIPv4))
+		return append(header, packet...)
+	}
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x00, 0x1b, 0x21, 0x3c, 0x4d, 0x5e},
+		DstMAC:       net.HardwareAddr{0x01, 0x00, 0x5e, 0x57, 0x15, 0x04},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	serializable := []gopacket.SerializableLayer{eth}
+	nextType := &eth.EthernetType
+	for i, vlan := range vlans {
+		// The outer tag of a double-tagged (QinQ) packet is an S-tag.
+		*nextType = layers.EthernetTypeDot1Q
+		if i == 0 && len(vlans) > 1 {
+			*nextType = layers.EthernetTypeQinQ
+		}
+
+		tag := &layers.Dot1Q{VLANIdentifier: vlan, Type: layers.EthernetTypeIPv4}
+		serializable = append(serializable, tag)
+		nextType = &tag.Type
+	}
+	serializable = append(serializable, gopacket.Payload(packet))
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, serializable...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Write a pcap dump of the given captured packets.
+func writeTestCapture(t *testing.T, linkType layers.LinkType, packets [][]byte) []byte {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	if err := w.WriteFileHeader(maxDatagramSize, linkType); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, packet := range packets {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     testSendTime.Add(time.Duration(i) * time.Microsecond),
+			CaptureLength: len(packet),
+			Length:        len(packet),
+		}
+		if err := w.WritePacket(ci, packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// Capture DEEP segments with the given link type and VLAN tags: an
+// unfragmented segment, a fragmented segment, and a fragmented segment
+// whose fragments were captured in reverse order, followed by another
+// unfragmented segment. Returns the dump and the number of messages.
+func makeFragmentedTestCapture(t *testing.T, linkType layers.LinkType, vlans []uint16) ([]byte, int) {
+	var packets [][]byte
+	addFragments := func(fragments [][]byte) {
+		for _, fragment := range fragments {
+			packets = append(packets, encapsulateTestPacket(t, linkType, vlans, fragment))
+		}
+	}
+
+	addFragments(makeTestFragments(t, 1, makeTestSegment(t, 1, 5), 1500))
+	// Segments of 80 trades are larger than an Ethernet frame.
+	addFragments(makeTestFragments(t, 2, makeTestSegment(t, 6, 80), 1480))
+	fragments := makeTestFragments(t, 3, makeTestSegment(t, 86, 80), 1024)
+	for i, j := 0, len(fragments)-1; i < j; i, j = i+1, j-1 {
+		fragments[i], fragments[j] = fragments[j], fragments[i]
+	}
+	addFragments(fragments)
+	addFragments(makeTestFragments(t, 4, makeTestSegment(t, 166, 5), 1500))
+
+	return writeTestCapture(t, linkType, packets), 170
+}
+
+func TestPcapDataSource_Encapsulations(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		linkType layers.LinkType
+		vlans    []uint16
+	}{
+		{"Ethernet", layers.LinkTypeEthernet, nil},
+		{"VLAN", layers.LinkTypeEthernet, []uint16{100}},
+		{"QinQ", layers.LinkTypeEthernet, []uint16{200, 100}},
+		{"Linux SLL", layers.LinkTypeLinuxSLL, nil},
+		{"Raw", layers.LinkTypeRaw, nil},
+		{"IPv4", linkTypeIPv4, nil},
+	} {
+		data, n := makeFragmentedTestCapture(t, tc.linkType, tc.vlans)
+		source, err := NewPcapDataSource(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+
+		scanner := NewPcapScanner(source)
+		tradeIDs := scanTradeIDs(t, scanner)
+		if expected := indexTestTradeIDs(1, int64(n)/5); !reflect.DeepEqual(tradeIDs, expected) {
+			t.Fatalf("%v: expected %v messages, got: %v", tc.name, n, tradeIDs)
+		}
+
+		metadata := scanner.PacketMetadata()
+		if metadata.Src.String() != testSrcAddr.String() || metadata.Dst.String() != testDstAddr.String() {
+			t.Fatalf("%v: unexpected metadata: %+v", tc.name, metadata)
+		}
+
+		pipeline, err := NewPcapPipeline(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		// Fragments of the same datagram span batches.
+		pipeline.SetBatchSize(2)
+
+		tradeIDs = scanTradeIDs(t, NewPcapScanner(pipeline))
+		pipeline.Close()
+		if expected := indexTestTradeIDs(1, int64(n)/5); !reflect.DeepEqual(tradeIDs, expected) {
+			t.Fatalf("%v: pipeline returned %v messages, expected: %v", tc.name, len(tradeIDs), n)
+		}
+	}
+}
+
+func TestDatagramReassembler_Incomplete(t *testing.T) {
+	fragments := makeTestFragments(t, 1, makeTestSegment(t, 1, 80), 1480)
+	var packets [][]byte
+	// The first fragment of a datagram that is never completed,
+	// followed by an unfragmented datagram.
+	packets = append(packets, fragments[0])
+	packets = append(packets, makeTestFragments(t, 2, makeTestSegment(t, 81, 5), 1500)...)
+	data := writeTestCapture(t, layers.LinkTypeRaw, packets)
+
+	source, err := NewPcapDataSource(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloads := 0
+	for {
+		payload, err := source.NextPayload()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(payload, makeTestSegment(t, 81, 5)) {
+			t.Fatalf("unexpected payload of %v bytes", len(payload))
+		}
+		payloads++
+	}
+
+	if payloads != 1 {
+		t.Fatalf("expected 1 payload, got: %v", payloads)
+	}
+}
+
+func TestDatagramReassembler_Timeout(t *testing.T) {
+	reassemble := func(dr *datagramReassembler, fragment []byte, timestamp time.Time) bool {
+		packet := gopacket.NewPacket(fragment, layers.LayerTypeIPv4, gopacket.Default)
+		_, _, ok := dr.reassemble(packet.NetworkLayer().(*layers.IPv4), timestamp)
+		return ok
+	}
+
+	dr := newDatagramReassembler()
+	incomplete := makeTestFragments(t, 1, makeTestSegment(t, 1, 80), 1480)
+	reassemble(dr, incomplete[0], testSendTime)
+
+	// Steady traffic of fragmented datagrams, which never leaves
+	// a gap of fragmentTimeout between fragments.
+	for i := 1; i <= 60; i++ {
+		timestamp := testSendTime.Add(time.Duration(i) * time.Second)
+		fragments := makeTestFragments(t, uint16(i+1), makeTestSegment(t, int64(i), 5), 104)
+		for j, fragment := range fragments {
+			if ok := reassemble(dr, fragment, timestamp); ok != (j == len(fragments)-1) {
+				t.Fatalf("datagram %v fragment %v: unexpected reassembly: %v", i+1, j, ok)
+			}
+		}
+	}
+
+	// The first fragment was discarded, so the datagram is never completed.
+	timestamp := testSendTime.Add(61 * time.Second)
+	for _, fragment := range incomplete[1:] {
+		if reassemble(dr, fragment, timestamp) {
+			t.Fatal("expected expired datagram to be discarded")
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package iex
+
+import (
+	"testing"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+	"github.com/xuforr/go-iex/iextp/tops"
+)
+
+func TestPcapScannerWithDecoder(t *testing.T) {
+	// A patched DEEP decoder that adjusts trade IDs.
+	decoder := iextp.NewDecoder()
+	tops.Register(decoder)
+	decoder.Register(deep.V_1_0_MessageProtocolID, func(buf []byte) (iextp.Message, error) {
+		msg, err := deep.Unmarshal(buf)
+		if trade, ok := msg.(*deep.TradeReportMessage); ok {
+			trade.TradeID += 1000
+		}
+		return msg, err
+	})
+
+	source := &payloadSource{[][]byte{
+		makeTestSegment(t, 1, 2),
+		makeTOPSSegment(t),
+	}}
+	scanner := NewPcapScannerWithDecoder(source, decoder)
+	for _, expected := range []int64{1001, 1002} {
+		msg, err := scanner.NextMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tradeID := msg.(*deep.TradeReportMessage).TradeID; tradeID != expected {
+			t.Fatalf("scanned trade %v, expected %v", tradeID, expected)
+		}
+	}
+	if msg, err := scanner.NextMessage(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*tops.TradeReportMessage); !ok {
+		t.Fatalf("expected TOPS trade report, got %v", msg)
+	}
+
+	// Scanners using the default decoder should not be affected.
+	scanner = NewPcapScanner(&payloadSource{[][]byte{makeTestSegment(t, 1, 1)}})
+	if msg, err := scanner.NextMessage(); err != nil {
+		t.Fatal(err)
+	} else if tradeID := msg.(*deep.TradeReportMessage).TradeID; tradeID != 1 {
+		t.Fatalf("default decoder returned trade %v, expected 1", tradeID)
+	}
+}
+
+func TestPcapScannerWithDecoder_Unregistered(t *testing.T) {
+	decoder := iextp.NewDecoder()
+	tops.Register(decoder)
+
+	scanner := NewPcapScannerWithDecoder(&payloadSource{[][]byte{makeTestSegment(t, 1, 1)}}, decoder)
+	if _, err := scanner.NextMessage(); err == nil {
+		t.Fatal("DEEP segments should not be decodable")
+	}
+}
@@ -0,0 +1,174 @@
+package iex
+
+import (
+	"net"
+
+	"github.com/xuforr/go-iex/iextp"
+)
+
+// PacketFilter reports whether a packet with the given capture metadata
+// should be kept.
+type PacketFilter func(metadata PacketMetadata) bool
+
+// MatchSrc returns a PacketFilter that keeps packets sent from the given
+// address. If addr.IP is nil, packets from any IP address are kept,
+// and if addr.Port is 0, packets from any port are kept. A nil addr
+// keeps packets from any address.
+func MatchSrc(addr *net.UDPAddr) PacketFilter {
+	return func(metadata PacketMetadata) bool {
+		return matchAddr(metadata.Src, addr)
+	}
+}
+
+// MatchDst returns a PacketFilter that keeps packets sent to the given
+// address, such as a multicast group. If addr.IP is nil, packets to any
+// IP address are kept, and if addr.Port is 0, packets to any port are kept.
+// A nil addr keeps packets to any address.
+func MatchDst(addr *net.UDPAddr) PacketFilter {
+	return func(metadata PacketMetadata) bool {
+		return matchAddr(metadata.Dst, addr)
+	}
+}
+
+// MatchPort returns a PacketFilter that keeps packets sent from
+// or to the given UDP port.
+func MatchPort(port int) PacketFilter {
+	return func(metadata PacketMetadata) bool {
+		return (metadata.Src != nil && metadata.Src.Port == port) ||
+			(metadata.Dst != nil && metadata.Dst.Port == port)
+	}
+}
+
+// MatchMulticast returns a PacketFilter that keeps packets sent to
+// any multicast group.
+func MatchMulticast() PacketFilter {
+	return func(metadata PacketMetadata) bool {
+		return metadata.Dst != nil && metadata.Dst.IP.IsMulticast()
+	}
+}
+
+func matchAddr(addr, pattern *net.UDPAddr) bool {
+	if addr == nil {
+		return false
+	}
+
+	if pattern == nil {
+		return true
+	}
+
+	if pattern.IP != nil && !pattern.IP.Equal(addr.IP) {
+		return false
+	}
+
+	return pattern.Port == 0 || pattern.Port == addr.Port
+}
+
+// FilteredDataSource implements PacketDataSource by passing on only the
+// payloads from an underlying source whose packets match all of the
+// given filters.
+type FilteredDataSource struct {
+	source   MetadataDataSource
+	filters  []PacketFilter
+	filtered int64
+}
+
+// NewFilteredDataSource creates a new FilteredDataSource that keeps the
+// packets from source that match all of the given filters.
+func NewFilteredDataSource(source MetadataDataSource, filters ...PacketFilter) *FilteredDataSource {
+	return &FilteredDataSource{
+		source:  source,
+		filters: filters,
+	}
+}
+
+// Filtered returns the number of packets that have been dropped
+// because they did not match the filters.
+func (fds *FilteredDataSource) Filtered() int64 {
+	return fds.filtered
+}
+
+// NextPayload implements PacketDataSource.
+func (fds *FilteredDataSource) NextPayload() ([]byte, error) {
+	payload, _, err := fds.NextPayloadWithMetadata()
+	return payload, err
+}
+
+// NextPayloadWithMetadata implements MetadataDataSource.
+func (fds *FilteredDataSource) NextPayloadWithMetadata() ([]byte, PacketMetadata, error) {
+	for {
+		payload, metadata, err := fds.source.NextPayloadWithMetadata()
+		if err != nil {
+			return payload, metadata, err
+		}
+
+		if fds.matches(metadata) {
+			return payload, metadata, nil
+		}
+		fds.filtered++
+	}
+}
+
+func (fds *FilteredDataSource) matches(metadata PacketMetadata) bool {
+	for _, filter := range fds.filters {
+		if !filter(metadata) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SegmentFilter reports whether a PcapScanner should decode
+// the IEX-TP segment with the given header.
+type SegmentFilter func(header *iextp.SegmentHeader) bool
+
+// MatchMessageProtocol returns a SegmentFilter that keeps segments
+// with any of the given message protocol IDs.
+func MatchMessageProtocol(ids ...uint16) SegmentFilter {
+	return func(header *iextp.SegmentHeader) bool {
+		for _, id := range ids {
+			if header.MessageProtocolID == id {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchChannel returns a SegmentFilter that keeps segments
+// with any of the given channel IDs.
+func MatchChannel(ids ...uint32) SegmentFilter {
+	return func(header *iextp.SegmentHeader) bool {
+		for _, id := range ids {
+			if header.ChannelID == id {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SetSegmentFilters sets the filters that a segment must match to be
+// decoded by the scanner. Segments that do not match all of the filters
+// are skipped, and are not checked for gaps or duplicates.
+func (p *PcapScanner) SetSegmentFilters(filters ...SegmentFilter) {
+	p.segmentFilters = filters
+}
+
+// SetSkipUndecodable sets whether payloads that cannot be decoded as
+// IEX-TP segments (e.g. unrelated traffic in a capture, or segments
+// of an unsupported protocol) are skipped, rather than returned as
+// an error by NextMessage. Skipped payloads are counted in Stats.
+func (p *PcapScanner) SetSkipUndecodable(skip bool) {
+	p.skipUndecodable = skip
+}
+
+func matchesSegmentFilters(filters []SegmentFilter, header *iextp.SegmentHeader) bool {
+	for _, filter := range filters {
+		if !filter(header) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,212 @@
+package iex
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+	"github.com/xuforr/go-iex/iextp/tops"
+)
+
+func TestPacketFilters(t *testing.T) {
+	metadata := PacketMetadata{
+		Src: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000},
+		Dst: &net.UDPAddr{IP: net.IPv4(233, 215, 21, 4), Port: 10378},
+	}
+
+	testCases := []struct {
+		name     string
+		filter   PacketFilter
+		expected bool
+	}{
+		{"src", MatchSrc(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)}), true},
+		{"src port", MatchSrc(&net.UDPAddr{Port: 5001}), false},
+		{"dst", MatchDst(&net.UDPAddr{IP: net.IPv4(233, 215, 21, 4), Port: 10378}), true},
+		{"dst group", MatchDst(&net.UDPAddr{IP: net.IPv4(233, 215, 21, 5), Port: 10378}), false},
+		{"dst port", MatchDst(&net.UDPAddr{Port: 10378}), true},
+		{"port", MatchPort(5000), true},
+		{"other port", MatchPort(10379), false},
+		{"multicast", MatchMulticast(), true},
+		{"any src", MatchSrc(nil), true},
+		{"any dst", MatchDst(nil), true},
+	}
+
+	for _, tc := range testCases {
+		if matches := tc.filter(metadata); matches != tc.expected {
+			t.Errorf("%v: matches = %v, expected %v", tc.name, matches, tc.expected)
+		}
+	}
+
+	if MatchMulticast()(PacketMetadata{}) || MatchPort(0)(PacketMetadata{}) {
+		t.Error("packets without addresses should not match")
+	}
+}
+
+func TestFilteredDataSource(t *testing.T) {
+	group := &net.UDPAddr{IP: net.IPv4(233, 215, 21, 4), Port: 10378}
+	otherGroup := &net.UDPAddr{IP: net.IPv4(233, 215, 21, 5), Port: 10378}
+	unicast := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 10378}
+
+	var buf bytes.Buffer
+	w, err := NewPcapWriter(&buf, FormatPcapNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	datagrams := []struct {
+		dst     *net.UDPAddr
+		payload string
+	}{
+		{group, "a"},
+		{otherGroup, "b"},
+		{unicast, "c"},
+		{group, "d"},
+	}
+	for _, d := range datagrams {
+		if err := w.WriteDatagram(time.Now(), testSrcAddr, d.dst, []byte(d.payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	packetDataSource, err := NewPcapDataSource(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := NewFilteredDataSource(packetDataSource, MatchMulticast(), MatchDst(group))
+	var payloads []string
+	for {
+		payload, err := source.NextPayload()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, string(payload))
+	}
+
+	if expected := []string{"a", "d"}; !reflect.DeepEqual(payloads, expected) {
+		t.Fatalf("filtered payloads: %v, expected: %v", payloads, expected)
+	}
+	if source.Filtered() != 2 {
+		t.Fatalf("expected 2 packets to be filtered, got %v", source.Filtered())
+	}
+}
+
+// Create a TOPS segment with a single trade report.
+func makeTOPSSegment(t *testing.T) []byte {
+	segment := iextp.Segment{
+		Header: iextp.SegmentHeader{
+			Version:                    1,
+			MessageProtocolID:          tops.V_1_6_MessageProtocolID,
+			ChannelID:                  tops.ChannelID,
+			SessionID:                  testSessionID,
+			FirstMessageSequenceNumber: 1,
+			SendTime:                   testSendTime,
+		},
+		Messages: []iextp.Message{
+			&tops.TradeReportMessage{
+				MessageType: tops.TradeReport,
+				Timestamp:   testSendTime,
+				Symbol:      "ZIEXT",
+				Size:        100,
+				Price:       99.05,
+				TradeID:     100,
+			},
+		},
+	}
+
+	buf, err := segment.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// Create a segment of an unsupported message protocol.
+func makeUnknownProtocolSegment(t *testing.T) []byte {
+	buf := makeTestSegment(t, 1, 1)
+	buf[2], buf[3] = 0xff, 0xff
+	return buf
+}
+
+func makeMixedSource(t *testing.T) *payloadSource {
+	return &payloadSource{[][]byte{
+		makeTestSegment(t, 1, 1),
+		[]byte("unrelated traffic"),
+		makeTOPSSegment(t),
+		makeUnknownProtocolSegment(t),
+		makeTestSegment(t, 2, 1),
+	}}
+}
+
+func TestPcapScanner_Undecodable(t *testing.T) {
+	scanner := NewPcapScanner(makeMixedSource(t))
+	if _, err := scanner.NextMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scanner.NextMessage(); err == nil {
+		t.Fatal("expected error decoding unrelated traffic")
+	}
+}
+
+func TestPcapScanner_SkipUndecodable(t *testing.T) {
+	scanner := NewPcapScanner(makeMixedSource(t))
+	scanner.SetSkipUndecodable(true)
+
+	var messages []iextp.Message
+	for {
+		msg, err := scanner.NextMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, msg)
+	}
+
+	if len(messages) != 3 {
+		t.Fatalf("expected 3 messages, got %v", len(messages))
+	}
+	if _, ok := messages[1].(*tops.TradeReportMessage); !ok {
+		t.Fatalf("expected TOPS trade report, got %v", messages[1])
+	}
+	if stats := scanner.Stats(); stats.UndecodablePayloads != 2 {
+		t.Fatalf("expected 2 undecodable payloads, got %+v", stats)
+	}
+}
+
+func TestPcapScanner_SegmentFilters(t *testing.T) {
+	scanner := NewPcapScanner(makeMixedSource(t))
+	scanner.SetSkipUndecodable(true)
+	scanner.SetSegmentFilters(
+		MatchMessageProtocol(deep.V_1_0_MessageProtocolID),
+		MatchChannel(deep.ChannelID))
+
+	tradeIDs := scanTradeIDs(t, scanner)
+	if expected := []int64{1, 2}; !reflect.DeepEqual(tradeIDs, expected) {
+		t.Fatalf("scanned: %v, expected: %v", tradeIDs, expected)
+	}
+
+	// The TOPS and unknown protocol segments are filtered,
+	// and the unrelated traffic cannot be decoded.
+	stats := scanner.Stats()
+	if stats.FilteredSegments != 2 || stats.UndecodablePayloads != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	scanner = NewPcapScanner(makeMixedSource(t))
+	scanner.SetSkipUndecodable(true)
+	scanner.SetSegmentFilters(MatchChannel(2))
+	if _, err := scanner.NextMessage(); err != io.EOF {
+		t.Fatalf("expected all segments to be filtered, got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package gapfill
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xuforr/go-iex"
+)
+
+// Client requests missing segments from a Server.
+// It implements iex.GapRecoverer.
+type Client struct {
+	mu      sync.Mutex
+	addr    string
+	timeout time.Duration
+	conn    net.Conn
+	r       *bufio.Reader
+}
+
+// Dial connects to the Server listening on the given TCP address.
+func Dial(addr string) (*Client, error) {
+	c := &Client{addr: addr}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// SetTimeout sets the maximum time to wait for the response to each
+// request, including connecting to the server if necessary. A timeout
+// of 0 (the default) waits indefinitely.
+func (c *Client) SetTimeout(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timeout = d
+}
+
+func (c *Client) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+	c.r = bufio.NewReader(conn)
+	return nil
+}
+
+// Recover implements iex.GapRecoverer by requesting the segments
+// containing the messages in the gap from the server.
+//
+// If the request fails, the connection is closed and a new one is
+// established for the next request.
+func (c *Client) Recover(gap iex.Gap) ([][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	segments, err := c.roundTrip(gap)
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	return segments, err
+}
+
+func (c *Client) roundTrip(gap iex.Gap) ([][]byte, error) {
+	var deadline time.Time
+	if c.timeout > 0 {
+		deadline = time.Now().Add(c.timeout)
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	if _, err := c.conn.Write(marshalRequest(gap)); err != nil {
+		return nil, err
+	}
+
+	return readResponse(c.r)
+}
+
+// Close closes the connection to the server.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
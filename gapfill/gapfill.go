@@ -0,0 +1,327 @@
+// Package gapfill implements a simple TCP retransmission protocol for
+// recovering IEX-TP segments that were lost by a live consumer.
+//
+// A Server holds recorded segments (e.g. from a pcap dump captured on
+// another host) and serves them by session and sequence number range.
+// A Client implements iex.GapRecoverer, so that it can be used to
+// backfill gaps detected by an iex.PcapScanner:
+//
+//	client, err := gapfill.Dial("127.0.0.1:9090")
+//	...
+//	scanner := iex.NewPcapScanner(packetDataSource)
+//	scanner.SetGapRecoverer(client)
+//
+// Each request is a fixed-length, little-endian encoded message:
+//
+//	MessageProtocolID   uint16
+//	ChannelID           uint32
+//	SessionID           uint32
+//	FirstSequenceNumber int64
+//	Count               int64
+//
+// The response is the sequence of IEX-TP segments containing the
+// requested messages, each prefixed by its uint32 length, followed by
+// a zero length to terminate the response. Multiple requests may be sent
+// sequentially on the same connection.
+package gapfill
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xuforr/go-iex"
+	"github.com/xuforr/go-iex/iextp"
+)
+
+const (
+	// Size of an encoded request, in bytes.
+	requestSize = 26
+	// Maximum size of an IEX-TP segment: the 40-byte segment
+	// header and up to 65535 bytes of payload.
+	maxSegmentSize = 40 + 65535
+)
+
+func marshalRequest(gap iex.Gap) []byte {
+	buf := make([]byte, requestSize)
+	binary.LittleEndian.PutUint16(buf[0:2], gap.MessageProtocolID)
+	binary.LittleEndian.PutUint32(buf[2:6], gap.ChannelID)
+	binary.LittleEndian.PutUint32(buf[6:10], gap.SessionID)
+	binary.LittleEndian.PutUint64(buf[10:18], uint64(gap.FirstSequenceNumber))
+	binary.LittleEndian.PutUint64(buf[18:26], uint64(gap.Count))
+	return buf
+}
+
+func unmarshalRequest(buf []byte) iex.Gap {
+	return iex.Gap{
+		MessageProtocolID:   binary.LittleEndian.Uint16(buf[0:2]),
+		ChannelID:           binary.LittleEndian.Uint32(buf[2:6]),
+		SessionID:           binary.LittleEndian.Uint32(buf[6:10]),
+		FirstSequenceNumber: int64(binary.LittleEndian.Uint64(buf[10:18])),
+		Count:               int64(binary.LittleEndian.Uint64(buf[18:26])),
+	}
+}
+
+// Identifies a stream of sequenced messages.
+type sessionKey struct {
+	messageProtocolID uint16
+	channelID         uint32
+	sessionID         uint32
+}
+
+// A recorded segment containing messages [first, end).
+type segment struct {
+	first   int64
+	end     int64
+	payload []byte
+}
+
+// The recorded segments of a session.
+type session struct {
+	segments []segment
+	// SendTime of the latest segment, which tells a restart of the
+	// session from a late copy of its first segment.
+	lastSent time.Time
+}
+
+// Server serves recorded IEX-TP segments to Clients.
+//
+// Segments are recorded in order of sequence number, so the segments of
+// redundant feeds may be added together: a segment missing from one feed
+// is filled from the other even if it is added after later segments, and
+// segments already recorded are dropped as duplicates. If a session is
+// restarted (its sequence numbers start over from 1, with a send time
+// after that of every segment added so far), only the segments since the
+// most recent restart are served.
+type Server struct {
+	mu        sync.RWMutex
+	sessions  map[sessionKey]*session
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// NewServer creates a Server with no recorded segments.
+func NewServer() *Server {
+	return &Server{
+		sessions:  make(map[sessionKey]*session),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Add records the given IEX-TP segment payload.
+// Heartbeat segments (with no messages) are ignored.
+func (s *Server) Add(payload []byte) error {
+	var header iextp.SegmentHeader
+	if err := header.Unmarshal(payload); err != nil {
+		return err
+	}
+
+	key := sessionKey{header.MessageProtocolID, header.ChannelID, header.SessionID}
+	first := header.FirstMessageSequenceNumber
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[key]
+	if !ok {
+		sess = &session{}
+		s.sessions[key] = sess
+	}
+	lastSent := sess.lastSent
+	if header.SendTime.After(lastSent) {
+		sess.lastSent = header.SendTime
+	}
+
+	if header.MessageCount == 0 {
+		return nil
+	}
+
+	isRestart := len(sess.segments) > 0 && first == 1 &&
+		header.StreamOffset == 0 && header.SendTime.After(lastSent)
+	if isRestart {
+		sess.segments = nil
+	}
+
+	i := sort.Search(len(sess.segments), func(i int) bool {
+		return sess.segments[i].first >= first
+	})
+	if i < len(sess.segments) && sess.segments[i].first == first {
+		return nil // Duplicate segment.
+	}
+
+	seg := segment{
+		first:   first,
+		end:     first + int64(header.MessageCount),
+		payload: make([]byte, len(payload)),
+	}
+	copy(seg.payload, payload)
+	sess.segments = append(sess.segments, segment{})
+	copy(sess.segments[i+1:], sess.segments[i:])
+	sess.segments[i] = seg
+	return nil
+}
+
+// AddFrom records all of the segments from the given packet source.
+// Returns nil once the source returns io.EOF.
+func (s *Server) AddFrom(packetDataSource iex.PacketDataSource) error {
+	for {
+		payload, err := packetDataSource.NextPayload()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := s.Add(payload); err != nil {
+			return err
+		}
+	}
+}
+
+// Recover implements iex.GapRecoverer, returning the recorded
+// segments that contain any of the messages in the given gap.
+func (s *Server) Recover(gap iex.Gap) ([][]byte, error) {
+	key := sessionKey{gap.MessageProtocolID, gap.ChannelID, gap.SessionID}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var segments []segment
+	if sess, ok := s.sessions[key]; ok {
+		segments = sess.segments
+	}
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].end > gap.FirstSequenceNumber
+	})
+
+	var result [][]byte
+	for ; i < len(segments) && segments[i].first < gap.End(); i++ {
+		result = append(result, segments[i].payload)
+	}
+
+	return result, nil
+}
+
+// Serve accepts connections on the given listener and serves
+// requests from each of them. Serve blocks until the listener fails
+// or the Server is closed, and always closes the listener.
+//
+// After Close, Serve returns nil.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return l.Close()
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.RLock()
+			closed := s.closed
+			s.mu.RUnlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops all listeners and closes all active connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	req := make([]byte, requestSize)
+	for {
+		if _, err := io.ReadFull(r, req); err != nil {
+			return
+		}
+
+		segments, _ := s.Recover(unmarshalRequest(req))
+		if err := writeResponse(w, segments); err != nil {
+			return
+		}
+	}
+}
+
+func writeResponse(w *bufio.Writer, segments [][]byte) error {
+	var length [4]byte
+	for _, payload := range segments {
+		binary.LittleEndian.PutUint32(length[:], uint32(len(payload)))
+		if _, err := w.Write(length[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(payload); err != nil {
+			return err
+		}
+	}
+
+	binary.LittleEndian.PutUint32(length[:], 0)
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func readResponse(r *bufio.Reader) ([][]byte, error) {
+	var result [][]byte
+	var length [4]byte
+	for {
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, err
+		}
+
+		n := binary.LittleEndian.Uint32(length[:])
+		if n == 0 {
+			return result, nil
+		} else if n > maxSegmentSize {
+			return nil, fmt.Errorf("invalid response: %v-length segment", n)
+		}
+
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		result = append(result, payload)
+	}
+}
@@ -0,0 +1,288 @@
+package gapfill
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex"
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+)
+
+const testSessionID uint32 = 1132527616
+
+var testSendTime = time.Date(2017, time.April, 25, 15, 3, 18, 0, time.UTC)
+
+// Create an encoded DEEP segment with nMessages trade reports,
+// starting at sequence number firstSeq. The TradeID of each
+// trade report is set to its sequence number.
+func makeTestSegment(t *testing.T, sendTime time.Time, firstSeq int64, nMessages int) []byte {
+	segment := iextp.Segment{
+		Header: iextp.SegmentHeader{
+			Version:                    1,
+			MessageProtocolID:          deep.V_1_0_MessageProtocolID,
+			ChannelID:                  deep.ChannelID,
+			SessionID:                  testSessionID,
+			StreamOffset:               38 * (firstSeq - 1),
+			FirstMessageSequenceNumber: firstSeq,
+			SendTime:                   sendTime,
+		},
+	}
+
+	for i := 0; i < nMessages; i++ {
+		segment.Messages = append(segment.Messages, &deep.TradeReportMessage{
+			MessageType: deep.TradeReport,
+			Timestamp:   sendTime,
+			Symbol:      "ZIEXT",
+			Size:        100,
+			Price:       99.05,
+			TradeID:     firstSeq + int64(i),
+		})
+	}
+
+	buf, err := segment.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func testGap(first, count int64) iex.Gap {
+	return iex.Gap{
+		MessageProtocolID:   deep.V_1_0_MessageProtocolID,
+		ChannelID:           deep.ChannelID,
+		SessionID:           testSessionID,
+		FirstSequenceNumber: first,
+		Count:               count,
+	}
+}
+
+// Returns the first sequence number of each segment.
+func firstSequenceNumbers(t *testing.T, payloads [][]byte) []int64 {
+	var result []int64
+	for _, payload := range payloads {
+		var header iextp.SegmentHeader
+		if err := header.Unmarshal(payload); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, header.FirstMessageSequenceNumber)
+	}
+	return result
+}
+
+func newTestServer(t *testing.T) *Server {
+	s := NewServer()
+	for _, seq := range []int64{1, 3, 6, 10} {
+		sendTime := testSendTime.Add(time.Duration(seq) * time.Millisecond)
+		if err := s.Add(makeTestSegment(t, sendTime, seq, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return s
+}
+
+func TestServer_Recover(t *testing.T) {
+	s := newTestServer(t)
+	testCases := []struct {
+		gap      iex.Gap
+		expected []int64
+	}{
+		{testGap(1, 1), []int64{1}},
+		{testGap(2, 3), []int64{1, 3}},
+		{testGap(5, 1), nil},
+		{testGap(4, 100), []int64{3, 6, 10}},
+		{testGap(12, 1), nil},
+	}
+
+	for _, tc := range testCases {
+		payloads, err := s.Recover(tc.gap)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if seqs := firstSequenceNumbers(t, payloads); !reflect.DeepEqual(seqs, tc.expected) {
+			t.Errorf("%v: recovered segments %v, expected: %v", tc.gap, seqs, tc.expected)
+		}
+	}
+}
+
+func TestServer_SessionRestart(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.Add(makeTestSegment(t, testSendTime.Add(time.Second), 1, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	payloads, err := s.Recover(testGap(1, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seqs := firstSequenceNumbers(t, payloads); !reflect.DeepEqual(seqs, []int64{1}) {
+		t.Fatalf("expected only the restarted segment, got: %v", seqs)
+	}
+}
+
+func TestServer_DuplicateFirstSegment(t *testing.T) {
+	s := newTestServer(t)
+	// A late copy of the first segment, e.g. from the other feed.
+	if err := s.Add(makeTestSegment(t, testSendTime.Add(time.Millisecond), 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	payloads, err := s.Recover(testGap(1, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seqs := firstSequenceNumbers(t, payloads); !reflect.DeepEqual(seqs, []int64{1, 3, 6, 10}) {
+		t.Fatalf("expected all recorded segments, got: %v", seqs)
+	}
+}
+
+func TestServer_RedundantFeeds(t *testing.T) {
+	s := NewServer()
+	// Segment 5 is missing from the A feed, which is added first.
+	for _, feed := range [][]int64{{1, 3, 7, 9}, {1, 3, 5, 7, 9}} {
+		for _, seq := range feed {
+			sendTime := testSendTime.Add(time.Duration(seq) * time.Millisecond)
+			if err := s.Add(makeTestSegment(t, sendTime, seq, 2)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	payloads, err := s.Recover(testGap(1, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seqs := firstSequenceNumbers(t, payloads); !reflect.DeepEqual(seqs, []int64{1, 3, 5, 7, 9}) {
+		t.Fatalf("expected segments of both feeds, got: %v", seqs)
+	}
+}
+
+func startTestServer(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	addr := startTestServer(t, s)
+
+	client, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetTimeout(5 * time.Second)
+
+	for _, gap := range []iex.Gap{testGap(4, 100), testGap(5, 1)} {
+		expected, _ := s.Recover(gap)
+		payloads, err := client.Recover(gap)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(payloads, expected) {
+			t.Fatalf("%v: recovered %v segments, expected %v", gap, len(payloads), len(expected))
+		}
+	}
+
+	// The client should reconnect if the connection is lost.
+	client.Close()
+	if payloads, err := client.Recover(testGap(1, 1)); err != nil {
+		t.Fatal(err)
+	} else if len(payloads) != 1 {
+		t.Fatalf("expected 1 segment, got %v", len(payloads))
+	}
+}
+
+// Drops every nth payload from the underlying source.
+type lossySource struct {
+	iex.PacketDataSource
+	n     int
+	count int
+}
+
+func (ls *lossySource) NextPayload() ([]byte, error) {
+	for {
+		payload, err := ls.PacketDataSource.NextPayload()
+		ls.count++
+		if err != nil || ls.count%ls.n != 0 {
+			return payload, err
+		}
+	}
+}
+
+func openTestPcap(t *testing.T, filename string) iex.PacketDataSource {
+	f, err := os.Open(filepath.Join("..", "testdata", filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	packetDataSource, err := iex.NewPcapDataSource(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return packetDataSource
+}
+
+func TestClient_TOPS16(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping pcap-ng test in short mode.")
+	}
+
+	s := NewServer()
+	defer s.Close()
+	if err := s.AddFrom(openTestPcap(t, "TOPS16.pcapng.gz")); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, s)
+
+	client, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	source := &lossySource{PacketDataSource: openTestPcap(t, "TOPS16.pcapng.gz"), n: 7}
+	scanner := iex.NewPcapScanner(source)
+	scanner.SetGapRecoverer(client)
+	scanner.SetGapHandler(func(gap iex.Gap) {
+		t.Fatalf("unrecovered gap: %v", gap)
+	})
+
+	count := 0
+	for {
+		_, err := scanner.NextMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+
+	if count != 57674 {
+		t.Fatalf("expected to process 57674 messages, got: %v", count)
+	}
+
+	if recovered := scanner.Stats().RecoveredMessages; recovered == 0 {
+		t.Fatal("expected to recover messages from dropped segments")
+	}
+}
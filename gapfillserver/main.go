@@ -0,0 +1,57 @@
+// gapfillserver is a small binary for serving IEX-TP segments recorded
+// in a pcap dump to gapfill.Clients, so that gaps in a live feed can be
+// recovered from a capture taken on another host.
+//
+// The pcap dump may be compressed with gzip, zstd, bzip2 or xz. If it
+// is truncated, the segments read before the end of the file are served.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+
+	"github.com/xuforr/go-iex"
+	"github.com/xuforr/go-iex/gapfill"
+)
+
+func main() {
+	pcapFilename := flag.String("pcap", "", "Path to the pcap file")
+	listenAddr := flag.String("listen", ":9090", "Address to listen on")
+	flag.Parse()
+
+	if *pcapFilename == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := os.Open(*pcapFilename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	packetSource, err := iex.NewPacketDataSource(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := gapfill.NewServer()
+	if err := server.AddFrom(packetSource); err == io.ErrUnexpectedEOF {
+		log.Printf("WARNING: %v is truncated", *pcapFilename)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Serving segments from %v on %v", *pcapFilename, l.Addr())
+	if err := server.Serve(l); err != nil {
+		log.Fatal(err)
+	}
+}
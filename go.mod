@@ -6,12 +6,14 @@ require (
 	github.com/google/go-querystring v1.1.0
 	github.com/google/gopacket v1.1.19
 	github.com/johnmccabe/go-bitbar v0.5.0
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.15
 )
 
 require filippo.io/edwards25519 v1.1.0 // indirect
 
 require (
 	github.com/go-sql-driver/mysql v1.8.1
-	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
-	golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
+	golang.org/x/net v0.35.0
+	golang.org/x/sys v0.30.0
 )
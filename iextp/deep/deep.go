@@ -1,4 +1,7 @@
 // Package deep implements an unmarshaler for the DEEP protocol, v1.0.
+//
+// As in package tops, fields appended to the message formats by later
+// revisions of the specification are kept in the Extension of each message.
 package deep
 
 import (
@@ -33,7 +36,13 @@ const (
 )
 
 func init() {
-	iextp.RegisterProtocol(V_1_0_MessageProtocolID, Unmarshal)
+	Register(iextp.DefaultDecoder)
+}
+
+// Register the DEEP protocol with the given Decoder.
+func Register(d *iextp.Decoder) {
+	d.Register(V_1_0_MessageProtocolID, Unmarshal)
+	d.RegisterReusable(V_1_0_MessageProtocolID, NewReusableUnmarshaler)
 }
 
 // Implements the DEEP protocol, v1.0.
@@ -78,6 +87,65 @@ func Unmarshal(buf []byte) (iextp.Message, error) {
 	return msg, err
 }
 
+// NewReusableUnmarshaler returns an implementation of the DEEP protocol,
+// v1.0, that unmarshals each message type into the same struct on every
+// call. The returned Message is only valid until the next call.
+func NewReusableUnmarshaler() iextp.Protocol {
+	var cache messageCache
+	return func(buf []byte) (iextp.Message, error) {
+		if len(buf) == 0 {
+			return nil, fmt.Errorf("cannot unmarshal %v-length buffer", len(buf))
+		}
+
+		var msg iextp.Message
+		switch buf[0] {
+		case SystemEvent:
+			msg = &cache.systemEvent
+		case SecurityDirectory:
+			msg = &cache.securityDirectory
+		case TradingStatus:
+			msg = &cache.tradingStatus
+		case OperationalHaltStatus:
+			msg = &cache.operationalHaltStatus
+		case ShortSalePriceTestStatus:
+			msg = &cache.shortSalePriceTestStatus
+		case SecurityEvent:
+			msg = &cache.securityEvent
+		case PriceLevelUpdateBuySide, PriceLevelUpdateSellSide:
+			msg = &cache.priceLevelUpdate
+		case TradeReport:
+			msg = &cache.tradeReport
+		case OfficialPrice:
+			msg = &cache.officialPrice
+		case TradeBreak:
+			msg = &cache.tradeBreak
+		case AuctionInformation:
+			msg = &cache.auctionInformation
+		default:
+			msg = &cache.unsupported
+		}
+
+		err := msg.Unmarshal(buf)
+		return msg, err
+	}
+}
+
+// One reusable message of each DEEP message type.
+type messageCache struct {
+	systemEvent              SystemEventMessage
+	securityDirectory        SecurityDirectoryMessage
+	tradingStatus            TradingStatusMessage
+	operationalHaltStatus    OperationalHaltStatusMessage
+	shortSalePriceTestStatus ShortSalePriceTestStatusMessage
+	securityEvent            SecurityEventMessage
+	priceLevelUpdate         PriceLevelUpdateMessage
+	tradeReport              TradeReportMessage
+	officialPrice            OfficialPriceMessage
+	tradeBreak               TradeBreakMessage
+	auctionInformation       AuctionInformationMessage
+	unsupported              iextp.UnsupportedMessage
+}
+
 type SystemEventMessage = tops.SystemEventMessage
 type SecurityDirectoryMessage = tops.SecurityDirectoryMessage
 type TradingStatusMessage = tops.TradingStatusMessage
@@ -98,6 +166,8 @@ type SecurityEventMessage struct {
 	Timestamp time.Time
 	// IEX-listed security represented in Nasdaq Integrated symbology.
 	Symbol string
+
+	Extension tops.Extension `json:",omitempty"`
 }
 
 func (m *SecurityEventMessage) Unmarshal(buf []byte) error {
@@ -111,9 +181,22 @@ func (m *SecurityEventMessage) Unmarshal(buf []byte) error {
 	m.SecurityEvent = uint8(buf[1])
 	m.Timestamp = tops.ParseTimestamp(buf[2:10])
 	m.Symbol = tops.ParseString(buf[10:18])
+
+	m.Extension = tops.ParseExtension(buf, 18)
 	return nil
 }
 
+func (m *SecurityEventMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 18)
+	buf[0] = m.MessageType
+	buf[1] = m.SecurityEvent
+	tops.PutTimestamp(buf[2:10], m.Timestamp)
+	if err := tops.PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	return append(buf, m.Extension...), nil
+}
+
 // Security event types.
 const (
 	// Indicates that the opening process is complete in this security
@@ -143,6 +226,8 @@ type PriceLevelUpdateMessage struct {
 	Size uint32
 	// Price level to add/update in the IEX Order Book.
 	Price float64
+
+	Extension tops.Extension `json:",omitempty"`
 }
 
 func (m *PriceLevelUpdateMessage) IsBuySide() bool {
@@ -170,5 +255,20 @@ func (m *PriceLevelUpdateMessage) Unmarshal(buf []byte) error {
 	m.Symbol = tops.ParseString(buf[10:18])
 	m.Size = binary.LittleEndian.Uint32(buf[18:22])
 	m.Price = tops.ParseFloat(buf[22:30])
+
+	m.Extension = tops.ParseExtension(buf, 30)
 	return nil
 }
+
+func (m *PriceLevelUpdateMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 30)
+	buf[0] = m.MessageType
+	buf[1] = m.EventFlags
+	tops.PutTimestamp(buf[2:10], m.Timestamp)
+	if err := tops.PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(buf[18:22], m.Size)
+	tops.PutFloat(buf[22:30], m.Price)
+	return append(buf, m.Extension...), nil
+}
@@ -1,6 +1,7 @@
 package deep
 
 import (
+	"bytes"
 	"reflect"
 	"testing"
 	"time"
@@ -8,6 +9,14 @@ import (
 	"github.com/xuforr/go-iex/iextp"
 )
 
+func TestRegister(t *testing.T) {
+	d := iextp.NewDecoder()
+	Register(d)
+	if _, ok := d.Protocol(V_1_0_MessageProtocolID); !ok {
+		t.Fatal("DEEP v1.0 should be registered")
+	}
+}
+
 func TestUnmarshal_UnknownMessageType(t *testing.T) {
 	data := []byte{0x02} // Not a known message type.
 	msg, err := Unmarshal(data)
@@ -57,6 +66,8 @@ func TestSecurityEventMessage(t *testing.T) {
 	if seMsg != expected {
 		t.Fatalf("parsed: %v, expected: %v", msg, expected)
 	}
+
+	checkMarshal(t, msg, data)
 }
 
 func TestPriceLevelUpdateMessage_BuySide(t *testing.T) {
@@ -89,6 +100,8 @@ func TestPriceLevelUpdateMessage_BuySide(t *testing.T) {
 		t.Fatalf("parsed: %v, expected: %v", msg, expected)
 	}
 
+	checkMarshal(t, msg, data)
+
 	if !pluMsg.IsBuySide() {
 		t.Fatal("message is buy side")
 	}
@@ -127,6 +140,8 @@ func TestPriceLevelUpdateMessage_SellSide(t *testing.T) {
 		t.Fatalf("parsed: %v, expected: %v", msg, expected)
 	}
 
+	checkMarshal(t, msg, data)
+
 	if pluMsg.IsBuySide() {
 		t.Fatal("message is sell side")
 	}
@@ -135,3 +150,79 @@ func TestPriceLevelUpdateMessage_SellSide(t *testing.T) {
 		t.Fatal("message is sell side")
 	}
 }
+
+func TestUnmarshal_AppendedFields(t *testing.T) {
+	data := []byte{
+		0x38,                                           // Price level update on the Buy Side
+		0x01,                                           // Event processing complete
+		0xac, 0x63, 0xc0, 0x20, 0x96, 0x86, 0x6d, 0x14, // 2016-08-23 15:30:32.572715948
+		0x5a, 0x49, 0x45, 0x58, 0x54, 0x20, 0x20, 0x20, // ZIEXT
+		0xe4, 0x25, 0x00, 0x00, // 9,700 shares
+		0x24, 0x1d, 0x0f, 0x00, 0x00, 0x00, 0x00, 0x00, // $99.05
+		0xff, 0xfe, // Unknown trailing fields
+	}
+
+	for _, unmarshal := range []iextp.Protocol{Unmarshal, NewReusableUnmarshaler()} {
+		msg, err := unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pluMsg := msg.(*PriceLevelUpdateMessage)
+		if pluMsg.Size != 9700 || pluMsg.Extension != "\xff\xfe" {
+			t.Fatalf("unexpected price level update: %v", pluMsg)
+		}
+
+		checkMarshal(t, msg, data)
+	}
+}
+
+func TestNewReusableUnmarshaler(t *testing.T) {
+	plu := &PriceLevelUpdateMessage{
+		MessageType: PriceLevelUpdateBuySide,
+		EventFlags:  1,
+		Timestamp:   time.Date(2016, time.August, 23, 19, 30, 32, 572715948, time.UTC),
+		Symbol:      "ZIEXT",
+		Size:        9700,
+		Price:       99.05,
+	}
+	unmarshal := NewReusableUnmarshaler()
+	var first *PriceLevelUpdateMessage
+	for _, side := range []uint8{PriceLevelUpdateBuySide, PriceLevelUpdateSellSide} {
+		plu.MessageType = side
+		data, err := plu.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed := msg.(*PriceLevelUpdateMessage)
+		if *parsed != *plu {
+			t.Fatalf("parsed: %v, expected: %v", parsed, plu)
+		}
+		if first == nil {
+			first = parsed
+		} else if parsed != first {
+			t.Fatal("expected messages to be decoded into the same struct")
+		}
+	}
+
+	if _, err := unmarshal(nil); err == nil {
+		t.Fatal("expected unmarshal error")
+	}
+}
+
+func checkMarshal(t *testing.T, msg iextp.Message, expected []byte) {
+	t.Helper()
+	buf, err := msg.(iextp.Marshaler).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf, expected) {
+		t.Fatalf("marshaled: %x, expected: %x", buf, expected)
+	}
+}
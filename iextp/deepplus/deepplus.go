@@ -0,0 +1,460 @@
+// Package deepplus implements an unmarshaler for the DEEP+ protocol, v1.0.
+//
+// DEEP+ is IEX's order-by-order market data feed. In addition to the
+// administrative and trading messages of DEEP, it disseminates every
+// displayed order resting on the IEX Order Book, and every change to it.
+//
+// As in package tops, fields appended to the message formats by later
+// revisions of the specification are kept in the Extension of each message.
+package deepplus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+	"github.com/xuforr/go-iex/iextp/tops"
+)
+
+const (
+	ChannelID               uint32 = 1
+	V_1_0_MessageProtocolID uint16 = 0x8005
+	FeedName                       = "DEEP+"
+)
+
+const (
+	SystemEvent              = tops.SystemEvent
+	SecurityDirectory        = tops.SecurityDirectory
+	TradingStatus            = tops.TradingStatus
+	OperationalHaltStatus    = tops.OperationalHaltStatus
+	ShortSalePriceTestStatus = tops.ShortSalePriceTestStatus
+	AuctionInformation       = tops.AuctionInformation
+	TradeReport              = tops.TradeReport
+	OfficialPrice            = tops.OfficialPrice
+	TradeBreak               = tops.TradeBreak
+	SecurityEvent            = deep.SecurityEvent
+
+	// Order book message formats.
+	AddOrder      = 0x61
+	OrderModify   = 0x4d
+	OrderDelete   = 0x52
+	OrderExecuted = 0x4c
+	ClearBook     = 0x43
+)
+
+// Order sides.
+const (
+	BuySide  uint8 = 0x38
+	SellSide uint8 = 0x35
+)
+
+func init() {
+	Register(iextp.DefaultDecoder)
+}
+
+// Register the DEEP+ protocol with the given Decoder.
+func Register(d *iextp.Decoder) {
+	d.Register(V_1_0_MessageProtocolID, Unmarshal)
+	d.RegisterReusable(V_1_0_MessageProtocolID, NewReusableUnmarshaler)
+}
+
+// Implements the DEEP+ protocol, v1.0.
+func Unmarshal(buf []byte) (iextp.Message, error) {
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("cannot unmarshal %v-length buffer", len(buf))
+	}
+
+	var msg iextp.Message
+
+	messageType := buf[0]
+	switch messageType {
+	case SystemEvent:
+		msg = &SystemEventMessage{}
+	case SecurityDirectory:
+		msg = &SecurityDirectoryMessage{}
+	case TradingStatus:
+		msg = &TradingStatusMessage{}
+	case OperationalHaltStatus:
+		msg = &OperationalHaltStatusMessage{}
+	case ShortSalePriceTestStatus:
+		msg = &ShortSalePriceTestStatusMessage{}
+	case SecurityEvent:
+		msg = &SecurityEventMessage{}
+	case AddOrder:
+		msg = &AddOrderMessage{}
+	case OrderModify:
+		msg = &OrderModifyMessage{}
+	case OrderDelete:
+		msg = &OrderDeleteMessage{}
+	case OrderExecuted:
+		msg = &OrderExecutedMessage{}
+	case ClearBook:
+		msg = &ClearBookMessage{}
+	case TradeReport:
+		msg = &TradeReportMessage{}
+	case OfficialPrice:
+		msg = &OfficialPriceMessage{}
+	case TradeBreak:
+		msg = &TradeBreakMessage{}
+	case AuctionInformation:
+		msg = &AuctionInformationMessage{}
+	default:
+		msg = &iextp.UnsupportedMessage{}
+	}
+
+	err := msg.Unmarshal(buf)
+	return msg, err
+}
+
+// NewReusableUnmarshaler returns an implementation of the DEEP+ protocol,
+// v1.0, that unmarshals each message type into the same struct on every
+// call. The returned Message is only valid until the next call.
+func NewReusableUnmarshaler() iextp.Protocol {
+	var cache messageCache
+	return func(buf []byte) (iextp.Message, error) {
+		if len(buf) == 0 {
+			return nil, fmt.Errorf("cannot unmarshal %v-length buffer", len(buf))
+		}
+
+		var msg iextp.Message
+		switch buf[0] {
+		case SystemEvent:
+			msg = &cache.systemEvent
+		case SecurityDirectory:
+			msg = &cache.securityDirectory
+		case TradingStatus:
+			msg = &cache.tradingStatus
+		case OperationalHaltStatus:
+			msg = &cache.operationalHaltStatus
+		case ShortSalePriceTestStatus:
+			msg = &cache.shortSalePriceTestStatus
+		case SecurityEvent:
+			msg = &cache.securityEvent
+		case AddOrder:
+			msg = &cache.addOrder
+		case OrderModify:
+			msg = &cache.orderModify
+		case OrderDelete:
+			msg = &cache.orderDelete
+		case OrderExecuted:
+			msg = &cache.orderExecuted
+		case ClearBook:
+			msg = &cache.clearBook
+		case TradeReport:
+			msg = &cache.tradeReport
+		case OfficialPrice:
+			msg = &cache.officialPrice
+		case TradeBreak:
+			msg = &cache.tradeBreak
+		case AuctionInformation:
+			msg = &cache.auctionInformation
+		default:
+			msg = &cache.unsupported
+		}
+
+		err := msg.Unmarshal(buf)
+		return msg, err
+	}
+}
+
+// One reusable message of each DEEP+ message type.
+type messageCache struct {
+	systemEvent              SystemEventMessage
+	securityDirectory        SecurityDirectoryMessage
+	tradingStatus            TradingStatusMessage
+	operationalHaltStatus    OperationalHaltStatusMessage
+	shortSalePriceTestStatus ShortSalePriceTestStatusMessage
+	securityEvent            SecurityEventMessage
+	addOrder                 AddOrderMessage
+	orderModify              OrderModifyMessage
+	orderDelete              OrderDeleteMessage
+	orderExecuted            OrderExecutedMessage
+	clearBook                ClearBookMessage
+	tradeReport              TradeReportMessage
+	officialPrice            OfficialPriceMessage
+	tradeBreak               TradeBreakMessage
+	auctionInformation       AuctionInformationMessage
+	unsupported              iextp.UnsupportedMessage
+}
+
+type SystemEventMessage = tops.SystemEventMessage
+type SecurityDirectoryMessage = tops.SecurityDirectoryMessage
+type TradingStatusMessage = tops.TradingStatusMessage
+type OperationalHaltStatusMessage = tops.OperationalHaltStatusMessage
+type ShortSalePriceTestStatusMessage = tops.ShortSalePriceTestStatusMessage
+type TradeReportMessage = tops.TradeReportMessage
+type OfficialPriceMessage = tops.OfficialPriceMessage
+type TradeBreakMessage = tops.TradeBreakMessage
+type AuctionInformationMessage = tops.AuctionInformationMessage
+type SecurityEventMessage = deep.SecurityEventMessage
+
+// AddOrderMessages are sent when a displayed order is added to
+// the IEX Order Book.
+type AddOrderMessage struct {
+	MessageType uint8
+	// Side of the order (BuySide or SellSide).
+	Side uint8
+	// The time the order was added, as set by the IEX Trading System logic.
+	Timestamp time.Time
+	// Security represented in Nasdaq Integrated symbology.
+	Symbol string
+	// IEX generated order identifier. A given order is uniquely
+	// identified within a day by its OrderID.
+	OrderID int64
+	// Displayed size of the order, in number of shares.
+	Size uint32
+	// Limit price of the order.
+	Price float64
+
+	Extension tops.Extension `json:",omitempty"`
+}
+
+func (m *AddOrderMessage) IsBuySide() bool {
+	return m.Side == BuySide
+}
+
+func (m *AddOrderMessage) IsSellSide() bool {
+	return m.Side == SellSide
+}
+
+func (m *AddOrderMessage) Unmarshal(buf []byte) error {
+	if len(buf) < 38 {
+		return fmt.Errorf(
+			"cannot unmarshal AddOrderMessage from %v-length buffer",
+			len(buf))
+	}
+
+	m.MessageType = uint8(buf[0])
+	m.Side = uint8(buf[1])
+	m.Timestamp = tops.ParseTimestamp(buf[2:10])
+	m.Symbol = tops.ParseString(buf[10:18])
+	m.OrderID = int64(binary.LittleEndian.Uint64(buf[18:26]))
+	m.Size = binary.LittleEndian.Uint32(buf[26:30])
+	m.Price = tops.ParseFloat(buf[30:38])
+
+	m.Extension = tops.ParseExtension(buf, 38)
+	return nil
+}
+
+func (m *AddOrderMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 38)
+	buf[0] = m.MessageType
+	buf[1] = m.Side
+	tops.PutTimestamp(buf[2:10], m.Timestamp)
+	if err := tops.PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint64(buf[18:26], uint64(m.OrderID))
+	binary.LittleEndian.PutUint32(buf[26:30], m.Size)
+	tops.PutFloat(buf[30:38], m.Price)
+	return append(buf, m.Extension...), nil
+}
+
+// OrderModifyMessages are sent when the size or price of a displayed
+// order on the IEX Order Book is changed.
+type OrderModifyMessage struct {
+	MessageType uint8
+	ModifyFlags uint8
+	// The time the order was modified, as set by the IEX Trading System logic.
+	Timestamp time.Time
+	// Security represented in Nasdaq Integrated symbology.
+	Symbol string
+	// Identifier of the modified order.
+	OrderID int64
+	// New displayed size of the order, in number of shares.
+	Size uint32
+	// New limit price of the order.
+	Price float64
+
+	Extension tops.Extension `json:",omitempty"`
+}
+
+// Whether the order lost its time priority as a result of the
+// modification, and is now behind all other orders at its price.
+func (m *OrderModifyMessage) ResetsPriority() bool {
+	return m.ModifyFlags&0x01 != 0
+}
+
+func (m *OrderModifyMessage) Unmarshal(buf []byte) error {
+	if len(buf) < 38 {
+		return fmt.Errorf(
+			"cannot unmarshal OrderModifyMessage from %v-length buffer",
+			len(buf))
+	}
+
+	m.MessageType = uint8(buf[0])
+	m.ModifyFlags = uint8(buf[1])
+	m.Timestamp = tops.ParseTimestamp(buf[2:10])
+	m.Symbol = tops.ParseString(buf[10:18])
+	m.OrderID = int64(binary.LittleEndian.Uint64(buf[18:26]))
+	m.Size = binary.LittleEndian.Uint32(buf[26:30])
+	m.Price = tops.ParseFloat(buf[30:38])
+
+	m.Extension = tops.ParseExtension(buf, 38)
+	return nil
+}
+
+func (m *OrderModifyMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 38)
+	buf[0] = m.MessageType
+	buf[1] = m.ModifyFlags
+	tops.PutTimestamp(buf[2:10], m.Timestamp)
+	if err := tops.PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint64(buf[18:26], uint64(m.OrderID))
+	binary.LittleEndian.PutUint32(buf[26:30], m.Size)
+	tops.PutFloat(buf[30:38], m.Price)
+	return append(buf, m.Extension...), nil
+}
+
+// OrderDeleteMessages are sent when a displayed order is removed
+// from the IEX Order Book, e.g. because it was canceled.
+type OrderDeleteMessage struct {
+	MessageType uint8
+	// The time the order was deleted, as set by the IEX Trading System logic.
+	Timestamp time.Time
+	// Security represented in Nasdaq Integrated symbology.
+	Symbol string
+	// Identifier of the deleted order.
+	OrderID int64
+
+	Extension tops.Extension `json:",omitempty"`
+}
+
+func (m *OrderDeleteMessage) Unmarshal(buf []byte) error {
+	if len(buf) < 26 {
+		return fmt.Errorf(
+			"cannot unmarshal OrderDeleteMessage from %v-length buffer",
+			len(buf))
+	}
+
+	m.MessageType = uint8(buf[0])
+	m.Timestamp = tops.ParseTimestamp(buf[2:10])
+	m.Symbol = tops.ParseString(buf[10:18])
+	m.OrderID = int64(binary.LittleEndian.Uint64(buf[18:26]))
+
+	m.Extension = tops.ParseExtension(buf, 26)
+	return nil
+}
+
+func (m *OrderDeleteMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 26)
+	buf[0] = m.MessageType
+	tops.PutTimestamp(buf[2:10], m.Timestamp)
+	if err := tops.PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint64(buf[18:26], uint64(m.OrderID))
+	return append(buf, m.Extension...), nil
+}
+
+// OrderExecutedMessages are sent when a displayed order on the IEX
+// Order Book is executed in whole or in part.
+type OrderExecutedMessage struct {
+	MessageType uint8
+	// Same as the SaleConditionFlags of a TradeReportMessage.
+	SaleConditionFlags uint8
+	// The time of the execution, as set by the IEX Trading System logic.
+	Timestamp time.Time
+	// Security represented in Nasdaq Integrated symbology.
+	Symbol string
+	// Identifier of the executed order.
+	OrderID int64
+	// Executed size, in number of shares.
+	Size uint32
+	// Execution price.
+	Price float64
+	// IEX generated trade identifier, as in the TradeReportMessage.
+	TradeID int64
+
+	Extension tops.Extension `json:",omitempty"`
+}
+
+// TradeReport returns the trade resulting from the execution.
+func (m *OrderExecutedMessage) TradeReport() *TradeReportMessage {
+	return &TradeReportMessage{
+		MessageType:        TradeReport,
+		SaleConditionFlags: m.SaleConditionFlags,
+		Timestamp:          m.Timestamp,
+		Symbol:             m.Symbol,
+		Size:               m.Size,
+		Price:              m.Price,
+		TradeID:            m.TradeID,
+	}
+}
+
+func (m *OrderExecutedMessage) Unmarshal(buf []byte) error {
+	if len(buf) < 46 {
+		return fmt.Errorf(
+			"cannot unmarshal OrderExecutedMessage from %v-length buffer",
+			len(buf))
+	}
+
+	m.MessageType = uint8(buf[0])
+	m.SaleConditionFlags = uint8(buf[1])
+	m.Timestamp = tops.ParseTimestamp(buf[2:10])
+	m.Symbol = tops.ParseString(buf[10:18])
+	m.OrderID = int64(binary.LittleEndian.Uint64(buf[18:26]))
+	m.Size = binary.LittleEndian.Uint32(buf[26:30])
+	m.Price = tops.ParseFloat(buf[30:38])
+	m.TradeID = int64(binary.LittleEndian.Uint64(buf[38:46]))
+
+	m.Extension = tops.ParseExtension(buf, 46)
+	return nil
+}
+
+func (m *OrderExecutedMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 46)
+	buf[0] = m.MessageType
+	buf[1] = m.SaleConditionFlags
+	tops.PutTimestamp(buf[2:10], m.Timestamp)
+	if err := tops.PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint64(buf[18:26], uint64(m.OrderID))
+	binary.LittleEndian.PutUint32(buf[26:30], m.Size)
+	tops.PutFloat(buf[30:38], m.Price)
+	binary.LittleEndian.PutUint64(buf[38:46], uint64(m.TradeID))
+	return append(buf, m.Extension...), nil
+}
+
+// ClearBookMessages are sent when all orders for a security have been
+// removed from the IEX Order Book, e.g. at the end of the trading day
+// or when recovering from a system failure.
+type ClearBookMessage struct {
+	MessageType uint8
+	// The time the book was cleared, as set by the IEX Trading System logic.
+	Timestamp time.Time
+	// Security represented in Nasdaq Integrated symbology.
+	Symbol string
+
+	Extension tops.Extension `json:",omitempty"`
+}
+
+func (m *ClearBookMessage) Unmarshal(buf []byte) error {
+	if len(buf) < 18 {
+		return fmt.Errorf(
+			"cannot unmarshal ClearBookMessage from %v-length buffer",
+			len(buf))
+	}
+
+	m.MessageType = uint8(buf[0])
+	m.Timestamp = tops.ParseTimestamp(buf[2:10])
+	m.Symbol = tops.ParseString(buf[10:18])
+
+	m.Extension = tops.ParseExtension(buf, 18)
+	return nil
+}
+
+func (m *ClearBookMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 18)
+	buf[0] = m.MessageType
+	tops.PutTimestamp(buf[2:10], m.Timestamp)
+	if err := tops.PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	return append(buf, m.Extension...), nil
+}
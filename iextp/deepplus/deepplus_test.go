@@ -0,0 +1,303 @@
+package deepplus
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+)
+
+var testTimestamp = time.Date(2016, time.August, 23, 19, 30, 32, 572715948, time.UTC)
+
+func TestRegister(t *testing.T) {
+	d := iextp.NewDecoder()
+	Register(d)
+	if _, ok := d.Protocol(V_1_0_MessageProtocolID); !ok {
+		t.Fatal("DEEP+ v1.0 should be registered")
+	}
+}
+
+func TestUnmarshal_UnknownMessageType(t *testing.T) {
+	data := []byte{0x02} // Not a known message type.
+	msg, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unkMsg, ok := msg.(*iextp.UnsupportedMessage)
+	if !ok {
+		t.Fatal("expected to decode UnsupportedMessage")
+	}
+
+	if !reflect.DeepEqual(unkMsg.Message, data) {
+		t.Fatal("message data not equal to input")
+	}
+}
+
+func TestUnmarshal_Empty(t *testing.T) {
+	data := []byte{}
+	_, err := Unmarshal(data)
+	if err.Error() != "cannot unmarshal 0-length buffer" {
+		t.Fatal("expected unmarshal error")
+	}
+}
+
+func TestUnmarshal_Short(t *testing.T) {
+	for _, messageType := range []byte{AddOrder, OrderModify, OrderDelete, OrderExecuted, ClearBook} {
+		if _, err := Unmarshal([]byte{messageType, 0x00}); err == nil {
+			t.Fatalf("expected error unmarshaling truncated %#x message", messageType)
+		}
+	}
+}
+
+func TestAddOrderMessage(t *testing.T) {
+	data := []byte{
+		0x61,                                           // a = Add Order
+		0x38,                                           // Buy Side
+		0xac, 0x63, 0xc0, 0x20, 0x96, 0x86, 0x6d, 0x14, // 2016-08-23 15:30:32.572715948
+		0x5a, 0x49, 0x45, 0x58, 0x54, 0x20, 0x20, 0x20, // ZIEXT
+		0x96, 0x8f, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, // Order ID 429974
+		0xe4, 0x25, 0x00, 0x00, // 9,700 shares
+		0x24, 0x1d, 0x0f, 0x00, 0x00, 0x00, 0x00, 0x00, // $99.05
+	}
+
+	msg, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aoMsg := *msg.(*AddOrderMessage)
+	expected := AddOrderMessage{
+		MessageType: AddOrder,
+		Side:        BuySide,
+		Timestamp:   testTimestamp,
+		Symbol:      "ZIEXT",
+		OrderID:     429974,
+		Size:        9700,
+		Price:       99.05,
+	}
+
+	if aoMsg != expected {
+		t.Fatalf("parsed: %v, expected: %v", msg, expected)
+	}
+
+	checkMarshal(t, msg, data)
+
+	if !aoMsg.IsBuySide() || aoMsg.IsSellSide() {
+		t.Fatal("message is buy side")
+	}
+}
+
+func TestOrderModifyMessage(t *testing.T) {
+	data := []byte{
+		0x4d,                                           // M = Order Modify
+		0x01,                                           // Priority reset
+		0xac, 0x63, 0xc0, 0x20, 0x96, 0x86, 0x6d, 0x14, // 2016-08-23 15:30:32.572715948
+		0x5a, 0x49, 0x45, 0x58, 0x54, 0x20, 0x20, 0x20, // ZIEXT
+		0x96, 0x8f, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, // Order ID 429974
+		0x64, 0x00, 0x00, 0x00, // 100 shares
+		0x24, 0x1d, 0x0f, 0x00, 0x00, 0x00, 0x00, 0x00, // $99.05
+	}
+
+	msg, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	omMsg := *msg.(*OrderModifyMessage)
+	expected := OrderModifyMessage{
+		MessageType: OrderModify,
+		ModifyFlags: 0x01,
+		Timestamp:   testTimestamp,
+		Symbol:      "ZIEXT",
+		OrderID:     429974,
+		Size:        100,
+		Price:       99.05,
+	}
+
+	if omMsg != expected {
+		t.Fatalf("parsed: %v, expected: %v", msg, expected)
+	}
+
+	checkMarshal(t, msg, data)
+
+	if !omMsg.ResetsPriority() {
+		t.Fatal("modification resets priority")
+	}
+}
+
+func TestOrderDeleteMessage(t *testing.T) {
+	data := []byte{
+		0x52,                                           // R = Order Delete
+		0x00,                                           // Reserved
+		0xac, 0x63, 0xc0, 0x20, 0x96, 0x86, 0x6d, 0x14, // 2016-08-23 15:30:32.572715948
+		0x5a, 0x49, 0x45, 0x58, 0x54, 0x20, 0x20, 0x20, // ZIEXT
+		0x96, 0x8f, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, // Order ID 429974
+	}
+
+	msg, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	odMsg := *msg.(*OrderDeleteMessage)
+	expected := OrderDeleteMessage{
+		MessageType: OrderDelete,
+		Timestamp:   testTimestamp,
+		Symbol:      "ZIEXT",
+		OrderID:     429974,
+	}
+
+	if odMsg != expected {
+		t.Fatalf("parsed: %v, expected: %v", msg, expected)
+	}
+
+	checkMarshal(t, msg, data)
+}
+
+func TestOrderExecutedMessage(t *testing.T) {
+	data := []byte{
+		0x4c,                                           // L = Order Executed
+		0x00,                                           // Regular trade
+		0xac, 0x63, 0xc0, 0x20, 0x96, 0x86, 0x6d, 0x14, // 2016-08-23 15:30:32.572715948
+		0x5a, 0x49, 0x45, 0x58, 0x54, 0x20, 0x20, 0x20, // ZIEXT
+		0x96, 0x8f, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, // Order ID 429974
+		0x64, 0x00, 0x00, 0x00, // 100 shares
+		0x24, 0x1d, 0x0f, 0x00, 0x00, 0x00, 0x00, 0x00, // $99.05
+		0x96, 0x8f, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, // Trade ID 429974
+	}
+
+	msg, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oeMsg := *msg.(*OrderExecutedMessage)
+	expected := OrderExecutedMessage{
+		MessageType: OrderExecuted,
+		Timestamp:   testTimestamp,
+		Symbol:      "ZIEXT",
+		OrderID:     429974,
+		Size:        100,
+		Price:       99.05,
+		TradeID:     429974,
+	}
+
+	if oeMsg != expected {
+		t.Fatalf("parsed: %v, expected: %v", msg, expected)
+	}
+
+	checkMarshal(t, msg, data)
+
+	trade := oeMsg.TradeReport()
+	if trade.MessageType != TradeReport || trade.TradeID != 429974 ||
+		trade.Size != 100 || trade.Price != 99.05 || trade.Symbol != "ZIEXT" {
+		t.Fatalf("unexpected trade report: %v", trade)
+	}
+}
+
+func TestClearBookMessage(t *testing.T) {
+	data := []byte{
+		0x43,                                           // C = Clear Book
+		0x00,                                           // Reserved
+		0xac, 0x63, 0xc0, 0x20, 0x96, 0x86, 0x6d, 0x14, // 2016-08-23 15:30:32.572715948
+		0x5a, 0x49, 0x45, 0x58, 0x54, 0x20, 0x20, 0x20, // ZIEXT
+	}
+
+	msg, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cbMsg := *msg.(*ClearBookMessage)
+	expected := ClearBookMessage{
+		MessageType: ClearBook,
+		Timestamp:   testTimestamp,
+		Symbol:      "ZIEXT",
+	}
+
+	if cbMsg != expected {
+		t.Fatalf("parsed: %v, expected: %v", msg, expected)
+	}
+
+	checkMarshal(t, msg, data)
+}
+
+func TestUnmarshal_AppendedFields(t *testing.T) {
+	data := []byte{
+		0x61,                                           // a = Add Order
+		0x38,                                           // Buy Side
+		0xac, 0x63, 0xc0, 0x20, 0x96, 0x86, 0x6d, 0x14, // 2016-08-23 15:30:32.572715948
+		0x5a, 0x49, 0x45, 0x58, 0x54, 0x20, 0x20, 0x20, // ZIEXT
+		0x96, 0x8f, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, // Order ID 429974
+		0xe4, 0x25, 0x00, 0x00, // 9,700 shares
+		0x24, 0x1d, 0x0f, 0x00, 0x00, 0x00, 0x00, 0x00, // $99.05
+		0xff, 0xfe, // Unknown trailing fields
+	}
+
+	for _, unmarshal := range []iextp.Protocol{Unmarshal, NewReusableUnmarshaler()} {
+		msg, err := unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		aoMsg := msg.(*AddOrderMessage)
+		if aoMsg.OrderID != 429974 || aoMsg.Extension != "\xff\xfe" {
+			t.Fatalf("unexpected add order: %v", aoMsg)
+		}
+
+		checkMarshal(t, msg, data)
+	}
+}
+
+func TestNewReusableUnmarshaler(t *testing.T) {
+	order := &AddOrderMessage{
+		MessageType: AddOrder,
+		Side:        BuySide,
+		Timestamp:   testTimestamp,
+		Symbol:      "ZIEXT",
+		Size:        100,
+		Price:       99.05,
+	}
+	unmarshal := NewReusableUnmarshaler()
+	var first *AddOrderMessage
+	for orderID := int64(1); orderID <= 2; orderID++ {
+		order.OrderID = orderID
+		data, err := order.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed := msg.(*AddOrderMessage)
+		if *parsed != *order {
+			t.Fatalf("parsed: %v, expected: %v", parsed, order)
+		}
+		if first == nil {
+			first = parsed
+		} else if parsed != first {
+			t.Fatal("expected messages to be decoded into the same struct")
+		}
+	}
+
+	if _, err := unmarshal(nil); err == nil {
+		t.Fatal("expected unmarshal error")
+	}
+}
+
+func checkMarshal(t *testing.T, msg iextp.Message, expected []byte) {
+	t.Helper()
+	buf, err := msg.(iextp.Marshaler).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf, expected) {
+		t.Fatalf("marshaled: %x, expected: %x", buf, expected)
+	}
+}
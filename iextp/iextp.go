@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"time"
 )
 
@@ -17,13 +18,62 @@ const segmentHeaderSize uint16 = 40
 // segment header.
 type Protocol func(buf []byte) (Message, error)
 
-var protocolRegistry = map[uint16]Protocol{}
+// Decoder decodes IEXTP segments using its own registry of protocols,
+// so that alternative protocol implementations can be used without
+// affecting other decoders in the same process.
+//
+// Protocols must be registered before the Decoder is used;
+// Register is not safe to call concurrently with UnmarshalSegment.
+type Decoder struct {
+	protocols map[uint16]Protocol
+	reusable  map[uint16]func() Protocol
+}
+
+// NewDecoder creates a Decoder with no registered protocols.
+func NewDecoder() *Decoder {
+	return &Decoder{
+		protocols: make(map[uint16]Protocol),
+		reusable:  make(map[uint16]func() Protocol),
+	}
+}
+
+// DefaultDecoder is the Decoder used by Segment.Unmarshal. The TOPS and
+// DEEP packages register their protocols with it when they are imported.
+var DefaultDecoder = NewDecoder()
+
+// Register a protocol to use for decoding the messages of segments with
+// the given message protocol ID, replacing any previously registered one.
+func (d *Decoder) Register(messageProtocolID uint16, p Protocol) {
+	d.protocols[messageProtocolID] = p
+	delete(d.reusable, messageProtocolID)
+}
 
-// Register an IEXTP protocol to use for decoding Segment Messages.
-// RegisterProtocol should be called at init time by packages that implement
-// IEXTP protocols, such as TOPS and DEEP.
+// RegisterReusable registers a constructor for a reusable implementation
+// of the protocol with the given message protocol ID, which is used by
+// SegmentReaders instead of the protocol registered with Register.
+//
+// Each SegmentReader calls newProtocol once. The returned Protocol may
+// unmarshal messages into structs that it owns and reuses on each call,
+// so the Message it returns need only remain valid until the next call.
+//
+// The protocol must be registered with Register first; registering it
+// again with Register removes the reusable implementation.
+func (d *Decoder) RegisterReusable(messageProtocolID uint16, newProtocol func() Protocol) {
+	d.reusable[messageProtocolID] = newProtocol
+}
+
+// Protocol returns the protocol registered for the given message
+// protocol ID, if any.
+func (d *Decoder) Protocol(messageProtocolID uint16) (Protocol, bool) {
+	p, ok := d.protocols[messageProtocolID]
+	return p, ok
+}
+
+// Register an IEXTP protocol to use for decoding Segment Messages
+// with the DefaultDecoder. RegisterProtocol should be called at init time
+// by packages that implement IEXTP protocols, such as TOPS and DEEP.
 func RegisterProtocol(messageProtocolID uint16, p Protocol) {
-	protocolRegistry[messageProtocolID] = p
+	DefaultDecoder.Register(messageProtocolID, p)
 }
 
 // Segment represents an IEXTP Segment.
@@ -32,7 +82,14 @@ type Segment struct {
 	Messages []Message
 }
 
+// Unmarshal decodes the segment in buf with the DefaultDecoder.
 func (s *Segment) Unmarshal(buf []byte) error {
+	return DefaultDecoder.UnmarshalSegment(buf, s)
+}
+
+// UnmarshalSegment decodes the segment in buf into s, using the
+// protocol registered for its message protocol ID.
+func (d *Decoder) UnmarshalSegment(buf []byte, s *Segment) error {
 	// Unmarshal segment header.
 	if err := s.Header.Unmarshal(buf); err != nil {
 		return err
@@ -42,33 +99,22 @@ func (s *Segment) Unmarshal(buf []byte) error {
 		return io.ErrUnexpectedEOF
 	}
 
-	protocol, ok := protocolRegistry[s.Header.MessageProtocolID]
+	protocol, ok := d.protocols[s.Header.MessageProtocolID]
 	if !ok {
 		return fmt.Errorf("unknown message protocol: %v",
 			s.Header.MessageProtocolID)
 	}
 
-	cur := segmentHeaderSize // Current position in buf.
 	s.Messages = make([]Message, s.Header.MessageCount)
-	for i := uint16(0); i < s.Header.MessageCount; i++ {
-		if int(cur+2) > len(buf) {
-			return errors.New(
-				"invalid segment: message exceeds payload length")
-		}
-
-		// Messages are variable-length depending on their type.
-		// Get the length of the next message in the segment.
-		messageLength := binary.LittleEndian.Uint16(buf[cur : cur+2])
-		cur += 2
-
-		if int(cur+messageLength) > len(buf) {
-			return errors.New(
-				"invalid segment: message exceeds payload length")
+	cur := int(segmentHeaderSize) // Current position in buf.
+	for i := range s.Messages {
+		msgBuf, next, err := nextMessageBlock(buf, cur)
+		if err != nil {
+			return err
 		}
+		cur = next
 
 		// Unmarshal the message.
-		msgBuf := buf[cur : cur+messageLength]
-		cur += messageLength
 		msg, err := protocol(msgBuf)
 		if err != nil {
 			return err
@@ -80,6 +126,70 @@ func (s *Segment) Unmarshal(buf []byte) error {
 	return nil
 }
 
+// Get the content of the message block at position cur in buf,
+// and the position of the following message block.
+func nextMessageBlock(buf []byte, cur int) ([]byte, int, error) {
+	if cur+2 > len(buf) {
+		return nil, cur, errors.New(
+			"invalid segment: message exceeds payload length")
+	}
+
+	// Messages are variable-length depending on their type.
+	// Get the length of the next message in the segment.
+	messageLength := int(binary.LittleEndian.Uint16(buf[cur : cur+2]))
+	cur += 2
+
+	if cur+messageLength > len(buf) {
+		return nil, cur, errors.New(
+			"invalid segment: message exceeds payload length")
+	}
+
+	return buf[cur : cur+messageLength], cur + messageLength, nil
+}
+
+// Marshal encodes the Segment into its IEXTP wire format.
+// The PayloadLength and MessageCount of the encoded header
+// are computed from the Segment Messages, which must all
+// implement Marshaler.
+func (s *Segment) Marshal() ([]byte, error) {
+	buf := make([]byte, segmentHeaderSize)
+	for _, msg := range s.Messages {
+		m, ok := msg.(Marshaler)
+		if !ok {
+			return nil, fmt.Errorf(
+				"invalid segment: cannot marshal message of type %T", msg)
+		}
+
+		msgBuf, err := m.Marshal()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(msgBuf) > math.MaxUint16 {
+			return nil, fmt.Errorf(
+				"invalid segment: %v-length message exceeds maximum length",
+				len(msgBuf))
+		}
+
+		var messageLength [2]byte
+		binary.LittleEndian.PutUint16(messageLength[:], uint16(len(msgBuf)))
+		buf = append(buf, messageLength[:]...)
+		buf = append(buf, msgBuf...)
+	}
+
+	payloadLength := len(buf) - int(segmentHeaderSize)
+	if payloadLength > math.MaxUint16 || len(s.Messages) > math.MaxUint16 {
+		return nil, errors.New(
+			"invalid segment: payload exceeds maximum length")
+	}
+
+	header := s.Header
+	header.PayloadLength = uint16(payloadLength)
+	header.MessageCount = uint16(len(s.Messages))
+	header.put(buf)
+	return buf, nil
+}
+
 // Message represents an IEXTP message.
 type Message interface {
 	// Unmarshal unmarshals the given byte content into the Message.
@@ -93,6 +203,15 @@ type Message interface {
 	Unmarshal(buf []byte) error
 }
 
+// Marshaler is implemented by Messages that can be encoded into
+// their wire format, such as those of the TOPS, DEEP and DEEP+
+// protocols.
+type Marshaler interface {
+	// Marshal encodes the Message into its wire format, including
+	// the leading message type byte.
+	Marshal() ([]byte, error)
+}
+
 // UnsupportedMessage may be returned by a protocol for any
 // message types it does not know how to decode.
 type UnsupportedMessage struct {
@@ -106,6 +225,17 @@ func (m *UnsupportedMessage) Unmarshal(buf []byte) error {
 	return nil
 }
 
+func (m *UnsupportedMessage) Marshal() ([]byte, error) {
+	if len(m.Message) == 0 {
+		return []byte{m.MessageType}, nil
+	}
+
+	buf := make([]byte, len(m.Message))
+	copy(buf, m.Message)
+	buf[0] = m.MessageType
+	return buf, nil
+}
+
 type SegmentHeader struct {
 	// Version of the IEX-TP protocol.
 	Version uint8
@@ -164,3 +294,27 @@ func (sh *SegmentHeader) Unmarshal(buf []byte) error {
 	sh.SendTime = time.Unix(0, timestampNs).In(time.UTC)
 	return nil
 }
+
+func (sh *SegmentHeader) Marshal() ([]byte, error) {
+	buf := make([]byte, segmentHeaderSize)
+	sh.put(buf)
+	return buf, nil
+}
+
+// Encode the header into the first 40 bytes of buf.
+func (sh *SegmentHeader) put(buf []byte) {
+	buf[0] = sh.Version
+	buf[1] = 0
+	binary.LittleEndian.PutUint16(buf[2:4], sh.MessageProtocolID)
+	binary.LittleEndian.PutUint32(buf[4:8], sh.ChannelID)
+	binary.LittleEndian.PutUint32(buf[8:12], sh.SessionID)
+	binary.LittleEndian.PutUint16(buf[12:14], sh.PayloadLength)
+	binary.LittleEndian.PutUint16(buf[14:16], sh.MessageCount)
+	binary.LittleEndian.PutUint64(buf[16:24], uint64(sh.StreamOffset))
+	binary.LittleEndian.PutUint64(buf[24:32], uint64(sh.FirstMessageSequenceNumber))
+	var timestampNs int64
+	if !sh.SendTime.IsZero() {
+		timestampNs = sh.SendTime.UnixNano()
+	}
+	binary.LittleEndian.PutUint64(buf[32:40], uint64(timestampNs))
+}
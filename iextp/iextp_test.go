@@ -1,6 +1,7 @@
 package iextp
 
 import (
+	"bytes"
 	"os"
 	"testing"
 	"time"
@@ -163,3 +164,97 @@ func TestUnmarshalSegment_NoMessages(t *testing.T) {
 		t.Fatal("should have unmarshaled 0 messages")
 	}
 }
+
+func TestMarshalSegmentHeader(t *testing.T) {
+	h := SegmentHeader{}
+	if err := h.Unmarshal(header); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := h.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf, header) {
+		t.Fatalf("marshaled: %x, expected: %x", buf, header)
+	}
+}
+
+func TestMarshalSegment(t *testing.T) {
+	var data []byte
+	data = append(data, header...)
+	data = append(data, payload...)
+
+	var segment Segment
+	if err := segment.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// The payload length and message count should be recomputed.
+	segment.Header.PayloadLength = 0
+	segment.Header.MessageCount = 0
+	buf, err := segment.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("marshaled: %x, expected: %x", buf, data)
+	}
+}
+
+// A message of a protocol that can only be decoded.
+type decodeOnlyMessage struct{}
+
+func (m *decodeOnlyMessage) Unmarshal(buf []byte) error {
+	return nil
+}
+
+func TestMarshalSegment_NotMarshaler(t *testing.T) {
+	segment := Segment{Messages: []Message{&decodeOnlyMessage{}}}
+	if _, err := segment.Marshal(); err == nil {
+		t.Fatal("expected error marshaling message that is not a Marshaler")
+	}
+}
+
+// A simulated alternative implementation of a protocol.
+type testMessage struct {
+	UnsupportedMessage
+}
+
+func TestDecoder(t *testing.T) {
+	var data []byte
+	data = append(data, header...)
+	data = append(data, payload...)
+
+	d := NewDecoder()
+	var segment Segment
+	if err := d.UnmarshalSegment(data, &segment); err == nil {
+		t.Fatal("expected unknown protocol")
+	}
+
+	d.Register(0x8004, func(buf []byte) (Message, error) {
+		msg := &testMessage{}
+		err := msg.Unmarshal(buf)
+		return msg, err
+	})
+	if _, ok := d.Protocol(0x8004); !ok {
+		t.Fatal("protocol should be registered")
+	}
+
+	if err := d.UnmarshalSegment(data, &segment); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := segment.Messages[0].(*testMessage); !ok {
+		t.Fatalf("expected message decoded by registered protocol, got %T", segment.Messages[0])
+	}
+
+	// The DefaultDecoder should not be affected.
+	if err := segment.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := segment.Messages[0].(*UnsupportedMessage); !ok {
+		t.Fatalf("expected message decoded by default protocol, got %T", segment.Messages[0])
+	}
+}
@@ -0,0 +1,153 @@
+package iextp
+
+import (
+	"fmt"
+	"io"
+)
+
+// SegmentReader iterates over the messages of IEX-TP segments without
+// allocating a Segment or a slice of Messages for each one.
+//
+// Messages are decoded with the reusable implementation of each protocol
+// where one is registered (see Decoder.RegisterReusable), so a Message
+// returned by Next is only valid until the next call to Next or Reset.
+// Callers must copy any messages that they need to retain.
+//
+// A SegmentReader is not safe for concurrent use.
+type SegmentReader struct {
+	decoder   *Decoder
+	protocols map[uint16]Protocol
+
+	header   SegmentHeader
+	protocol Protocol
+	buf      []byte
+	cur      int
+	// Number of messages remaining in the current segment.
+	remaining int
+}
+
+// NewSegmentReader creates a SegmentReader that decodes messages
+// using the protocols registered with d.
+func (d *Decoder) NewSegmentReader() *SegmentReader {
+	return &SegmentReader{
+		decoder:   d,
+		protocols: make(map[uint16]Protocol),
+	}
+}
+
+// Reset prepares to read the messages of the segment in buf.
+// Returns an error if the segment header cannot be decoded, or its
+// message protocol is not registered with the Decoder.
+//
+// NOTE: buf must not be modified until its messages have been read.
+func (r *SegmentReader) Reset(buf []byte) error {
+	r.buf = nil
+	r.remaining = 0
+	if err := r.header.Unmarshal(buf); err != nil {
+		return err
+	}
+
+	if int(r.header.PayloadLength) != len(buf)-int(segmentHeaderSize) {
+		return io.ErrUnexpectedEOF
+	}
+
+	protocol, err := r.protocolFor(r.header.MessageProtocolID)
+	if err != nil {
+		return err
+	}
+
+	r.protocol = protocol
+	r.buf = buf
+	r.cur = int(segmentHeaderSize)
+	r.remaining = int(r.header.MessageCount)
+	return nil
+}
+
+// Get the protocol to decode messages of the given protocol ID,
+// instantiating its reusable implementation on first use.
+func (r *SegmentReader) protocolFor(messageProtocolID uint16) (Protocol, error) {
+	if protocol, ok := r.protocols[messageProtocolID]; ok {
+		return protocol, nil
+	}
+
+	var protocol Protocol
+	if newProtocol, ok := r.decoder.reusable[messageProtocolID]; ok {
+		protocol = newProtocol()
+	} else if protocol, ok = r.decoder.protocols[messageProtocolID]; !ok {
+		return nil, fmt.Errorf("unknown message protocol: %v", messageProtocolID)
+	}
+
+	r.protocols[messageProtocolID] = protocol
+	return protocol, nil
+}
+
+// Header returns the header of the current segment.
+//
+// NOTE: The header is overwritten by the next call to Reset.
+func (r *SegmentReader) Header() *SegmentHeader {
+	return &r.header
+}
+
+// Next decodes the next message of the current segment.
+// Returns io.EOF if there are no more messages in the segment.
+func (r *SegmentReader) Next() (Message, error) {
+	msgBuf, err := r.nextBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.protocol(msgBuf)
+}
+
+// Skip discards the next n messages of the current segment
+// without decoding them.
+func (r *SegmentReader) Skip(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := r.nextBlock(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *SegmentReader) nextBlock() ([]byte, error) {
+	if r.remaining == 0 {
+		return nil, io.EOF
+	}
+
+	msgBuf, next, err := nextMessageBlock(r.buf, r.cur)
+	if err != nil {
+		r.remaining = 0
+		return nil, err
+	}
+
+	r.cur = next
+	r.remaining--
+	return msgBuf, nil
+}
+
+// VisitSegment decodes the segment in buf with a SegmentReader,
+// calling visit with each of its messages in order. If visit returns
+// an error, decoding stops and the error is returned.
+//
+// NOTE: The header and message passed to visit are only valid
+// for the duration of the call.
+func (r *SegmentReader) VisitSegment(buf []byte, visit func(header *SegmentHeader, msg Message) error) error {
+	if err := r.Reset(buf); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := visit(&r.header, msg); err != nil {
+			return err
+		}
+	}
+}
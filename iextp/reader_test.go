@@ -0,0 +1,134 @@
+package iextp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func testSegmentData() []byte {
+	var data []byte
+	data = append(data, header...)
+	data = append(data, payload...)
+	return data
+}
+
+func TestSegmentReader(t *testing.T) {
+	data := testSegmentData()
+	r := DefaultDecoder.NewSegmentReader()
+	if err := r.Reset(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Header().MessageCount != 2 || r.Header().FirstMessageSequenceNumber != 970 {
+		t.Fatalf("unexpected header: %+v", r.Header())
+	}
+
+	for _, expectedType := range []uint8{0x54, 0x38} {
+		msg, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgType := msg.(*UnsupportedMessage).MessageType; msgType != expectedType {
+			t.Fatalf("read message type %#x, expected %#x", msgType, expectedType)
+		}
+	}
+
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	// Skip the first message.
+	if err := r.Reset(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Skip(1); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := r.Next(); err != nil {
+		t.Fatal(err)
+	} else if msg.(*UnsupportedMessage).MessageType != 0x38 {
+		t.Fatalf("unexpected message after skip: %v", msg)
+	}
+	if err := r.Skip(1); err != io.EOF {
+		t.Fatalf("expected EOF skipping past end of segment, got %v", err)
+	}
+}
+
+func TestSegmentReader_Invalid(t *testing.T) {
+	r := DefaultDecoder.NewSegmentReader()
+	data := testSegmentData()
+	if err := r.Reset(data[:len(data)-1]); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("expected no messages after failed reset, got %v", err)
+	}
+
+	// Message length exceeding the payload.
+	data[len(header)] = 0xff
+	if err := r.Reset(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Next(); err == nil || err == io.EOF {
+		t.Fatalf("expected invalid segment error, got %v", err)
+	}
+
+	if err := NewDecoder().NewSegmentReader().Reset(testSegmentData()); err == nil {
+		t.Fatal("expected unknown protocol")
+	}
+}
+
+func TestSegmentReader_Reusable(t *testing.T) {
+	d := NewDecoder()
+	d.Register(0x8004, testUnmarshal)
+	nCreated := 0
+	d.RegisterReusable(0x8004, func() Protocol {
+		nCreated++
+		msg := &testMessage{}
+		return func(buf []byte) (Message, error) {
+			err := msg.Unmarshal(buf)
+			return msg, err
+		}
+	})
+
+	r := d.NewSegmentReader()
+	var messages []Message
+	err := r.VisitSegment(testSegmentData(), func(header *SegmentHeader, msg Message) error {
+		if header.MessageProtocolID != 0x8004 {
+			t.Fatalf("unexpected header: %+v", header)
+		}
+		messages = append(messages, msg)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(messages) != 2 || messages[0] != messages[1] {
+		t.Fatal("expected both messages to be decoded into the same struct")
+	}
+	if !bytes.Equal(messages[1].(*testMessage).Message, payload[42:]) {
+		t.Fatal("message data not equal to input")
+	}
+
+	// The reusable protocol is only created once per reader.
+	if err := r.VisitSegment(testSegmentData(), func(*SegmentHeader, Message) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if nCreated != 1 {
+		t.Fatalf("expected reusable protocol to be created once, got %v", nCreated)
+	}
+
+	// Registering the protocol again replaces the reusable implementation.
+	d.Register(0x8004, testUnmarshal)
+	r = d.NewSegmentReader()
+	if err := r.Reset(testSegmentData()); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := r.Next(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*UnsupportedMessage); !ok {
+		t.Fatalf("expected message decoded by registered protocol, got %T", msg)
+	}
+}
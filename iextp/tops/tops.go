@@ -1,10 +1,18 @@
-// Package tops implements an unmarshaler for the TOPS protocol, v1.6.
+// Package tops implements an unmarshaler for the TOPS protocol,
+// v1.5 and v1.6.
+//
+// TOPS v1.6 adds the Retail Liquidity Indicator message to v1.5.
+// Later revisions of the specification may append fields to existing
+// message formats; these are kept in the Extension of each message.
 package tops
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"math"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/xuforr/go-iex/iextp"
@@ -33,50 +41,168 @@ const (
 
 	// Auction message formats.
 	AuctionInformation = 0x41
+
+	// Retail Liquidity Indicator message format (v1.6 only).
+	RetailLiquidityIndicator = 0x49
 )
 
 func init() {
-	// This package can parse both TOPS v1.5 and TOPS v1.6.
-	iextp.RegisterProtocol(V_1_5_MessageProtocolID, Unmarshal)
-	iextp.RegisterProtocol(V_1_6_MessageProtocolID, Unmarshal)
+	Register(iextp.DefaultDecoder)
 }
 
-// Implements the TOPS protocol, v1.6.
+// Register the TOPS protocol with the given Decoder.
+// Segments are decoded according to the version of their
+// MessageProtocolID, TOPS v1.5 or TOPS v1.6.
+func Register(d *iextp.Decoder) {
+	d.Register(V_1_5_MessageProtocolID, UnmarshalV1_5)
+	d.Register(V_1_6_MessageProtocolID, UnmarshalV1_6)
+	d.RegisterReusable(V_1_5_MessageProtocolID, NewReusableUnmarshalerV1_5)
+	d.RegisterReusable(V_1_6_MessageProtocolID, NewReusableUnmarshalerV1_6)
+}
+
+// Implements the latest supported version of the TOPS protocol, v1.6.
 func Unmarshal(buf []byte) (iextp.Message, error) {
+	return UnmarshalV1_6(buf)
+}
+
+// Implements the TOPS protocol, v1.5.
+func UnmarshalV1_5(buf []byte) (iextp.Message, error) {
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("cannot unmarshal %v-length buffer", len(buf))
+	}
+
+	return unmarshal(buf, newV1_5Message(buf[0]))
+}
+
+// Implements the TOPS protocol, v1.6.
+func UnmarshalV1_6(buf []byte) (iextp.Message, error) {
 	if len(buf) == 0 {
 		return nil, fmt.Errorf("cannot unmarshal %v-length buffer", len(buf))
 	}
 
 	var msg iextp.Message
+	switch buf[0] {
+	case RetailLiquidityIndicator:
+		msg = &RetailLiquidityIndicatorMessage{}
+	default:
+		msg = newV1_5Message(buf[0])
+	}
+
+	return unmarshal(buf, msg)
+}
 
-	messageType := buf[0]
+func unmarshal(buf []byte, msg iextp.Message) (iextp.Message, error) {
+	err := msg.Unmarshal(buf)
+	return msg, err
+}
+
+// NewReusableUnmarshalerV1_5 returns an implementation of the TOPS
+// protocol, v1.5, that unmarshals each message type into the same
+// struct on every call. The returned Message is only valid until
+// the next call.
+func NewReusableUnmarshalerV1_5() iextp.Protocol {
+	var cache messageCache
+	return func(buf []byte) (iextp.Message, error) {
+		if len(buf) == 0 {
+			return nil, fmt.Errorf("cannot unmarshal %v-length buffer", len(buf))
+		}
+
+		return unmarshal(buf, cache.v1_5Message(buf[0]))
+	}
+}
+
+// NewReusableUnmarshalerV1_6 returns an implementation of the TOPS
+// protocol, v1.6, that unmarshals each message type into the same
+// struct on every call. The returned Message is only valid until
+// the next call.
+func NewReusableUnmarshalerV1_6() iextp.Protocol {
+	var cache messageCache
+	return func(buf []byte) (iextp.Message, error) {
+		if len(buf) == 0 {
+			return nil, fmt.Errorf("cannot unmarshal %v-length buffer", len(buf))
+		}
+
+		var msg iextp.Message
+		switch buf[0] {
+		case RetailLiquidityIndicator:
+			msg = &cache.retailLiquidityIndicator
+		default:
+			msg = cache.v1_5Message(buf[0])
+		}
+
+		return unmarshal(buf, msg)
+	}
+}
+
+// One reusable message of each TOPS message type.
+type messageCache struct {
+	systemEvent              SystemEventMessage
+	securityDirectory        SecurityDirectoryMessage
+	tradingStatus            TradingStatusMessage
+	operationalHaltStatus    OperationalHaltStatusMessage
+	shortSalePriceTestStatus ShortSalePriceTestStatusMessage
+	quoteUpdate              QuoteUpdateMessage
+	tradeReport              TradeReportMessage
+	officialPrice            OfficialPriceMessage
+	tradeBreak               TradeBreakMessage
+	auctionInformation       AuctionInformationMessage
+	retailLiquidityIndicator RetailLiquidityIndicatorMessage
+	unsupported              iextp.UnsupportedMessage
+}
+
+func (c *messageCache) v1_5Message(messageType byte) iextp.Message {
 	switch messageType {
 	case SystemEvent:
-		msg = &SystemEventMessage{}
+		return &c.systemEvent
 	case SecurityDirectory:
-		msg = &SecurityDirectoryMessage{}
+		return &c.securityDirectory
 	case TradingStatus:
-		msg = &TradingStatusMessage{}
+		return &c.tradingStatus
 	case OperationalHaltStatus:
-		msg = &OperationalHaltStatusMessage{}
+		return &c.operationalHaltStatus
 	case ShortSalePriceTestStatus:
-		msg = &ShortSalePriceTestStatusMessage{}
+		return &c.shortSalePriceTestStatus
 	case QuoteUpdate:
-		msg = &QuoteUpdateMessage{}
+		return &c.quoteUpdate
 	case TradeReport:
-		msg = &TradeReportMessage{}
+		return &c.tradeReport
 	case OfficialPrice:
-		msg = &OfficialPriceMessage{}
+		return &c.officialPrice
 	case TradeBreak:
-		msg = &TradeBreakMessage{}
+		return &c.tradeBreak
 	case AuctionInformation:
-		msg = &AuctionInformationMessage{}
+		return &c.auctionInformation
 	default:
-		msg = &iextp.UnsupportedMessage{}
+		return &c.unsupported
 	}
+}
 
-	err := msg.Unmarshal(buf)
-	return msg, err
+// Create a message of the given type from the TOPS v1.5 message formats.
+func newV1_5Message(messageType byte) iextp.Message {
+	switch messageType {
+	case SystemEvent:
+		return &SystemEventMessage{}
+	case SecurityDirectory:
+		return &SecurityDirectoryMessage{}
+	case TradingStatus:
+		return &TradingStatusMessage{}
+	case OperationalHaltStatus:
+		return &OperationalHaltStatusMessage{}
+	case ShortSalePriceTestStatus:
+		return &ShortSalePriceTestStatusMessage{}
+	case QuoteUpdate:
+		return &QuoteUpdateMessage{}
+	case TradeReport:
+		return &TradeReportMessage{}
+	case OfficialPrice:
+		return &OfficialPriceMessage{}
+	case TradeBreak:
+		return &TradeBreakMessage{}
+	case AuctionInformation:
+		return &AuctionInformationMessage{}
+	default:
+		return &iextp.UnsupportedMessage{}
+	}
 }
 
 // Parse the TOPS timestamp type: 8 bytes, signed integer containing
@@ -105,10 +231,129 @@ func ParseFloat(buf []byte) float64 {
 
 // Parse the TOPS string type: fixed-length ASCII byte sequence,
 // left justified and space filled on the right.
+//
+// Strings of up to 8 bytes (such as symbols) are interned, so that
+// parsing the symbol of each message does not allocate a new string.
 func ParseString(buf []byte) string {
+	if len(buf) <= 8 {
+		return internString(buf)
+	}
+
 	return strings.TrimRight(string(buf), " ")
 }
 
+// Strings are interned in a fixed-size, 4-way set associative cache,
+// which is safe for concurrent use and bounded in size. A string that
+// has been evicted from the cache is allocated again when next parsed.
+const (
+	stringCacheBits = 15
+	stringCacheWays = 4
+)
+
+var stringCache [1 << stringCacheBits]atomic.Pointer[internedString]
+
+type internedString struct {
+	key uint64
+	s   string
+}
+
+func internString(buf []byte) string {
+	// Strings are space filled, so padding them with spaces
+	// does not change the parsed result.
+	var padded [8]byte
+	n := copy(padded[:], buf)
+	for i := n; i < len(padded); i++ {
+		padded[i] = ' '
+	}
+	key := binary.LittleEndian.Uint64(padded[:])
+
+	// Fibonacci hashing of the string bytes selects the set.
+	hash := (key * 0x9e3779b97f4a7c15) >> (64 - stringCacheBits)
+	set := stringCache[hash&^(stringCacheWays-1):][:stringCacheWays]
+	for i := range set {
+		if e := set[i].Load(); e == nil {
+			break
+		} else if e.key == key {
+			return e.s
+		}
+	}
+
+	s := strings.TrimRight(string(buf), " ")
+	entry := &internedString{key, s}
+	for i := range set {
+		if set[i].CompareAndSwap(nil, entry) {
+			return s
+		}
+	}
+
+	// The set is full, evict one of its entries.
+	set[hash&(stringCacheWays-1)].Store(entry)
+	return s
+}
+
+// Put the time t into buf as the TOPS timestamp type.
+// The zero time.Time is encoded as 0.
+func PutTimestamp(buf []byte, t time.Time) {
+	var timestampNs int64
+	if !t.IsZero() {
+		timestampNs = t.UnixNano()
+	}
+	binary.LittleEndian.PutUint64(buf, uint64(timestampNs))
+}
+
+// Put the time t into buf as the TOPS event time type.
+// The zero time.Time is encoded as 0.
+func PutEventTime(buf []byte, t time.Time) {
+	var timestampSecs uint32
+	if !t.IsZero() {
+		timestampSecs = uint32(t.Unix())
+	}
+	binary.LittleEndian.PutUint32(buf, timestampSecs)
+}
+
+// Put the price f into buf as the TOPS price type,
+// rounded to 4 decimal places.
+func PutFloat(buf []byte, f float64) {
+	n := int64(math.Round(f * 10000))
+	binary.LittleEndian.PutUint64(buf, uint64(n))
+}
+
+// Put the string s into buf as the TOPS string type, space filled
+// on the right. Returns an error if s does not fit in buf.
+func PutString(buf []byte, s string) error {
+	if len(s) > len(buf) {
+		return fmt.Errorf("cannot marshal %q into %v-length string", s, len(buf))
+	}
+
+	n := copy(buf, s)
+	for i := n; i < len(buf); i++ {
+		buf[i] = ' '
+	}
+	return nil
+}
+
+// Extension holds the fields that later revisions of the specification
+// append to a message format, which are not otherwise decoded. They are
+// kept so that they may be decoded by the caller, and are appended to the
+// message when it is marshaled. Extensions are strings of raw bytes, so
+// that messages remain comparable.
+type Extension string
+
+// MarshalText encodes the extension in hexadecimal.
+func (e Extension) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString([]byte(e))), nil
+}
+
+// ParseExtension returns the fields appended to a message
+// format of length n, if any.
+func ParseExtension(buf []byte, n int) Extension {
+	if len(buf) <= n {
+		return ""
+	}
+
+	return Extension(buf[n:])
+}
+
 // SystemEventMessage is used to indicate events that apply
 // to the market or the data feed.
 //
@@ -120,6 +365,8 @@ type SystemEventMessage struct {
 	SystemEvent uint8
 	// Time stamp of the system event.
 	Timestamp time.Time
+
+	Extension Extension `json:",omitempty"`
 }
 
 func (m *SystemEventMessage) Unmarshal(buf []byte) error {
@@ -133,9 +380,18 @@ func (m *SystemEventMessage) Unmarshal(buf []byte) error {
 	m.SystemEvent = uint8(buf[1])
 	m.Timestamp = ParseTimestamp(buf[2:10])
 
+	m.Extension = ParseExtension(buf, 10)
 	return nil
 }
 
+func (m *SystemEventMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 10)
+	buf[0] = m.MessageType
+	buf[1] = m.SystemEvent
+	PutTimestamp(buf[2:10], m.Timestamp)
+	return append(buf, m.Extension...), nil
+}
+
 const (
 	// Outside of heartbeat messages on the lower level protocol,
 	// the start of day message is the first message in any trading session.
@@ -179,6 +435,8 @@ type SecurityDirectoryMessage struct {
 	// Indicates which Limit Up-Limit Down price band calculation
 	// parameter is to be used.
 	LULDTier uint8
+
+	Extension Extension `json:",omitempty"`
 }
 
 func (m *SecurityDirectoryMessage) Unmarshal(buf []byte) error {
@@ -196,9 +454,24 @@ func (m *SecurityDirectoryMessage) Unmarshal(buf []byte) error {
 	m.AdjustedPOCPrice = ParseFloat(buf[22:30])
 	m.LULDTier = uint8(buf[30])
 
+	m.Extension = ParseExtension(buf, 31)
 	return nil
 }
 
+func (m *SecurityDirectoryMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 31)
+	buf[0] = m.MessageType
+	buf[1] = m.Flags
+	PutTimestamp(buf[2:10], m.Timestamp)
+	if err := PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(buf[18:22], m.RoundLotSize)
+	PutFloat(buf[22:30], m.AdjustedPOCPrice)
+	buf[30] = m.LULDTier
+	return append(buf, m.Extension...), nil
+}
+
 func (m *SecurityDirectoryMessage) IsTestSecurity() bool {
 	return m.Flags&0x80 != 0
 }
@@ -263,6 +536,8 @@ type TradingStatusMessage struct {
 	// The Reason will be blank when the trading status is TradingPause
 	// or Trading.
 	Reason string
+
+	Extension Extension `json:",omitempty"`
 }
 
 func (m *TradingStatusMessage) Unmarshal(buf []byte) error {
@@ -277,9 +552,24 @@ func (m *TradingStatusMessage) Unmarshal(buf []byte) error {
 	m.Timestamp = ParseTimestamp(buf[2:10])
 	m.Symbol = ParseString(buf[10:18])
 	m.Reason = ParseString(buf[18:22])
+	m.Extension = ParseExtension(buf, 22)
 	return nil
 }
 
+func (m *TradingStatusMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 22)
+	buf[0] = m.MessageType
+	buf[1] = m.TradingStatus
+	PutTimestamp(buf[2:10], m.Timestamp)
+	if err := PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	if err := PutString(buf[18:22], m.Reason); err != nil {
+		return nil, err
+	}
+	return append(buf, m.Extension...), nil
+}
+
 const (
 	// Trading halted across all US equity markets.
 	TradingHalt uint8 = 0x48
@@ -332,6 +622,8 @@ type OperationalHaltStatusMessage struct {
 	Timestamp time.Time
 	// Security represented in Nasdaq integrated symbology.
 	Symbol string
+
+	Extension Extension `json:",omitempty"`
 }
 
 func (m *OperationalHaltStatusMessage) Unmarshal(buf []byte) error {
@@ -345,9 +637,21 @@ func (m *OperationalHaltStatusMessage) Unmarshal(buf []byte) error {
 	m.OperationalHaltStatus = uint8(buf[1])
 	m.Timestamp = ParseTimestamp(buf[2:10])
 	m.Symbol = ParseString(buf[10:18])
+	m.Extension = ParseExtension(buf, 18)
 	return nil
 }
 
+func (m *OperationalHaltStatusMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 18)
+	buf[0] = m.MessageType
+	buf[1] = m.OperationalHaltStatus
+	PutTimestamp(buf[2:10], m.Timestamp)
+	if err := PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	return append(buf, m.Extension...), nil
+}
+
 const (
 	IEXSpecificOperationalHalt uint8 = 0x4f
 	NotOperationallyHalted     uint8 = 0x4e
@@ -376,6 +680,8 @@ type ShortSalePriceTestStatusMessage struct {
 	// this field will be set to DetailNotAvailable for non-IEX-listed
 	// securities.
 	Detail uint8
+
+	Extension Extension `json:",omitempty"`
 }
 
 func (m *ShortSalePriceTestStatusMessage) Unmarshal(buf []byte) error {
@@ -390,9 +696,24 @@ func (m *ShortSalePriceTestStatusMessage) Unmarshal(buf []byte) error {
 	m.Timestamp = ParseTimestamp(buf[2:10])
 	m.Symbol = ParseString(buf[10:18])
 	m.Detail = uint8(buf[18])
+	m.Extension = ParseExtension(buf, 19)
 	return nil
 }
 
+func (m *ShortSalePriceTestStatusMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 19)
+	buf[0] = m.MessageType
+	if m.ShortSalePriceTestStatus {
+		buf[1] = 1
+	}
+	PutTimestamp(buf[2:10], m.Timestamp)
+	if err := PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	buf[18] = m.Detail
+	return append(buf, m.Extension...), nil
+}
+
 const (
 	// No price test in place.
 	NoPriceTest uint8 = 0x20
@@ -427,6 +748,8 @@ type QuoteUpdateMessage struct {
 	AskPrice float64
 	// Size of the quote at the ask, in number of shares.
 	AskSize uint32
+
+	Extension Extension `json:",omitempty"`
 }
 
 func (m *QuoteUpdateMessage) Unmarshal(buf []byte) error {
@@ -444,9 +767,25 @@ func (m *QuoteUpdateMessage) Unmarshal(buf []byte) error {
 	m.BidPrice = ParseFloat(buf[22:30])
 	m.AskPrice = ParseFloat(buf[30:38])
 	m.AskSize = binary.LittleEndian.Uint32(buf[38:42])
+	m.Extension = ParseExtension(buf, 42)
 	return nil
 }
 
+func (m *QuoteUpdateMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 42)
+	buf[0] = m.MessageType
+	buf[1] = m.Flags
+	PutTimestamp(buf[2:10], m.Timestamp)
+	if err := PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(buf[18:22], m.BidSize)
+	PutFloat(buf[22:30], m.BidPrice)
+	PutFloat(buf[30:38], m.AskPrice)
+	binary.LittleEndian.PutUint32(buf[38:42], m.AskSize)
+	return append(buf, m.Extension...), nil
+}
+
 func (m *QuoteUpdateMessage) IsActive() bool {
 	return m.Flags&0x80 == 0
 }
@@ -473,6 +812,8 @@ type TradeReportMessage struct {
 	// IEX generated trade identifier. A given trade is uniquely
 	// identified within a day by its TradeID.
 	TradeID int64
+
+	Extension Extension `json:",omitempty"`
 }
 
 func (m *TradeReportMessage) Unmarshal(buf []byte) error {
@@ -489,9 +830,24 @@ func (m *TradeReportMessage) Unmarshal(buf []byte) error {
 	m.Size = binary.LittleEndian.Uint32(buf[18:22])
 	m.Price = ParseFloat(buf[22:30])
 	m.TradeID = int64(binary.LittleEndian.Uint64(buf[30:38]))
+	m.Extension = ParseExtension(buf, 38)
 	return nil
 }
 
+func (m *TradeReportMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 38)
+	buf[0] = m.MessageType
+	buf[1] = m.SaleConditionFlags
+	PutTimestamp(buf[2:10], m.Timestamp)
+	if err := PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(buf[18:22], m.Size)
+	PutFloat(buf[22:30], m.Price)
+	binary.LittleEndian.PutUint64(buf[30:38], uint64(m.TradeID))
+	return append(buf, m.Extension...), nil
+}
+
 // Trade resulted from an Intermarket Sweep Order.
 func (m *TradeReportMessage) IsISO() bool {
 	return m.SaleConditionFlags&0x80 != 0
@@ -547,6 +903,8 @@ type OfficialPriceMessage struct {
 	Symbol string
 	// IEX Official Opening or Closing Price of an IEX-listed security.
 	OfficialPrice float64
+
+	Extension Extension `json:",omitempty"`
 }
 
 func (m *OfficialPriceMessage) Unmarshal(buf []byte) error {
@@ -561,9 +919,22 @@ func (m *OfficialPriceMessage) Unmarshal(buf []byte) error {
 	m.Timestamp = ParseTimestamp(buf[2:10])
 	m.Symbol = ParseString(buf[10:18])
 	m.OfficialPrice = ParseFloat(buf[18:26])
+	m.Extension = ParseExtension(buf, 26)
 	return nil
 }
 
+func (m *OfficialPriceMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 26)
+	buf[0] = m.MessageType
+	buf[1] = m.PriceType
+	PutTimestamp(buf[2:10], m.Timestamp)
+	if err := PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	PutFloat(buf[18:26], m.OfficialPrice)
+	return append(buf, m.Extension...), nil
+}
+
 // TradeBreakMessages are sent when an execution on IEX is broken
 // on that same trading day. Trade breaks are rare and only affect
 // applications that rely upon IEX execution based data.
@@ -582,6 +953,8 @@ type TradeBreakMessage struct {
 	// IEX generated trade identifier. A given trade is uniquely
 	// identified within a day by its TradeID.
 	TradeID int64
+
+	Extension Extension `json:",omitempty"`
 }
 
 func (m *TradeBreakMessage) Unmarshal(buf []byte) error {
@@ -598,9 +971,24 @@ func (m *TradeBreakMessage) Unmarshal(buf []byte) error {
 	m.Size = binary.LittleEndian.Uint32(buf[18:22])
 	m.Price = ParseFloat(buf[22:30])
 	m.TradeID = int64(binary.LittleEndian.Uint64(buf[30:38]))
+	m.Extension = ParseExtension(buf, 38)
 	return nil
 }
 
+func (m *TradeBreakMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 38)
+	buf[0] = m.MessageType
+	buf[1] = m.SaleConditionFlags
+	PutTimestamp(buf[2:10], m.Timestamp)
+	if err := PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(buf[18:22], m.Size)
+	PutFloat(buf[22:30], m.Price)
+	binary.LittleEndian.PutUint64(buf[30:38], uint64(m.TradeID))
+	return append(buf, m.Extension...), nil
+}
+
 // DEEP broadcasts an AuctionInformationmessage every one second between
 // the Lock-in Time and the auction match for Opening and Closing Auctions,
 // and during the Display Only Period for IPO, Halt, and Volatility Auctions.
@@ -638,6 +1026,8 @@ type AuctionInformationMessage struct {
 	LowerAuctionCollar float64
 	// Upper threshold price of the auction caller, if any.
 	UpperAuctionCollar float64
+
+	Extension Extension `json:",omitempty"`
 }
 
 func (m *AuctionInformationMessage) Unmarshal(buf []byte) error {
@@ -662,9 +1052,32 @@ func (m *AuctionInformationMessage) Unmarshal(buf []byte) error {
 	m.CollarReferencePrice = ParseFloat(buf[56:64])
 	m.LowerAuctionCollar = ParseFloat(buf[64:72])
 	m.UpperAuctionCollar = ParseFloat(buf[72:80])
+	m.Extension = ParseExtension(buf, 80)
 	return nil
 }
 
+func (m *AuctionInformationMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 80)
+	buf[0] = m.MessageType
+	buf[1] = m.AuctionType
+	PutTimestamp(buf[2:10], m.Timestamp)
+	if err := PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(buf[18:22], m.PairedShares)
+	PutFloat(buf[22:30], m.ReferencePrice)
+	PutFloat(buf[30:38], m.IndicativeClearingPrice)
+	binary.LittleEndian.PutUint32(buf[38:42], m.ImbalanceShares)
+	buf[42] = m.ImbalanceSide
+	buf[43] = m.ExtensionNumber
+	PutEventTime(buf[44:48], m.ScheduledAuctionTime)
+	PutFloat(buf[48:56], m.AuctionBookClearingPrice)
+	PutFloat(buf[56:64], m.CollarReferencePrice)
+	PutFloat(buf[64:72], m.LowerAuctionCollar)
+	PutFloat(buf[72:80], m.UpperAuctionCollar)
+	return append(buf, m.Extension...), nil
+}
+
 // Auction types.
 const (
 	OpeningAuction    uint8 = 0x4f
@@ -680,3 +1093,70 @@ const (
 	SellSideImbalance uint8 = 0x53
 	NoImbalance       uint8 = 0x4e
 )
+
+// RetailLiquidityIndicatorMessages are sent when the Retail Liquidity
+// Indicator of a security changes, indicating the presence of retail
+// liquidity (Retail Price Improvement orders) on the IEX Order Book.
+//
+// This message was added in TOPS v1.6.
+type RetailLiquidityIndicatorMessage struct {
+	MessageType uint8
+	// Retail liquidity indicator identifier.
+	RetailLiquidityIndicator uint8
+	// The time of the update as set by the IEX Trading System logic.
+	Timestamp time.Time
+	// Security represented in Nasdaq Integrated symbology.
+	Symbol string
+
+	Extension Extension `json:",omitempty"`
+}
+
+func (m *RetailLiquidityIndicatorMessage) Unmarshal(buf []byte) error {
+	if len(buf) < 18 {
+		return fmt.Errorf(
+			"cannot unmarshal RetailLiquidityIndicatorMessage from %v-length buffer",
+			len(buf))
+	}
+
+	m.MessageType = uint8(buf[0])
+	m.RetailLiquidityIndicator = uint8(buf[1])
+	m.Timestamp = ParseTimestamp(buf[2:10])
+	m.Symbol = ParseString(buf[10:18])
+	m.Extension = ParseExtension(buf, 18)
+	return nil
+}
+
+func (m *RetailLiquidityIndicatorMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 18)
+	buf[0] = m.MessageType
+	buf[1] = m.RetailLiquidityIndicator
+	PutTimestamp(buf[2:10], m.Timestamp)
+	if err := PutString(buf[10:18], m.Symbol); err != nil {
+		return nil, err
+	}
+	return append(buf, m.Extension...), nil
+}
+
+// Whether there is retail interest on the buy side.
+func (m *RetailLiquidityIndicatorMessage) HasBuyInterest() bool {
+	return m.RetailLiquidityIndicator == RetailBuyInterest ||
+		m.RetailLiquidityIndicator == RetailBuySellInterest
+}
+
+// Whether there is retail interest on the sell side.
+func (m *RetailLiquidityIndicatorMessage) HasSellInterest() bool {
+	return m.RetailLiquidityIndicator == RetailSellInterest ||
+		m.RetailLiquidityIndicator == RetailBuySellInterest
+}
+
+// Retail liquidity indicators.
+const (
+	// Retail interest not applicable.
+	RetailInterestNotApplicable uint8 = 0x20
+	// Buy interest for Retail.
+	RetailBuyInterest uint8 = 0x41
+	// Sell interest for Retail.
+	RetailSellInterest uint8 = 0x42
+	// Buy and sell interest for Retail.
+	RetailBuySellInterest uint8 = 0x43
+)
@@ -1,6 +1,8 @@
 package tops
 
 import (
+	"bytes"
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
@@ -8,6 +10,16 @@ import (
 	"github.com/xuforr/go-iex/iextp"
 )
 
+func TestRegister(t *testing.T) {
+	d := iextp.NewDecoder()
+	Register(d)
+	for _, id := range []uint16{V_1_5_MessageProtocolID, V_1_6_MessageProtocolID} {
+		if _, ok := d.Protocol(id); !ok {
+			t.Fatalf("protocol %#x should be registered", id)
+		}
+	}
+}
+
 func TestUnmarshal_UnknownMessageType(t *testing.T) {
 	data := []byte{0x02} // Not a known message type.
 	msg, err := Unmarshal(data)
@@ -54,6 +66,8 @@ func TestSystemEventMessage(t *testing.T) {
 	if *msg.(*SystemEventMessage) != expected {
 		t.Fatalf("parsed: %v, expected: %v", msg, expected)
 	}
+
+	checkMarshal(t, msg, data)
 }
 
 func TestSecurityDirectoryMessage(t *testing.T) {
@@ -87,6 +101,8 @@ func TestSecurityDirectoryMessage(t *testing.T) {
 		t.Fatalf("parsed: %v, expected: %v", msg, expected)
 	}
 
+	checkMarshal(t, msg, data)
+
 	if !sdMsg.IsTestSecurity() {
 		t.Error("message should be a test security")
 	}
@@ -126,6 +142,8 @@ func TestTradingStatusMessage(t *testing.T) {
 	if tsMsg != expected {
 		t.Fatalf("parsed: %v, expected: %v", msg, expected)
 	}
+
+	checkMarshal(t, msg, data)
 }
 
 func TestOperationalHaltStatusMessage(t *testing.T) {
@@ -152,6 +170,8 @@ func TestOperationalHaltStatusMessage(t *testing.T) {
 	if ohsMsg != expected {
 		t.Fatalf("parsed: %v, expected: %v", msg, expected)
 	}
+
+	checkMarshal(t, msg, data)
 }
 
 func TestShortSalePriceTestStatusMessage(t *testing.T) {
@@ -180,6 +200,8 @@ func TestShortSalePriceTestStatusMessage(t *testing.T) {
 	if ssptsMsg != expected {
 		t.Fatalf("parsed: %v, expected: %v", msg, expected)
 	}
+
+	checkMarshal(t, msg, data)
 }
 
 func TestQuoteUpdateMessage(t *testing.T) {
@@ -215,6 +237,8 @@ func TestQuoteUpdateMessage(t *testing.T) {
 		t.Fatalf("parsed: %v, expected: %v", msg, expected)
 	}
 
+	checkMarshal(t, msg, data)
+
 	if !quMsg.IsActive() {
 		t.Error("message flags should be active")
 	}
@@ -255,6 +279,8 @@ func TestTradeReportMessage(t *testing.T) {
 		t.Fatalf("parsed: %v, expected: %v", msg, expected)
 	}
 
+	checkMarshal(t, msg, data)
+
 	if trMsg.IsISO() {
 		t.Error("message should be non-ISO")
 	}
@@ -314,6 +340,8 @@ func TestOfficialPriceMessage(t *testing.T) {
 	if opMsg != expected {
 		t.Fatalf("parsed: %v, expected: %v", msg, expected)
 	}
+
+	checkMarshal(t, msg, data)
 }
 
 func TestTradeBreakMessage(t *testing.T) {
@@ -346,6 +374,8 @@ func TestTradeBreakMessage(t *testing.T) {
 	if tbMsg != expected {
 		t.Fatalf("parsed: %v, expected: %v", msg, expected)
 	}
+
+	checkMarshal(t, msg, data)
 }
 
 func TestAuctionInformationMessage(t *testing.T) {
@@ -398,4 +428,257 @@ func TestAuctionInformationMessage(t *testing.T) {
 	if aiMsg != expected {
 		t.Fatalf("parsed: %v, expected: %v", msg, expected)
 	}
+
+	checkMarshal(t, msg, data)
+}
+
+func TestRetailLiquidityIndicatorMessage(t *testing.T) {
+	data := []byte{
+		0x49,                                           // I = Retail Liquidity Indicator
+		0x41,                                           // A = Buy interest for Retail
+		0xdd, 0xc7, 0xf0, 0x9a, 0x1a, 0x3a, 0xb6, 0x14, // 2017-04-17 15:50:12.462929885
+		0x5a, 0x49, 0x45, 0x58, 0x54, 0x20, 0x20, 0x20, // ZIEXT
+	}
+
+	msg, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rliMsg := *msg.(*RetailLiquidityIndicatorMessage)
+	expected := RetailLiquidityIndicatorMessage{
+		MessageType:              RetailLiquidityIndicator,
+		RetailLiquidityIndicator: RetailBuyInterest,
+		Timestamp:                time.Date(2017, time.April, 17, 15, 50, 12, 462929885, time.UTC),
+		Symbol:                   "ZIEXT",
+	}
+
+	if rliMsg != expected {
+		t.Fatalf("parsed: %v, expected: %v", msg, expected)
+	}
+
+	checkMarshal(t, msg, data)
+
+	if !rliMsg.HasBuyInterest() || rliMsg.HasSellInterest() {
+		t.Fatal("expected buy interest only")
+	}
+
+	// The Retail Liquidity Indicator was introduced in TOPS v1.6.
+	msg, err = UnmarshalV1_5(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*iextp.UnsupportedMessage); !ok {
+		t.Fatalf("expected TOPS v1.5 to decode UnsupportedMessage, got %v", msg)
+	}
+
+	if _, err := Unmarshal(data[:17]); err == nil {
+		t.Fatal("expected error unmarshaling truncated message")
+	}
+}
+
+func TestRegister_Versions(t *testing.T) {
+	d := iextp.NewDecoder()
+	Register(d)
+
+	rli := &RetailLiquidityIndicatorMessage{
+		MessageType:              RetailLiquidityIndicator,
+		RetailLiquidityIndicator: RetailBuySellInterest,
+		Symbol:                   "ZIEXT",
+	}
+	for _, tc := range []struct {
+		id        uint16
+		supported bool
+	}{
+		{V_1_5_MessageProtocolID, false},
+		{V_1_6_MessageProtocolID, true},
+	} {
+		segment := iextp.Segment{
+			Header: iextp.SegmentHeader{
+				Version:           1,
+				MessageProtocolID: tc.id,
+				ChannelID:         ChannelID,
+			},
+			Messages: []iextp.Message{rli},
+		}
+		buf, err := segment.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded iextp.Segment
+		if err := d.UnmarshalSegment(buf, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		_, ok := decoded.Messages[0].(*RetailLiquidityIndicatorMessage)
+		if ok != tc.supported {
+			t.Fatalf("protocol %#x: decoded %T", tc.id, decoded.Messages[0])
+		}
+	}
+}
+
+func TestUnmarshal_AppendedFields(t *testing.T) {
+	// Fields appended by later revisions of the specification
+	// are kept in the extension of the message.
+	data := []byte{
+		0x53,                                           // S = System Event
+		0x45,                                           // E = End of System Hours
+		0x00, 0xa0, 0x99, 0x97, 0xe9, 0x3d, 0xb6, 0x14, // 2017-04-17 17:00:00
+		0xff, 0xfe, // Unknown trailing fields
+	}
+
+	for _, unmarshal := range []iextp.Protocol{Unmarshal, NewReusableUnmarshalerV1_5()} {
+		msg, err := unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seMsg := msg.(*SystemEventMessage)
+		if seMsg.SystemEvent != EndOfSystemHours || seMsg.Extension != "\xff\xfe" {
+			t.Fatalf("unexpected system event: %v", seMsg)
+		}
+
+		buf, err := seMsg.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("marshaled %x, expected: %x", buf, data)
+		}
+	}
+
+	// Messages of the original length have no extension.
+	msg, err := Unmarshal(data[:10])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext := msg.(*SystemEventMessage).Extension; ext != "" {
+		t.Fatalf("unexpected extension: %x", ext)
+	}
+}
+
+func TestNewReusableUnmarshaler(t *testing.T) {
+	trade := &TradeReportMessage{
+		MessageType: TradeReport,
+		Timestamp:   time.Date(2017, time.April, 17, 9, 30, 0, 0, time.UTC),
+		Symbol:      "ZIEXT",
+		Size:        100,
+		Price:       99.05,
+		TradeID:     1,
+	}
+	rli := &RetailLiquidityIndicatorMessage{
+		MessageType:              RetailLiquidityIndicator,
+		RetailLiquidityIndicator: RetailSellInterest,
+		Symbol:                   "ZIEXT",
+	}
+
+	for _, tc := range []struct {
+		name      string
+		unmarshal iextp.Protocol
+		v1_6      bool
+	}{
+		{"v1.5", NewReusableUnmarshalerV1_5(), false},
+		{"v1.6", NewReusableUnmarshalerV1_6(), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var first iextp.Message
+			for tradeID := int64(1); tradeID <= 3; tradeID++ {
+				trade.TradeID = tradeID
+				data, err := trade.Marshal()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				msg, err := tc.unmarshal(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if *msg.(*TradeReportMessage) != *trade {
+					t.Fatalf("parsed: %v, expected: %v", msg, trade)
+				}
+
+				if first == nil {
+					first = msg
+				} else if msg != first {
+					t.Fatal("expected messages to be decoded into the same struct")
+				}
+			}
+
+			data, err := rli.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := tc.unmarshal(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := msg.(*RetailLiquidityIndicatorMessage); ok != tc.v1_6 {
+				t.Fatalf("unexpected message type: %T", msg)
+			}
+
+			if _, err := tc.unmarshal(nil); err == nil {
+				t.Fatal("expected unmarshal error")
+			}
+		})
+	}
+}
+
+func TestParseString_Interned(t *testing.T) {
+	buf := []byte("ZIEXT   ")
+	if s := ParseString(buf); s != "ZIEXT" {
+		t.Fatalf("parsed: %q, expected: %q", s, "ZIEXT")
+	}
+	if allocs := testing.AllocsPerRun(100, func() { ParseString(buf) }); allocs != 0 {
+		t.Fatalf("expected interned string not to allocate, got %v allocations", allocs)
+	}
+
+	// Strings with the same content but different lengths.
+	if s := ParseString([]byte("ZIEXT")); s != "ZIEXT" {
+		t.Fatalf("parsed: %q, expected: %q", s, "ZIEXT")
+	}
+	if s := ParseString([]byte("ZIE\x00")); s != "ZIE\x00" {
+		t.Fatalf("parsed: %q, expected: %q", s, "ZIE\x00")
+	}
+	if s := ParseString([]byte("LONGER THAN 8 ")); s != "LONGER THAN 8" {
+		t.Fatalf("parsed: %q, expected: %q", s, "LONGER THAN 8")
+	}
+
+	// More strings than fit in the cache are still parsed correctly.
+	for i := 0; i < 2*len(stringCache); i++ {
+		symbol := fmt.Sprintf("S%d", i)
+		if s := ParseString([]byte(symbol)); s != symbol {
+			t.Fatalf("parsed: %q, expected: %q", s, symbol)
+		}
+	}
+}
+
+func BenchmarkParseString(b *testing.B) {
+	buf := []byte("ZIEXT   ")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ParseString(buf)
+	}
+}
+
+func TestPutString_TooLong(t *testing.T) {
+	msg := &OperationalHaltStatusMessage{
+		MessageType: OperationalHaltStatus,
+		Symbol:      "TOOLONGSYMBOL",
+	}
+
+	if _, err := msg.Marshal(); err == nil {
+		t.Fatal("expected error marshaling symbol longer than 8 characters")
+	}
+}
+
+func checkMarshal(t *testing.T, msg iextp.Message, expected []byte) {
+	t.Helper()
+	buf, err := msg.(iextp.Marshaler).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf, expected) {
+		t.Fatalf("marshaled: %x, expected: %x", buf, expected)
+	}
 }
@@ -0,0 +1,586 @@
+package iex
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/xuforr/go-iex/iextp"
+)
+
+const (
+	// Default number of uncompressed bytes of the dump between index entries.
+	defaultPcapIndexSpan = 1 << 20
+
+	pcapIndexMagic   = "IEXPCIDX"
+	pcapIndexVersion = 1
+
+	// Maximum size of a pcap record or pcap-ng block, which bounds the
+	// memory allocated for a corrupt dump, and of the file header and
+	// pcap-ng blocks preceding the first packet.
+	maxPcapRecordSize = 1 << 18
+	maxPcapHeaderSize = 1 << 20
+)
+
+var (
+	errInvalidPcapIndex   = errors.New("invalid pcap index")
+	errInvalidPacketBlock = errors.New("invalid pcap-ng packet block")
+)
+
+// PcapIndex records the positions of IEX-TP segments in a pcap or
+// pcap-ng dump, so that reading can start from a given send time or
+// sequence number without scanning the dump from the start
+// (see IndexedPcapDataSource and PcapScanner.SeekTime).
+//
+// For gzipped dumps, the index also records periodic checkpoints of the
+// state of the decompressor, from which inflation can be resumed.
+//
+// An index is usually stored in a sidecar file next to the dump
+// (see IndexFilename), written with WriteTo and read with ReadPcapIndex.
+type PcapIndex struct {
+	// Size of the indexed dump, in bytes.
+	Size int64
+	// Whether the indexed dump is gzipped.
+	Gzipped bool
+	// The pcap file header, or the pcap-ng blocks preceding the first
+	// packet, which are needed to read the dump from an entry.
+	Header []byte
+	// Index entries, in the order of the dump.
+	Entries []PcapIndexEntry
+
+	checkpoints []inflateCheckpoint
+}
+
+// PcapIndexEntry is the position of an IEX-TP segment in a dump.
+type PcapIndexEntry struct {
+	// Offset of the record of the packet containing the segment,
+	// in the uncompressed dump.
+	Offset int64
+	// The header of the segment.
+	Segment iextp.SegmentHeader
+
+	// The inflate checkpoint preceding Offset, if gzipped.
+	checkpoint int
+}
+
+// IndexFilename returns the name of the sidecar index file
+// for the given pcap or pcap-ng dump.
+func IndexFilename(pcapFilename string) string {
+	return pcapFilename + ".idx"
+}
+
+// PcapIndexBuilder builds a PcapIndex from a pcap or pcap-ng dump.
+type PcapIndexBuilder struct {
+	span int64
+}
+
+// NewPcapIndexBuilder creates a PcapIndexBuilder with the default span.
+func NewPcapIndexBuilder() *PcapIndexBuilder {
+	return &PcapIndexBuilder{span: defaultPcapIndexSpan}
+}
+
+// SetSpan sets the minimum number of bytes of the (uncompressed) dump
+// between index entries. Smaller spans make seeking faster, but make the
+// index larger: each entry of a gzipped dump includes up to 32KB of
+// decompressor state. The default is 1MB.
+func (b *PcapIndexBuilder) SetSpan(n int64) {
+	if n > 0 {
+		b.span = n
+	}
+}
+
+// BuildPcapIndex builds a PcapIndex with the default span from the pcap
+// or pcap-ng dump in r, which may be gzipped.
+func BuildPcapIndex(r io.Reader) (*PcapIndex, error) {
+	return NewPcapIndexBuilder().Build(r)
+}
+
+// Build reads the pcap or pcap-ng dump in r, which may be gzipped, and
+// returns its index. Dumps compressed in other formats cannot be indexed,
+// since their decompression cannot be resumed from checkpoints. A truncated
+// dump (e.g. one that is still being recorded) is indexed up to its last
+// complete packet record.
+func (b *PcapIndexBuilder) Build(r io.Reader) (*PcapIndex, error) {
+	counter := &countingReader{r: r}
+	input := bufio.NewReader(counter)
+	magic, err := input.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &PcapIndex{}
+	var stream io.Reader = input
+	var inflater *blockInflater
+	if magic[0] == magicGzip1 && magic[1] == magicGzip2 {
+		index.Gzipped = true
+		inflater = newBlockInflater(input)
+		inflater.recordCheckpoints(b.span)
+		stream = inflater
+	} else if _, compression, err := decompress(input); err != nil {
+		return nil, err
+	} else if compression != Uncompressed {
+		return nil, fmt.Errorf("cannot index %v-compressed dump", compression)
+	}
+
+	records := newPcapRecordReader(bufio.NewReader(stream))
+	// Record an entry for the first segment following each checkpoint
+	// of a gzipped dump, or every span bytes otherwise.
+	pending := true
+	nextEntry := int64(0)
+	checkpoint := -1
+	for {
+		offset, data, linkType, err := records.next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if inflater != nil {
+			for checkpoint+1 < len(inflater.checkpoints) &&
+				inflater.checkpoints[checkpoint+1].Out <= offset {
+				checkpoint++
+				pending = true
+			}
+		} else if offset >= nextEntry {
+			pending = true
+		}
+
+		if !pending {
+			continue
+		}
+
+		entry := PcapIndexEntry{Offset: offset, checkpoint: checkpoint}
+		if !unmarshalPacketSegmentHeader(data, linkType, &entry.Segment) {
+			continue
+		}
+
+		index.Entries = append(index.Entries, entry)
+		pending = false
+		nextEntry = offset + b.span
+	}
+
+	index.Size = counter.n
+	index.Header = records.header
+	if inflater != nil {
+		index.setCheckpoints(inflater.checkpoints)
+	}
+	return index, nil
+}
+
+// Keep only the checkpoints used by the entries.
+func (index *PcapIndex) setCheckpoints(checkpoints []inflateCheckpoint) {
+	used := make(map[int]int)
+	for i := range index.Entries {
+		entry := &index.Entries[i]
+		n, ok := used[entry.checkpoint]
+		if !ok {
+			n = len(index.checkpoints)
+			used[entry.checkpoint] = n
+			index.checkpoints = append(index.checkpoints, checkpoints[entry.checkpoint])
+		}
+		entry.checkpoint = n
+	}
+}
+
+// Decode the header of the IEX-TP segment in the given packet, if any.
+func unmarshalPacketSegmentHeader(data []byte, linkType layers.LinkType, header *iextp.SegmentHeader) bool {
+	packet := gopacket.NewPacket(data, linkTypeDecoder(linkType),
+		gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	app := packet.ApplicationLayer()
+	if app == nil {
+		return false
+	}
+
+	payload := app.Payload()
+	if err := header.Unmarshal(payload); err != nil {
+		return false
+	}
+	return int(header.PayloadLength) == len(payload)-40
+}
+
+// Find the last entry sent before t, or the first entry
+// if there is none. Returns nil if the index is empty.
+func (index *PcapIndex) entryBeforeTime(t time.Time) *PcapIndexEntry {
+	i := sort.Search(len(index.Entries), func(i int) bool {
+		return !index.Entries[i].Segment.SendTime.Before(t)
+	})
+	return index.entryBefore(i)
+}
+
+// Find the last entry of the session of the first entry whose segment
+// starts at or before sequence number seq, or the first entry if there
+// is none. Returns nil if the index is empty.
+func (index *PcapIndex) entryBeforeSequence(seq int64) *PcapIndexEntry {
+	if len(index.Entries) == 0 {
+		return nil
+	}
+
+	key := sessionKeyOf(&index.Entries[0].Segment)
+	found := 0
+	for i := range index.Entries {
+		h := &index.Entries[i].Segment
+		if sessionKeyOf(h) != key {
+			continue
+		} else if h.FirstMessageSequenceNumber > seq {
+			break
+		}
+		found = i
+	}
+
+	return &index.Entries[found]
+}
+
+func (index *PcapIndex) entryBefore(i int) *PcapIndexEntry {
+	if len(index.Entries) == 0 {
+		return nil
+	} else if i > 0 {
+		i--
+	}
+	return &index.Entries[i]
+}
+
+// WriteTo writes the index to w in its (gzipped) binary format.
+// It implements io.WriterTo.
+func (index *PcapIndex) WriteTo(w io.Writer) (int64, error) {
+	counter := &countingWriter{w: w}
+	gzw := gzip.NewWriter(counter)
+	bufw := bufio.NewWriter(gzw)
+
+	var gzipped uint8
+	if index.Gzipped {
+		gzipped = 1
+	}
+
+	bufw.WriteString(pcapIndexMagic)
+	writeIndexValues(bufw, uint32(pcapIndexVersion), index.Size, gzipped,
+		uint32(len(index.Header)))
+	bufw.Write(index.Header)
+
+	writeIndexValues(bufw, uint32(len(index.checkpoints)))
+	for _, cp := range index.checkpoints {
+		writeIndexValues(bufw, cp.In, cp.Out, uint32(len(cp.Window)))
+		bufw.Write(cp.Window)
+	}
+
+	writeIndexValues(bufw, uint32(len(index.Entries)))
+	for _, entry := range index.Entries {
+		segmentHeader, _ := entry.Segment.Marshal()
+		writeIndexValues(bufw, entry.Offset, int32(entry.checkpoint))
+		bufw.Write(segmentHeader)
+	}
+
+	if err := bufw.Flush(); err != nil {
+		return counter.n, err
+	}
+	err := gzw.Close()
+	return counter.n, err
+}
+
+func writeIndexValues(w io.Writer, values ...interface{}) {
+	for _, v := range values {
+		// Errors are reported by flushing the buffered writer.
+		binary.Write(w, binary.LittleEndian, v)
+	}
+}
+
+// ReadPcapIndex reads an index written by PcapIndex.WriteTo.
+func ReadPcapIndex(r io.Reader) (*PcapIndex, error) {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	input := bufio.NewReader(gzr)
+
+	var magic [len(pcapIndexMagic)]byte
+	if _, err := io.ReadFull(input, magic[:]); err != nil {
+		return nil, err
+	} else if string(magic[:]) != pcapIndexMagic {
+		return nil, errInvalidPcapIndex
+	}
+
+	var header struct {
+		Version   uint32
+		Size      int64
+		Gzipped   uint8
+		HeaderLen uint32
+	}
+	if err := binary.Read(input, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	} else if header.Version != pcapIndexVersion {
+		return nil, fmt.Errorf("unsupported pcap index version: %v", header.Version)
+	}
+
+	index := &PcapIndex{
+		Size:    header.Size,
+		Gzipped: header.Gzipped != 0,
+	}
+	if header.HeaderLen > maxPcapHeaderSize {
+		return nil, errInvalidPcapIndex
+	}
+	index.Header = make([]byte, header.HeaderLen)
+	if _, err := io.ReadFull(input, index.Header); err != nil {
+		return nil, err
+	}
+
+	var n uint32
+	if err := binary.Read(input, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < n; i++ {
+		var cp struct {
+			In, Out   int64
+			WindowLen uint32
+		}
+		if err := binary.Read(input, binary.LittleEndian, &cp); err != nil {
+			return nil, err
+		} else if cp.WindowLen > inflateWindowSize {
+			return nil, errInvalidPcapIndex
+		}
+
+		window := make([]byte, cp.WindowLen)
+		if _, err := io.ReadFull(input, window); err != nil {
+			return nil, err
+		}
+		index.checkpoints = append(index.checkpoints,
+			inflateCheckpoint{In: cp.In, Out: cp.Out, Window: window})
+	}
+
+	if err := binary.Read(input, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	segmentHeader := make([]byte, 40)
+	for i := uint32(0); i < n; i++ {
+		var entry struct {
+			Offset     int64
+			Checkpoint int32
+		}
+		if err := binary.Read(input, binary.LittleEndian, &entry); err != nil {
+			return nil, err
+		} else if _, err := io.ReadFull(input, segmentHeader); err != nil {
+			return nil, err
+		}
+
+		checkpoint := int(entry.Checkpoint)
+		if index.Gzipped && (checkpoint < 0 || checkpoint >= len(index.checkpoints)) {
+			return nil, errInvalidPcapIndex
+		}
+
+		indexEntry := PcapIndexEntry{Offset: entry.Offset, checkpoint: checkpoint}
+		if err := indexEntry.Segment.Unmarshal(segmentHeader); err != nil {
+			return nil, err
+		}
+		index.Entries = append(index.Entries, indexEntry)
+	}
+
+	return index, nil
+}
+
+// countingReader counts the number of bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// pcapRecordReader reads the packet records of a pcap or pcap-ng dump,
+// tracking their offsets in the dump.
+type pcapRecordReader struct {
+	r      *bufio.Reader
+	offset int64
+
+	started bool
+	ng      bool
+	order   binary.ByteOrder
+	// Link type of the pcap dump, or of each pcap-ng interface.
+	linkTypes []layers.LinkType
+
+	// The data preceding the first packet record.
+	header     []byte
+	sawPackets bool
+	buf        []byte
+}
+
+func newPcapRecordReader(r *bufio.Reader) *pcapRecordReader {
+	return &pcapRecordReader{r: r}
+}
+
+// Read the next packet record, returning its offset, data and link type.
+// The data is only valid until the next call to next.
+func (rr *pcapRecordReader) next() (int64, []byte, layers.LinkType, error) {
+	if !rr.started {
+		rr.started = true
+		if err := rr.readFileHeader(); err != nil {
+			return 0, nil, 0, err
+		}
+	}
+
+	if rr.ng {
+		return rr.nextBlock()
+	}
+
+	offset := rr.offset
+	recordHeader, err := rr.read(16)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+
+	data, err := rr.read(int(rr.order.Uint32(recordHeader[8:12])))
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	return offset, data, rr.linkTypes[0], nil
+}
+
+// Read n bytes into rr.buf.
+func (rr *pcapRecordReader) read(n int) ([]byte, error) {
+	if n < 0 || n > maxPcapRecordSize {
+		return nil, fmt.Errorf("pcap record of %v bytes exceeds maximum size", n)
+	} else if !rr.sawPackets && len(rr.header)+n > maxPcapHeaderSize {
+		return nil, fmt.Errorf("pcap header exceeds maximum size of %v bytes", maxPcapHeaderSize)
+	}
+	if cap(rr.buf) < n {
+		rr.buf = make([]byte, n)
+	}
+
+	buf := rr.buf[:n]
+	nRead, err := io.ReadFull(rr.r, buf)
+	rr.offset += int64(nRead)
+	if !rr.sawPackets {
+		rr.header = append(rr.header, buf[:nRead]...)
+	}
+	return buf[:nRead], err
+}
+
+func (rr *pcapRecordReader) readFileHeader() error {
+	magicBuf, err := rr.r.Peek(4)
+	if err != nil {
+		return err
+	}
+
+	if binary.LittleEndian.Uint32(magicBuf) == pcapNGMagic {
+		rr.ng = true
+		return nil
+	}
+
+	header, err := rr.read(24)
+	if err != nil {
+		return err
+	}
+
+	switch binary.LittleEndian.Uint32(header[:4]) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		rr.order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		rr.order = binary.BigEndian
+	default:
+		return fmt.Errorf("unknown pcap magic number: %#x", header[:4])
+	}
+
+	rr.linkTypes = []layers.LinkType{layers.LinkType(rr.order.Uint32(header[20:24]))}
+	rr.sawPackets = true
+	return nil
+}
+
+// Read pcap-ng blocks until the next packet block.
+func (rr *pcapRecordReader) nextBlock() (int64, []byte, layers.LinkType, error) {
+	for {
+		offset := rr.offset
+		if _, err := rr.r.Peek(1); err == io.EOF {
+			return 0, nil, 0, io.EOF
+		}
+
+		// Peek at the block header so that packet blocks
+		// are not included in the header.
+		blockHeader, err := rr.r.Peek(12)
+		if err != nil {
+			return 0, nil, 0, io.ErrUnexpectedEOF
+		}
+
+		blockType := binary.LittleEndian.Uint32(blockHeader[:4])
+		if blockType == pcapNGMagic {
+			if rr.sawPackets {
+				return 0, nil, 0, errors.New(
+					"cannot index pcap-ng dump with multiple sections")
+			}
+
+			switch binary.LittleEndian.Uint32(blockHeader[8:12]) {
+			case 0x1a2b3c4d:
+				rr.order = binary.LittleEndian
+			case 0x4d3c2b1a:
+				rr.order = binary.BigEndian
+			default:
+				return 0, nil, 0, errors.New("invalid pcap-ng byte-order magic")
+			}
+		} else if rr.order == nil {
+			return 0, nil, 0, errors.New("pcap-ng dump does not start with a section header")
+		} else {
+			blockType = rr.order.Uint32(blockHeader[:4])
+		}
+
+		isPacket := blockType == 2 || blockType == 3 || blockType == 6
+		if isPacket {
+			rr.sawPackets = true
+		}
+
+		blockLength := int(rr.order.Uint32(blockHeader[4:8]))
+		if blockLength < 12 || blockLength%4 != 0 {
+			return 0, nil, 0, fmt.Errorf("invalid pcap-ng block length: %v", blockLength)
+		}
+
+		block, err := rr.read(blockLength)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		body := block[8 : blockLength-4]
+
+		switch blockType {
+		case 1: // Interface Description Block
+			if rr.sawPackets {
+				return 0, nil, 0, errors.New(
+					"cannot index pcap-ng dump with interfaces described after packets")
+			}
+			if len(body) < 8 {
+				return 0, nil, 0, errors.New("invalid pcap-ng interface description block")
+			}
+			rr.linkTypes = append(rr.linkTypes, layers.LinkType(rr.order.Uint16(body[:2])))
+		case 2, 6: // (Obsolete) Packet Block, Enhanced Packet Block
+			if len(body) < 20 {
+				return 0, nil, 0, errInvalidPacketBlock
+			}
+			var interfaceID int
+			if blockType == 2 {
+				interfaceID = int(rr.order.Uint16(body[:2]))
+			} else {
+				interfaceID = int(rr.order.Uint32(body[:4]))
+			}
+			capturedLength := int(rr.order.Uint32(body[12:16]))
+			if interfaceID >= len(rr.linkTypes) || 20+capturedLength > len(body) {
+				return 0, nil, 0, errInvalidPacketBlock
+			}
+			return offset, body[20 : 20+capturedLength], rr.linkTypes[interfaceID], nil
+		case 3: // Simple Packet Block
+			if len(rr.linkTypes) == 0 || len(body) < 4 {
+				return 0, nil, 0, errInvalidPacketBlock
+			}
+			data := body[4:]
+			if originalLength := int(rr.order.Uint32(body[:4])); originalLength < len(data) {
+				data = data[:originalLength]
+			}
+			return offset, data, rr.linkTypes[0], nil
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package iex
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Generate data with a mix of compressible and incompressible runs.
+func makeInflateTestData(n int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, 0, n)
+	for len(data) < n {
+		run := make([]byte, rng.Intn(4096))
+		if rng.Intn(2) == 0 {
+			rng.Read(run)
+		} else {
+			for i := range run {
+				run[i] = "IEX-TP segment "[(i+len(data))%15]
+			}
+		}
+		data = append(data, run...)
+	}
+	return data[:n]
+}
+
+func gzipTestData(t *testing.T, level int, members ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, member := range members {
+		gzw, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gzw.Name = "test.pcap"
+		if _, err := gzw.Write(member); err != nil {
+			t.Fatal(err)
+		}
+		if err := gzw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestBlockInflater(t *testing.T) {
+	data := makeInflateTestData(1 << 20)
+	for _, level := range []int{gzip.NoCompression, gzip.HuffmanOnly,
+		gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression} {
+		compressed := gzipTestData(t, level, data[:1<<19], data[1<<19:])
+
+		inflater := newBlockInflater(bufio.NewReader(bytes.NewReader(compressed)))
+		inflater.recordCheckpoints(1 << 16)
+		inflated, err := io.ReadAll(inflater)
+		if err != nil {
+			t.Fatalf("level %v: %v", level, err)
+		} else if !bytes.Equal(inflated, data) {
+			t.Fatalf("level %v: inflated data does not match", level)
+		}
+
+		if len(inflater.checkpoints) < 4 {
+			t.Fatalf("level %v: expected checkpoints, got: %v", level, len(inflater.checkpoints))
+		}
+
+		for _, cp := range inflater.checkpoints {
+			r := bufio.NewReader(bytes.NewReader(compressed[cp.In/8:]))
+			resumed, err := resumeBlockInflater(r, cp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			inflated, err := io.ReadAll(resumed)
+			if err != nil {
+				t.Fatalf("level %v: %v", level, err)
+			} else if !bytes.Equal(inflated, data[cp.Out:]) {
+				t.Fatalf("level %v: data resumed from %v does not match", level, cp.Out)
+			}
+		}
+	}
+}
+
+func TestBlockInflater_Errors(t *testing.T) {
+	compressed := gzipTestData(t, gzip.DefaultCompression, makeInflateTestData(1<<16))
+
+	corrupt := append([]byte(nil), compressed...)
+	corrupt[len(corrupt)-5] ^= 0xff // CRC-32
+	inflater := newBlockInflater(bufio.NewReader(bytes.NewReader(corrupt)))
+	if _, err := io.ReadAll(inflater); err != errGzipChecksum {
+		t.Fatalf("expected checksum error, got: %v", err)
+	}
+
+	truncated := compressed[:len(compressed)/2]
+	inflater = newBlockInflater(bufio.NewReader(bytes.NewReader(truncated)))
+	if _, err := io.ReadAll(inflater); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected unexpected EOF, got: %v", err)
+	}
+
+	inflater = newBlockInflater(bufio.NewReader(bytes.NewReader([]byte("not gzip data"))))
+	if _, err := io.ReadAll(inflater); err != errInvalidGzip {
+		t.Fatalf("expected invalid header, got: %v", err)
+	}
+}
+
+func FuzzBlockInflater(f *testing.F) {
+	data := makeInflateTestData(1 << 14)
+	for _, level := range []int{flate.NoCompression, flate.HuffmanOnly,
+		flate.BestSpeed, flate.BestCompression} {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, level)
+		w.Write(data)
+		w.Close()
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0x03, 0x00})
+
+	// Header of a gzip member without optional fields.
+	header := []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff}
+	f.Fuzz(func(t *testing.T, deflated []byte) {
+		r := bytes.NewReader(deflated)
+		want, wantErr := io.ReadAll(flate.NewReader(r))
+		if wantErr == nil {
+			// Drop any data following the final block.
+			deflated = deflated[:len(deflated)-r.Len()]
+		}
+
+		member := append(append([]byte(nil), header...), deflated...)
+		member = binary.LittleEndian.AppendUint32(member, crc32.ChecksumIEEE(want))
+		member = binary.LittleEndian.AppendUint32(member, uint32(len(want)))
+		inflater := newBlockInflater(bufio.NewReader(bytes.NewReader(member)))
+		inflater.recordCheckpoints(1 << 10)
+		got, err := io.ReadAll(inflater)
+		if wantErr != nil {
+			if err == nil {
+				t.Fatalf("expected error %v, got none", wantErr)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		} else if !bytes.Equal(got, want) {
+			t.Fatalf("inflated data does not match compress/flate")
+		}
+	})
+}
+
+// Write a pcap dump of n DEEP segments of 5 trades each.
+func makeIndexTestDump(t *testing.T, format PcapFormat, gzipped bool, n int) []byte {
+	var buf bytes.Buffer
+	var dst io.Writer = &buf
+	var gzw *gzip.Writer
+	if gzipped {
+		gzw = gzip.NewWriter(&buf)
+		dst = gzw
+	}
+
+	w, err := NewPcapWriter(dst, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		payload := makeTestSegment(t, int64(1+5*i), 5)
+		if err := w.WriteDatagram(testSendTime, testSrcAddr, testDstAddr, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if gzw != nil {
+		if err := gzw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestBuildPcapIndex(t *testing.T) {
+	for _, format := range []PcapFormat{FormatPcap, FormatPcapNG} {
+		for _, gzipped := range []bool{false, true} {
+			data := makeIndexTestDump(t, format, gzipped, 2000)
+			builder := NewPcapIndexBuilder()
+			builder.SetSpan(16 << 10)
+			index, err := builder.Build(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if index.Size != int64(len(data)) || index.Gzipped != gzipped {
+				t.Fatalf("%v (gzipped: %v): unexpected index of %v bytes: %+v",
+					format, gzipped, len(data), index)
+			}
+
+			if len(index.Entries) < 5 {
+				t.Fatalf("%v (gzipped: %v): expected entries, got: %v",
+					format, gzipped, len(index.Entries))
+			}
+
+			if seq := index.Entries[0].Segment.FirstMessageSequenceNumber; seq != 1 {
+				t.Fatalf("%v (gzipped: %v): expected first entry at sequence 1, got: %v",
+					format, gzipped, seq)
+			}
+
+			for i := 1; i < len(index.Entries); i++ {
+				prev, entry := index.Entries[i-1], index.Entries[i]
+				if entry.Offset <= prev.Offset ||
+					!entry.Segment.SendTime.After(prev.Segment.SendTime) {
+					t.Fatalf("%v (gzipped: %v): entries out of order: %+v, %+v",
+						format, gzipped, prev, entry)
+				}
+			}
+
+			var buf bytes.Buffer
+			if _, err := index.WriteTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+
+			readIndex, err := ReadPcapIndex(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(readIndex, index) {
+				t.Fatalf("%v (gzipped: %v): read index does not match written index",
+					format, gzipped)
+			}
+		}
+	}
+}
+
+func TestBuildPcapIndex_Truncated(t *testing.T) {
+	data := makeIndexTestDump(t, FormatPcap, false, 100)
+	index, err := BuildPcapIndex(bytes.NewReader(data[:len(data)-10]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(index.Entries) != 1 {
+		t.Fatalf("expected 1 entry, got: %v", len(index.Entries))
+	}
+}
+
+func TestBuildPcapIndex_ShortBlocks(t *testing.T) {
+	// Section header block, little-endian, version 1.0, unknown length.
+	section := []byte{
+		0x0a, 0x0d, 0x0d, 0x0a, 28, 0, 0, 0,
+		0x4d, 0x3c, 0x2b, 0x1a, 1, 0, 0, 0,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		28, 0, 0, 0,
+	}
+	for _, blockType := range []byte{1, 2, 6} {
+		// A block with an empty body.
+		block := []byte{blockType, 0, 0, 0, 12, 0, 0, 0, 12, 0, 0, 0}
+		data := append(append([]byte(nil), section...), block...)
+		if _, err := BuildPcapIndex(bytes.NewReader(data)); err == nil {
+			t.Fatalf("block type %v: expected error", blockType)
+		}
+	}
+}
+
+func TestBuildPcapIndex_OversizedRecord(t *testing.T) {
+	data := make([]byte, 40)
+	binary.LittleEndian.PutUint32(data[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(data[4:6], 2)
+	binary.LittleEndian.PutUint16(data[6:8], 4)
+	binary.LittleEndian.PutUint32(data[16:20], 65535)
+	binary.LittleEndian.PutUint32(data[20:24], uint32(layers.LinkTypeRaw))
+	// A record claiming to capture 2GB.
+	binary.LittleEndian.PutUint32(data[32:36], 1<<31)
+	binary.LittleEndian.PutUint32(data[36:40], 1<<31)
+
+	if _, err := BuildPcapIndex(bytes.NewReader(data)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestReadPcapIndex_Invalid(t *testing.T) {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	gzw.Write([]byte("NOTANIDX"))
+	gzw.Close()
+
+	if _, err := ReadPcapIndex(&buf); err != errInvalidPcapIndex {
+		t.Fatalf("expected invalid index, got: %v", err)
+	}
+
+	// An index with an oversized dump header.
+	buf.Reset()
+	gzw = gzip.NewWriter(&buf)
+	gzw.Write([]byte(pcapIndexMagic))
+	binary.Write(gzw, binary.LittleEndian, struct {
+		Version   uint32
+		Size      int64
+		Gzipped   uint8
+		HeaderLen uint32
+	}{pcapIndexVersion, 0, 0, 1 << 31})
+	gzw.Close()
+
+	if _, err := ReadPcapIndex(&buf); err != errInvalidPcapIndex {
+		t.Fatalf("expected invalid index, got: %v", err)
+	}
+}
+
+func TestBuildPcapIndex_DEEP10(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping pcap test in short mode.")
+	}
+
+	f, err := os.Open(filepath.Join("testdata", "DEEP10.pcap.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	index, err := BuildPcapIndex(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !index.Gzipped || len(index.Header) != 24 {
+		t.Fatalf("unexpected index: %+v", index)
+	}
+
+	// One entry per 1MB of the 22MB uncompressed dump.
+	if len(index.Entries) != 22 || len(index.checkpoints) != 22 {
+		t.Fatalf("expected 22 entries, got: %v (%v checkpoints)",
+			len(index.Entries), len(index.checkpoints))
+	}
+}
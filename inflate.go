@@ -0,0 +1,697 @@
+package iex
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+const (
+	// Size of the DEFLATE history window.
+	inflateWindowSize = 1 << 15
+	// Maximum number of bytes decoded ahead of the reader.
+	inflateBufferSize = 1 << 17
+	// Maximum length of a DEFLATE match.
+	inflateMaxMatch = 258
+
+	// Number of bits decoded by the primary Huffman lookup table.
+	huffmanPrimaryBits = 9
+	huffmanMaxBits     = 15
+)
+
+var (
+	errInvalidDeflate  = errors.New("gzip: invalid deflate data")
+	errInvalidGzip     = errors.New("gzip: invalid header")
+	errGzipChecksum    = errors.New("gzip: invalid checksum")
+	errCheckpointStart = errors.New("gzip: invalid inflate checkpoint")
+)
+
+// inflateCheckpoint is the state needed to resume inflating a gzip
+// stream at the start of a DEFLATE block.
+type inflateCheckpoint struct {
+	// Offset of the block in the compressed stream, in bits.
+	In int64
+	// Offset of the block's output in the uncompressed stream, in bytes.
+	Out int64
+	// The (up to) 32KB of output preceding the block.
+	Window []byte
+}
+
+// Decoder states.
+const (
+	inflateMemberHeader = iota
+	inflateBlockHeader
+	inflateStoredBlock
+	inflateHuffmanBlock
+	inflateMemberTrailer
+)
+
+// blockInflater decompresses gzip data like compress/gzip, but can record
+// checkpoints at DEFLATE block boundaries and resume inflation from them,
+// which allows random access into gzipped dumps (see PcapIndex).
+type blockInflater struct {
+	r     io.ByteReader
+	in    int64 // Number of bytes read from r.
+	rErr  error
+	bits  uint64
+	nbits uint
+
+	// Decoded data, including up to inflateWindowSize bytes of history
+	// before the read position.
+	out     []byte
+	rpos    int
+	outBase int64 // Offset of out[0] in the uncompressed stream.
+
+	state     int
+	members   int
+	final     bool
+	remaining int // Remaining bytes of the current stored block.
+	lit, dist huffmanDecoder
+
+	// The CRC-32 and size of the current member are only
+	// checked if it was inflated from its start.
+	verify    bool
+	crc       uint32
+	crcPos    int
+	memberOut int64 // Offset of the start of the member's output.
+
+	// Minimum uncompressed distance between recorded checkpoints,
+	// or 0 if checkpoints are not recorded.
+	span        int64
+	checkpoints []inflateCheckpoint
+
+	err error
+}
+
+func newBlockInflater(r io.ByteReader) *blockInflater {
+	return &blockInflater{
+		r:   r,
+		out: make([]byte, 0, inflateWindowSize+inflateBufferSize),
+	}
+}
+
+// Create a blockInflater that resumes inflation at the given checkpoint,
+// reading the compressed stream from r, which must be positioned at the
+// byte containing the first bit of the checkpoint's block.
+func resumeBlockInflater(r io.ByteReader, cp inflateCheckpoint) (*blockInflater, error) {
+	f := newBlockInflater(r)
+	f.in = cp.In / 8
+	if skip := uint(cp.In % 8); skip != 0 {
+		if err := f.needBits(skip); err != nil {
+			return nil, err
+		}
+		f.dropBits(skip)
+	}
+
+	if len(cp.Window) > inflateWindowSize {
+		return nil, errCheckpointStart
+	}
+
+	f.out = append(f.out, cp.Window...)
+	f.rpos = len(f.out)
+	f.crcPos = len(f.out)
+	f.outBase = cp.Out - int64(len(cp.Window))
+	f.state = inflateBlockHeader
+	f.members = 1
+	return f, nil
+}
+
+// Record a checkpoint at block boundaries at least span bytes of
+// output apart, starting with the first block.
+func (f *blockInflater) recordCheckpoints(span int64) {
+	f.span = span
+}
+
+// Read implements io.Reader.
+func (f *blockInflater) Read(p []byte) (int, error) {
+	for f.rpos == len(f.out) {
+		if f.err != nil {
+			return 0, f.err
+		}
+		f.err = f.inflate()
+	}
+
+	n := copy(p, f.out[f.rpos:])
+	f.rpos += n
+	return n, nil
+}
+
+// Decode until the output buffer is full, or an error occurs.
+func (f *blockInflater) inflate() error {
+	f.slide()
+	for len(f.out)+inflateMaxMatch <= cap(f.out) {
+		var err error
+		switch f.state {
+		case inflateMemberHeader:
+			err = f.readMemberHeader()
+		case inflateBlockHeader:
+			err = f.readBlockHeader()
+		case inflateStoredBlock:
+			err = f.copyStored()
+		case inflateHuffmanBlock:
+			err = f.decodeHuffman()
+		case inflateMemberTrailer:
+			err = f.readMemberTrailer()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Discard output that has been read and is no longer needed as history.
+func (f *blockInflater) slide() {
+	discard := f.rpos - inflateWindowSize
+	if discard <= 0 {
+		return
+	}
+
+	f.updateChecksum()
+	n := copy(f.out, f.out[discard:])
+	f.out = f.out[:n]
+	f.rpos -= discard
+	f.crcPos -= discard
+	f.outBase += int64(discard)
+}
+
+func (f *blockInflater) updateChecksum() {
+	if f.verify {
+		f.crc = crc32.Update(f.crc, crc32.IEEETable, f.out[f.crcPos:])
+	}
+	f.crcPos = len(f.out)
+}
+
+// Read up to 64 bits into the bit buffer.
+func (f *blockInflater) fill() {
+	for f.nbits <= 56 && f.rErr == nil {
+		b, err := f.r.ReadByte()
+		if err != nil {
+			f.rErr = err
+			return
+		}
+
+		f.bits |= uint64(b) << f.nbits
+		f.nbits += 8
+		f.in++
+	}
+}
+
+func (f *blockInflater) needBits(n uint) error {
+	if f.nbits < n {
+		f.fill()
+		if f.nbits < n {
+			if f.rErr == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return f.rErr
+		}
+	}
+	return nil
+}
+
+func (f *blockInflater) dropBits(n uint) {
+	f.bits >>= n
+	f.nbits -= n
+}
+
+func (f *blockInflater) getBits(n uint) (int, error) {
+	if err := f.needBits(n); err != nil {
+		return 0, err
+	}
+
+	v := int(f.bits & (1<<n - 1))
+	f.dropBits(n)
+	return v, nil
+}
+
+func (f *blockInflater) getByte() (byte, error) {
+	v, err := f.getBits(8)
+	return byte(v), err
+}
+
+// Discard the remaining bits of the current byte.
+func (f *blockInflater) alignToByte() {
+	f.dropBits(f.nbits % 8)
+}
+
+// Offset of the next unread bit of the compressed stream.
+func (f *blockInflater) bitOffset() int64 {
+	return f.in*8 - int64(f.nbits)
+}
+
+func (f *blockInflater) readMemberHeader() error {
+	if f.members > 0 {
+		// Return io.EOF if there are no further gzip members.
+		if f.fill(); f.nbits == 0 {
+			if f.rErr == io.EOF {
+				return io.EOF
+			}
+			return f.rErr
+		}
+	}
+
+	var header [10]byte
+	for i := range header {
+		b, err := f.getByte()
+		if err != nil {
+			return err
+		}
+		header[i] = b
+	}
+
+	if header[0] != magicGzip1 || header[1] != magicGzip2 || header[2] != 8 {
+		return errInvalidGzip
+	}
+
+	flags := header[3]
+	if flags&0x04 != 0 { // FEXTRA
+		xlen, err := f.getBits(16)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < xlen; i++ {
+			if _, err := f.getByte(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, flag := range []byte{0x08, 0x10} { // FNAME, FCOMMENT
+		if flags&flag == 0 {
+			continue
+		}
+		for {
+			b, err := f.getByte()
+			if err != nil {
+				return err
+			} else if b == 0 {
+				break
+			}
+		}
+	}
+
+	if flags&0x02 != 0 { // FHCRC
+		if _, err := f.getBits(16); err != nil {
+			return err
+		}
+	}
+
+	f.members++
+	f.verify = true
+	f.crc = 0
+	f.crcPos = len(f.out)
+	f.memberOut = f.outBase + int64(len(f.out))
+	f.state = inflateBlockHeader
+	return nil
+}
+
+func (f *blockInflater) readMemberTrailer() error {
+	f.alignToByte()
+	crc, err := f.getBits(32)
+	if err != nil {
+		return err
+	}
+	size, err := f.getBits(32)
+	if err != nil {
+		return err
+	}
+
+	if f.verify {
+		f.updateChecksum()
+		memberSize := f.outBase + int64(len(f.out)) - f.memberOut
+		if uint32(crc) != f.crc || uint32(size) != uint32(memberSize) {
+			return errGzipChecksum
+		}
+	}
+
+	f.state = inflateMemberHeader
+	return nil
+}
+
+func (f *blockInflater) readBlockHeader() error {
+	if f.span > 0 {
+		f.checkpoint()
+	}
+
+	header, err := f.getBits(3)
+	if err != nil {
+		return err
+	}
+
+	f.final = header&1 != 0
+	switch header >> 1 {
+	case 0:
+		f.alignToByte()
+		length, err := f.getBits(16)
+		if err != nil {
+			return err
+		}
+		nlength, err := f.getBits(16)
+		if err != nil {
+			return err
+		}
+		if length != ^nlength&0xffff {
+			return errInvalidDeflate
+		}
+		f.remaining = length
+		f.state = inflateStoredBlock
+	case 1:
+		f.lit, f.dist = fixedHuffmanDecoders()
+		f.state = inflateHuffmanBlock
+	case 2:
+		if err := f.readDynamicTables(); err != nil {
+			return err
+		}
+		f.state = inflateHuffmanBlock
+	default:
+		return errInvalidDeflate
+	}
+
+	return nil
+}
+
+func (f *blockInflater) endBlock() {
+	if f.final {
+		f.state = inflateMemberTrailer
+	} else {
+		f.state = inflateBlockHeader
+	}
+}
+
+// Record a checkpoint at the current block boundary,
+// if it is far enough from the previous one.
+func (f *blockInflater) checkpoint() {
+	out := f.outBase + int64(len(f.out))
+	if n := len(f.checkpoints); n != 0 && out-f.checkpoints[n-1].Out < f.span {
+		return
+	}
+
+	window := f.out
+	if len(window) > inflateWindowSize {
+		window = window[len(window)-inflateWindowSize:]
+	}
+
+	f.checkpoints = append(f.checkpoints, inflateCheckpoint{
+		In:     f.bitOffset(),
+		Out:    out,
+		Window: append(make([]byte, 0, len(window)), window...),
+	})
+}
+
+func (f *blockInflater) copyStored() error {
+	for f.remaining > 0 && len(f.out) < cap(f.out) {
+		b, err := f.getByte()
+		if err != nil {
+			return err
+		}
+		f.out = append(f.out, b)
+		f.remaining--
+	}
+
+	if f.remaining == 0 {
+		f.endBlock()
+	}
+	return nil
+}
+
+var (
+	lengthBase = [...]uint16{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31,
+		35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [...]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2,
+		3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase = [...]uint16{
+		1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193,
+		257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145,
+		8193, 12289, 16385, 24577}
+	distExtra = [...]uint8{
+		0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6,
+		7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+)
+
+// Decode symbols of the current block until it ends or the output is full.
+func (f *blockInflater) decodeHuffman() error {
+	for len(f.out)+inflateMaxMatch <= cap(f.out) {
+		sym, err := f.decodeSymbol(&f.lit)
+		if err != nil {
+			return err
+		}
+
+		if sym < 256 {
+			f.out = append(f.out, byte(sym))
+			continue
+		} else if sym == 256 {
+			f.endBlock()
+			return nil
+		}
+
+		sym -= 257
+		if sym >= len(lengthBase) {
+			return errInvalidDeflate
+		}
+		extra, err := f.getBits(uint(lengthExtra[sym]))
+		if err != nil {
+			return err
+		}
+		length := int(lengthBase[sym]) + extra
+
+		sym, err = f.decodeSymbol(&f.dist)
+		if err != nil {
+			return err
+		} else if sym >= len(distBase) {
+			return errInvalidDeflate
+		}
+		extra, err = f.getBits(uint(distExtra[sym]))
+		if err != nil {
+			return err
+		}
+		dist := int(distBase[sym]) + extra
+		if dist > len(f.out) {
+			return errInvalidDeflate
+		}
+
+		start := len(f.out) - dist
+		if dist >= length {
+			f.out = append(f.out, f.out[start:start+length]...)
+		} else {
+			for i := 0; i < length; i++ {
+				f.out = append(f.out, f.out[start+i])
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *blockInflater) decodeSymbol(h *huffmanDecoder) (int, error) {
+	if f.nbits < huffmanMaxBits {
+		f.fill()
+	}
+
+	if e := h.primary[f.bits&(1<<huffmanPrimaryBits-1)]; e != 0 && uint(e&15) <= f.nbits {
+		f.dropBits(uint(e & 15))
+		return int(e >> 4), nil
+	}
+
+	// Decode longer codes one bit at a time.
+	code, first, index := 0, 0, 0
+	for length := 1; length <= huffmanMaxBits; length++ {
+		bit, err := f.getBits(1)
+		if err != nil {
+			return 0, err
+		}
+
+		code |= bit
+		count := int(h.count[length])
+		if code-count < first {
+			return int(h.symbol[index+code-first]), nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+
+	return 0, errInvalidDeflate
+}
+
+// Order of the code length code lengths in a dynamic block header.
+var codeLengthOrder = [...]uint8{
+	16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+func (f *blockInflater) readDynamicTables() error {
+	counts, err := f.getBits(14)
+	if err != nil {
+		return err
+	}
+
+	nlit := counts&0x1f + 257
+	ndist := (counts>>5)&0x1f + 1
+	ncode := counts>>10 + 4
+	if nlit > 286 || ndist > 30 {
+		return errInvalidDeflate
+	}
+
+	var lengths [286 + 30]uint8
+	for i := 0; i < ncode; i++ {
+		length, err := f.getBits(3)
+		if err != nil {
+			return err
+		}
+		lengths[codeLengthOrder[i]] = uint8(length)
+	}
+
+	var codeLengths huffmanDecoder
+	if err := codeLengths.init(lengths[:19]); err != nil {
+		return err
+	}
+
+	lengths = [286 + 30]uint8{}
+	for i := 0; i < nlit+ndist; {
+		sym, err := f.decodeSymbol(&codeLengths)
+		if err != nil {
+			return err
+		}
+
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+
+		var length uint8
+		var repeat int
+		switch sym {
+		case 16:
+			if i == 0 {
+				return errInvalidDeflate
+			}
+			length = lengths[i-1]
+			repeat, err = f.getBits(2)
+			repeat += 3
+		case 17:
+			repeat, err = f.getBits(3)
+			repeat += 3
+		default:
+			repeat, err = f.getBits(7)
+			repeat += 11
+		}
+		if err != nil {
+			return err
+		} else if i+repeat > nlit+ndist {
+			return errInvalidDeflate
+		}
+
+		for ; repeat > 0; repeat-- {
+			lengths[i] = length
+			i++
+		}
+	}
+
+	if lengths[256] == 0 {
+		return errInvalidDeflate
+	}
+
+	if err := f.lit.init(lengths[:nlit]); err != nil {
+		return err
+	}
+	return f.dist.init(lengths[nlit : nlit+ndist])
+}
+
+// huffmanDecoder decodes the canonical Huffman code with the given lengths,
+// using a lookup table for codes of up to huffmanPrimaryBits bits.
+type huffmanDecoder struct {
+	// Symbol<<4 | length for each code of up to huffmanPrimaryBits bits,
+	// indexed by the (bit-reversed) code and any following bits.
+	primary [1 << huffmanPrimaryBits]uint16
+	// Number of codes of each length, and the symbols ordered by code.
+	count  [huffmanMaxBits + 1]uint16
+	symbol [288]uint16
+}
+
+func (h *huffmanDecoder) init(lengths []uint8) error {
+	h.count = [huffmanMaxBits + 1]uint16{}
+	for _, length := range lengths {
+		h.count[length]++
+	}
+	h.count[0] = 0
+
+	// Reject over-subscribed codes. Incomplete codes are permitted,
+	// and only fail if an unused code is decoded.
+	left := 1
+	for length := 1; length <= huffmanMaxBits; length++ {
+		left = left<<1 - int(h.count[length])
+		if left < 0 {
+			return errInvalidDeflate
+		}
+	}
+
+	var offsets [huffmanMaxBits + 1]uint16
+	for length := 1; length < huffmanMaxBits; length++ {
+		offsets[length+1] = offsets[length] + h.count[length]
+	}
+	for sym, length := range lengths {
+		if length != 0 {
+			h.symbol[offsets[length]] = uint16(sym)
+			offsets[length]++
+		}
+	}
+
+	h.primary = [1 << huffmanPrimaryBits]uint16{}
+	code, index := 0, 0
+	for length := 1; length <= huffmanPrimaryBits; length++ {
+		for n := 0; n < int(h.count[length]); n++ {
+			// Codes are packed starting with their most significant bit.
+			reversed := 0
+			for i := 0; i < length; i++ {
+				reversed |= (code >> i & 1) << (length - 1 - i)
+			}
+
+			entry := h.symbol[index]<<4 | uint16(length)
+			for i := reversed; i < len(h.primary); i += 1 << length {
+				h.primary[i] = entry
+			}
+			code++
+			index++
+		}
+		code <<= 1
+	}
+
+	return nil
+}
+
+var (
+	fixedLit, fixedDist huffmanDecoder
+	fixedOnce           sync.Once
+)
+
+func fixedHuffmanDecoders() (huffmanDecoder, huffmanDecoder) {
+	fixedOnce.Do(func() {
+		var lengths [288]uint8
+		for i := range lengths {
+			switch {
+			case i < 144:
+				lengths[i] = 8
+			case i < 256:
+				lengths[i] = 9
+			case i < 280:
+				lengths[i] = 7
+			default:
+				lengths[i] = 8
+			}
+		}
+		fixedLit.init(lengths[:])
+
+		for i := 0; i < 30; i++ {
+			lengths[i] = 5
+		}
+		fixedDist.init(lengths[:30])
+	})
+
+	return fixedLit, fixedDist
+}
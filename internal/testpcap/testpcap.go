@@ -0,0 +1,48 @@
+// Package testpcap reads the sample pcap dumps in the testdata directory
+// of the repository for the tests of its packages.
+package testpcap
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/xuforr/go-iex"
+	"github.com/xuforr/go-iex/iextp"
+)
+
+// Scan calls f with each message of the given dump in the testdata
+// directory, e.g. "TOPS16.pcapng.gz". The test is skipped in short mode,
+// and fails if the dump cannot be read.
+func Scan(t testing.TB, name string, f func(msg iextp.Message)) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("Skipping pcap test in short mode.")
+	}
+
+	_, file, _, _ := runtime.Caller(0)
+	r, err := os.Open(filepath.Join(filepath.Dir(file), "..", "..", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	packetDataSource, err := iex.NewPcapDataSource(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := iex.NewPcapScanner(packetDataSource)
+
+	for {
+		msg, err := scanner.NextMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		f(msg)
+	}
+}
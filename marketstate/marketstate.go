@@ -0,0 +1,334 @@
+// Package marketstate tracks the phase of the IEX trading session and
+// the trading status of each symbol from the administrative messages of
+// the TOPS, DEEP and DEEP+ feeds.
+package marketstate
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+	"github.com/xuforr/go-iex/iextp/tops"
+)
+
+// Phase is the phase of the trading session,
+// as indicated by the system event messages.
+type Phase uint8
+
+const (
+	// No system event has been received.
+	PhaseUnknown Phase = iota
+	// Messages have started, but IEX is not yet accepting orders.
+	PhaseStartOfMessages
+	// IEX is accepting orders, before regular market hours.
+	PhaseSystemHours
+	// Regular market hours.
+	PhaseRegularMarketHours
+	// IEX is accepting orders, after regular market hours.
+	PhasePostMarket
+	// IEX is closed and no longer accepting orders.
+	PhaseEndOfSystemHours
+	// The last message of the trading session has been sent.
+	PhaseEndOfMessages
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseUnknown:
+		return "Unknown"
+	case PhaseStartOfMessages:
+		return "StartOfMessages"
+	case PhaseSystemHours:
+		return "SystemHours"
+	case PhaseRegularMarketHours:
+		return "RegularMarketHours"
+	case PhasePostMarket:
+		return "PostMarket"
+	case PhaseEndOfSystemHours:
+		return "EndOfSystemHours"
+	case PhaseEndOfMessages:
+		return "EndOfMessages"
+	default:
+		return fmt.Sprintf("Phase(%d)", uint8(p))
+	}
+}
+
+// PhaseOf returns the phase of the trading session that
+// starts with the given system event (e.g. tops.StartOfSystemHours).
+// Returns false if the system event is unknown.
+func PhaseOf(systemEvent uint8) (Phase, bool) {
+	switch systemEvent {
+	case tops.StartOfMessages:
+		return PhaseStartOfMessages, true
+	case tops.StartOfSystemHours:
+		return PhaseSystemHours, true
+	case tops.StartOfRegularMarketHours:
+		return PhaseRegularMarketHours, true
+	case tops.EndOfRegularMarketHours:
+		return PhasePostMarket, true
+	case tops.EndOfSystemHours:
+		return PhaseEndOfSystemHours, true
+	case tops.EndOfMessages:
+		return PhaseEndOfMessages, true
+	default:
+		return PhaseUnknown, false
+	}
+}
+
+// PhaseChange is a transition between phases of the trading session.
+type PhaseChange struct {
+	Phase Phase
+	// The time of the system event that started the phase.
+	Timestamp time.Time
+}
+
+// Status is the state of a single symbol on IEX.
+type Status struct {
+	Symbol string
+	// The trading status (e.g. tops.Trading or tops.TradingHalt),
+	// or 0 if no trading status has been received.
+	TradingStatus uint8
+	// The reason for a halt or order acceptance period, if any
+	// (e.g. tops.HaltNewsPending).
+	Reason string
+	// The operational halt status (e.g. tops.NotOperationallyHalted),
+	// or 0 if no operational halt status has been received.
+	OperationalHaltStatus uint8
+	// Whether a short sale price test restriction (Rule 201)
+	// is in effect, and the detail of the latest change.
+	ShortSalePriceTest       bool
+	ShortSalePriceTestDetail uint8
+	// Whether the opening and closing processes are complete
+	// (DEEP and DEEP+ only).
+	OpeningProcessComplete bool
+	ClosingProcessComplete bool
+	// The time of the last update to the status.
+	Timestamp time.Time
+}
+
+// Halted returns true if trading in the symbol is halted
+// across all US equity markets.
+func (s Status) Halted() bool {
+	return s.TradingStatus == tops.TradingHalt
+}
+
+// Paused returns true if trading in the symbol is paused on IEX.
+func (s Status) Paused() bool {
+	return s.TradingStatus == tops.TradingPaused
+}
+
+// InOrderAcceptancePeriod returns true if the symbol has been released
+// from a halt or pause into an Order Acceptance Period.
+func (s Status) InOrderAcceptancePeriod() bool {
+	return s.TradingStatus == tops.TradingOrderAcceptancePeriod
+}
+
+// OperationallyHalted returns true if the symbol is operationally halted
+// on IEX. Symbols that were absent from the pre-market spin of operational
+// halt status messages are treated as operationally halted.
+func (s Status) OperationallyHalted() bool {
+	return s.OperationalHaltStatus != tops.NotOperationallyHalted
+}
+
+// IsTrading returns true if the symbol is available for trading on IEX.
+func (s Status) IsTrading() bool {
+	return s.TradingStatus == tops.Trading && !s.OperationallyHalted()
+}
+
+// Equal returns true if the two statuses are the same.
+// Timestamps are not compared.
+func (s Status) Equal(other Status) bool {
+	s.Timestamp = other.Timestamp
+	return s == other
+}
+
+// PhaseFunc is called when the phase of the trading session changes.
+type PhaseFunc func(prev, cur PhaseChange)
+
+// TransitionFunc is called when the status of a symbol changes.
+// prev is the zero Status (other than Symbol) if this is
+// the first update for the symbol.
+type TransitionFunc func(prev, cur Status)
+
+// Tracker maintains the phase of the trading session and the status of
+// every symbol, along with their history, so that the state of the
+// market at any earlier time can be queried.
+//
+// A Tracker tracks a single trading session: the status of each symbol
+// is carried over if the messages of a new session are processed.
+type Tracker struct {
+	phases   []PhaseChange
+	statuses map[string][]Status
+
+	onPhaseChange []PhaseFunc
+	onTransition  []TransitionFunc
+}
+
+// NewTracker creates a Tracker with no state.
+func NewTracker() *Tracker {
+	return &Tracker{
+		statuses: make(map[string][]Status),
+	}
+}
+
+// OnPhaseChange registers f to be called each time the phase of the
+// trading session changes. Callbacks are invoked synchronously from
+// Process, in the order they were registered.
+func (t *Tracker) OnPhaseChange(f PhaseFunc) {
+	t.onPhaseChange = append(t.onPhaseChange, f)
+}
+
+// OnTransition registers f to be called each time the status of a
+// symbol changes. Callbacks are invoked synchronously from Process,
+// in the order they were registered.
+func (t *Tracker) OnTransition(f TransitionFunc) {
+	t.onTransition = append(t.onTransition, f)
+}
+
+// Process updates the tracked state with the given message. Messages
+// other than system event, trading status, operational halt status,
+// short sale price test status and security event messages are ignored.
+//
+// Returns true if the phase or the status of a symbol changed.
+func (t *Tracker) Process(msg iextp.Message) bool {
+	switch msg := msg.(type) {
+	case *tops.SystemEventMessage:
+		return t.processSystemEvent(msg)
+	case *tops.TradingStatusMessage:
+		return t.update(msg.Symbol, msg.Timestamp, func(s *Status) {
+			s.TradingStatus = msg.TradingStatus
+			s.Reason = msg.Reason
+		})
+	case *tops.OperationalHaltStatusMessage:
+		return t.update(msg.Symbol, msg.Timestamp, func(s *Status) {
+			s.OperationalHaltStatus = msg.OperationalHaltStatus
+		})
+	case *tops.ShortSalePriceTestStatusMessage:
+		return t.update(msg.Symbol, msg.Timestamp, func(s *Status) {
+			s.ShortSalePriceTest = msg.ShortSalePriceTestStatus
+			s.ShortSalePriceTestDetail = msg.Detail
+		})
+	case *deep.SecurityEventMessage:
+		return t.update(msg.Symbol, msg.Timestamp, func(s *Status) {
+			switch msg.SecurityEvent {
+			case deep.OpeningProcessComplete:
+				s.OpeningProcessComplete = true
+			case deep.ClosingProcessComplete:
+				s.ClosingProcessComplete = true
+			}
+		})
+	default:
+		return false
+	}
+}
+
+func (t *Tracker) processSystemEvent(msg *tops.SystemEventMessage) bool {
+	phase, ok := PhaseOf(msg.SystemEvent)
+	prev := t.currentPhase()
+	if !ok || phase == prev.Phase {
+		return false
+	}
+
+	cur := PhaseChange{Phase: phase, Timestamp: msg.Timestamp}
+	t.phases = append(t.phases, cur)
+	for _, f := range t.onPhaseChange {
+		f(prev, cur)
+	}
+
+	return true
+}
+
+// Apply the given update to the status of symbol.
+func (t *Tracker) update(symbol string, timestamp time.Time, f func(s *Status)) bool {
+	history := t.statuses[symbol]
+	prev := Status{Symbol: symbol}
+	if len(history) > 0 {
+		prev = history[len(history)-1]
+	}
+
+	cur := prev
+	f(&cur)
+	cur.Timestamp = timestamp
+	if len(history) > 0 && prev.Equal(cur) {
+		return false
+	}
+
+	t.statuses[symbol] = append(history, cur)
+	for _, f := range t.onTransition {
+		f(prev, cur)
+	}
+
+	return true
+}
+
+func (t *Tracker) currentPhase() PhaseChange {
+	if len(t.phases) == 0 {
+		return PhaseChange{}
+	}
+
+	return t.phases[len(t.phases)-1]
+}
+
+// Phase returns the current phase of the trading session.
+func (t *Tracker) Phase() Phase {
+	return t.currentPhase().Phase
+}
+
+// PhaseAt returns the phase of the trading session at time ts.
+func (t *Tracker) PhaseAt(ts time.Time) Phase {
+	i := sort.Search(len(t.phases), func(i int) bool {
+		return t.phases[i].Timestamp.After(ts)
+	})
+	if i == 0 {
+		return PhaseUnknown
+	}
+
+	return t.phases[i-1].Phase
+}
+
+// Phases returns the history of phase changes, in order.
+func (t *Tracker) Phases() []PhaseChange {
+	return append([]PhaseChange(nil), t.phases...)
+}
+
+// Status returns the current status of the given symbol.
+// Returns false if no update has been received for the symbol.
+func (t *Tracker) Status(symbol string) (Status, bool) {
+	history := t.statuses[symbol]
+	if len(history) == 0 {
+		return Status{}, false
+	}
+
+	return history[len(history)-1], true
+}
+
+// StatusAt returns the status of the given symbol at time ts.
+// Returns false if no update had been received for the symbol by then.
+func (t *Tracker) StatusAt(symbol string, ts time.Time) (Status, bool) {
+	history := t.statuses[symbol]
+	i := sort.Search(len(history), func(i int) bool {
+		return history[i].Timestamp.After(ts)
+	})
+	if i == 0 {
+		return Status{}, false
+	}
+
+	return history[i-1], true
+}
+
+// History returns the history of the status of the given symbol, in order.
+func (t *Tracker) History(symbol string) []Status {
+	return append([]Status(nil), t.statuses[symbol]...)
+}
+
+// Symbols returns the sorted list of symbols with a status.
+func (t *Tracker) Symbols() []string {
+	symbols := make([]string, 0, len(t.statuses))
+	for symbol := range t.statuses {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
@@ -0,0 +1,277 @@
+package marketstate
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+	"github.com/xuforr/go-iex/iextp/tops"
+	"github.com/xuforr/go-iex/internal/testpcap"
+)
+
+var startTime = time.Date(2017, time.July, 10, 12, 0, 0, 0, time.UTC)
+
+func at(minutes int) time.Time {
+	return startTime.Add(time.Duration(minutes) * time.Minute)
+}
+
+func systemEvent(event uint8, minutes int) *tops.SystemEventMessage {
+	return &tops.SystemEventMessage{
+		MessageType: tops.SystemEvent,
+		SystemEvent: event,
+		Timestamp:   at(minutes),
+	}
+}
+
+func TestTracker_Phases(t *testing.T) {
+	tracker := NewTracker()
+	var changes [][2]PhaseChange
+	tracker.OnPhaseChange(func(prev, cur PhaseChange) {
+		changes = append(changes, [2]PhaseChange{prev, cur})
+	})
+
+	if phase := tracker.Phase(); phase != PhaseUnknown {
+		t.Fatalf("expected unknown phase, got: %v", phase)
+	}
+
+	for i, event := range []uint8{tops.StartOfMessages, tops.StartOfSystemHours,
+		tops.StartOfRegularMarketHours, tops.EndOfRegularMarketHours,
+		tops.EndOfSystemHours, tops.EndOfMessages} {
+		if !tracker.Process(systemEvent(event, 60*i)) {
+			t.Fatalf("system event %#x should change the phase", event)
+		}
+	}
+
+	// A repeated or unknown system event is not a change.
+	if tracker.Process(systemEvent(tops.EndOfMessages, 301)) {
+		t.Fatal("repeated system event should not be a change")
+	}
+	if tracker.Process(systemEvent(0x5a, 302)) {
+		t.Fatal("unknown system event should not be a change")
+	}
+
+	if len(changes) != 6 || changes[0][0] != (PhaseChange{}) {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+	if expected := (PhaseChange{PhaseRegularMarketHours, at(120)}); changes[2][1] != expected {
+		t.Fatalf("unexpected change: %v, expected: %v", changes[2][1], expected)
+	}
+
+	for _, tc := range []struct {
+		minutes  int
+		expected Phase
+	}{
+		{-1, PhaseUnknown},
+		{0, PhaseStartOfMessages},
+		{90, PhaseSystemHours},
+		{120, PhaseRegularMarketHours},
+		{239, PhasePostMarket},
+		{240, PhaseEndOfSystemHours},
+		{1000, PhaseEndOfMessages},
+	} {
+		if phase := tracker.PhaseAt(at(tc.minutes)); phase != tc.expected {
+			t.Errorf("phase at %v minutes: %v, expected: %v", tc.minutes, phase, tc.expected)
+		}
+	}
+
+	if phase := tracker.Phase(); phase != PhaseEndOfMessages {
+		t.Fatalf("unexpected phase: %v", phase)
+	}
+}
+
+func TestTracker_Status(t *testing.T) {
+	tracker := NewTracker()
+	var transitions [][2]Status
+	tracker.OnTransition(func(prev, cur Status) {
+		transitions = append(transitions, [2]Status{prev, cur})
+	})
+
+	// The pre-market spin.
+	messages := []iextp.Message{
+		&tops.TradingStatusMessage{
+			MessageType:   tops.TradingStatus,
+			TradingStatus: tops.Trading,
+			Timestamp:     at(0),
+			Symbol:        "ZIEXT",
+		},
+		&tops.OperationalHaltStatusMessage{
+			MessageType:           tops.OperationalHaltStatus,
+			OperationalHaltStatus: tops.NotOperationallyHalted,
+			Timestamp:             at(0),
+			Symbol:                "ZIEXT",
+		},
+		&tops.ShortSalePriceTestStatusMessage{
+			MessageType: tops.ShortSalePriceTestStatus,
+			Timestamp:   at(0),
+			Symbol:      "ZIEXT",
+			Detail:      tops.NoPriceTest,
+		},
+		&deep.SecurityEventMessage{
+			MessageType:   deep.SecurityEvent,
+			SecurityEvent: deep.OpeningProcessComplete,
+			Timestamp:     at(150),
+			Symbol:        "ZIEXT",
+		},
+		// A halt, released into an Order Acceptance Period and then trading.
+		&tops.TradingStatusMessage{
+			MessageType:   tops.TradingStatus,
+			TradingStatus: tops.TradingHalt,
+			Timestamp:     at(180),
+			Symbol:        "ZIEXT",
+			Reason:        tops.HaltNewsPending,
+		},
+		&tops.TradingStatusMessage{
+			MessageType:   tops.TradingStatus,
+			TradingStatus: tops.TradingOrderAcceptancePeriod,
+			Timestamp:     at(190),
+			Symbol:        "ZIEXT",
+			Reason:        tops.HaltNewsDisseminations,
+		},
+		&tops.TradingStatusMessage{
+			MessageType:   tops.TradingStatus,
+			TradingStatus: tops.Trading,
+			Timestamp:     at(195),
+			Symbol:        "ZIEXT",
+		},
+		&tops.ShortSalePriceTestStatusMessage{
+			MessageType:              tops.ShortSalePriceTestStatus,
+			ShortSalePriceTestStatus: true,
+			Timestamp:                at(200),
+			Symbol:                   "ZIEXT",
+			Detail:                   tops.ShortSalePriceTestActivated,
+		},
+		&tops.OperationalHaltStatusMessage{
+			MessageType:           tops.OperationalHaltStatus,
+			OperationalHaltStatus: tops.IEXSpecificOperationalHalt,
+			Timestamp:             at(210),
+			Symbol:                "ZIEXT",
+		},
+	}
+	for _, msg := range messages {
+		if !tracker.Process(msg) {
+			t.Fatalf("expected status change from %+v", msg)
+		}
+	}
+
+	// Repeated statuses and other messages are not changes.
+	repeat := *messages[len(messages)-1].(*tops.OperationalHaltStatusMessage)
+	repeat.Timestamp = at(220)
+	if tracker.Process(&repeat) {
+		t.Fatal("repeated status should not be a change")
+	}
+	if tracker.Process(&tops.TradeReportMessage{Symbol: "ZIEXT"}) {
+		t.Fatal("trade reports should be ignored")
+	}
+
+	if len(transitions) != len(messages) {
+		t.Fatalf("expected %v transitions, got: %v", len(messages), len(transitions))
+	}
+	if transitions[0][0] != (Status{Symbol: "ZIEXT"}) {
+		t.Fatalf("first transition should be from the zero status, got: %+v", transitions[0][0])
+	}
+
+	for _, tc := range []struct {
+		minutes                                   int
+		trading, halted, oap, opHalted, ssr, open bool
+	}{
+		{0, true, false, false, false, false, false},
+		{150, true, false, false, false, false, true},
+		{185, false, true, false, false, false, true},
+		{190, false, false, true, false, false, true},
+		{199, true, false, false, false, false, true},
+		{205, true, false, false, false, true, true},
+		{300, false, false, false, true, true, true},
+	} {
+		s, ok := tracker.StatusAt("ZIEXT", at(tc.minutes))
+		if !ok {
+			t.Fatalf("expected status at %v minutes", tc.minutes)
+		}
+
+		if s.IsTrading() != tc.trading || s.Halted() != tc.halted ||
+			s.InOrderAcceptancePeriod() != tc.oap || s.OperationallyHalted() != tc.opHalted ||
+			s.ShortSalePriceTest != tc.ssr || s.OpeningProcessComplete != tc.open {
+			t.Errorf("unexpected status at %v minutes: %+v", tc.minutes, s)
+		}
+	}
+
+	if s, _ := tracker.StatusAt("ZIEXT", at(185)); s.Reason != tops.HaltNewsPending {
+		t.Fatalf("unexpected halt reason: %q", s.Reason)
+	}
+	if _, ok := tracker.StatusAt("ZIEXT", at(-1)); ok {
+		t.Fatal("should not have a status before the first update")
+	}
+	if _, ok := tracker.Status("SPY"); ok {
+		t.Fatal("should not have a status for SPY")
+	}
+
+	if s, _ := tracker.Status("ZIEXT"); s != transitions[len(transitions)-1][1] {
+		t.Fatalf("unexpected current status: %+v", s)
+	}
+	if history := tracker.History("ZIEXT"); len(history) != len(messages) {
+		t.Fatalf("expected %v statuses in history, got: %v", len(messages), len(history))
+	}
+	if symbols := tracker.Symbols(); !reflect.DeepEqual(symbols, []string{"ZIEXT"}) {
+		t.Fatalf("unexpected symbols: %v", symbols)
+	}
+}
+
+func TestStatus_NotInSpin(t *testing.T) {
+	// A symbol without an operational halt status is treated as halted.
+	s := Status{Symbol: "ZIEXT", TradingStatus: tops.Trading}
+	if !s.OperationallyHalted() || s.IsTrading() {
+		t.Fatalf("symbol absent from spin should be operationally halted: %+v", s)
+	}
+}
+
+func TestTracker_TOPS16(t *testing.T) {
+	tracker := NewTracker()
+	nTransitions := 0
+	tracker.OnTransition(func(prev, cur Status) {
+		nTransitions++
+		if cur.Timestamp.Before(prev.Timestamp) {
+			t.Fatalf("%v: status went back in time: %+v -> %+v", cur.Symbol, prev, cur)
+		}
+	})
+
+	testpcap.Scan(t, "TOPS16.pcapng.gz", func(msg iextp.Message) {
+		tracker.Process(msg)
+	})
+
+	var phases []Phase
+	for _, change := range tracker.Phases() {
+		phases = append(phases, change.Phase)
+	}
+	expected := []Phase{PhaseStartOfMessages, PhaseSystemHours, PhaseRegularMarketHours,
+		PhasePostMarket, PhaseEndOfSystemHours, PhaseEndOfMessages}
+	if !reflect.DeepEqual(phases, expected) {
+		t.Fatalf("unexpected phases: %v", phases)
+	}
+
+	if nTransitions != 23406 {
+		t.Fatalf("expected 23406 transitions, got %v", nTransitions)
+	}
+
+	nTrading, nHalted, nRestricted := 0, 0, 0
+	for _, symbol := range tracker.Symbols() {
+		s, _ := tracker.Status(symbol)
+		if s.IsTrading() {
+			nTrading++
+		}
+		if s.Halted() || s.Paused() {
+			nHalted++
+		}
+		if s.ShortSalePriceTest {
+			nRestricted++
+		}
+	}
+
+	if nSymbols := len(tracker.Symbols()); nSymbols != 7799 {
+		t.Fatalf("expected statuses for 7799 symbols, got %v", nSymbols)
+	}
+	if nTrading != 7797 || nHalted != 2 || nRestricted != 2 {
+		t.Fatalf("unexpected statuses: %v trading, %v halted, %v restricted",
+			nTrading, nHalted, nRestricted)
+	}
+}
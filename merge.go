@@ -0,0 +1,149 @@
+package iex
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+	"github.com/xuforr/go-iex/iextp/deepplus"
+	"github.com/xuforr/go-iex/iextp/tops"
+)
+
+// FeedName returns the name of the feed with the given IEX-TP message
+// protocol ID, e.g. "TOPS" or "DEEP". The names of unknown protocols
+// are their hexadecimal ID.
+func FeedName(messageProtocolID uint16) string {
+	switch messageProtocolID {
+	case tops.V_1_5_MessageProtocolID, tops.V_1_6_MessageProtocolID:
+		return tops.FeedName
+	case deep.V_1_0_MessageProtocolID:
+		return deep.FeedName
+	case deepplus.V_1_0_MessageProtocolID:
+		return deepplus.FeedName
+	default:
+		return fmt.Sprintf("%#04x", messageProtocolID)
+	}
+}
+
+// MergedMessage is a message returned by a MergeScanner,
+// tagged with the feed and the source that it came from.
+type MergedMessage struct {
+	Message iextp.Message
+	// Name of the feed of the message (see FeedName).
+	Feed string
+	// Index of the packet source of the message,
+	// in the order passed to NewMergeScanner.
+	Source int
+	// The header of the segment containing the message,
+	// and the capture metadata of its packet.
+	SegmentHeader  iextp.SegmentHeader
+	PacketMetadata PacketMetadata
+}
+
+// MergeScanner merges the messages from multiple packet sources, such as
+// the pcap dumps of a day that was split across files, or the TOPS and
+// DEEP dumps of the same day, into a single stream ordered by send time.
+//
+// Each source is read by its own PcapScanner, which may be configured
+// (e.g. with segment filters) before the first call to NextMessage.
+// Messages with the same send time are returned in the order of their
+// sources, and the messages of each source are returned in their
+// original order.
+type MergeScanner struct {
+	scanners []*PcapScanner
+	heads    mergeHeap
+	// Sources from which the next message must be read
+	// before the next message can be returned.
+	unread []int
+}
+
+// NewMergeScanner creates a MergeScanner that merges messages from the
+// given packet sources. Segments are decoded with iextp.DefaultDecoder.
+func NewMergeScanner(sources ...PacketDataSource) *MergeScanner {
+	ms := &MergeScanner{}
+	for i, source := range sources {
+		ms.scanners = append(ms.scanners, NewPcapScanner(source))
+		ms.unread = append(ms.unread, i)
+	}
+	return ms
+}
+
+// Scanner returns the PcapScanner that reads the i'th packet source.
+func (ms *MergeScanner) Scanner(i int) *PcapScanner {
+	return ms.scanners[i]
+}
+
+// NextMessage returns the message with the earliest send time of the
+// next messages of each source. Returns io.EOF once all of the sources
+// have returned io.EOF.
+//
+// If a source returns any other error, NextMessage returns the error and
+// stops reading that source; subsequent calls continue to merge the
+// messages of the remaining sources.
+func (ms *MergeScanner) NextMessage() (MergedMessage, error) {
+	for len(ms.unread) != 0 {
+		i := ms.unread[len(ms.unread)-1]
+		ms.unread = ms.unread[:len(ms.unread)-1]
+		if err := ms.read(i); err != nil && err != io.EOF {
+			return MergedMessage{}, err
+		}
+	}
+
+	if len(ms.heads) == 0 {
+		return MergedMessage{}, io.EOF
+	}
+
+	msg := heap.Pop(&ms.heads).(MergedMessage)
+	ms.unread = append(ms.unread, msg.Source)
+	return msg, nil
+}
+
+// Read the next message of the i'th source.
+func (ms *MergeScanner) read(i int) error {
+	scanner := ms.scanners[i]
+	msg, err := scanner.NextMessage()
+	if err != nil {
+		return err
+	}
+
+	header := scanner.SegmentHeader()
+	heap.Push(&ms.heads, MergedMessage{
+		Message:        msg,
+		Feed:           FeedName(header.MessageProtocolID),
+		Source:         i,
+		SegmentHeader:  header,
+		PacketMetadata: scanner.PacketMetadata(),
+	})
+	return nil
+}
+
+// mergeHeap implements heap.Interface, ordering the next message
+// of each source by send time and then by source.
+type mergeHeap []MergedMessage
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	ti, tj := h[i].SegmentHeader.SendTime, h[j].SegmentHeader.SendTime
+	if !ti.Equal(tj) {
+		return ti.Before(tj)
+	}
+	return h[i].Source < h[j].Source
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) {
+	*h = append(*h, x.(MergedMessage))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	msg := old[n-1]
+	old[n-1] = MergedMessage{}
+	*h = old[:n-1]
+	return msg
+}
@@ -0,0 +1,205 @@
+package iex
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+	"github.com/xuforr/go-iex/iextp/tops"
+)
+
+// Create a TOPS segment with a single trade report, sent at
+// the given number of milliseconds after testSendTime.
+func makeTOPSSegmentAt(t *testing.T, ms int, seq int64, tradeID int64) []byte {
+	sendTime := testSendTime.Add(time.Duration(ms) * time.Millisecond)
+	segment := iextp.Segment{
+		Header: iextp.SegmentHeader{
+			Version:                    1,
+			MessageProtocolID:          tops.V_1_6_MessageProtocolID,
+			ChannelID:                  tops.ChannelID,
+			SessionID:                  testSessionID,
+			FirstMessageSequenceNumber: seq,
+			SendTime:                   sendTime,
+		},
+		Messages: []iextp.Message{
+			&tops.TradeReportMessage{
+				MessageType: tops.TradeReport,
+				Timestamp:   sendTime,
+				Symbol:      "ZIEXT",
+				Size:        100,
+				Price:       99.05,
+				TradeID:     tradeID,
+			},
+		},
+	}
+
+	buf, err := segment.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+type mergedTrade struct {
+	Feed    string
+	Source  int
+	TradeID int64
+}
+
+func mergeTrades(t *testing.T, ms *MergeScanner) []mergedTrade {
+	var result []mergedTrade
+	for {
+		msg, err := ms.NextMessage()
+		if err == io.EOF {
+			return result
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		// DEEP and TOPS share the same trade report message.
+		trade := msg.Message.(*tops.TradeReportMessage)
+		result = append(result, mergedTrade{msg.Feed, msg.Source, trade.TradeID})
+	}
+}
+
+func TestMergeScanner(t *testing.T) {
+	// A day of DEEP split across two sources, sent at 1-4ms and 5-6ms.
+	deep1 := &payloadSource{[][]byte{
+		makeTestSegment(t, 1, 2),
+		makeTestSegment(t, 3, 2),
+	}}
+	deep2 := &payloadSource{[][]byte{
+		makeTestSegment(t, 5, 2),
+	}}
+	topsSource := &payloadSource{[][]byte{
+		makeTOPSSegmentAt(t, 0, 1, 100),
+		makeTOPSSegmentAt(t, 3, 2, 101),
+		makeTOPSSegmentAt(t, 10, 3, 102),
+	}}
+
+	ms := NewMergeScanner(deep1, deep2, topsSource)
+	trades := mergeTrades(t, ms)
+	expected := []mergedTrade{
+		{"TOPS", 2, 100},
+		{"DEEP", 0, 1},
+		{"DEEP", 0, 2},
+		{"DEEP", 0, 3}, // Sent at the same time as TOPS 101.
+		{"DEEP", 0, 4},
+		{"TOPS", 2, 101},
+		{"DEEP", 1, 5},
+		{"DEEP", 1, 6},
+		{"TOPS", 2, 102},
+	}
+
+	if !reflect.DeepEqual(trades, expected) {
+		t.Fatalf("merged %v, expected: %v", trades, expected)
+	}
+
+	if _, err := ms.NextMessage(); err != io.EOF {
+		t.Fatalf("expected EOF, got: %v", err)
+	}
+}
+
+// errorSource returns the given payloads, and then err.
+type errorSource struct {
+	payloadSource
+	err error
+}
+
+func (es *errorSource) NextPayload() ([]byte, error) {
+	if len(es.payloads) == 0 {
+		return nil, es.err
+	}
+	return es.payloadSource.NextPayload()
+}
+
+func TestMergeScanner_Error(t *testing.T) {
+	errTest := errors.New("test error")
+	failing := &errorSource{
+		payloadSource{[][]byte{makeTOPSSegmentAt(t, 0, 1, 100)}},
+		errTest,
+	}
+	deepSource := &payloadSource{[][]byte{
+		makeTestSegment(t, 1, 2),
+	}}
+
+	ms := NewMergeScanner(failing, deepSource)
+	if msg, err := ms.NextMessage(); err != nil || msg.Feed != "TOPS" {
+		t.Fatalf("expected TOPS message, got: %+v, %v", msg, err)
+	}
+
+	if _, err := ms.NextMessage(); err != errTest {
+		t.Fatalf("expected error, got: %v", err)
+	}
+
+	// The remaining source continues to be read.
+	trades := mergeTrades(t, ms)
+	if expected := []mergedTrade{{"DEEP", 1, 1}, {"DEEP", 1, 2}}; !reflect.DeepEqual(trades, expected) {
+		t.Fatalf("merged %v, expected: %v", trades, expected)
+	}
+}
+
+func TestFeedName(t *testing.T) {
+	for id, expected := range map[uint16]string{
+		tops.V_1_5_MessageProtocolID: "TOPS",
+		tops.V_1_6_MessageProtocolID: "TOPS",
+		deep.V_1_0_MessageProtocolID: "DEEP",
+		0x8005:                       "DEEP+",
+		0x1234:                       "0x1234",
+	} {
+		if name := FeedName(id); name != expected {
+			t.Errorf("FeedName(%#x) = %v, expected: %v", id, name, expected)
+		}
+	}
+}
+
+func TestMergeScanner_Pcaps(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping pcap test in short mode.")
+	}
+
+	var sources []PacketDataSource
+	for _, filename := range []string{"DEEP10.pcap.gz", "TOPS16.pcapng.gz"} {
+		f, err := os.Open(filepath.Join("testdata", filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		source, err := NewPcapDataSource(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, source)
+	}
+
+	ms := NewMergeScanner(sources...)
+	counts := make(map[string]int)
+	var last time.Time
+	for {
+		msg, err := ms.NextMessage()
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			continue // DEEP10.pcap.gz is truncated.
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.SegmentHeader.SendTime.Before(last) {
+			t.Fatalf("message sent at %v returned after %v", msg.SegmentHeader.SendTime, last)
+		}
+		last = msg.SegmentHeader.SendTime
+		counts[msg.Feed]++
+	}
+
+	if expected := map[string]int{"DEEP": 391999, "TOPS": 57674}; !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("merged %v messages, expected: %v", counts, expected)
+	}
+}
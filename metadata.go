@@ -0,0 +1,97 @@
+package iex
+
+import (
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PacketMetadata describes how a packet payload was captured.
+type PacketMetadata struct {
+	// Time at which the packet was captured (for pcap dumps)
+	// or received (for live connections).
+	Timestamp time.Time
+	// Source and destination addresses of the packet, if known.
+	Src *net.UDPAddr
+	Dst *net.UDPAddr
+}
+
+// MetadataDataSource is a PacketDataSource that can also provide
+// the capture metadata of each payload.
+type MetadataDataSource interface {
+	PacketDataSource
+
+	// NextPayloadWithMetadata returns the next decoded packet payload,
+	// along with its capture metadata.
+	//
+	// NOTE: The underlying byte array may be reused in
+	// subsequent calls to NextPayload or NextPayloadWithMetadata.
+	NextPayloadWithMetadata() ([]byte, PacketMetadata, error)
+}
+
+// NextPayloadWithMetadata implements MetadataDataSource.
+func (gds *GopacketDataSource) NextPayloadWithMetadata() ([]byte, PacketMetadata, error) {
+	for {
+		packet, err := gds.packetSource.NextPacket()
+		if err != nil {
+			return nil, PacketMetadata{}, err
+		}
+
+		if payload, metadata, ok := gds.datagrams.datagram(packet); ok {
+			return payload, metadata, nil
+		}
+	}
+}
+
+// NextPayloadWithMetadata implements MetadataDataSource.
+// The Timestamp is the time at which the payload was read.
+func (pcds *PacketConnDataSource) NextPayloadWithMetadata() ([]byte, PacketMetadata, error) {
+	n, addr, err := pcds.conn.ReadFrom(pcds.buf)
+	metadata := PacketMetadata{Timestamp: time.Now()}
+	metadata.Src, _ = addr.(*net.UDPAddr)
+	metadata.Dst, _ = pcds.conn.LocalAddr().(*net.UDPAddr)
+	return pcds.buf[:n], metadata, err
+}
+
+// NextPayloadWithMetadata implements MetadataDataSource.
+// The Timestamp is the time at which the payload was read,
+// and Dst is the address of the multicast group.
+func (mds *MulticastDataSource) NextPayloadWithMetadata() ([]byte, PacketMetadata, error) {
+	n, oobn, _, src, err := mds.conn.ReadMsgUDP(mds.buf, mds.oob)
+	metadata := PacketMetadata{Timestamp: time.Now()}
+	if err != nil {
+		return nil, metadata, err
+	}
+
+	metadata.Src = src
+	metadata.Dst, _ = mds.conn.LocalAddr().(*net.UDPAddr)
+	mds.updateDrops(mds.oob[:oobn])
+	return mds.buf[:n], metadata, nil
+}
+
+func packetMetadataOf(packet gopacket.Packet) PacketMetadata {
+	metadata := PacketMetadata{
+		Timestamp: packet.Metadata().Timestamp,
+	}
+
+	var srcIP, dstIP net.IP
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		srcIP, dstIP = ip.SrcIP, ip.DstIP
+	case *layers.IPv6:
+		srcIP, dstIP = ip.SrcIP, ip.DstIP
+	default:
+		return metadata
+	}
+
+	var srcPort, dstPort int
+	if udp, ok := packet.TransportLayer().(*layers.UDP); ok {
+		srcPort, dstPort = int(udp.SrcPort), int(udp.DstPort)
+	}
+
+	metadata.Src = &net.UDPAddr{IP: srcIP, Port: srcPort}
+	metadata.Dst = &net.UDPAddr{IP: dstIP, Port: dstPort}
+	return metadata
+}
@@ -0,0 +1,168 @@
+package iex
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp/deep"
+)
+
+func TestPcapScanner_Metadata(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewPcapWriter(&buf, FormatPcap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Segments with 2 messages each, captured 1us after they were sent.
+	captureTime := func(firstSeq int64) time.Time {
+		return testSendTime.Add(time.Duration(firstSeq)*time.Millisecond + time.Microsecond)
+	}
+	for _, firstSeq := range []int64{1, 3, 5} {
+		payload := makeTestSegment(t, firstSeq, 2)
+		if err := w.WriteDatagram(captureTime(firstSeq), testSrcAddr, testDstAddr, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	packetDataSource, err := NewPcapDataSource(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := NewPcapScanner(packetDataSource)
+	for seq := int64(1); seq <= 6; seq++ {
+		msg, err := scanner.NextMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tradeID := msg.(*deep.TradeReportMessage).TradeID; tradeID != seq {
+			t.Fatalf("scanned trade %v, expected %v", tradeID, seq)
+		}
+
+		firstSeq := seq - (seq-1)%2
+		header := scanner.SegmentHeader()
+		if header.FirstMessageSequenceNumber != firstSeq || header.MessageCount != 2 {
+			t.Fatalf("message %v: unexpected segment header: %+v", seq, header)
+		}
+
+		metadata := scanner.PacketMetadata()
+		if !metadata.Timestamp.Equal(captureTime(firstSeq)) {
+			t.Fatalf("message %v: capture time %v, expected %v",
+				seq, metadata.Timestamp, captureTime(firstSeq))
+		}
+		if latency := metadata.Timestamp.Sub(header.SendTime); latency != time.Microsecond {
+			t.Fatalf("message %v: unexpected latency %v", seq, latency)
+		}
+		if metadata.Src.String() != testSrcAddr.String() || metadata.Dst.String() != testDstAddr.String() {
+			t.Fatalf("message %v: unexpected addresses %v -> %v", seq, metadata.Src, metadata.Dst)
+		}
+	}
+
+	if _, err := scanner.NextMessage(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestPcapScanner_RecoveredSegmentHeader(t *testing.T) {
+	source := &payloadSource{[][]byte{
+		makeTestSegment(t, 1, 1),
+		makeTestSegment(t, 5, 1), // Missing 2-4
+	}}
+
+	scanner := NewPcapScanner(source)
+	scanner.SetGapRecoverer(&testRecoverer{
+		payloads: [][]byte{
+			makeTestSegment(t, 2, 1),
+			makeTestSegment(t, 3, 2),
+		},
+	})
+
+	expectedFirstSeqs := []int64{1, 2, 3, 3, 5}
+	for i, expected := range expectedFirstSeqs {
+		if _, err := scanner.NextMessage(); err != nil {
+			t.Fatal(err)
+		}
+
+		if firstSeq := scanner.SegmentHeader().FirstMessageSequenceNumber; firstSeq != expected {
+			t.Fatalf("message %v: segment starts at %v, expected %v", i, firstSeq, expected)
+		}
+	}
+}
+
+func TestPacketConnDataSource_Metadata(t *testing.T) {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+
+	conn, err := net.Dial("udp", packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(makeTestSegment(t, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	scanner := NewPcapScanner(NewPacketConnDataSource(packetConn))
+	if _, err := scanner.NextMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := scanner.PacketMetadata()
+	if metadata.Timestamp.Before(start) {
+		t.Fatalf("receive time %v should be after %v", metadata.Timestamp, start)
+	}
+	if metadata.Src.String() != conn.LocalAddr().String() {
+		t.Fatalf("source address %v, expected %v", metadata.Src, conn.LocalAddr())
+	}
+	if metadata.Dst.String() != packetConn.LocalAddr().String() {
+		t.Fatalf("destination address %v, expected %v", metadata.Dst, packetConn.LocalAddr())
+	}
+}
+
+func TestPcapNgScanner_Metadata(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping pcap-ng test in short mode.")
+	}
+
+	f, err := os.Open(filepath.Join("testdata", "TOPS16.pcapng.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	packetDataSource, err := NewPcapDataSource(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := NewPcapScanner(packetDataSource)
+	for {
+		_, err := scanner.NextMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		metadata := scanner.PacketMetadata()
+		if metadata.Timestamp.IsZero() || metadata.Dst == nil || !metadata.Dst.IP.IsMulticast() {
+			t.Fatalf("unexpected metadata: %+v", metadata)
+		}
+
+		// Packets cannot be captured before they are sent.
+		if sendTime := scanner.SegmentHeader().SendTime; metadata.Timestamp.Before(sendTime) {
+			t.Fatalf("packet captured at %v, before it was sent at %v", metadata.Timestamp, sendTime)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package iex
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// MulticastDataSource implements PacketDataSource for live IEX-TP feeds
+// received by joining a UDP multicast group.
+type MulticastDataSource struct {
+	conn *net.UDPConn
+	buf  []byte
+	oob  []byte
+
+	// Whether the kernel reports the number of dropped datagrams.
+	dropsSupported bool
+	drops          atomic.Uint64
+}
+
+// NewMulticastDataSource joins the multicast group at the given address
+// (e.g. "233.215.21.4:10378") on the named network interface, and
+// returns a PacketDataSource for the datagrams sent to the group.
+// If ifaceName is empty, the system default interface is used.
+//
+// Where the platform supports it (currently Linux), the number of
+// datagrams dropped by the kernel because the receive buffer was full
+// is reported by Drops.
+func NewMulticastDataSource(ifaceName, groupAddr string) (*MulticastDataSource, error) {
+	addr, err := net.ResolveUDPAddr("udp", groupAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !addr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%v is not a multicast address", addr.IP)
+	}
+
+	var iface *net.Interface
+	if ifaceName != "" {
+		if iface, err = net.InterfaceByName(ifaceName); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.ListenMulticastUDP("udp", iface, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mds := &MulticastDataSource{
+		conn: conn,
+		buf:  make([]byte, maxDatagramSize),
+	}
+
+	if err := enableDropCounter(conn); err == nil {
+		mds.dropsSupported = true
+		mds.oob = make([]byte, dropCounterOOBSize)
+	}
+
+	return mds, nil
+}
+
+// SetReadBuffer sets the size of the socket's receive buffer, in bytes.
+// A larger buffer reduces the number of datagrams dropped when the
+// consumer falls behind during bursts of activity.
+//
+// The operating system may limit the size of the buffer (e.g. by
+// net.core.rmem_max on Linux). Where possible, the limit is bypassed
+// if the process has sufficient privileges. On Linux, ReadBuffer
+// returns the size that was actually set.
+func (mds *MulticastDataSource) SetReadBuffer(bytes int) error {
+	return setReadBuffer(mds.conn, bytes)
+}
+
+// ReadBuffer returns the size of the socket's receive buffer, in bytes,
+// as reported by the operating system. It is only supported on Linux;
+// on other platforms, an error is returned.
+func (mds *MulticastDataSource) ReadBuffer() (int, error) {
+	return readBuffer(mds.conn)
+}
+
+// Drops returns the number of datagrams dropped by the kernel since the
+// group was joined, as of the most recently received datagram.
+// ok is false if the platform does not report dropped datagrams.
+//
+// NOTE: Datagrams lost elsewhere in the network are not included,
+// but are detected as gaps by the PcapScanner.
+func (mds *MulticastDataSource) Drops() (n uint64, ok bool) {
+	return mds.drops.Load(), mds.dropsSupported
+}
+
+// LocalAddr returns the address of the joined multicast group.
+func (mds *MulticastDataSource) LocalAddr() net.Addr {
+	return mds.conn.LocalAddr()
+}
+
+// NextPayload implements PacketDataSource.
+func (mds *MulticastDataSource) NextPayload() ([]byte, error) {
+	n, oobn, _, _, err := mds.conn.ReadMsgUDP(mds.buf, mds.oob)
+	if err != nil {
+		return nil, err
+	}
+
+	mds.updateDrops(mds.oob[:oobn])
+	return mds.buf[:n], nil
+}
+
+// Update the drop counter from the control messages received
+// with a datagram.
+func (mds *MulticastDataSource) updateDrops(oob []byte) {
+	if len(oob) == 0 {
+		return
+	}
+
+	if drops, ok := parseDropCounter(oob); ok {
+		mds.drops.Store(uint64(drops))
+	}
+}
+
+// Close leaves the multicast group and closes the underlying socket.
+// Any blocked call to NextPayload returns an error.
+func (mds *MulticastDataSource) Close() error {
+	return mds.conn.Close()
+}
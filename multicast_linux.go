@@ -0,0 +1,89 @@
+//go:build linux
+
+package iex
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// Size of the control message buffer needed to receive SO_RXQ_OVFL.
+var dropCounterOOBSize = unix.CmsgSpace(4)
+
+// Enable the SO_RXQ_OVFL socket option, so that each datagram is
+// received with the number of datagrams dropped by the socket so far.
+func enableDropCounter(conn *net.UDPConn) error {
+	return setsockoptInt(conn, unix.SO_RXQ_OVFL, 1)
+}
+
+// Returns the value of the SO_RXQ_OVFL control message, if present.
+// The kernel omits it until the first datagram is dropped.
+func parseDropCounter(oob []byte) (uint32, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+
+	for _, msg := range msgs {
+		if msg.Header.Level == unix.SOL_SOCKET &&
+			msg.Header.Type == unix.SO_RXQ_OVFL && len(msg.Data) >= 4 {
+			return binary.NativeEndian.Uint32(msg.Data), true
+		}
+	}
+
+	return 0, false
+}
+
+// Set the receive buffer size with SO_RCVBUFFORCE, which ignores the
+// net.core.rmem_max limit but requires CAP_NET_ADMIN, and fall back to
+// SO_RCVBUF otherwise.
+func setReadBuffer(conn *net.UDPConn, bytes int) error {
+	if err := setsockoptInt(conn, unix.SO_RCVBUFFORCE, bytes); err == nil {
+		return nil
+	}
+
+	return conn.SetReadBuffer(bytes)
+}
+
+// Returns the receive buffer size. The kernel doubles the requested
+// size to allow for bookkeeping overhead, so the value returned here
+// is halved to match the size passed to setReadBuffer.
+func readBuffer(conn *net.UDPConn) (int, error) {
+	bytes, err := getsockoptInt(conn, unix.SO_RCVBUF)
+	return bytes / 2, err
+}
+
+func setsockoptInt(conn *net.UDPConn, opt, value int) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, opt, value)
+	}); err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+func getsockoptInt(conn *net.UDPConn, opt int) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var value int
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		value, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, opt)
+	}); err != nil {
+		return 0, err
+	}
+
+	return value, sockErr
+}
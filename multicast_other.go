@@ -0,0 +1,26 @@
+//go:build !linux
+
+package iex
+
+import (
+	"errors"
+	"net"
+)
+
+const dropCounterOOBSize = 0
+
+func enableDropCounter(conn *net.UDPConn) error {
+	return errors.New("dropped datagrams are not reported on this platform")
+}
+
+func parseDropCounter(oob []byte) (uint32, bool) {
+	return 0, false
+}
+
+func setReadBuffer(conn *net.UDPConn, bytes int) error {
+	return conn.SetReadBuffer(bytes)
+}
+
+func readBuffer(conn *net.UDPConn) (int, error) {
+	return 0, errors.New("the receive buffer size is not available on this platform")
+}
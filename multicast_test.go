@@ -0,0 +1,175 @@
+package iex
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+
+	"github.com/xuforr/go-iex/iextp/deep"
+)
+
+const testMulticastGroup = "239.255.84.21:10378"
+
+func TestNewMulticastDataSource_NotMulticast(t *testing.T) {
+	if _, err := NewMulticastDataSource("", "127.0.0.1:10378"); err == nil {
+		t.Fatal("expected error for unicast address")
+	}
+}
+
+// Find a loopback interface that supports multicast,
+// or skip the test if there is none.
+func multicastLoopback(t *testing.T) *net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 &&
+			iface.Flags&net.FlagMulticast != 0 {
+			return &iface
+		}
+	}
+
+	t.Skip("No multicast loopback interface available.")
+	return nil
+}
+
+// Dial the given multicast group on the given interface.
+func dialMulticast(t *testing.T, iface *net.Interface, group string) net.Conn {
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Skipf("Cannot send to multicast group: %v", err)
+	}
+
+	pc := ipv4.NewPacketConn(conn)
+	if err := pc.SetMulticastInterface(iface); err != nil {
+		conn.Close()
+		t.Skipf("Cannot send to multicast group: %v", err)
+	}
+	if err := pc.SetMulticastLoopback(true); err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func TestMulticastDataSource(t *testing.T) {
+	iface := multicastLoopback(t)
+	source, err := NewMulticastDataSource(iface.Name, testMulticastGroup)
+	if err != nil {
+		t.Skipf("Cannot join multicast group: %v", err)
+	}
+	defer source.Close()
+
+	if err := source.SetReadBuffer(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" {
+		if size, err := source.ReadBuffer(); err != nil {
+			t.Fatal(err)
+		} else if size <= 0 {
+			t.Fatalf("unexpected receive buffer size: %v", size)
+		}
+	}
+
+	conn := dialMulticast(t, iface, testMulticastGroup)
+	defer conn.Close()
+
+	replayer := NewReplayer(makeLineSource(t, 10))
+	replayer.SetSpeed(0)
+	if _, err := replayer.Replay(conn); err != nil {
+		t.Skipf("Cannot send to multicast group: %v", err)
+	}
+
+	scanner := NewPcapScanner(&deadlineSource{source, 5 * time.Second})
+	for seq := int64(1); seq <= 10; seq++ {
+		msg, err := scanner.NextMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tradeID := msg.(*deep.TradeReportMessage).TradeID; tradeID != seq {
+			t.Fatalf("received trade %v, expected %v", tradeID, seq)
+		}
+	}
+
+	if drops, ok := source.Drops(); ok != (runtime.GOOS == "linux") || drops != 0 {
+		t.Fatalf("unexpected drops: %v (supported: %v)", drops, ok)
+	}
+}
+
+func TestMulticastDataSource_Drops(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Dropped datagrams are only reported on Linux.")
+	}
+
+	iface := multicastLoopback(t)
+	source, err := NewMulticastDataSource(iface.Name, testMulticastGroup)
+	if err != nil {
+		t.Skipf("Cannot join multicast group: %v", err)
+	}
+	defer source.Close()
+
+	// Overflow a small receive buffer.
+	if err := source.SetReadBuffer(4096); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dialMulticast(t, iface, testMulticastGroup)
+	defer conn.Close()
+
+	nSent := 1000
+	replayer := NewReplayer(makeLineSource(t, int64(nSent)))
+	replayer.SetSpeed(0)
+	if _, err := replayer.Replay(conn); err != nil {
+		t.Skipf("Cannot send to multicast group: %v", err)
+	}
+
+	nReceived := 0
+	deadlined := &deadlineSource{source, 100 * time.Millisecond}
+	for {
+		if _, err := deadlined.NextPayload(); err != nil {
+			break
+		}
+		nReceived++
+	}
+
+	// The drop counter is reported with the next datagram received.
+	replayer = NewReplayer(makeLineSource(t, 1))
+	replayer.SetSpeed(0)
+	if _, err := replayer.Replay(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&deadlineSource{source, 5 * time.Second}).NextPayload(); err != nil {
+		t.Fatal(err)
+	}
+
+	drops, ok := source.Drops()
+	if !ok {
+		t.Fatal("drops should be supported on Linux")
+	}
+	if nReceived+int(drops) != nSent {
+		t.Fatalf("received %v datagrams and dropped %v, expected %v in total",
+			nReceived, drops, nSent)
+	}
+}
+
+// deadlineSource fails if no payload is received within timeout.
+type deadlineSource struct {
+	*MulticastDataSource
+	timeout time.Duration
+}
+
+func (ds *deadlineSource) NextPayload() ([]byte, error) {
+	ds.conn.SetReadDeadline(time.Now().Add(ds.timeout))
+	return ds.MulticastDataSource.NextPayload()
+}
@@ -2,8 +2,8 @@ package iex
 
 import (
 	"bufio"
-	"compress/gzip"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 
@@ -12,6 +12,7 @@ import (
 
 	"github.com/xuforr/go-iex/iextp"
 	_ "github.com/xuforr/go-iex/iextp/deep"
+	_ "github.com/xuforr/go-iex/iextp/deepplus"
 	_ "github.com/xuforr/go-iex/iextp/tops"
 )
 
@@ -68,30 +69,31 @@ func (pcds *PacketConnDataSource) NextPayload() ([]byte, error) {
 
 // GopacketDataSource implements PacketDataSource for gopacket.PacketSource.
 // It can be used to source the packet payload data from a pcap or pcap-ng file.
+//
+// UDP datagrams that were fragmented at the IPv4 layer are reassembled,
+// and returned once their last fragment has been read.
 type GopacketDataSource struct {
 	packetSource *gopacket.PacketSource
+	datagrams    *datagramReassembler
 }
 
 func NewGopacketDataSource(packetSource *gopacket.PacketSource) *GopacketDataSource {
-	return &GopacketDataSource{packetSource}
+	return &GopacketDataSource{
+		packetSource: packetSource,
+		datagrams:    newDatagramReassembler(),
+	}
 }
 
-// Create a new GopacketDataSource from the given pcap or pcap-ng file data.
+// Create a new GopacketDataSource from the given pcap or pcap-ng file data,
+// which may be compressed with gzip, zstd, bzip2 or xz. Packets may be
+// captured on Ethernet (optionally VLAN or QinQ tagged), as Linux cooked
+// captures, or as raw IP packets.
 func NewPcapDataSource(r io.Reader) (*GopacketDataSource, error) {
-	input := bufio.NewReader(r)
-	gzipMagic, err := input.Peek(2)
+	input, _, err := decompress(bufio.NewReader(r))
 	if err != nil {
 		return nil, err
 	}
 
-	if gzipMagic[0] == magicGzip1 && gzipMagic[1] == magicGzip2 {
-		if gzf, err := gzip.NewReader(input); err != nil {
-			return nil, err
-		} else {
-			input = bufio.NewReader(gzf)
-		}
-	}
-
 	magicBuf, err := input.Peek(4)
 	if err != nil {
 		return nil, err
@@ -104,13 +106,13 @@ func NewPcapDataSource(r io.Reader) (*GopacketDataSource, error) {
 		if err != nil {
 			return nil, err
 		}
-		packetSource = gopacket.NewPacketSource(packetReader, packetReader.LinkType())
+		packetSource = gopacket.NewPacketSource(packetReader, linkTypeDecoder(packetReader.LinkType()))
 	} else {
 		packetReader, err := pcapgo.NewReader(input)
 		if err != nil {
 			return nil, err
 		}
-		packetSource = gopacket.NewPacketSource(packetReader, packetReader.LinkType())
+		packetSource = gopacket.NewPacketSource(packetReader, linkTypeDecoder(packetReader.LinkType()))
 	}
 
 	return NewGopacketDataSource(packetSource), nil
@@ -124,27 +126,93 @@ func (gds *GopacketDataSource) NextPayload() ([]byte, error) {
 			return nil, err
 		}
 
-		if app := packet.ApplicationLayer(); app != nil {
-			return app.Payload(), nil
+		if payload, _, ok := gds.datagrams.datagram(packet); ok {
+			return payload, nil
 		}
 	}
 }
 
 // PcapScanner is a high-level reader for iterating through messages from
 // from IEX pcap dumps or streaming UDP connections.
+//
+// The scanner tracks the message sequence numbers of each IEX-TP session.
+// Messages that have already been received (e.g. retransmissions) are
+// dropped, and gaps due to lost packets are filled by the GapRecoverer
+// registered with SetGapRecoverer, if any. Gaps that cannot be recovered
+// are counted in Stats and reported to the handler registered with
+// SetGapHandler, if any.
+//
+// If the packet source implements MetadataDataSource, the capture
+// metadata of the packet containing the current message is available
+// from PacketMetadata.
 type PcapScanner struct {
 	packetSource    PacketDataSource
+	metadataSource  MetadataDataSource
+	segmentSource   segmentDataSource
+	decoder         *iextp.Decoder
 	currentSegment  []iextp.Message
 	currentMsgIndex int
+	// The segments that the messages in currentSegment came from,
+	// and the index of the segment containing the current message.
+	segments     []scannedSegment
+	segmentIndex int
+
+	sequences       *sequenceTracker
+	onGap           func(Gap)
+	recoverer       GapRecoverer
+	segmentFilters  []SegmentFilter
+	skipUndecodable bool
+	stats           ScannerStats
+
+	// Used by Visit to decode segments without allocating.
+	reader *iextp.SegmentReader
+
+	// A payload read while seeking, to be returned by the next read.
+	unread         []byte
+	unreadMetadata PacketMetadata
 }
 
 // Create a new PcapScanner with the given source of network packets.
+// Segments are decoded with iextp.DefaultDecoder, which supports
+// TOPS and DEEP.
 func NewPcapScanner(packetDataSource PacketDataSource) *PcapScanner {
+	return NewPcapScannerWithDecoder(packetDataSource, iextp.DefaultDecoder)
+}
+
+// Create a new PcapScanner with the given source of network packets,
+// that decodes segments using the protocols registered with decoder.
+func NewPcapScannerWithDecoder(packetDataSource PacketDataSource, decoder *iextp.Decoder) *PcapScanner {
+	metadataSource, _ := packetDataSource.(MetadataDataSource)
+	segmentSource, _ := packetDataSource.(segmentDataSource)
 	return &PcapScanner{
-		packetSource: packetDataSource,
+		packetSource:   packetDataSource,
+		metadataSource: metadataSource,
+		segmentSource:  segmentSource,
+		decoder:        decoder,
+		sequences:      newSequenceTracker(),
 	}
 }
 
+// A segment that messages returned by the scanner came from.
+type scannedSegment struct {
+	header   iextp.SegmentHeader
+	metadata PacketMetadata
+	// Index in currentSegment of the first message from the segment.
+	start int
+}
+
+// SetGapHandler registers f to be called when a gap is detected in
+// the message sequence numbers of a session. f is called before any
+// of the messages following the gap are returned by NextMessage.
+func (p *PcapScanner) SetGapHandler(f func(Gap)) {
+	p.onGap = f
+}
+
+// Stats returns the counters accumulated by the scanner so far.
+func (p *PcapScanner) Stats() ScannerStats {
+	return p.stats
+}
+
 // Get the next Message in the pcap dump.
 // Returns io.EOF if the underlying packet source has no more data.
 func (p *PcapScanner) NextMessage() (iextp.Message, error) {
@@ -155,29 +223,157 @@ func (p *PcapScanner) NextMessage() (iextp.Message, error) {
 	}
 
 	msg := p.currentSegment[p.currentMsgIndex]
+	for p.segmentIndex+1 < len(p.segments) &&
+		p.segments[p.segmentIndex+1].start <= p.currentMsgIndex {
+		p.segmentIndex++
+	}
 	p.currentMsgIndex++
+	p.stats.Messages++
 	return msg, nil
 }
 
+// SegmentHeader returns the header of the IEX-TP segment containing the
+// message most recently returned by NextMessage. For messages filled
+// by the GapRecoverer, it is the header of the recovered segment.
+func (p *PcapScanner) SegmentHeader() iextp.SegmentHeader {
+	if len(p.segments) == 0 {
+		return iextp.SegmentHeader{}
+	}
+	return p.segments[p.segmentIndex].header
+}
+
+// PacketMetadata returns the capture metadata of the packet containing
+// the message most recently returned by NextMessage. The metadata is
+// empty if the packet source does not implement MetadataDataSource,
+// or if the message was filled by the GapRecoverer.
+func (p *PcapScanner) PacketMetadata() PacketMetadata {
+	if len(p.segments) == 0 {
+		return PacketMetadata{}
+	}
+	return p.segments[p.segmentIndex].metadata
+}
+
+func (p *PcapScanner) nextPayload() ([]byte, PacketMetadata, error) {
+	if p.unread != nil {
+		payload := p.unread
+		p.unread = nil
+		return payload, p.unreadMetadata, nil
+	}
+
+	if p.metadataSource != nil {
+		return p.metadataSource.NextPayloadWithMetadata()
+	}
+
+	payload, err := p.packetSource.NextPayload()
+	return payload, PacketMetadata{}, err
+}
+
 // Read packets until we find the next one with > 0 messages.
 // Returns an error if the underlying packet source returns an error,
-// or if the payload cannot be decoded as an IEX-TP segment.
+// or if the payload cannot be decoded as an IEX-TP segment
+// (unless undecodable payloads are skipped).
 func (p *PcapScanner) nextSegment() error {
 	for {
-		payload, err := p.packetSource.NextPayload()
-		if err != nil {
+		segment, metadata, err := p.nextDecodedSegment()
+		if err == errSkippedSegment {
+			continue
+		} else if err != nil {
 			return err
 		}
 
-		segment := iextp.Segment{}
-		if err := segment.Unmarshal(payload); err != nil {
-			return err
+		p.stats.Segments++
+		nDuplicate, gap := p.sequences.check(&segment.Header)
+		p.stats.DuplicateMessages += int64(nDuplicate)
+		messages := segment.Messages[nDuplicate:]
+		segments := p.segments[:0]
+		if gap.Count != 0 {
+			var recovered []iextp.Message
+			recovered, segments = p.handleGap(gap, segments)
+			if len(recovered) != 0 {
+				messages = append(recovered, messages...)
+			}
 		}
 
-		if len(segment.Messages) != 0 {
-			p.currentSegment = segment.Messages
+		if len(messages) != 0 {
+			p.currentSegment = messages
 			p.currentMsgIndex = 0
+			p.segments = append(segments, scannedSegment{
+				header:   segment.Header,
+				metadata: metadata,
+				start:    len(messages) - (len(segment.Messages) - nDuplicate),
+			})
+			p.segmentIndex = 0
 			return nil
 		}
 	}
 }
+
+// Returned by nextDecodedSegment if the segment was filtered,
+// or could not be decoded and undecodable payloads are skipped.
+var errSkippedSegment = errors.New("skipped segment")
+
+// Read and decode the next segment from the packet source.
+func (p *PcapScanner) nextDecodedSegment() (iextp.Segment, PacketMetadata, error) {
+	segment := iextp.Segment{}
+	if p.decodesConcurrently() {
+		decoded, err := p.segmentSource.nextSegment()
+		if err != nil {
+			return segment, PacketMetadata{}, err
+		} else if decoded.filtered {
+			p.stats.FilteredSegments++
+			return segment, PacketMetadata{}, errSkippedSegment
+		} else if decoded.decodeErr != nil {
+			return segment, PacketMetadata{}, p.undecodablePayload(decoded.decodeErr)
+		}
+
+		return decoded.segment, decoded.metadata, nil
+	}
+
+	payload, metadata, err := p.nextPayload()
+	if err != nil {
+		return segment, metadata, err
+	}
+
+	if len(p.segmentFilters) != 0 {
+		if err := segment.Header.Unmarshal(payload); err != nil {
+			return segment, metadata, p.undecodablePayload(err)
+		}
+
+		if !matchesSegmentFilters(p.segmentFilters, &segment.Header) {
+			p.stats.FilteredSegments++
+			return segment, metadata, errSkippedSegment
+		}
+	}
+
+	if err := p.decoder.UnmarshalSegment(payload, &segment); err != nil {
+		return segment, metadata, p.undecodablePayload(err)
+	}
+
+	return segment, metadata, nil
+}
+
+// Returns errSkippedSegment if undecodable payloads are skipped,
+// or err otherwise.
+func (p *PcapScanner) undecodablePayload(err error) error {
+	if p.skipUndecodable {
+		p.stats.UndecodablePayloads++
+		return errSkippedSegment
+	}
+	return err
+}
+
+// Whether segments are decoded concurrently by the packet source.
+func (p *PcapScanner) decodesConcurrently() bool {
+	return p.segmentSource != nil &&
+		p.segmentSource.decodeSegments(p.decoder, p.segmentFilters)
+}
+
+// segmentDataSource is implemented by packet sources that can
+// decode IEX-TP segments concurrently, such as PcapPipeline.
+type segmentDataSource interface {
+	// Start decoding segments with the given decoder and filters.
+	// Returns false if the source was already started without decoding.
+	decodeSegments(decoder *iextp.Decoder, filters []SegmentFilter) bool
+	// Get the next decoded segment.
+	nextSegment() (*pipelinePacket, error)
+}
@@ -2,8 +2,15 @@
 // from a pcap dump and converting them to minute-resolution bars
 // in CSV format for research.
 //
-// The pcap dump is read from stdin, and may be gzipped,
-// and the resulting CSV data is written to stdout.
+// The pcap dump is read from stdin, and may be compressed with gzip,
+// zstd, bzip2 or xz, and the resulting CSV data is written to stdout.
+// The CSV file is compressed if its name ends in .gz, .zst or .xz.
+// Trades in test securities, as indicated by the security directory
+// of the feed, and broken trades are excluded from the bars.
+//
+// Trades may be broken after their bar was written. If a fourth argument
+// is given, a log of the corrections of such bars is written to the CSV
+// file that it names.
 package main
 
 import (
@@ -12,13 +19,13 @@ import (
 	"io"
 	"log"
 	"os"
-	"sort"
 	"strconv"
 	"time"
 
 	"github.com/xuforr/go-iex"
 	"github.com/xuforr/go-iex/consolidator"
 	"github.com/xuforr/go-iex/iextp/tops"
+	"github.com/xuforr/go-iex/refdata"
 )
 
 var header = []string{
@@ -31,20 +38,6 @@ var header = []string{
 	"volume",
 }
 
-func makeBars(trades []*tops.TradeReportMessage, openTime, closeTime time.Time) []*consolidator.Bar {
-	bars := consolidator.MakeBars(trades)
-	for _, bar := range bars {
-		bar.OpenTime = openTime
-		bar.CloseTime = closeTime
-	}
-
-	sort.Slice(bars, func(i, j int) bool {
-		return bars[i].Symbol < bars[j].Symbol
-	})
-
-	return bars
-}
-
 func writeBar(bar *consolidator.Bar, w *csv.Writer) error {
 	row := []string{
 		bar.Symbol,
@@ -59,16 +52,6 @@ func writeBar(bar *consolidator.Bar, w *csv.Writer) error {
 	return w.Write(row)
 }
 
-func writeBars(bars []*consolidator.Bar, w *csv.Writer) error {
-	for _, bar := range bars {
-		if err := writeBar(bar, w); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 func main() {
 	args := os.Args
 	if len(args) < 3 {
@@ -85,6 +68,10 @@ func main() {
 			log.Fatal(err)
 		}
 	}
+	correctionsFileName := ""
+	if len(args) > 4 {
+		correctionsFileName = args[4]
+	}
 
 	fmt.Println("====================================")
 	fmt.Printf("Parsing %v to %v\n", pcapFilename, outFileName)
@@ -105,7 +92,7 @@ func main() {
 	}
 	fmt.Printf("Processing input file %v", pcapFilename)
 
-	output, err := os.Create(outFileName)
+	output, err := iex.CreateCompressed(outFileName)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -116,8 +103,35 @@ func main() {
 	}
 	defer writer.Flush()
 
-	var trades []*tops.TradeReportMessage
-	var openTime, closeTime time.Time
+	tape := consolidator.NewTape()
+	if correctionsFileName != "" {
+		correctionsOutput, err := iex.CreateCompressed(correctionsFileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer correctionsOutput.Close()
+		correctionsWriter := csv.NewWriter(correctionsOutput)
+		if err := correctionsWriter.Write(consolidator.CorrectionCSVHeader); err != nil {
+			log.Fatal(err)
+		}
+		defer correctionsWriter.Flush()
+
+		tape.OnCorrection(func(c consolidator.Correction) {
+			if err := correctionsWriter.Write(c.CSVRecord()); err != nil {
+				log.Fatal(err)
+			}
+		})
+	}
+
+	builder := consolidator.NewBarBuilder(time.Minute)
+	builder.OnBar(func(bar *consolidator.Bar) {
+		if err := writeBar(bar, writer); err != nil {
+			log.Fatal(err)
+		}
+		tape.Publish(bar)
+	})
+
+	directory := refdata.NewDirectory()
 	parsed := 0
 	for {
 		msg, err := scanner.NextMessage()
@@ -129,29 +143,24 @@ func main() {
 			log.Fatal(err)
 		}
 
+		directory.Process(msg)
 		if msg, ok := msg.(*tops.TradeReportMessage); ok {
-			if openTime.IsZero() {
-				openTime = msg.Timestamp.Truncate(time.Minute)
-				closeTime = openTime.Add(time.Minute)
-			}
-
-			if msg.Timestamp.After(closeTime) && len(trades) > 0 {
-				bars := makeBars(trades, openTime, closeTime)
-				if err := writeBars(bars, writer); err != nil {
-					log.Fatal(err)
-				}
-
-				trades = trades[:0]
-				openTime = msg.Timestamp.Truncate(time.Minute)
-				closeTime = openTime.Add(time.Minute)
-			}
-
-			trades = append(trades, msg)
 			parsed = parsed + 1
 			if statusReportGap > 0 && parsed%statusReportGap == 0 {
 				fmt.Printf("Processed %d records\n", parsed)
 			}
+
+			if directory.IsTestSecurity(msg.Symbol) {
+				continue
+			}
 		}
+
+		tape.Process(msg)
+		builder.Process(msg)
+	}
+	builder.Flush()
+	if n := len(tape.Corrections()); n > 0 {
+		fmt.Printf("%d bars were corrected for broken trades\n", n)
 	}
 	fmt.Printf("Done! A total of %d records were processed.\nExiting...\n", parsed)
 }
@@ -1,13 +1,15 @@
 // pcap2json is a small binary for extracting IEXTP messages
 // from a pcap dump and converting them to JSON.
 //
-// The pcap dump is read from stdin, and may be gzipped,
-// and the resulting JSON messages are written to stdout.
+// The pcap dump is read from stdin, and may be compressed with gzip,
+// zstd, bzip2 or xz, and the resulting JSON messages are written to
+// stdout, compressed in the format given by the -compress flag.
 package main
 
 import (
 	"bufio"
 	"encoding/json"
+	"flag"
 	"io"
 	"log"
 	"os"
@@ -17,6 +19,14 @@ import (
 )
 
 func main() {
+	compress := flag.String("compress", "none", "Compression of the output: none, gzip, zstd or xz")
+	flag.Parse()
+
+	compression, err := iex.ParseCompression(*compress)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	packetSource, err := iex.NewPacketDataSource(os.Stdin)
 	if err != nil {
 		log.Fatal(err)
@@ -25,7 +35,12 @@ func main() {
 	scanner := iex.NewPcapScanner(packetSource)
 	output := bufio.NewWriter(os.Stdout)
 	defer output.Flush()
-	enc := json.NewEncoder(output)
+	compressor, err := iex.NewCompressedWriter(output, compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer compressor.Close()
+	enc := json.NewEncoder(compressor)
 
 	for {
 		msg, err := scanner.NextMessage()
@@ -38,7 +53,8 @@ func main() {
 		}
 
 		if msg, ok := msg.(*iextp.UnsupportedMessage); ok {
-			log.Printf("WARNING: Unsupported message type %v", byte(msg.MessageType))
+			log.Printf("WARNING: Unsupported message type %v for protocol %#x",
+				byte(msg.MessageType), scanner.SegmentHeader().MessageProtocolID)
 		}
 
 		enc.Encode(msg)
@@ -7,8 +7,9 @@ import (
 	"io"
 	"log"
 	"os"
-	"sort"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -16,6 +17,7 @@ import (
 	"github.com/xuforr/go-iex/consolidator"
 	"github.com/xuforr/go-iex/db"
 	"github.com/xuforr/go-iex/iextp/tops"
+	"github.com/xuforr/go-iex/refdata"
 )
 
 var header = []string{
@@ -49,6 +51,17 @@ type Config struct {
 	MySQLConfigFile string
 	StatusReportGap int
 	CsvFile         string
+	RefDataFile     string
+	CorrectionsFile string
+	Interval        time.Duration
+	Alignment       time.Duration
+	FillMode        consolidator.FillMode
+}
+
+var fillModes = map[string]consolidator.FillMode{
+	"none":    consolidator.NoFill,
+	"empty":   consolidator.EmptyFill,
+	"forward": consolidator.ForwardFill,
 }
 
 func main() {
@@ -59,6 +72,9 @@ func main() {
 	fmt.Printf("MySQL Config File: %s\n", config.MySQLConfigFile)
 	fmt.Printf("Status Report Gap: %d\n", config.StatusReportGap)
 	fmt.Printf("Also Write To CSV: %s\n", config.CsvFile)
+	fmt.Printf("Security Directory File: %s\n", config.RefDataFile)
+	fmt.Printf("Corrections File: %s\n", config.CorrectionsFile)
+	fmt.Printf("Bar Interval: %v (aligned at %v)\n", config.Interval, config.Alignment)
 
 	processPcapFile(config)
 }
@@ -66,8 +82,13 @@ func main() {
 func parseArgs() Config {
 	pcapFilename := flag.String("pcap", "", "Path to the pcap file")
 	mySQLConfigFile := flag.String("db", "", "Path to the MySQL config file")
-	csvFile := flag.String("csv", "", "Path to the CSV file")
+	csvFile := flag.String("csv", "", "Path to the CSV file, compressed if it ends in .gz, .zst or .xz")
 	statusReportGap := flag.Int("status_print_interval", 0, "Status report interval")
+	refDataFile := flag.String("refdata", "", "Path to write the security directory to, as JSON or as CSV if it ends in .csv")
+	correctionsFile := flag.String("corrections", "", "Path to the CSV file to log corrections of bars with broken trades to")
+	interval := flag.Duration("interval", time.Minute, "Length of the bars")
+	alignment := flag.Duration("alignment", 0, "Offset of the start of the bars, e.g. 30m for hourly bars starting on the half hour")
+	fill := flag.String("fill", "none", "Bars to write for intervals without trades: none, empty or forward (filled)")
 
 	flag.Parse()
 
@@ -77,11 +98,23 @@ func parseArgs() Config {
 		os.Exit(1)
 	}
 
+	fillMode, ok := fillModes[*fill]
+	if !ok || *interval <= 0 {
+		fmt.Println("Please provide a valid bar interval and fill mode")
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	return Config{
 		PcapFilename:    *pcapFilename,
 		MySQLConfigFile: *mySQLConfigFile,
 		StatusReportGap: *statusReportGap,
 		CsvFile:         *csvFile,
+		RefDataFile:     *refDataFile,
+		CorrectionsFile: *correctionsFile,
+		Interval:        *interval,
+		Alignment:       *alignment,
+		FillMode:        fillMode,
 	}
 }
 
@@ -124,8 +157,8 @@ func processPcapFile(config Config) {
 
 	var csvWriter *csv.Writer
 	if config.CsvFile != "" {
-		var csvFile *os.File
-		csvFile, err = os.Create(config.CsvFile)
+		var csvFile io.WriteCloser
+		csvFile, err = iex.CreateCompressed(config.CsvFile)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -139,17 +172,76 @@ func processPcapFile(config Config) {
 		fmt.Println("Successfully created CSV file!")
 	}
 
+	// Log corrections of written bars whose trades are broken
+	tape := consolidator.NewTape()
+	if config.CorrectionsFile != "" {
+		correctionsFile, err := iex.CreateCompressed(config.CorrectionsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer correctionsFile.Close()
+		correctionsWriter := csv.NewWriter(correctionsFile)
+		if err := correctionsWriter.Write(consolidator.CorrectionCSVHeader); err != nil {
+			log.Fatal(err)
+		}
+		defer correctionsWriter.Flush()
+		tape.OnCorrection(func(c consolidator.Correction) {
+			if err := correctionsWriter.Write(c.CSVRecord()); err != nil {
+				log.Fatal(err)
+			}
+		})
+	}
+
+	// Build the bars, correcting written bars whose trades are broken
+	builder := consolidator.NewBarBuilder(config.Interval)
+	builder.SetAlignment(config.Alignment)
+	builder.SetFillMode(config.FillMode)
+	builder.OnBar(func(bar *consolidator.Bar) {
+		entry := makeEntry(bar)
+		if err := writeSingleEntry(&entry, writers); err != nil {
+			log.Fatal(err)
+		}
+		tape.Publish(bar)
+	})
+
 	// Process the pcap file and write to MySQL and optionally to CSV
-	processAndWrite(pcapFile, writers, config.StatusReportGap)
+	directory := refdata.NewDirectory()
+	processAndWrite(pcapFile, builder, directory, tape, config.StatusReportGap)
+	if n := len(tape.Corrections()); n > 0 {
+		fmt.Printf("%d bars were corrected for broken trades\n", n)
+	}
+
+	if config.RefDataFile != "" {
+		if err := writeDirectory(directory, config.RefDataFile); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Wrote %d securities to %v\n", directory.Len(), config.RefDataFile)
+	}
 }
 
-func computeOpenAndCloseTime(t time.Time) (time.Time, time.Time) {
-	openTime := t.Truncate(time.Minute)
-	closeTime := openTime.Add(time.Minute)
-	return openTime, closeTime
+// Write the security directory to the given file, in CSV format if
+// its name (without any compression extension) ends in .csv, or else
+// in JSON format.
+func writeDirectory(directory *refdata.Directory, filename string) error {
+	f, err := iex.CreateCompressed(filename)
+	if err != nil {
+		return err
+	}
+
+	uncompressedName := strings.TrimSuffix(filename, iex.CompressionOf(filename).Extension())
+	if filepath.Ext(uncompressedName) == ".csv" {
+		err = directory.WriteCSV(f)
+	} else {
+		err = directory.WriteJSON(f)
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
-func processAndWrite(pcapFile *os.File, w Writer, statusReportGap int) {
+func processAndWrite(pcapFile *os.File, builder *consolidator.BarBuilder, directory *refdata.Directory, tape *consolidator.Tape, statusReportGap int) {
 	// Create a packet source and scanner to read the pcap file
 	packetSource, err := iex.NewPacketDataSource(pcapFile)
 	scanner := iex.NewPcapScanner(packetSource)
@@ -157,70 +249,48 @@ func processAndWrite(pcapFile *os.File, w Writer, statusReportGap int) {
 		log.Fatal(err)
 	}
 
-	var trades []*tops.TradeReportMessage
-	var openTime, closeTime time.Time
 	parsed := 0
-	done := false
-
-	for !done {
+	for {
 		msg, err := scanner.NextMessage()
 		if err != nil {
 			if err == io.EOF {
-				done = true
-				continue
+				break
 			}
 			log.Fatal(err)
 		}
 
+		directory.Process(msg)
 		if msg, ok := msg.(*tops.TradeReportMessage); ok {
-			if openTime.IsZero() {
-				openTime, closeTime = computeOpenAndCloseTime(msg.Timestamp)
-			}
-
-			// All trades for this unit has been accumulated
-			if msg.Timestamp.After(closeTime) && len(trades) > 0 {
-				entries := makeEntries(trades, openTime, closeTime)
-				if err := writeEntries(entries, w); err != nil {
-					log.Fatal(err)
-				}
-
-				trades = trades[:0]
-				openTime, closeTime = computeOpenAndCloseTime(msg.Timestamp)
-			}
-
-			trades = append(trades, msg)
 			parsed = parsed + 1
 			if statusReportGap > 0 && parsed%statusReportGap == 0 {
 				fmt.Printf("Processed %d records\n", parsed)
 			}
+
+			// Trades in test securities are excluded
+			if directory.IsTestSecurity(msg.Symbol) {
+				continue
+			}
 		}
+
+		tape.Process(msg)
+		builder.Process(msg)
 	}
 
+	// Write the bars of the last interval
+	builder.Flush()
 }
 
-func makeEntries(trades []*tops.TradeReportMessage, openTime, closeTime time.Time) map[string]Entry {
-	bars := consolidator.MakeBars(trades)
-	for _, bar := range bars {
-		bar.OpenTime = openTime
-		bar.CloseTime = closeTime
+func makeEntry(bar *consolidator.Bar) Entry {
+	return Entry{
+		Symbol:        bar.Symbol,
+		Time:          bar.OpenTime,
+		Open:          bar.Open,
+		High:          bar.High,
+		Low:           bar.Low,
+		Close:         bar.Close,
+		Volume:        bar.Volume,
+		IsTradingHour: isTradingHour(bar.OpenTime),
 	}
-
-	entries := make(map[string]Entry)
-	for _, bar := range bars {
-		entry := Entry{
-			Symbol:        bar.Symbol,
-			Time:          bar.OpenTime,
-			Open:          bar.Open,
-			High:          bar.High,
-			Low:           bar.Low,
-			Close:         bar.Close,
-			Volume:        bar.Volume,
-			IsTradingHour: isTradingHour(bar.OpenTime),
-		}
-		entries[bar.Symbol] = entry
-	}
-
-	return entries
 }
 
 func writeSingleEntry(entry *Entry, w Writer) error {
@@ -251,20 +321,3 @@ func isTradingHour(t time.Time) bool {
 	tradingEnd := time.Date(est.Year(), est.Month(), est.Day(), 16, 0, 0, 0, est.Location())
 	return est.Equal(tradingStart) || (est.After(tradingStart) && est.Before(tradingEnd))
 }
-
-func writeEntries(entries map[string]Entry, w Writer) error {
-	keys := make([]string, 0, len(entries))
-	for key := range entries {
-		keys = append(keys, key)
-	}
-	sort.Strings(keys)
-
-	for _, key := range keys {
-		entry := entries[key]
-		if err := writeSingleEntry(&entry, w); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
@@ -1,12 +1,15 @@
 package iex
 
 import (
+	"bytes"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/xuforr/go-iex/iextp"
 )
 
 func TestPcapScanner(t *testing.T) {
@@ -71,6 +74,10 @@ func testPcapScanner(t *testing.T, filename string) int {
 		t.Fatal(err)
 	}
 
+	if stats := scanner.Stats(); stats.Gaps != 0 || stats.DuplicateMessages != 0 {
+		t.Fatalf("unexpected gaps or duplicates: %+v", stats)
+	}
+
 	return count
 }
 
@@ -90,9 +97,10 @@ func TestUDPScanner(t *testing.T) {
 
 	// Replay the given pcap dump to the given UDP address.
 	testFilename := filepath.Join("testdata", "DEEP10.pcap.gz")
-	go udpReplay(t, testFilename, packetConn.LocalAddr(), nPacketsToSend)
+	if err := udpReplay(testFilename, packetConn.LocalAddr(), nPacketsToSend); err != nil {
+		t.Fatal(err)
+	}
 
-	time.Sleep(time.Second)
 	t.Log("Scanning UDP packets")
 	scanner := NewPcapScanner(packetSource)
 	for i := 0; i < nPacketsToSend; i++ {
@@ -102,41 +110,102 @@ func TestUDPScanner(t *testing.T) {
 	}
 }
 
-// Replays all packets in the given pcap filename to the given address.
-func udpReplay(t *testing.T, pcapFilename string, addr net.Addr, nPacketsToSend int) {
-	t.Log("Dialing: ", addr)
+// Replays the first nPacketsToSend packets in the given pcap filename
+// to the given address.
+func udpReplay(pcapFilename string, addr net.Addr, nPacketsToSend int) error {
 	conn, err := net.DialTimeout("udp", addr.String(), time.Second)
 	if err != nil {
-		t.Fatal("could not connect to server: ", err)
+		return err
 	}
 	defer conn.Close()
 
 	f, err := os.Open(pcapFilename)
 	if err != nil {
-		t.Fatal(err)
+		return err
 	}
 	defer f.Close()
 
 	packetSource, err := NewPcapDataSource(f)
 	if err != nil {
-		t.Fatal(err)
+		return err
 	}
 
-	t.Logf("Replaying first %d packets from %s", nPacketsToSend, pcapFilename)
-	for i := 0; i < nPacketsToSend; i++ {
-		payload, err := packetSource.NextPayload()
-		if err != nil {
-			if err == io.EOF {
-				return
+	replayer := NewReplayer(&limitedSource{packetSource, nPacketsToSend})
+	replayer.SetSpeed(0)
+	_, err = replayer.Replay(conn)
+	return err
+}
+
+// limitedSource returns io.EOF after n payloads.
+type limitedSource struct {
+	PacketDataSource
+	n int
+}
+
+func (ls *limitedSource) NextPayload() ([]byte, error) {
+	if ls.n <= 0 {
+		return nil, io.EOF
+	}
+	ls.n--
+	return ls.PacketDataSource.NextPayload()
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping pcap test in short mode.")
+	}
+
+	testCases := []struct {
+		filename  string
+		nSegments int
+	}{
+		{"DEEP10.pcap.gz", 121314},
+		{"TOPS16.pcapng.gz", 13022},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.filename, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", tc.filename))
+			if err != nil {
+				t.Fatal(err)
 			}
+			defer f.Close()
 
-			t.Fatal("could not write payload to server:", err)
-			return
-		}
+			packetDataSource, err := NewPcapDataSource(f)
+			if err != nil {
+				t.Fatal(err)
+			}
 
-		if _, err := conn.Write(payload); err != nil {
-			t.Fatal("could not write payload to server:", err)
-			return
-		}
+			nSegments := 0
+			for {
+				payload, err := packetDataSource.NextPayload()
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+
+				var segment iextp.Segment
+				if err := segment.Unmarshal(payload); err != nil {
+					t.Fatal(err)
+				}
+
+				buf, err := segment.Marshal()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(buf, payload) {
+					t.Fatalf("segment %d: marshaled: %x, expected: %x",
+						nSegments, buf, payload)
+				}
+				nSegments++
+			}
+
+			if nSegments != tc.nSegments {
+				t.Fatalf("expected to re-encode %v segments, got: %v",
+					tc.nSegments, nSegments)
+			}
+		})
 	}
 }
@@ -0,0 +1,64 @@
+// pcapindex is a small binary for indexing pcap dumps, so that they can
+// be read from a given send time or sequence number without scanning
+// them from the start (see iex.OpenIndexedPcap and PcapScanner.SeekTime).
+//
+// The index of each dump is written to a sidecar file next to it,
+// with the .idx extension appended.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/xuforr/go-iex"
+)
+
+func indexFile(builder *iex.PcapIndexBuilder, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	index, err := builder.Build(f)
+	if err != nil {
+		return err
+	}
+
+	output, err := os.Create(iex.IndexFilename(filename))
+	if err != nil {
+		return err
+	}
+
+	if _, err := index.WriteTo(output); err != nil {
+		output.Close()
+		return err
+	}
+
+	if len(index.Entries) != 0 {
+		first, last := index.Entries[0].Segment, index.Entries[len(index.Entries)-1].Segment
+		log.Printf("Indexed %v: %v entries from %v to %v",
+			filename, len(index.Entries), first.SendTime, last.SendTime)
+	}
+
+	return output.Close()
+}
+
+func main() {
+	span := flag.Int64("span", 1<<20, "Minimum number of uncompressed bytes between index entries")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	builder := iex.NewPcapIndexBuilder()
+	builder.SetSpan(*span)
+	for _, filename := range flag.Args() {
+		if err := indexFile(builder, filename); err != nil {
+			log.Fatalf("%v: %v", filename, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// pcaprecord is a small binary for recording a live IEX-TP feed
+// to pcap or pcap-ng dumps that can be read by the other tools.
+//
+// The output format is determined by the extension of the output path
+// (.pcap or .pcapng, optionally followed by .gz, .zst or .xz).
+// Existing files are never overwritten. Recording stops cleanly on
+// SIGINT or SIGTERM.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/xuforr/go-iex"
+)
+
+func listen(addr, ifaceName string) (net.PacketConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !udpAddr.IP.IsMulticast() {
+		return net.ListenUDP("udp", udpAddr)
+	}
+
+	var iface *net.Interface
+	if ifaceName != "" {
+		if iface, err = net.InterfaceByName(ifaceName); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.ListenMulticastUDP("udp", iface, udpAddr)
+}
+
+func main() {
+	listenAddr := flag.String("listen", "", "UDP address (or multicast group:port) to listen on")
+	ifaceName := flag.String("iface", "", "Network interface to join the multicast group on")
+	output := flag.String("o", "", "Path to the output pcap file, e.g. tops.pcap.gz or tops.pcap.zst")
+	maxSize := flag.Int64("max_size", 0, "Rotate output files after this many bytes")
+	rotate := flag.Duration("rotate", 0, "Rotate output files at this interval, e.g. 1h")
+	flag.Parse()
+
+	if *listenAddr == "" || *output == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	conn, err := listen(*listenAddr, *ifaceName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	recorder := iex.NewRecorder(*output)
+	recorder.SetMaxFileSize(*maxSize)
+	recorder.SetRotateInterval(*rotate)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, stopping", sig)
+		if err := recorder.Close(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	log.Printf("Recording udp://%v to %v", conn.LocalAddr(), *output)
+	if err := recorder.Record(conn); err != nil {
+		recorder.Close()
+		log.Fatal(err)
+	}
+
+	for _, filename := range recorder.Filenames() {
+		log.Printf("Wrote %v", filename)
+	}
+}
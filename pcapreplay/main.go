@@ -0,0 +1,122 @@
+// pcapreplay is a small binary for replaying the IEX-TP segments in a
+// pcap dump to a UDP address, for testing consumers of a live feed.
+//
+// Segments are paced according to their SendTime, at real time by
+// default. The address may be a multicast group, in which case the
+// datagrams are also delivered to listeners on the local host.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/ipv4"
+
+	"github.com/xuforr/go-iex"
+)
+
+func dial(addr, ifaceName string, ttl int) (net.Conn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if udpAddr.IP.IsMulticast() && udpAddr.IP.To4() != nil {
+		pc := ipv4.NewPacketConn(conn)
+		if err := pc.SetMulticastTTL(ttl); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := pc.SetMulticastLoopback(true); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if ifaceName != "" {
+			iface, err := net.InterfaceByName(ifaceName)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if err := pc.SetMulticastInterface(iface); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return conn, nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+func main() {
+	pcapFilename := flag.String("pcap", "", "Path to the pcap file")
+	addr := flag.String("addr", "", "UDP address (or multicast group:port) to send to")
+	ifaceName := flag.String("iface", "", "Network interface to send multicast datagrams on")
+	ttl := flag.Int("ttl", 1, "Multicast TTL")
+	speed := flag.Float64("speed", 1, "Replay speed as a multiple of real time (0 = as fast as possible)")
+	start := flag.String("start", "", "Skip segments sent before this time (RFC 3339)")
+	end := flag.String("end", "", "Stop at the first segment sent after this time (RFC 3339)")
+	flag.Parse()
+
+	if *pcapFilename == "" || *addr == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	startTime, err := parseTime(*start)
+	if err != nil {
+		log.Fatal(err)
+	}
+	endTime, err := parseTime(*end)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := os.Open(*pcapFilename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	packetSource, err := iex.NewPcapDataSource(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conn, err := dial(*addr, *ifaceName, *ttl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	replayer := iex.NewReplayer(packetSource)
+	replayer.SetSpeed(*speed)
+	replayer.SetStartTime(startTime)
+	replayer.SetEndTime(endTime)
+
+	log.Printf("Replaying %v to udp://%v", *pcapFilename, conn.RemoteAddr())
+	n, err := replayer.Replay(conn)
+	if err == io.ErrUnexpectedEOF {
+		log.Printf("WARNING: %v is truncated", *pcapFilename)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Replayed %d packets", n)
+}
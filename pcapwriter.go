@@ -0,0 +1,180 @@
+package iex
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// PcapFormat is the file format written by a PcapWriter.
+type PcapFormat int
+
+const (
+	// The libpcap file format, with nanosecond resolution timestamps.
+	FormatPcap PcapFormat = iota
+	// The pcap-ng file format.
+	FormatPcapNG
+)
+
+func (f PcapFormat) String() string {
+	switch f {
+	case FormatPcap:
+		return "pcap"
+	case FormatPcapNG:
+		return "pcapng"
+	default:
+		return fmt.Sprintf("PcapFormat(%d)", int(f))
+	}
+}
+
+// Maximum size of a UDP payload in an IPv4 packet.
+const maxUDPPayloadSize = 65535 - 20 - 8
+
+// packetWriter is implemented by pcapgo.Writer and pcapgo.NgWriter.
+type packetWriter interface {
+	WritePacket(ci gopacket.CaptureInfo, data []byte) error
+}
+
+// PcapWriter writes UDP datagrams to a pcap or pcap-ng dump that can be
+// read back with NewPcapDataSource.
+//
+// Since only the datagram payloads are received from a net.PacketConn,
+// each datagram is written as a synthesized Ethernet/IP/UDP packet with
+// the given source and destination addresses.
+type PcapWriter struct {
+	w      packetWriter
+	flush  func() error
+	buf    gopacket.SerializeBuffer
+	opts   gopacket.SerializeOptions
+	ipv4ID uint16
+}
+
+// NewPcapWriter creates a new PcapWriter that writes to w in the given
+// format. The file header is written immediately.
+//
+// NOTE: Data may be buffered, so Flush must be called once all packets
+// have been written.
+func NewPcapWriter(w io.Writer, format PcapFormat) (*PcapWriter, error) {
+	pw := &PcapWriter{
+		buf: gopacket.NewSerializeBuffer(),
+		opts: gopacket.SerializeOptions{
+			FixLengths:       true,
+			ComputeChecksums: true,
+		},
+	}
+
+	switch format {
+	case FormatPcap:
+		writer := pcapgo.NewWriterNanos(w)
+		if err := writer.WriteFileHeader(maxDatagramSize, layers.LinkTypeEthernet); err != nil {
+			return nil, err
+		}
+		pw.w = writer
+		pw.flush = func() error { return nil }
+	case FormatPcapNG:
+		writer, err := pcapgo.NewNgWriter(w, layers.LinkTypeEthernet)
+		if err != nil {
+			return nil, err
+		}
+		pw.w = writer
+		pw.flush = writer.Flush
+	default:
+		return nil, fmt.Errorf("unsupported pcap format: %v", format)
+	}
+
+	return pw, nil
+}
+
+// WriteDatagram writes a UDP packet with the given payload that was
+// received at the given time. If src or dst is nil, the unspecified
+// IPv4 address and port 0 are used.
+func (pw *PcapWriter) WriteDatagram(timestamp time.Time, src, dst *net.UDPAddr, payload []byte) error {
+	srcIP, srcPort := udpAddrParts(src)
+	dstIP, dstPort := udpAddrParts(dst)
+	if len(payload) > maxUDPPayloadSize {
+		return fmt.Errorf("cannot write datagram: payload of %d bytes is too large", len(payload))
+	}
+
+	eth := &layers.Ethernet{
+		SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 0},
+		DstMAC: destinationMAC(dstIP),
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(srcPort),
+		DstPort: layers.UDPPort(dstPort),
+	}
+
+	var ip gopacket.SerializableLayer
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		pw.ipv4ID++
+		ipv4 := &layers.IPv4{
+			Version:  4,
+			Id:       pw.ipv4ID,
+			Flags:    layers.IPv4DontFragment,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    srcIP.To4(),
+			DstIP:    dstIP.To4(),
+		}
+		udp.SetNetworkLayerForChecksum(ipv4)
+		ip = ipv4
+	} else {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ipv6 := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      srcIP.To16(),
+			DstIP:      dstIP.To16(),
+		}
+		udp.SetNetworkLayerForChecksum(ipv6)
+		ip = ipv6
+	}
+
+	if err := gopacket.SerializeLayers(pw.buf, pw.opts,
+		eth, ip, udp, gopacket.Payload(payload)); err != nil {
+		return err
+	}
+
+	data := pw.buf.Bytes()
+	ci := gopacket.CaptureInfo{
+		Timestamp:     timestamp,
+		CaptureLength: len(data),
+		Length:        len(data),
+	}
+	return pw.w.WritePacket(ci, data)
+}
+
+// Flush writes any buffered data to the underlying io.Writer.
+func (pw *PcapWriter) Flush() error {
+	return pw.flush()
+}
+
+func udpAddrParts(addr *net.UDPAddr) (net.IP, int) {
+	if addr == nil || addr.IP == nil {
+		return net.IPv4zero, 0
+	}
+
+	return addr.IP, addr.Port
+}
+
+// Returns the Ethernet address that packets sent to the given IP address
+// would be delivered to. Multicast groups are mapped as described in
+// RFC 1112 and RFC 2464.
+func destinationMAC(ip net.IP) net.HardwareAddr {
+	if ip4 := ip.To4(); ip4 != nil {
+		if ip4.IsMulticast() {
+			return net.HardwareAddr{0x01, 0x00, 0x5e, ip4[1] & 0x7f, ip4[2], ip4[3]}
+		}
+	} else if ip.IsMulticast() {
+		return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+	}
+
+	return net.HardwareAddr{0, 0, 0, 0, 0, 0}
+}
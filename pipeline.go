@@ -0,0 +1,441 @@
+package iex
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/xuforr/go-iex/iextp"
+)
+
+const (
+	// Size of the chunks of data passed from the decompression stage
+	// to the packet reading stage, and the number of chunks buffered.
+	pipelineChunkSize   = 1 << 20
+	pipelineChunkBuffer = 4
+
+	defaultPipelineBatchSize = 256
+)
+
+// Returned by a PcapPipeline after it has been closed.
+var errPipelineClosed = errors.New("pcap pipeline closed")
+
+// PcapPipeline implements MetadataDataSource for pcap and pcap-ng dumps,
+// separating the work of reading the dump into concurrent stages:
+//
+//  1. Decompression of compressed dumps.
+//  2. Reading the capture records from the dump, in batches.
+//  3. Parsing the packets of each batch, by a pool of workers.
+//
+// When a PcapPipeline is the packet source of a PcapScanner, the workers
+// also decode the IEX-TP segments of each packet, so that only sequencing
+// of the decoded messages is left to the scanner. Payloads and messages
+// are always returned in the order in which they were captured.
+//
+// Fragmented UDP datagrams are reassembled as they are consumed, and their
+// segments decoded then, since their fragments may span several batches.
+//
+// Memory is bounded by the number of batches in flight (see SetMaxBatches).
+// Close should be called to stop the pipeline when it is no longer needed.
+type PcapPipeline struct {
+	reader      pipelinePacketReader
+	linkDecoder gopacket.Decoder
+	inflater    *inflater
+
+	workers    int
+	batchSize  int
+	maxBatches int
+
+	startOnce sync.Once
+	// Set when the pipeline is started by a PcapScanner,
+	// and immutable thereafter.
+	decoder *iextp.Decoder
+	filters []SegmentFilter
+
+	batches   chan *pipelineBatch
+	done      chan struct{}
+	closeOnce sync.Once
+
+	current   *pipelineBatch
+	index     int
+	datagrams *datagramReassembler
+}
+
+// Implemented by both pcapgo.Reader and pcapgo.NgReader.
+type pipelinePacketReader interface {
+	ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// A batch of packets read from the dump.
+type pipelineBatch struct {
+	// The captured data of all packets in the batch.
+	data    []byte
+	packets []pipelinePacket
+	// Closed when the packets of the batch have been parsed.
+	ready chan struct{}
+	// The error that ended reading from the dump after this batch, if any.
+	err error
+}
+
+type pipelinePacket struct {
+	ci         gopacket.CaptureInfo
+	start, end int // Position of the packet data in pipelineBatch.data.
+
+	hasPayload bool
+	payload    []byte
+	metadata   PacketMetadata
+	// If the packet is a fragment of a UDP datagram.
+	fragment *layers.IPv4
+
+	// If the pipeline is decoding segments.
+	segment   iextp.Segment
+	filtered  bool
+	decodeErr error
+}
+
+// NewPcapPipeline creates a new PcapPipeline from the given pcap or
+// pcap-ng file data, which may be compressed with gzip, zstd, bzip2 or xz.
+//
+// Decompression starts immediately; the remaining
+// stages are started by the first read from the pipeline.
+func NewPcapPipeline(r io.Reader) (*PcapPipeline, error) {
+	pp := &PcapPipeline{
+		workers:   runtime.GOMAXPROCS(0),
+		batchSize: defaultPipelineBatchSize,
+		done:      make(chan struct{}),
+		datagrams: newDatagramReassembler(),
+	}
+	pp.maxBatches = 4 * pp.workers
+
+	input, compression, err := decompress(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+
+	if compression != Uncompressed {
+		pp.inflater = newInflater(input, pp.done)
+		input = bufio.NewReader(pp.inflater)
+	}
+
+	magicBuf, err := input.Peek(4)
+	if err != nil {
+		pp.Close()
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(magicBuf) == pcapNGMagic {
+		pp.reader, err = pcapgo.NewNgReader(input, pcapgo.DefaultNgReaderOptions)
+	} else {
+		pp.reader, err = pcapgo.NewReader(input)
+	}
+	if err != nil {
+		pp.Close()
+		return nil, err
+	}
+
+	pp.linkDecoder = linkTypeDecoder(pp.reader.LinkType())
+	return pp, nil
+}
+
+// SetWorkers sets the number of workers that parse packets (and decode
+// segments) concurrently. The default is runtime.GOMAXPROCS(0).
+// It has no effect once reading from the pipeline has started.
+func (pp *PcapPipeline) SetWorkers(n int) {
+	if n > 0 {
+		pp.workers = n
+	}
+}
+
+// SetBatchSize sets the number of packets in each batch of work.
+// The default is 256. It has no effect once reading from the pipeline
+// has started.
+func (pp *PcapPipeline) SetBatchSize(n int) {
+	if n > 0 {
+		pp.batchSize = n
+	}
+}
+
+// SetMaxBatches sets the maximum number of batches of packets that have
+// been read from the dump but not yet consumed, which bounds the memory
+// used by the pipeline. The default is four times the number of workers.
+// It has no effect once reading from the pipeline has started.
+func (pp *PcapPipeline) SetMaxBatches(n int) {
+	if n > 0 {
+		pp.maxBatches = n
+	}
+}
+
+// Close stops the pipeline. Subsequent reads return an error.
+func (pp *PcapPipeline) Close() error {
+	pp.closeOnce.Do(func() {
+		close(pp.done)
+	})
+	return nil
+}
+
+// NextPayload implements PacketDataSource.
+func (pp *PcapPipeline) NextPayload() ([]byte, error) {
+	payload, _, err := pp.NextPayloadWithMetadata()
+	return payload, err
+}
+
+// NextPayloadWithMetadata implements MetadataDataSource.
+func (pp *PcapPipeline) NextPayloadWithMetadata() ([]byte, PacketMetadata, error) {
+	pkt, err := pp.nextPacket()
+	if err != nil {
+		return nil, PacketMetadata{}, err
+	}
+
+	return pkt.payload, pkt.metadata, nil
+}
+
+// Start the pipeline, decoding segments with the given decoder (if
+// non-nil) and filters. Returns whether the pipeline decodes segments,
+// which is determined by the first call.
+func (pp *PcapPipeline) decodeSegments(decoder *iextp.Decoder, filters []SegmentFilter) bool {
+	pp.start(decoder, filters)
+	return pp.decoder != nil
+}
+
+// Get the next decoded segment.
+func (pp *PcapPipeline) nextSegment() (*pipelinePacket, error) {
+	return pp.nextPacket()
+}
+
+func (pp *PcapPipeline) start(decoder *iextp.Decoder, filters []SegmentFilter) {
+	pp.startOnce.Do(func() {
+		pp.decoder = decoder
+		pp.filters = filters
+		pp.batches = make(chan *pipelineBatch, pp.maxBatches)
+		work := make(chan *pipelineBatch, pp.workers)
+		go pp.read(work)
+		for i := 0; i < pp.workers; i++ {
+			go pp.work(work)
+		}
+	})
+}
+
+// Get the next packet with a payload from the pipeline.
+func (pp *PcapPipeline) nextPacket() (*pipelinePacket, error) {
+	pp.start(nil, nil)
+	for {
+		select {
+		case <-pp.done:
+			return nil, errPipelineClosed
+		default:
+		}
+
+		if batch := pp.current; batch != nil {
+			for pp.index < len(batch.packets) {
+				pkt := &batch.packets[pp.index]
+				pp.index++
+				if pkt.fragment != nil {
+					pp.reassemble(pkt)
+				}
+				if pkt.hasPayload {
+					return pkt, nil
+				}
+			}
+
+			if batch.err != nil {
+				return nil, batch.err
+			}
+		}
+
+		var batch *pipelineBatch
+		select {
+		case batch = <-pp.batches:
+		case <-pp.done:
+			return nil, errPipelineClosed
+		}
+
+		select {
+		case <-batch.ready:
+		case <-pp.done:
+			return nil, errPipelineClosed
+		}
+
+		pp.current, pp.index = batch, 0
+	}
+}
+
+// Read batches of packets from the dump, queueing each one to be
+// consumed in order and to be parsed by the workers.
+func (pp *PcapPipeline) read(work chan<- *pipelineBatch) {
+	defer close(work)
+	// Size the data of each batch based on the previous one.
+	dataSize := 0
+	for {
+		batch := &pipelineBatch{
+			data:    make([]byte, 0, dataSize+dataSize/8),
+			packets: make([]pipelinePacket, 0, pp.batchSize),
+			ready:   make(chan struct{}),
+		}
+
+		for len(batch.packets) < pp.batchSize {
+			data, ci, err := pp.reader.ZeroCopyReadPacketData()
+			if err != nil {
+				batch.err = err
+				break
+			}
+
+			start := len(batch.data)
+			batch.data = append(batch.data, data...)
+			batch.packets = append(batch.packets, pipelinePacket{
+				ci:    ci,
+				start: start,
+				end:   len(batch.data),
+			})
+		}
+
+		dataSize = len(batch.data)
+		select {
+		case pp.batches <- batch:
+		case <-pp.done:
+			return
+		}
+
+		select {
+		case work <- batch:
+		case <-pp.done:
+			return
+		}
+
+		if batch.err != nil {
+			return
+		}
+	}
+}
+
+func (pp *PcapPipeline) work(work <-chan *pipelineBatch) {
+	for batch := range work {
+		for i := range batch.packets {
+			pp.parsePacket(batch, &batch.packets[i])
+		}
+		close(batch.ready)
+	}
+}
+
+func (pp *PcapPipeline) parsePacket(batch *pipelineBatch, pkt *pipelinePacket) {
+	packet := gopacket.NewPacket(batch.data[pkt.start:pkt.end], pp.linkDecoder,
+		gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	packet.Metadata().CaptureInfo = pkt.ci
+	if ip, ok := packet.NetworkLayer().(*layers.IPv4); ok && isIPv4Fragment(ip) {
+		pkt.fragment = ip
+		return
+	}
+
+	app := packet.ApplicationLayer()
+	if app == nil {
+		return
+	}
+
+	pkt.hasPayload = true
+	pkt.payload = app.Payload()
+	pkt.metadata = packetMetadataOf(packet)
+	pp.decodeSegment(pkt)
+}
+
+// Add the given fragment to the datagram that it is part of, and
+// if the datagram is complete, decode it in place of the fragment.
+func (pp *PcapPipeline) reassemble(pkt *pipelinePacket) {
+	pkt.payload, pkt.metadata, pkt.hasPayload = pp.datagrams.reassemble(pkt.fragment, pkt.ci.Timestamp)
+	if pkt.hasPayload {
+		pp.decodeSegment(pkt)
+	}
+}
+
+// Decode the segment of the given packet's payload, if decoding segments.
+func (pp *PcapPipeline) decodeSegment(pkt *pipelinePacket) {
+	if pp.decoder == nil {
+		return
+	}
+
+	if len(pp.filters) != 0 {
+		if err := pkt.segment.Header.Unmarshal(pkt.payload); err != nil {
+			pkt.decodeErr = err
+			return
+		}
+
+		if !matchesSegmentFilters(pp.filters, &pkt.segment.Header) {
+			pkt.filtered = true
+			return
+		}
+	}
+
+	pkt.decodeErr = pp.decoder.UnmarshalSegment(pkt.payload, &pkt.segment)
+}
+
+// inflater decompresses its source in a separate goroutine,
+// buffering a bounded number of chunks of decompressed data.
+type inflater struct {
+	chunks chan inflatedChunk
+	done   <-chan struct{}
+	cur    []byte
+	err    error
+}
+
+type inflatedChunk struct {
+	data []byte
+	err  error
+}
+
+func newInflater(src io.Reader, done <-chan struct{}) *inflater {
+	inf := &inflater{
+		chunks: make(chan inflatedChunk, pipelineChunkBuffer),
+		done:   done,
+	}
+	go inf.inflate(src)
+	return inf
+}
+
+func (inf *inflater) inflate(src io.Reader) {
+	for {
+		buf := make([]byte, pipelineChunkSize)
+		n := 0
+		var err error
+		for n < len(buf) && err == nil {
+			var nRead int
+			nRead, err = src.Read(buf[n:])
+			n += nRead
+		}
+
+		select {
+		case inf.chunks <- inflatedChunk{buf[:n], err}:
+		case <-inf.done:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read implements io.Reader.
+func (inf *inflater) Read(p []byte) (int, error) {
+	for len(inf.cur) == 0 {
+		if inf.err != nil {
+			return 0, inf.err
+		}
+
+		select {
+		case chunk := <-inf.chunks:
+			inf.cur, inf.err = chunk.data, chunk.err
+		case <-inf.done:
+			return 0, errPipelineClosed
+		}
+	}
+
+	n := copy(p, inf.cur)
+	inf.cur = inf.cur[n:]
+	return n, nil
+}
@@ -0,0 +1,267 @@
+package iex
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+)
+
+func openTestPipeline(t testing.TB, filename string) *PcapPipeline {
+	f, err := os.Open(filepath.Join("testdata", filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pipeline, err := NewPcapPipeline(f)
+	if err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+
+	// The pipeline reads the file in the background, so close
+	// the file once the pipeline has been stopped.
+	t.Cleanup(func() {
+		pipeline.Close()
+		time.Sleep(10 * time.Millisecond)
+		f.Close()
+	})
+	return pipeline
+}
+
+func TestPcapPipeline_Payloads(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping pcap test in short mode.")
+	}
+
+	for _, filename := range []string{"DEEP10.pcap.gz", "TOPS16.pcapng.gz"} {
+		t.Run(filename, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			expected, err := NewPcapDataSource(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pipeline := openTestPipeline(t, filename)
+			pipeline.SetWorkers(3)
+			pipeline.SetBatchSize(7)
+			pipeline.SetMaxBatches(2)
+
+			for n := 0; ; n++ {
+				expectedPayload, expectedMetadata, expectedErr := expected.NextPayloadWithMetadata()
+				payload, metadata, err := pipeline.NextPayloadWithMetadata()
+				if err != expectedErr {
+					t.Fatalf("payload %v: error %v, expected %v", n, err, expectedErr)
+				} else if err != nil {
+					break
+				}
+
+				if !bytes.Equal(payload, expectedPayload) {
+					t.Fatalf("payload %v: %x, expected: %x", n, payload, expectedPayload)
+				}
+				if !reflect.DeepEqual(metadata, expectedMetadata) {
+					t.Fatalf("payload %v: metadata %+v, expected: %+v", n, metadata, expectedMetadata)
+				}
+			}
+		})
+	}
+}
+
+func TestPcapPipeline_Scanner(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping pcap test in short mode.")
+	}
+
+	for _, filename := range []string{"DEEP10.pcap.gz", "TOPS16.pcapng.gz"} {
+		t.Run(filename, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			source, err := NewPcapDataSource(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := NewPcapScanner(source)
+			scanner := NewPcapScanner(openTestPipeline(t, filename))
+
+			for n := 0; ; n++ {
+				expectedMsg, expectedErr := expected.NextMessage()
+				msg, err := scanner.NextMessage()
+				if err != expectedErr {
+					t.Fatalf("message %v: error %v, expected %v", n, err, expectedErr)
+				} else if err != nil {
+					break
+				}
+
+				buf, _ := msg.(iextp.Marshaler).Marshal()
+				expectedBuf, _ := expectedMsg.(iextp.Marshaler).Marshal()
+				if !bytes.Equal(buf, expectedBuf) {
+					t.Fatalf("message %v: %v, expected: %v", n, msg, expectedMsg)
+				}
+				if scanner.SegmentHeader() != expected.SegmentHeader() {
+					t.Fatalf("message %v: segment header %+v, expected: %+v",
+						n, scanner.SegmentHeader(), expected.SegmentHeader())
+				}
+				if !reflect.DeepEqual(scanner.PacketMetadata(), expected.PacketMetadata()) {
+					t.Fatalf("message %v: metadata %+v, expected: %+v",
+						n, scanner.PacketMetadata(), expected.PacketMetadata())
+				}
+			}
+
+			if scanner.Stats() != expected.Stats() {
+				t.Fatalf("stats: %+v, expected: %+v", scanner.Stats(), expected.Stats())
+			}
+		})
+	}
+}
+
+// Write the given payloads to an uncompressed pcap dump.
+func writeTestPcap(t *testing.T, payloads [][]byte) []byte {
+	var buf bytes.Buffer
+	w, err := NewPcapWriter(&buf, FormatPcap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, payload := range payloads {
+		if err := w.WriteDatagram(testSendTime, testSrcAddr, testDstAddr, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestPcapPipeline_SegmentFilters(t *testing.T) {
+	data := writeTestPcap(t, makeMixedSource(t).payloads)
+	pipeline, err := NewPcapPipeline(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipeline.Close()
+
+	pipeline.SetBatchSize(2)
+	scanner := NewPcapScanner(pipeline)
+	scanner.SetSkipUndecodable(true)
+	scanner.SetSegmentFilters(MatchMessageProtocol(deep.V_1_0_MessageProtocolID))
+
+	var tradeIDs []int64
+	err = scanner.Visit(func(msg iextp.Message) error {
+		if trade, ok := msg.(*deep.TradeReportMessage); ok {
+			tradeIDs = append(tradeIDs, trade.TradeID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []int64{1, 2}; !reflect.DeepEqual(tradeIDs, expected) {
+		t.Fatalf("scanned: %v, expected: %v", tradeIDs, expected)
+	}
+	if stats := scanner.Stats(); stats.Messages != 2 || stats.FilteredSegments != 2 ||
+		stats.UndecodablePayloads != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// Without skipping, the unrelated traffic is an error.
+	pipeline, err = NewPcapPipeline(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipeline.Close()
+
+	scanner = NewPcapScanner(pipeline)
+	if _, err := scanner.NextMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scanner.NextMessage(); err == nil {
+		t.Fatal("expected error decoding unrelated traffic")
+	}
+}
+
+func TestPcapPipeline_Close(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping pcap test in short mode.")
+	}
+
+	nGoroutines := runtime.NumGoroutine()
+	pipeline := openTestPipeline(t, "DEEP10.pcap.gz")
+	pipeline.SetMaxBatches(1)
+	if _, err := pipeline.NextPayload(); err != nil {
+		t.Fatal(err)
+	}
+
+	pipeline.Close()
+	if _, err := pipeline.NextPayload(); err != errPipelineClosed {
+		t.Fatalf("expected error reading from closed pipeline, got %v", err)
+	}
+
+	// All stages should stop.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > nGoroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v goroutines still running after close, expected %v",
+				runtime.NumGoroutine(), nGoroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewPcapPipeline_Invalid(t *testing.T) {
+	if _, err := NewPcapPipeline(bytes.NewReader([]byte("not a pcap"))); err == nil {
+		t.Fatal("expected error creating pipeline from invalid data")
+	}
+}
+
+func BenchmarkPcapPipeline_DEEP10(b *testing.B) {
+	f, err := os.Open(filepath.Join("testdata", "DEEP10.pcap.gz"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(stat.Size())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		pipeline, err := NewPcapPipeline(f)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		scanner := NewPcapScanner(pipeline)
+		for {
+			if _, err := scanner.NextMessage(); err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package iex
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recorder persists UDP datagrams, such as those received from an IEX-TP
+// multicast feed, to pcap or pcap-ng dumps that can be read back with
+// NewPcapDataSource.
+//
+// The format of the dump is determined by the extension of the path:
+// ".pcapng" files are written in the pcap-ng format, and all others in
+// the pcap format. If the path ends in the extension of a compression
+// format (e.g. "tops.pcap.gz" or "tops.pcap.zst"), the dump is compressed
+// in that format (see CompressionOf). Bzip2 output is not supported.
+//
+// If rotation is enabled with SetMaxFileSize or SetRotateInterval, a
+// sequence number is inserted before the extension of each file, e.g.
+// "tops-000001.pcap.gz", "tops-000002.pcap.gz", ... Existing files are
+// never overwritten: names that are already taken, such as by the files
+// of a previous recording, are skipped. Without rotation, writing fails
+// if the file already exists.
+//
+// A Recorder is safe for concurrent use. Close must be called to flush
+// and close the current file; otherwise it may be truncated.
+type Recorder struct {
+	path           string
+	format         PcapFormat
+	compression    Compression
+	maxFileSize    int64
+	rotateInterval time.Duration
+
+	mu         sync.Mutex
+	closed     bool
+	conn       net.PacketConn
+	fileNum    int
+	filenames  []string
+	file       *os.File
+	counter    *countingWriter
+	bufw       *bufio.Writer
+	compressor io.WriteCloser
+	writer     *PcapWriter
+	fileTime   time.Time
+}
+
+// NewRecorder creates a new Recorder that writes to the given path.
+// The first file is not created until the first datagram is written.
+func NewRecorder(path string) *Recorder {
+	ext := filepath.Ext(path)
+	compression := CompressionOf(path)
+	if compression != Uncompressed {
+		ext = filepath.Ext(strings.TrimSuffix(path, ext))
+	}
+
+	format := FormatPcap
+	if ext == ".pcapng" {
+		format = FormatPcapNG
+	}
+
+	return &Recorder{
+		path:        path,
+		format:      format,
+		compression: compression,
+	}
+}
+
+// SetMaxFileSize enables rotation to a new file once the current file
+// has reached n bytes. The limit is approximate, since data is buffered
+// (and compressed, for compressed files) before it is written to the file.
+// A limit of 0 (the default) disables rotation by size.
+func (r *Recorder) SetMaxFileSize(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxFileSize = n
+}
+
+// SetRotateInterval enables rotation to a new file at each multiple of d
+// since the zero time, based on the timestamps of the written datagrams.
+// For example, an interval of time.Hour starts a new file at the top of
+// every hour. An interval of 0 (the default) disables rotation by time.
+func (r *Recorder) SetRotateInterval(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rotateInterval = d
+}
+
+// Filenames returns the names of all files written so far,
+// in the order they were created.
+func (r *Recorder) Filenames() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.filenames...)
+}
+
+// WriteDatagram records a datagram with the given payload received
+// at the given time from src, addressed to dst.
+func (r *Recorder) WriteDatagram(timestamp time.Time, src, dst *net.UDPAddr, payload []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return fmt.Errorf("cannot write datagram: recorder is closed")
+	}
+
+	if r.writer == nil || r.shouldRotate(timestamp) {
+		if err := r.rotate(timestamp); err != nil {
+			return err
+		}
+	}
+
+	return r.writer.WriteDatagram(timestamp, src, dst, payload)
+}
+
+// Record reads datagrams from conn and records them with the time they
+// were received, until Close is called or conn returns an error.
+// The destination address of each datagram is taken to be the local
+// address of conn.
+//
+// Returns nil if the recording was stopped by Close.
+func (r *Recorder) Record(conn net.PacketConn) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.conn = conn
+	r.mu.Unlock()
+
+	dst, _ := conn.LocalAddr().(*net.UDPAddr)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		timestamp := time.Now()
+		if err != nil {
+			if r.isClosed() {
+				return nil
+			}
+			return err
+		}
+
+		src, _ := addr.(*net.UDPAddr)
+		if err := r.WriteDatagram(timestamp, src, dst, buf[:n]); err != nil {
+			if r.isClosed() {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Close stops the active call to Record (if any) and flushes and closes
+// the current file. The connection passed to Record is not closed.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	if r.conn != nil {
+		// Unblock the pending read in Record.
+		r.conn.SetReadDeadline(time.Now())
+	}
+
+	return r.closeFile()
+}
+
+func (r *Recorder) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+func (r *Recorder) isRotating() bool {
+	return r.maxFileSize > 0 || r.rotateInterval > 0
+}
+
+func (r *Recorder) shouldRotate(timestamp time.Time) bool {
+	if r.maxFileSize > 0 && r.counter.n >= r.maxFileSize {
+		return true
+	}
+
+	return r.rotateInterval > 0 &&
+		!timestamp.Truncate(r.rotateInterval).Equal(r.fileTime)
+}
+
+// Returns the name of the i'th file written when rotation is enabled.
+func (r *Recorder) filename(i int) string {
+	ext := filepath.Ext(r.path)
+	if r.compression != Uncompressed {
+		ext = filepath.Ext(strings.TrimSuffix(r.path, ext)) + ext
+	}
+	base := strings.TrimSuffix(r.path, ext)
+
+	return fmt.Sprintf("%s-%06d%s", base, i, ext)
+}
+
+// Close the current file (if any) and open the next one.
+func (r *Recorder) rotate(timestamp time.Time) error {
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+
+	f, err := r.createNext()
+	if err != nil {
+		return err
+	}
+
+	r.filenames = append(r.filenames, f.Name())
+	r.file = f
+	r.counter = &countingWriter{w: f}
+	r.bufw = bufio.NewWriter(r.counter)
+	r.compressor, err = NewCompressedWriter(r.bufw, r.compression)
+	if err != nil {
+		r.closeFile()
+		return err
+	}
+
+	r.writer, err = NewPcapWriter(r.compressor, r.format)
+	if err != nil {
+		r.closeFile()
+		return err
+	}
+
+	if r.rotateInterval > 0 {
+		r.fileTime = timestamp.Truncate(r.rotateInterval)
+	}
+
+	return nil
+}
+
+// Create the next file. When rotation is enabled, the file is created
+// with the next sequence number whose name is not already taken.
+func (r *Recorder) createNext() (*os.File, error) {
+	const flag = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if !r.isRotating() {
+		r.fileNum++
+		return os.OpenFile(r.path, flag, 0666)
+	}
+
+	for {
+		r.fileNum++
+		f, err := os.OpenFile(r.filename(r.fileNum), flag, 0666)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
+
+func (r *Recorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+
+	var err error
+	if r.writer != nil {
+		err = r.writer.Flush()
+	}
+	if r.compressor != nil {
+		if compressErr := r.compressor.Close(); err == nil {
+			err = compressErr
+		}
+	}
+	if flushErr := r.bufw.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	r.file = nil
+	r.counter = nil
+	r.bufw = nil
+	r.compressor = nil
+	r.writer = nil
+	return err
+}
+
+// countingWriter counts the number of bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
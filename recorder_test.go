@@ -0,0 +1,365 @@
+package iex
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	testSrcAddr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 10378}
+	testDstAddr = &net.UDPAddr{IP: net.IPv4(233, 215, 21, 4), Port: 10378}
+)
+
+func makeTestPayloads(n int) [][]byte {
+	var payloads [][]byte
+	for i := 0; i < n; i++ {
+		payloads = append(payloads, []byte(fmt.Sprintf("datagram %d", i)))
+	}
+	return payloads
+}
+
+// Read all of the payloads from the given pcap dump file(s).
+func readPayloads(t *testing.T, filenames ...string) [][]byte {
+	var result [][]byte
+	for _, filename := range filenames {
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		packetDataSource, err := NewPcapDataSource(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for {
+			payload, err := packetDataSource.NextPayload()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%v: %v", filename, err)
+			}
+
+			result = append(result, append([]byte(nil), payload...))
+		}
+	}
+
+	return result
+}
+
+func TestPcapWriter(t *testing.T) {
+	payloads := makeTestPayloads(10)
+	for _, format := range []PcapFormat{FormatPcap, FormatPcapNG} {
+		var buf bytes.Buffer
+		w, err := NewPcapWriter(&buf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Date(2017, time.April, 25, 15, 3, 18, 123456789, time.UTC)
+		for i, payload := range payloads {
+			timestamp := start.Add(time.Duration(i) * time.Millisecond)
+			if err := w.WriteDatagram(timestamp, testSrcAddr, testDstAddr, payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		packetDataSource, err := NewPcapDataSource(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, payload := range payloads {
+			packet, err := packetDataSource.packetSource.NextPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedTime := start.Add(time.Duration(i) * time.Millisecond)
+			if ts := packet.Metadata().Timestamp; !ts.Equal(expectedTime) {
+				t.Fatalf("%v: packet timestamp %v, expected %v", format, ts, expectedTime)
+			}
+
+			ip, _ := packet.NetworkLayer().(*layers.IPv4)
+			udp, _ := packet.TransportLayer().(*layers.UDP)
+			if ip == nil || udp == nil {
+				t.Fatalf("%v: expected an IPv4/UDP packet, got: %v", format, packet)
+			}
+			if !ip.SrcIP.Equal(testSrcAddr.IP) || !ip.DstIP.Equal(testDstAddr.IP) ||
+				int(udp.SrcPort) != testSrcAddr.Port || int(udp.DstPort) != testDstAddr.Port {
+				t.Fatalf("%v: unexpected addresses: %v", format, packet)
+			}
+
+			eth := packet.LinkLayer().(*layers.Ethernet)
+			if eth.DstMAC.String() != "01:00:5e:57:15:04" {
+				t.Fatalf("%v: unexpected multicast MAC: %v", format, eth.DstMAC)
+			}
+
+			if !bytes.Equal(packet.ApplicationLayer().Payload(), payload) {
+				t.Fatalf("%v: payload %q, expected %q", format,
+					packet.ApplicationLayer().Payload(), payload)
+			}
+		}
+
+		if _, err := packetDataSource.NextPayload(); err != io.EOF {
+			t.Fatalf("%v: expected EOF, got %v", format, err)
+		}
+	}
+}
+
+func TestPcapWriter_IPv6(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewPcapWriter(&buf, FormatPcap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &net.UDPAddr{IP: net.ParseIP("ff02::1"), Port: 10378}
+	if err := w.WriteDatagram(time.Now(), nil, dst, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	packetDataSource, err := NewPcapDataSource(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := packetDataSource.packetSource.NextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := packet.NetworkLayer().(*layers.IPv6); !ok {
+		t.Fatalf("expected an IPv6 packet, got %v", packet)
+	}
+	if payload := packet.ApplicationLayer().Payload(); string(payload) != "hello" {
+		t.Fatalf("unexpected payload: %q", payload)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	payloads := makeTestPayloads(100)
+	for _, name := range []string{"test.pcap", "test.pcap.gz", "test.pcapng", "test.pcapng.gz",
+		"test.pcap.zst", "test.pcapng.xz"} {
+		path := filepath.Join(t.TempDir(), name)
+		r := NewRecorder(path)
+		for _, payload := range payloads {
+			if err := r.WriteDatagram(time.Now(), testSrcAddr, testDstAddr, payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if filenames := r.Filenames(); !reflect.DeepEqual(filenames, []string{path}) {
+			t.Fatalf("%v: unexpected filenames: %v", name, filenames)
+		}
+
+		if recorded := readPayloads(t, path); !reflect.DeepEqual(recorded, payloads) {
+			t.Fatalf("%v: recorded %d payloads, expected %d", name, len(recorded), len(payloads))
+		}
+
+		if err := r.WriteDatagram(time.Now(), nil, nil, payloads[0]); err == nil {
+			t.Fatalf("%v: should not be able to write after Close", name)
+		}
+	}
+}
+
+func TestRecorder_RotateBySize(t *testing.T) {
+	payloads := makeTestPayloads(1000)
+	dir := t.TempDir()
+	r := NewRecorder(filepath.Join(dir, "test.pcap.gz"))
+	r.SetMaxFileSize(1024)
+	for _, payload := range payloads {
+		if err := r.WriteDatagram(time.Now(), testSrcAddr, testDstAddr, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	filenames := r.Filenames()
+	if len(filenames) < 2 {
+		t.Fatalf("expected multiple files, got: %v", filenames)
+	}
+	if expected := filepath.Join(dir, "test-000002.pcap.gz"); filenames[1] != expected {
+		t.Fatalf("unexpected filename %v, expected %v", filenames[1], expected)
+	}
+
+	if recorded := readPayloads(t, filenames...); !reflect.DeepEqual(recorded, payloads) {
+		t.Fatalf("recorded %d payloads, expected %d", len(recorded), len(payloads))
+	}
+}
+
+func TestRecorder_RotateByTime(t *testing.T) {
+	payloads := makeTestPayloads(6)
+	r := NewRecorder(filepath.Join(t.TempDir(), "test.pcapng"))
+	r.SetRotateInterval(time.Hour)
+
+	start := time.Date(2017, time.April, 25, 13, 30, 0, 0, time.UTC)
+	for i, payload := range payloads {
+		// Two datagrams every half hour, starting at 13:30.
+		timestamp := start.Add(time.Duration(i/2) * 30 * time.Minute)
+		if err := r.WriteDatagram(timestamp, testSrcAddr, testDstAddr, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	filenames := r.Filenames()
+	if len(filenames) != 2 {
+		t.Fatalf("expected 2 files, got: %v", filenames)
+	}
+	if recorded := readPayloads(t, filenames[0]); !reflect.DeepEqual(recorded, payloads[:2]) {
+		t.Fatalf("unexpected payloads in first file: %q", recorded)
+	}
+	if recorded := readPayloads(t, filenames[1]); !reflect.DeepEqual(recorded, payloads[2:]) {
+		t.Fatalf("unexpected payloads in second file: %q", recorded)
+	}
+}
+
+func TestRecorder_RotateExisting(t *testing.T) {
+	payloads := makeTestPayloads(4)
+	dir := t.TempDir()
+	record := func(payloads [][]byte) []string {
+		r := NewRecorder(filepath.Join(dir, "test.pcap"))
+		r.SetRotateInterval(time.Hour)
+		start := time.Date(2017, time.April, 25, 13, 0, 0, 0, time.UTC)
+		for i, payload := range payloads {
+			timestamp := start.Add(time.Duration(i) * time.Hour)
+			if err := r.WriteDatagram(timestamp, testSrcAddr, testDstAddr, payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return r.Filenames()
+	}
+
+	first := record(payloads[:2])
+	// Restarting the recording must not overwrite the previous files.
+	second := record(payloads[2:])
+	expected := []string{filepath.Join(dir, "test-000003.pcap"), filepath.Join(dir, "test-000004.pcap")}
+	if !reflect.DeepEqual(second, expected) {
+		t.Fatalf("unexpected filenames: %v, expected: %v", second, expected)
+	}
+
+	if recorded := readPayloads(t, append(first, second...)...); !reflect.DeepEqual(recorded, payloads) {
+		t.Fatalf("recorded %d payloads, expected %d", len(recorded), len(payloads))
+	}
+}
+
+func TestRecorder_Existing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.pcap")
+	if err := os.WriteFile(path, []byte("previous recording"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRecorder(path)
+	if err := r.WriteDatagram(time.Now(), testSrcAddr, testDstAddr, []byte("payload")); err == nil {
+		t.Fatal("expected error writing to an existing file")
+	}
+	r.Close()
+
+	if data, err := os.ReadFile(path); err != nil || string(data) != "previous recording" {
+		t.Fatalf("existing file was overwritten: %q, %v", data, err)
+	}
+}
+
+// notifyingConn signals on reading before each call to ReadFrom.
+type notifyingConn struct {
+	net.PacketConn
+	reading chan struct{}
+}
+
+func (nc *notifyingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case nc.reading <- struct{}{}:
+	default:
+	}
+	return nc.PacketConn.ReadFrom(p)
+}
+
+func TestRecorder_Record(t *testing.T) {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+	conn := &notifyingConn{packetConn, make(chan struct{}, 100)}
+
+	path := filepath.Join(t.TempDir(), "test.pcap.gz")
+	r := NewRecorder(path)
+	done := make(chan error)
+	go func() {
+		done <- r.Record(conn)
+	}()
+
+	sender, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	payloads := makeTestPayloads(10)
+	for _, payload := range payloads {
+		if _, err := sender.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Wait for all of the datagrams to be recorded, i.e. until Record
+	// is waiting to read the next one, before closing.
+	for i := 0; i <= len(payloads); i++ {
+		select {
+		case <-conn.reading:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for datagrams to be recorded")
+		}
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Record should return nil after Close, got: %v", err)
+	}
+
+	if recorded := readPayloads(t, path); !reflect.DeepEqual(recorded, payloads) {
+		t.Fatalf("recorded %q, expected %q", recorded, payloads)
+	}
+
+	// The recorded packets should be addressed to the listener.
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	packetDataSource, err := NewPcapDataSource(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := packetDataSource.packetSource.NextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if udp := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); int(udp.DstPort) != conn.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("unexpected destination port: %v", udp.DstPort)
+	}
+}
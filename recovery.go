@@ -0,0 +1,133 @@
+package iex
+
+import (
+	"sort"
+
+	"github.com/xuforr/go-iex/iextp"
+)
+
+// GapRecoverer retrieves messages that a PcapScanner did not receive,
+// for example from a retransmission server.
+type GapRecoverer interface {
+	// Recover returns the payloads of the IEX-TP segments containing
+	// the messages in the given gap. The segments may also contain
+	// messages outside of the gap, which are ignored.
+	//
+	// If only part of the gap can be recovered, Recover should return
+	// the segments that are available. Any messages that are not
+	// recovered are reported as a gap by the PcapScanner.
+	Recover(gap Gap) ([][]byte, error)
+}
+
+// SetGapRecoverer sets the GapRecoverer that is used to fill any gaps
+// in the message sequence numbers of a session. Recovered messages are
+// returned by NextMessage in sequence order, before the messages that
+// follow the gap.
+//
+// If the recoverer returns an error, or only some of the messages in
+// a gap can be recovered, the remaining missing messages are reported
+// to the gap handler.
+func (p *PcapScanner) SetGapRecoverer(r GapRecoverer) {
+	p.recoverer = r
+}
+
+// Handle a detected gap, recovering any missing messages if possible.
+// Returns the recovered messages in sequence order, and appends the
+// segments they came from to segments.
+func (p *PcapScanner) handleGap(gap Gap, segments []scannedSegment) ([]iextp.Message, []scannedSegment) {
+	if p.recoverer == nil {
+		p.reportGap(gap)
+		return nil, segments
+	}
+
+	recovered, segments, missing := p.recoverGap(gap, segments)
+	p.stats.RecoveredMessages += int64(len(recovered))
+	for _, gap := range missing {
+		p.reportGap(gap)
+	}
+
+	return recovered, segments
+}
+
+func (p *PcapScanner) reportGap(gap Gap) {
+	p.stats.Gaps++
+	p.stats.MissingMessages += gap.Count
+	if p.onGap != nil {
+		p.onGap(gap)
+	}
+}
+
+// A message recovered from a segment.
+type recoveredMessage struct {
+	msg    iextp.Message
+	header *iextp.SegmentHeader
+}
+
+// Request the messages in the gap from the recoverer. Returns the
+// messages that were recovered, the segments they came from appended
+// to segments, and the remaining gaps (if any).
+func (p *PcapScanner) recoverGap(gap Gap, segments []scannedSegment) ([]iextp.Message, []scannedSegment, []Gap) {
+	payloads, err := p.recoverer.Recover(gap)
+	if err != nil {
+		return nil, segments, []Gap{gap}
+	}
+
+	// Messages are indexed by sequence number, since the size of the gap
+	// comes from the wire and may be far larger than what is recovered.
+	key := sessionKey{gap.MessageProtocolID, gap.ChannelID, gap.SessionID}
+	bySeq := make(map[int64]recoveredMessage)
+	for _, payload := range payloads {
+		segment := iextp.Segment{}
+		if err := p.decoder.UnmarshalSegment(payload, &segment); err != nil {
+			continue
+		}
+
+		if sessionKeyOf(&segment.Header) != key {
+			continue
+		}
+
+		header := &segment.Header
+		for i, msg := range segment.Messages {
+			seq := header.FirstMessageSequenceNumber + int64(i)
+			if seq >= gap.FirstSequenceNumber && seq < gap.End() {
+				bySeq[seq] = recoveredMessage{msg, header}
+			}
+		}
+	}
+
+	seqs := make([]int64, 0, len(bySeq))
+	for seq := range bySeq {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	var recovered []iextp.Message
+	var missing []Gap
+	var lastHeader *iextp.SegmentHeader
+	next := gap.FirstSequenceNumber
+	addMissing := func(end int64) {
+		if end > next {
+			remaining := gap
+			remaining.FirstSequenceNumber = next
+			remaining.Count = end - next
+			missing = append(missing, remaining)
+		}
+	}
+	for _, seq := range seqs {
+		addMissing(seq)
+		next = seq + 1
+
+		rm := bySeq[seq]
+		if rm.header != lastHeader {
+			lastHeader = rm.header
+			segments = append(segments, scannedSegment{
+				header: *rm.header,
+				start:  len(recovered),
+			})
+		}
+		recovered = append(recovered, rm.msg)
+	}
+	addMissing(gap.End())
+
+	return recovered, segments, missing
+}
@@ -0,0 +1,116 @@
+package iex
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Recovers segments from a fixed list of payloads.
+type testRecoverer struct {
+	payloads [][]byte
+	requests []Gap
+	err      error
+}
+
+func (tr *testRecoverer) Recover(gap Gap) ([][]byte, error) {
+	tr.requests = append(tr.requests, gap)
+	return tr.payloads, tr.err
+}
+
+func TestPcapScanner_GapRecovery(t *testing.T) {
+	source := &payloadSource{[][]byte{
+		makeTestSegment(t, 1, 2),
+		makeTestSegment(t, 8, 2), // Missing 3-7
+	}}
+
+	recoverer := &testRecoverer{
+		payloads: [][]byte{
+			makeTestSegment(t, 2, 3), // Overlaps with already received messages.
+			makeTestSegment(t, 6, 2),
+		},
+	}
+
+	scanner := NewPcapScanner(source)
+	scanner.SetGapRecoverer(recoverer)
+	var gaps []Gap
+	scanner.SetGapHandler(func(gap Gap) {
+		gaps = append(gaps, gap)
+	})
+
+	tradeIDs := scanTradeIDs(t, scanner)
+	expectedIDs := []int64{1, 2, 3, 4, 6, 7, 8, 9}
+	if !reflect.DeepEqual(tradeIDs, expectedIDs) {
+		t.Fatalf("scanned: %v, expected: %v", tradeIDs, expectedIDs)
+	}
+
+	if len(recoverer.requests) != 1 || recoverer.requests[0].FirstSequenceNumber != 3 ||
+		recoverer.requests[0].Count != 5 {
+		t.Fatalf("unexpected recovery requests: %v", recoverer.requests)
+	}
+
+	// Sequence number 5 could not be recovered.
+	if len(gaps) != 1 || gaps[0].FirstSequenceNumber != 5 || gaps[0].Count != 1 {
+		t.Fatalf("unexpected gaps: %v", gaps)
+	}
+
+	stats := scanner.Stats()
+	if stats.RecoveredMessages != 4 || stats.Gaps != 1 || stats.MissingMessages != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestPcapScanner_GapRecoveryError(t *testing.T) {
+	source := &payloadSource{[][]byte{
+		makeTestSegment(t, 1, 2),
+		makeTestSegment(t, 5, 1),
+	}}
+
+	recoverer := &testRecoverer{
+		payloads: [][]byte{makeTestSegment(t, 3, 2)},
+		err:      errors.New("recovery failed"),
+	}
+
+	scanner := NewPcapScanner(source)
+	scanner.SetGapRecoverer(recoverer)
+
+	tradeIDs := scanTradeIDs(t, scanner)
+	expectedIDs := []int64{1, 2, 5}
+	if !reflect.DeepEqual(tradeIDs, expectedIDs) {
+		t.Fatalf("scanned: %v, expected: %v", tradeIDs, expectedIDs)
+	}
+
+	if stats := scanner.Stats(); stats.Gaps != 1 || stats.MissingMessages != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestPcapScanner_GapRecoveryCorruptSequence(t *testing.T) {
+	// A corrupt sequence number makes for an enormous gap.
+	const corrupt = int64(1) << 40
+	source := &payloadSource{[][]byte{
+		makeTestSegment(t, 1, 2),
+		makeTestSegment(t, corrupt, 1),
+	}}
+
+	recoverer := &testRecoverer{
+		payloads: [][]byte{makeTestSegment(t, 3, 2)},
+	}
+
+	scanner := NewPcapScanner(source)
+	scanner.SetGapRecoverer(recoverer)
+	var gaps []Gap
+	scanner.SetGapHandler(func(gap Gap) {
+		gaps = append(gaps, gap)
+	})
+
+	tradeIDs := scanTradeIDs(t, scanner)
+	expectedIDs := []int64{1, 2, 3, 4, corrupt}
+	if !reflect.DeepEqual(tradeIDs, expectedIDs) {
+		t.Fatalf("scanned: %v, expected: %v", tradeIDs, expectedIDs)
+	}
+
+	if len(gaps) != 1 || gaps[0].FirstSequenceNumber != 5 || gaps[0].Count != corrupt-5 {
+		t.Fatalf("unexpected gaps: %v", gaps)
+	}
+}
@@ -0,0 +1,188 @@
+// Package refdata maintains reference data for the securities traded
+// on IEX from the security directory messages of the TOPS, DEEP and
+// DEEP+ feeds.
+package refdata
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/tops"
+)
+
+// Security is the reference data for a single security.
+type Security struct {
+	Symbol string `json:"symbol"`
+	// The number of shares that represent a round lot for the security.
+	RoundLotSize uint32 `json:"roundLotSize"`
+	// The corporate action adjusted previous official closing price.
+	AdjustedPOCPrice float64 `json:"adjustedPOCPrice"`
+	// The Limit Up-Limit Down price band tier (e.g. tops.LULDTier1).
+	LULDTier uint8 `json:"luldTier"`
+	// Whether the security is a test security, a when issued
+	// security, or an exchange traded product.
+	TestSecurity bool `json:"testSecurity"`
+	WhenIssued   bool `json:"whenIssued"`
+	ETP          bool `json:"etp"`
+	// The time of the last update to the security.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// FromMessage returns the Security described by the given
+// SecurityDirectoryMessage.
+func FromMessage(msg *tops.SecurityDirectoryMessage) Security {
+	return Security{
+		Symbol:           msg.Symbol,
+		RoundLotSize:     msg.RoundLotSize,
+		AdjustedPOCPrice: msg.AdjustedPOCPrice,
+		LULDTier:         msg.LULDTier,
+		TestSecurity:     msg.IsTestSecurity(),
+		WhenIssued:       msg.IsWhenIssuedSecurity(),
+		ETP:              msg.IsETP(),
+		Timestamp:        msg.Timestamp,
+	}
+}
+
+var csvHeader = []string{
+	"symbol",
+	"round_lot_size",
+	"adjusted_poc_price",
+	"luld_tier",
+	"test_security",
+	"when_issued",
+	"etp",
+	"timestamp",
+}
+
+func (s Security) csvRecord() []string {
+	return []string{
+		s.Symbol,
+		strconv.FormatUint(uint64(s.RoundLotSize), 10),
+		strconv.FormatFloat(s.AdjustedPOCPrice, 'f', 4, 64),
+		strconv.Itoa(int(s.LULDTier)),
+		strconv.FormatBool(s.TestSecurity),
+		strconv.FormatBool(s.WhenIssued),
+		strconv.FormatBool(s.ETP),
+		s.Timestamp.Format(time.RFC3339Nano),
+	}
+}
+
+// Directory is a store of the reference data of every security
+// in the security directory of a feed.
+//
+// IEX disseminates a pre-market spin of the security directory for
+// IEX-listed securities, and relays intraday changes thereafter, so a
+// Directory populated from a full day of data includes every security.
+// Directories may also be saved with WriteJSON and loaded with ReadJSON.
+type Directory struct {
+	securities map[string]Security
+}
+
+// NewDirectory creates an empty Directory.
+func NewDirectory() *Directory {
+	return &Directory{
+		securities: make(map[string]Security),
+	}
+}
+
+// Process updates the directory with the given message.
+// Messages other than SecurityDirectoryMessages are ignored.
+//
+// Returns true if the message was a SecurityDirectoryMessage.
+func (d *Directory) Process(msg iextp.Message) bool {
+	sd, ok := msg.(*tops.SecurityDirectoryMessage)
+	if !ok {
+		return false
+	}
+
+	d.Add(FromMessage(sd))
+	return true
+}
+
+// Add adds the given security to the directory,
+// replacing any existing security with the same symbol.
+func (d *Directory) Add(s Security) {
+	d.securities[s.Symbol] = s
+}
+
+// Security returns the reference data for the given symbol.
+// Returns false if the symbol is not in the directory.
+func (d *Directory) Security(symbol string) (Security, bool) {
+	s, ok := d.securities[symbol]
+	return s, ok
+}
+
+// IsTestSecurity returns true if the given symbol is in
+// the directory and is a test security.
+func (d *Directory) IsTestSecurity(symbol string) bool {
+	return d.securities[symbol].TestSecurity
+}
+
+// Len returns the number of securities in the directory.
+func (d *Directory) Len() int {
+	return len(d.securities)
+}
+
+// Symbols returns the sorted list of symbols in the directory.
+func (d *Directory) Symbols() []string {
+	symbols := make([]string, 0, len(d.securities))
+	for symbol := range d.securities {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// Securities returns the securities in the directory, sorted by symbol.
+func (d *Directory) Securities() []Security {
+	result := make([]Security, 0, len(d.securities))
+	for _, symbol := range d.Symbols() {
+		result = append(result, d.securities[symbol])
+	}
+	return result
+}
+
+// WriteJSON writes the directory to w as a JSON array
+// of securities, sorted by symbol.
+func (d *Directory) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d.Securities())
+}
+
+// ReadJSON reads a directory written by WriteJSON.
+func ReadJSON(r io.Reader) (*Directory, error) {
+	var securities []Security
+	if err := json.NewDecoder(r).Decode(&securities); err != nil {
+		return nil, err
+	}
+
+	d := NewDirectory()
+	for _, s := range securities {
+		d.Add(s)
+	}
+	return d, nil
+}
+
+// WriteCSV writes the directory to w in CSV format, with
+// a header row followed by a row per security, sorted by symbol.
+func (d *Directory) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+
+	for _, s := range d.Securities() {
+		if err := writer.Write(s.csvRecord()); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,151 @@
+package refdata
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/tops"
+	"github.com/xuforr/go-iex/internal/testpcap"
+)
+
+var directoryTime = time.Date(2017, time.July, 10, 14, 32, 38, 379246212, time.UTC)
+
+func TestFromMessage(t *testing.T) {
+	s := FromMessage(&tops.SecurityDirectoryMessage{
+		MessageType:      tops.SecurityDirectory,
+		Flags:            0xa0,
+		Timestamp:        directoryTime,
+		Symbol:           "ZIEXT",
+		RoundLotSize:     100,
+		AdjustedPOCPrice: 99.05,
+		LULDTier:         tops.LULDTier1,
+	})
+
+	expected := Security{
+		Symbol:           "ZIEXT",
+		RoundLotSize:     100,
+		AdjustedPOCPrice: 99.05,
+		LULDTier:         tops.LULDTier1,
+		TestSecurity:     true,
+		ETP:              true,
+		Timestamp:        directoryTime,
+	}
+	if s != expected {
+		t.Fatalf("security: %+v, expected: %+v", s, expected)
+	}
+}
+
+func makeTestDirectory() *Directory {
+	d := NewDirectory()
+	d.Add(Security{
+		Symbol:           "ZIEXT",
+		RoundLotSize:     100,
+		AdjustedPOCPrice: 99.05,
+		TestSecurity:     true,
+		Timestamp:        directoryTime,
+	})
+	d.Add(Security{
+		Symbol:           "BRK.A",
+		RoundLotSize:     1,
+		AdjustedPOCPrice: 250000,
+		LULDTier:         tops.LULDTier1,
+		Timestamp:        directoryTime,
+	})
+	return d
+}
+
+func TestDirectory(t *testing.T) {
+	d := NewDirectory()
+	msg := &tops.SecurityDirectoryMessage{
+		MessageType:  tops.SecurityDirectory,
+		Flags:        0x80,
+		Timestamp:    directoryTime,
+		Symbol:       "ZIEXT",
+		RoundLotSize: 100,
+	}
+	if !d.Process(msg) {
+		t.Fatal("security directory message should be processed")
+	}
+	if d.Process(&tops.TradeReportMessage{Symbol: "ZIEXT"}) {
+		t.Fatal("trade reports should be ignored")
+	}
+
+	if !d.IsTestSecurity("ZIEXT") || d.IsTestSecurity("SPY") {
+		t.Fatal("only ZIEXT should be a test security")
+	}
+
+	// Intraday updates replace the security.
+	update := *msg
+	update.Timestamp = directoryTime.Add(time.Hour)
+	update.RoundLotSize = 10
+	d.Process(&update)
+	if s, ok := d.Security("ZIEXT"); !ok || s != FromMessage(&update) {
+		t.Fatalf("unexpected security: %+v", s)
+	}
+
+	if _, ok := d.Security("SPY"); ok {
+		t.Fatal("should not have a security for SPY")
+	}
+	if d.Len() != 1 || !reflect.DeepEqual(d.Symbols(), []string{"ZIEXT"}) {
+		t.Fatalf("unexpected symbols: %v", d.Symbols())
+	}
+}
+
+func TestDirectory_JSON(t *testing.T) {
+	d := makeTestDirectory()
+	var buf bytes.Buffer
+	if err := d.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), `"roundLotSize": 100`) {
+		t.Fatalf("unexpected JSON: %s", buf.String())
+	}
+
+	read, err := ReadJSON(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read.Securities(), d.Securities()) {
+		t.Fatalf("read %+v, expected: %+v", read.Securities(), d.Securities())
+	}
+}
+
+func TestDirectory_CSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := makeTestDirectory().WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "symbol,round_lot_size,adjusted_poc_price,luld_tier,test_security,when_issued,etp,timestamp\n" +
+		"BRK.A,1,250000.0000,1,false,false,false,2017-07-10T14:32:38.379246212Z\n" +
+		"ZIEXT,100,99.0500,0,true,false,false,2017-07-10T14:32:38.379246212Z\n"
+	if buf.String() != expected {
+		t.Fatalf("CSV:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestDirectory_TOPS16(t *testing.T) {
+	d := NewDirectory()
+	testpcap.Scan(t, "TOPS16.pcapng.gz", func(msg iextp.Message) {
+		d.Process(msg)
+	})
+
+	if d.Len() != 10 {
+		t.Fatalf("expected 10 securities, got %v", d.Len())
+	}
+
+	var testSecurities []string
+	for _, s := range d.Securities() {
+		if s.TestSecurity {
+			testSecurities = append(testSecurities, s.Symbol)
+		}
+	}
+	if expected := []string{"ZEXIT", "ZIEXT", "ZXIET"}; !reflect.DeepEqual(testSecurities, expected) {
+		t.Fatalf("test securities: %v, expected: %v", testSecurities, expected)
+	}
+}
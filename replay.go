@@ -0,0 +1,94 @@
+package iex
+
+import (
+	"io"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+)
+
+// Replayer re-emits the payloads from a PacketDataSource, such as a pcap
+// dump, pacing them according to the SendTime of each IEX-TP segment.
+// It can be used to test consumers of a live feed against recorded
+// sessions.
+type Replayer struct {
+	source    PacketDataSource
+	speed     float64
+	startTime time.Time
+	endTime   time.Time
+}
+
+// NewReplayer creates a new Replayer for the given source that replays
+// payloads in real time.
+func NewReplayer(source PacketDataSource) *Replayer {
+	return &Replayer{
+		source: source,
+		speed:  1,
+	}
+}
+
+// SetSpeed sets the replay speed as a multiple of real time,
+// e.g. 2 replays twice as fast as the payloads were originally sent.
+// A speed of 0 replays payloads as fast as possible, without pacing.
+func (r *Replayer) SetSpeed(multiplier float64) {
+	r.speed = multiplier
+}
+
+// SetStartTime skips all segments sent before t.
+func (r *Replayer) SetStartTime(t time.Time) {
+	r.startTime = t
+}
+
+// SetEndTime stops the replay at the first segment sent after t.
+func (r *Replayer) SetEndTime(t time.Time) {
+	r.endTime = t
+}
+
+// Replay writes each payload to w with a separate call to Write, which
+// for a UDP net.Conn sends each payload as a separate datagram.
+// Payloads that cannot be decoded as IEX-TP segments are written
+// immediately after the preceding payload.
+//
+// Returns the number of payloads written, and nil once the source
+// returns io.EOF or the end time is reached.
+func (r *Replayer) Replay(w io.Writer) (int, error) {
+	var firstSendTime, replayStart time.Time
+	nWritten := 0
+	for {
+		payload, err := r.source.NextPayload()
+		if err == io.EOF {
+			return nWritten, nil
+		} else if err != nil {
+			return nWritten, err
+		}
+
+		var header iextp.SegmentHeader
+		if err := header.Unmarshal(payload); err == nil && !header.SendTime.IsZero() {
+			sendTime := header.SendTime
+			if !r.startTime.IsZero() && sendTime.Before(r.startTime) {
+				continue
+			}
+			if !r.endTime.IsZero() && sendTime.After(r.endTime) {
+				return nWritten, nil
+			}
+
+			if firstSendTime.IsZero() {
+				firstSendTime = sendTime
+				replayStart = time.Now()
+			} else if r.speed > 0 {
+				offset := time.Duration(float64(sendTime.Sub(firstSendTime)) / r.speed)
+				if wait := time.Until(replayStart.Add(offset)); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+		} else if firstSendTime.IsZero() && !r.startTime.IsZero() {
+			// Not yet within the replay window.
+			continue
+		}
+
+		if _, err := w.Write(payload); err != nil {
+			return nWritten, err
+		}
+		nWritten++
+	}
+}
@@ -0,0 +1,98 @@
+package iex
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// payloadWriter records each payload written to it.
+type payloadWriter struct {
+	payloads [][]byte
+	times    []time.Time
+}
+
+func (pw *payloadWriter) Write(p []byte) (int, error) {
+	pw.payloads = append(pw.payloads, append([]byte(nil), p...))
+	pw.times = append(pw.times, time.Now())
+	return len(p), nil
+}
+
+// Decode the TradeIDs of the trade reports in the given payloads.
+func tradeIDsOf(t *testing.T, payloads [][]byte) []int64 {
+	return scanTradeIDs(t, NewPcapScanner(&payloadSource{payloads}))
+}
+
+func TestReplayer(t *testing.T) {
+	source := &payloadSource{[][]byte{
+		makeTestSegmentAt(t, testSendTime, 1, 1),
+		makeTestSegmentAt(t, testSendTime.Add(100*time.Millisecond), 2, 1),
+		[]byte("not a segment"),
+		makeTestSegmentAt(t, testSendTime.Add(200*time.Millisecond), 3, 1),
+	}}
+	expected := append([][]byte(nil), source.payloads...)
+
+	replayer := NewReplayer(source)
+	replayer.SetSpeed(2)
+	w := &payloadWriter{}
+	n, err := replayer.Replay(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != len(expected) || !reflect.DeepEqual(w.payloads, expected) {
+		t.Fatalf("replayed %d payloads, expected %d", n, len(expected))
+	}
+
+	// At 2x speed, the segments should be sent 50ms apart.
+	if elapsed := w.times[3].Sub(w.times[0]); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("replay took %v, expected 100ms", elapsed)
+	}
+	if elapsed := w.times[1].Sub(w.times[0]); elapsed < 50*time.Millisecond {
+		t.Fatalf("second segment was sent after %v, expected 50ms", elapsed)
+	}
+}
+
+func TestReplayer_Unpaced(t *testing.T) {
+	source := &payloadSource{[][]byte{
+		makeTestSegmentAt(t, testSendTime, 1, 1),
+		makeTestSegmentAt(t, testSendTime.Add(time.Hour), 2, 1),
+	}}
+
+	replayer := NewReplayer(source)
+	replayer.SetSpeed(0)
+	start := time.Now()
+	if n, err := replayer.Replay(&payloadWriter{}); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("replayed %d payloads, expected 2", n)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("unpaced replay took %v", elapsed)
+	}
+}
+
+func TestReplayer_Window(t *testing.T) {
+	source := makeLineSource(t, 10)
+	replayer := NewReplayer(source)
+	replayer.SetSpeed(0)
+	// makeTestSegment sends sequence number i at i milliseconds.
+	replayer.SetStartTime(testSendTime.Add(3 * time.Millisecond))
+	replayer.SetEndTime(testSendTime.Add(6 * time.Millisecond))
+
+	w := &payloadWriter{}
+	if _, err := replayer.Replay(w); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int64{3, 4, 5, 6}
+	if tradeIDs := tradeIDsOf(t, w.payloads); !reflect.DeepEqual(tradeIDs, expected) {
+		t.Fatalf("replayed: %v, expected: %v", tradeIDs, expected)
+	}
+
+	// The remaining segments should not have been read.
+	if len(source.payloads) != 3 {
+		t.Fatalf("expected 3 unread payloads, got %d", len(source.payloads))
+	}
+}
@@ -0,0 +1,243 @@
+package iex
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+)
+
+// IndexedPcapDataSource implements MetadataDataSource for an indexed pcap
+// or pcap-ng dump, which may be gzipped. A PcapScanner reading from an
+// IndexedPcapDataSource can seek to a send time or sequence number
+// with SeekTime or SeekSequence.
+type IndexedPcapDataSource struct {
+	r      io.ReaderAt
+	index  *PcapIndex
+	source *GopacketDataSource
+	closer io.Closer
+}
+
+// NewIndexedPcapDataSource creates a new IndexedPcapDataSource from the
+// dump in r, with the given index of it, starting from the first packet.
+func NewIndexedPcapDataSource(r io.ReaderAt, index *PcapIndex) (*IndexedPcapDataSource, error) {
+	ipds := &IndexedPcapDataSource{r: r, index: index}
+	if err := ipds.seek(nil); err != nil {
+		return nil, err
+	}
+	return ipds, nil
+}
+
+// OpenIndexedPcap opens the named pcap or pcap-ng dump with the index in
+// its sidecar file (see IndexFilename). If the sidecar file does not
+// exist or is out of date, the dump is indexed when it is opened.
+//
+// The dump is closed by Close.
+func OpenIndexedPcap(filename string) (*IndexedPcapDataSource, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := readIndexFor(f, filename)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	ipds, err := NewIndexedPcapDataSource(f, index)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	ipds.closer = f
+	return ipds, nil
+}
+
+// Read the sidecar index of f, or build it if it is missing or out of date.
+func readIndexFor(f *os.File, filename string) (*PcapIndex, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if idxf, err := os.Open(IndexFilename(filename)); err == nil {
+		index, err := ReadPcapIndex(idxf)
+		idxf.Close()
+		if err == nil && index.Size == stat.Size() {
+			return index, nil
+		}
+	}
+
+	return BuildPcapIndex(io.NewSectionReader(f, 0, stat.Size()))
+}
+
+// Index returns the index of the dump.
+func (ipds *IndexedPcapDataSource) Index() *PcapIndex {
+	return ipds.index
+}
+
+// Close closes the dump, if it was opened by OpenIndexedPcap.
+func (ipds *IndexedPcapDataSource) Close() error {
+	if ipds.closer != nil {
+		return ipds.closer.Close()
+	}
+	return nil
+}
+
+// NextPayload implements PacketDataSource.
+func (ipds *IndexedPcapDataSource) NextPayload() ([]byte, error) {
+	return ipds.source.NextPayload()
+}
+
+// NextPayloadWithMetadata implements MetadataDataSource.
+func (ipds *IndexedPcapDataSource) NextPayloadWithMetadata() ([]byte, PacketMetadata, error) {
+	return ipds.source.NextPayloadWithMetadata()
+}
+
+// Continue reading the dump from the given entry,
+// or from the start of the dump if it is nil.
+func (ipds *IndexedPcapDataSource) seek(entry *PcapIndexEntry) error {
+	size := ipds.index.Size
+	if entry == nil {
+		source, err := NewPcapDataSource(io.NewSectionReader(ipds.r, 0, size))
+		if err != nil {
+			return err
+		}
+		ipds.source = source
+		return nil
+	}
+
+	var stream io.Reader
+	if ipds.index.Gzipped {
+		cp := ipds.index.checkpoints[entry.checkpoint]
+		compressed := io.NewSectionReader(ipds.r, cp.In/8, size-cp.In/8)
+		inflater, err := resumeBlockInflater(bufio.NewReader(compressed), cp)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.CopyN(io.Discard, inflater, entry.Offset-cp.Out); err != nil {
+			return err
+		}
+		stream = inflater
+	} else {
+		stream = io.NewSectionReader(ipds.r, entry.Offset, size-entry.Offset)
+	}
+
+	// Prepend the header of the dump to the packet records.
+	source, err := NewPcapDataSource(
+		io.MultiReader(bytes.NewReader(ipds.index.Header), stream))
+	if err != nil {
+		return err
+	}
+
+	ipds.source = source
+	return nil
+}
+
+var errNotIndexed = errors.New("packet source is not an IndexedPcapDataSource")
+
+// SeekTime positions the scanner at the first segment sent at or after t,
+// so that the next message returned is the first message of that segment.
+// If there is no such segment, the scanner is positioned at the end of
+// the dump.
+//
+// The packet source of the scanner must be an IndexedPcapDataSource.
+// The state of the scanner's sessions is reset, so that the messages
+// preceding the position are not reported as a gap.
+func (p *PcapScanner) SeekTime(t time.Time) error {
+	source, ok := p.packetSource.(*IndexedPcapDataSource)
+	if !ok {
+		return errNotIndexed
+	}
+
+	_, _, err := p.seek(source, source.index.entryBeforeTime(t),
+		func(h *iextp.SegmentHeader) bool {
+			return !h.SendTime.Before(t)
+		})
+	return err
+}
+
+// SeekSequence positions the scanner so that the next message returned
+// is the message with the given sequence number, or the first message
+// after it if it is missing from the dump. If there is no such message,
+// the scanner is positioned at the end of the dump.
+//
+// Sequence numbers are those of the session of the first segment in the
+// dump, such as the single session of an IEX HIST dump. Messages of other
+// sessions that follow the position are returned as usual.
+//
+// The packet source of the scanner must be an IndexedPcapDataSource.
+// The state of the scanner's sessions is reset, and the messages of the
+// segment at the position that precede seq are dropped as duplicates.
+func (p *PcapScanner) SeekSequence(seq int64) error {
+	source, ok := p.packetSource.(*IndexedPcapDataSource)
+	if !ok {
+		return errNotIndexed
+	}
+
+	entry := source.index.entryBeforeSequence(seq)
+	if entry == nil {
+		_, _, err := p.seek(source, nil, nil)
+		return err
+	}
+
+	key := sessionKeyOf(&entry.Segment)
+	header, found, err := p.seek(source, entry,
+		func(h *iextp.SegmentHeader) bool {
+			return sessionKeyOf(h) == key &&
+				h.FirstMessageSequenceNumber+int64(h.MessageCount) > seq
+		})
+	if err != nil || !found {
+		return err
+	}
+
+	if header.FirstMessageSequenceNumber < seq {
+		p.sequences.resume(&header, seq)
+	}
+	return nil
+}
+
+// Reposition the source at the given entry, then read segments until one
+// satisfies isTarget, which is then returned by the next read from the
+// scanner. Returns the header of the segment, and whether it was found.
+func (p *PcapScanner) seek(source *IndexedPcapDataSource, entry *PcapIndexEntry,
+	isTarget func(h *iextp.SegmentHeader) bool) (iextp.SegmentHeader, bool, error) {
+	var header iextp.SegmentHeader
+	if err := source.seek(entry); err != nil {
+		return header, false, err
+	}
+
+	p.currentSegment = nil
+	p.currentMsgIndex = 0
+	p.segments = p.segments[:0]
+	p.segmentIndex = 0
+	p.sequences = newSequenceTracker()
+	p.unread = nil
+	if isTarget == nil {
+		return header, false, nil
+	}
+
+	for {
+		payload, metadata, err := source.NextPayloadWithMetadata()
+		if err == io.EOF {
+			return header, false, nil
+		} else if err != nil {
+			return header, false, err
+		}
+
+		if err := header.Unmarshal(payload); err != nil || !isTarget(&header) {
+			continue
+		}
+
+		p.unread = append(p.unread[:0], payload...)
+		p.unreadMetadata = metadata
+		return header, true, nil
+	}
+}
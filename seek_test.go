@@ -0,0 +1,217 @@
+package iex
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+)
+
+// The TradeIDs (and sequence numbers) of the messages
+// of makeIndexTestDump, starting at first.
+func indexTestTradeIDs(first, n int64) []int64 {
+	var result []int64
+	for id := first; id <= 5*n; id++ {
+		result = append(result, id)
+	}
+	return result
+}
+
+func newIndexedTestSource(t *testing.T, data []byte) *IndexedPcapDataSource {
+	builder := NewPcapIndexBuilder()
+	builder.SetSpan(16 << 10)
+	index, err := builder.Build(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := NewIndexedPcapDataSource(bytes.NewReader(data), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func TestPcapScanner_SeekTime(t *testing.T) {
+	const n = 2000
+	for _, format := range []PcapFormat{FormatPcap, FormatPcapNG} {
+		for _, gzipped := range []bool{false, true} {
+			data := makeIndexTestDump(t, format, gzipped, n)
+			scanner := NewPcapScanner(newIndexedTestSource(t, data))
+
+			// Segment with first sequence number seq is sent at seq ms.
+			for _, seq := range []int64{5001, 1, 9996, 2501, 6} {
+				sendTime := testSendTime.Add(time.Duration(seq) * time.Millisecond)
+				if err := scanner.SeekTime(sendTime.Add(-time.Microsecond)); err != nil {
+					t.Fatal(err)
+				}
+
+				tradeIDs := scanTradeIDs(t, scanner)
+				if expected := indexTestTradeIDs(seq, n); !reflect.DeepEqual(tradeIDs, expected) {
+					t.Fatalf("%v (gzipped: %v): seeking to %v: expected %v messages from %v, got %v from %v",
+						format, gzipped, sendTime, len(expected), seq, len(tradeIDs), tradeIDs[0])
+				}
+			}
+
+			if err := scanner.SeekTime(testSendTime.Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if tradeIDs := scanTradeIDs(t, scanner); len(tradeIDs) != 0 {
+				t.Fatalf("expected no messages after end, got: %v", len(tradeIDs))
+			}
+
+			if stats := scanner.Stats(); stats.Gaps != 0 || stats.DuplicateMessages != 0 {
+				t.Fatalf("unexpected stats: %+v", stats)
+			}
+		}
+	}
+}
+
+func TestPcapScanner_SeekSequence(t *testing.T) {
+	const n = 2000
+	for _, gzipped := range []bool{false, true} {
+		data := makeIndexTestDump(t, FormatPcap, gzipped, n)
+		scanner := NewPcapScanner(newIndexedTestSource(t, data))
+
+		for _, seq := range []int64{7003, 1, 5001, 10000, 42} {
+			if err := scanner.SeekSequence(seq); err != nil {
+				t.Fatal(err)
+			}
+
+			var tradeIDs []int64
+			err := scanner.Visit(func(msg iextp.Message) error {
+				tradeIDs = append(tradeIDs, msg.(*deep.TradeReportMessage).TradeID)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected := indexTestTradeIDs(seq, n); !reflect.DeepEqual(tradeIDs, expected) {
+				t.Fatalf("gzipped: %v: seeking to %v: expected %v messages, got %v from %v",
+					gzipped, seq, len(expected), len(tradeIDs), tradeIDs[0])
+			}
+		}
+
+		if err := scanner.SeekSequence(10001); err != nil {
+			t.Fatal(err)
+		}
+		if tradeIDs := scanTradeIDs(t, scanner); len(tradeIDs) != 0 {
+			t.Fatalf("expected no messages after end, got: %v", len(tradeIDs))
+		}
+
+		if stats := scanner.Stats(); stats.Gaps != 0 {
+			t.Fatalf("unexpected stats: %+v", stats)
+		}
+	}
+}
+
+func TestPcapScanner_SeekNotIndexed(t *testing.T) {
+	scanner := NewPcapScanner(&payloadSource{})
+	if err := scanner.SeekTime(testSendTime); err != errNotIndexed {
+		t.Fatalf("expected error, got: %v", err)
+	}
+	if err := scanner.SeekSequence(1); err != errNotIndexed {
+		t.Fatalf("expected error, got: %v", err)
+	}
+}
+
+func TestOpenIndexedPcap(t *testing.T) {
+	const n = 100
+	filename := filepath.Join(t.TempDir(), "test.pcap.gz")
+	if err := os.WriteFile(filename, makeIndexTestDump(t, FormatPcap, true, n), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a sidecar index.
+	source, err := OpenIndexedPcap(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := source.Index()
+	source.Close()
+
+	idxf, err := os.Create(IndexFilename(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := index.WriteTo(idxf); err != nil {
+		t.Fatal(err)
+	}
+	idxf.Close()
+
+	source, err = OpenIndexedPcap(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	if !reflect.DeepEqual(source.Index(), index) {
+		t.Fatal("sidecar index does not match built index")
+	}
+
+	scanner := NewPcapScanner(source)
+	if err := scanner.SeekSequence(251); err != nil {
+		t.Fatal(err)
+	}
+	if tradeIDs := scanTradeIDs(t, scanner); !reflect.DeepEqual(tradeIDs, indexTestTradeIDs(251, n)) {
+		t.Fatalf("unexpected messages: %v", tradeIDs)
+	}
+}
+
+func TestPcapScanner_SeekTime_DEEP10(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping pcap test in short mode.")
+	}
+
+	source, err := OpenIndexedPcap(filepath.Join("testdata", "DEEP10.pcap.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	// Record the segment header of each message.
+	scanner := NewPcapScanner(source)
+	var headers []iextp.SegmentHeader
+	err = scanner.Visit(func(msg iextp.Message) error {
+		headers = append(headers, scanner.SegmentHeader())
+		return nil
+	})
+	if err != nil && err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+
+	for _, i := range []int{0, 1000, len(headers) / 3, len(headers) * 9 / 10} {
+		// Find the first message of the segment.
+		for i > 0 && headers[i-1].SendTime.Equal(headers[i].SendTime) {
+			i--
+		}
+
+		if err := scanner.SeekTime(headers[i].SendTime); err != nil {
+			t.Fatal(err)
+		}
+
+		count := 0
+		err := scanner.Visit(func(msg iextp.Message) error {
+			if count == 0 && !reflect.DeepEqual(scanner.SegmentHeader(), headers[i]) {
+				t.Fatalf("expected segment %+v, got: %+v", headers[i], scanner.SegmentHeader())
+			}
+			count++
+			return nil
+		})
+		if err != nil && err != io.ErrUnexpectedEOF {
+			t.Fatal(err)
+		}
+
+		if count != len(headers)-i {
+			t.Fatalf("seeking to %v: expected %v messages, got: %v",
+				headers[i].SendTime, len(headers)-i, count)
+		}
+	}
+}
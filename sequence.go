@@ -0,0 +1,134 @@
+package iex
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+)
+
+// Gap describes a range of messages that were not received
+// from an IEX-TP session.
+type Gap struct {
+	MessageProtocolID uint16
+	ChannelID         uint32
+	SessionID         uint32
+	// Sequence number of the first missing message.
+	FirstSequenceNumber int64
+	// Number of missing messages.
+	Count int64
+}
+
+// End returns the sequence number of the first message after the gap.
+func (g Gap) End() int64 {
+	return g.FirstSequenceNumber + g.Count
+}
+
+func (g Gap) String() string {
+	return fmt.Sprintf("session %v (protocol %#x, channel %v): missing %v messages [%v, %v)",
+		g.SessionID, g.MessageProtocolID, g.ChannelID,
+		g.Count, g.FirstSequenceNumber, g.End())
+}
+
+// ScannerStats contains counters maintained by a PcapScanner.
+type ScannerStats struct {
+	// Number of segments decoded, including heartbeats.
+	Segments int64
+	// Number of messages returned by NextMessage.
+	Messages int64
+	// Number of gaps detected in message sequence numbers
+	// that could not be recovered.
+	Gaps int64
+	// Total number of messages missing from all gaps.
+	MissingMessages int64
+	// Number of missing messages that were filled by the GapRecoverer.
+	RecoveredMessages int64
+	// Number of messages dropped because they had already been received.
+	DuplicateMessages int64
+	// Number of segments skipped because they did not match
+	// the segment filters.
+	FilteredSegments int64
+	// Number of payloads skipped because they could not be decoded.
+	UndecodablePayloads int64
+}
+
+// Identifies a stream of sequenced messages.
+type sessionKey struct {
+	messageProtocolID uint16
+	channelID         uint32
+	sessionID         uint32
+}
+
+func sessionKeyOf(h *iextp.SegmentHeader) sessionKey {
+	return sessionKey{h.MessageProtocolID, h.ChannelID, h.SessionID}
+}
+
+// sequenceTracker tracks the next expected message sequence number
+// for each session in order to detect gaps and duplicates.
+type sequenceTracker struct {
+	nextSeq  map[sessionKey]int64
+	lastSent map[sessionKey]time.Time
+}
+
+func newSequenceTracker() *sequenceTracker {
+	return &sequenceTracker{
+		nextSeq:  make(map[sessionKey]int64),
+		lastSent: make(map[sessionKey]time.Time),
+	}
+}
+
+// Check the given segment header against the expected sequence number
+// for its session. Returns the number of leading messages in the segment
+// that have already been seen, and the gap preceding the segment
+// (if any, Gap.Count is zero otherwise).
+//
+// A segment with StreamOffset 0 and sequence number 1 that was sent
+// after all previous segments of the session restarts the session's
+// sequence, whereas a retransmission of the first segment would have
+// its original SendTime.
+func (st *sequenceTracker) check(h *iextp.SegmentHeader) (nDuplicate int, gap Gap) {
+	key := sessionKeyOf(h)
+	first := h.FirstMessageSequenceNumber
+	end := first + int64(h.MessageCount)
+
+	next, ok := st.nextSeq[key]
+	lastSent := st.lastSent[key]
+	if h.SendTime.After(lastSent) {
+		st.lastSent[key] = h.SendTime
+	}
+
+	isRestart := first == 1 && h.StreamOffset == 0 && h.SendTime.After(lastSent)
+	if !ok || isRestart {
+		st.nextSeq[key] = end
+		return 0, gap
+	}
+
+	if first > next {
+		gap = Gap{
+			MessageProtocolID:   h.MessageProtocolID,
+			ChannelID:           h.ChannelID,
+			SessionID:           h.SessionID,
+			FirstSequenceNumber: next,
+			Count:               first - next,
+		}
+	} else if first < next {
+		nDuplicate = int(next - first)
+		if nDuplicate > int(h.MessageCount) {
+			nDuplicate = int(h.MessageCount)
+		}
+	}
+
+	if end > next {
+		st.nextSeq[key] = end
+	}
+
+	return nDuplicate, gap
+}
+
+// Expect the next message of the session of h to have sequence number
+// seq, as if all messages preceding it had already been received.
+func (st *sequenceTracker) resume(h *iextp.SegmentHeader, seq int64) {
+	key := sessionKeyOf(h)
+	st.nextSeq[key] = seq
+	st.lastSent[key] = h.SendTime
+}
@@ -0,0 +1,171 @@
+package iex
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+)
+
+const testSessionID uint32 = 1132527616
+
+// payloadSource implements PacketDataSource for a fixed list of payloads.
+type payloadSource struct {
+	payloads [][]byte
+}
+
+func (ps *payloadSource) NextPayload() ([]byte, error) {
+	if len(ps.payloads) == 0 {
+		return nil, io.EOF
+	}
+
+	payload := ps.payloads[0]
+	ps.payloads = ps.payloads[1:]
+	return payload, nil
+}
+
+var testSendTime = time.Date(2017, time.April, 25, 15, 3, 18, 0, time.UTC)
+
+// Create an encoded DEEP segment with nMessages trade reports,
+// starting at sequence number firstSeq. The TradeID of each
+// trade report is set to its sequence number.
+func makeTestSegment(t *testing.T, firstSeq int64, nMessages int) []byte {
+	sendTime := testSendTime.Add(time.Duration(firstSeq) * time.Millisecond)
+	return makeTestSegmentAt(t, sendTime, firstSeq, nMessages)
+}
+
+func makeTestSegmentAt(t *testing.T, sendTime time.Time, firstSeq int64, nMessages int) []byte {
+	segment := iextp.Segment{
+		Header: iextp.SegmentHeader{
+			Version:                    1,
+			MessageProtocolID:          deep.V_1_0_MessageProtocolID,
+			ChannelID:                  deep.ChannelID,
+			SessionID:                  testSessionID,
+			StreamOffset:               38 * (firstSeq - 1),
+			FirstMessageSequenceNumber: firstSeq,
+			SendTime:                   sendTime,
+		},
+	}
+
+	for i := 0; i < nMessages; i++ {
+		seq := firstSeq + int64(i)
+		segment.Messages = append(segment.Messages, &deep.TradeReportMessage{
+			MessageType: deep.TradeReport,
+			Timestamp:   segment.Header.SendTime,
+			Symbol:      "ZIEXT",
+			Size:        100,
+			Price:       99.05,
+			TradeID:     seq,
+		})
+	}
+
+	buf, err := segment.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// Read all messages from the scanner and return their TradeIDs.
+func scanTradeIDs(t *testing.T, scanner *PcapScanner) []int64 {
+	var result []int64
+	for {
+		msg, err := scanner.NextMessage()
+		if err == io.EOF {
+			return result
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		result = append(result, msg.(*deep.TradeReportMessage).TradeID)
+	}
+}
+
+func TestPcapScanner_Gaps(t *testing.T) {
+	source := &payloadSource{[][]byte{
+		makeTestSegment(t, 1, 0), // Heartbeat
+		makeTestSegment(t, 1, 2),
+		makeTestSegment(t, 3, 1),
+		makeTestSegment(t, 6, 2), // Missing 4-5
+		makeTestSegment(t, 8, 0), // Heartbeat
+		makeTestSegment(t, 9, 1), // Missing 8
+	}}
+
+	scanner := NewPcapScanner(source)
+	var gaps []Gap
+	scanner.SetGapHandler(func(gap Gap) {
+		gaps = append(gaps, gap)
+	})
+
+	tradeIDs := scanTradeIDs(t, scanner)
+	expectedIDs := []int64{1, 2, 3, 6, 7, 9}
+	if !reflect.DeepEqual(tradeIDs, expectedIDs) {
+		t.Fatalf("scanned: %v, expected: %v", tradeIDs, expectedIDs)
+	}
+
+	expectedGaps := []Gap{
+		{deep.V_1_0_MessageProtocolID, deep.ChannelID, testSessionID, 4, 2},
+		{deep.V_1_0_MessageProtocolID, deep.ChannelID, testSessionID, 8, 1},
+	}
+	if !reflect.DeepEqual(gaps, expectedGaps) {
+		t.Fatalf("gaps: %v, expected: %v", gaps, expectedGaps)
+	}
+
+	expectedStats := ScannerStats{
+		Segments:        6,
+		Messages:        6,
+		Gaps:            2,
+		MissingMessages: 3,
+	}
+	if stats := scanner.Stats(); stats != expectedStats {
+		t.Fatalf("stats: %+v, expected: %+v", stats, expectedStats)
+	}
+}
+
+func TestPcapScanner_Duplicates(t *testing.T) {
+	source := &payloadSource{[][]byte{
+		makeTestSegment(t, 1, 3),
+		makeTestSegment(t, 1, 3), // Exact duplicate
+		makeTestSegment(t, 2, 3), // Partially overlapping
+		makeTestSegment(t, 5, 1),
+		makeTestSegment(t, 4, 1), // Late duplicate
+	}}
+
+	scanner := NewPcapScanner(source)
+	scanner.SetGapHandler(func(gap Gap) {
+		t.Fatalf("unexpected gap: %v", gap)
+	})
+
+	tradeIDs := scanTradeIDs(t, scanner)
+	expectedIDs := []int64{1, 2, 3, 4, 5}
+	if !reflect.DeepEqual(tradeIDs, expectedIDs) {
+		t.Fatalf("scanned: %v, expected: %v", tradeIDs, expectedIDs)
+	}
+
+	if dups := scanner.Stats().DuplicateMessages; dups != 6 {
+		t.Fatalf("expected 6 duplicate messages, got %v", dups)
+	}
+}
+
+func TestPcapScanner_SessionRestart(t *testing.T) {
+	source := &payloadSource{[][]byte{
+		makeTestSegment(t, 1, 3),
+		// The stream restarts from the beginning.
+		makeTestSegmentAt(t, testSendTime.Add(time.Second), 1, 2),
+		makeTestSegmentAt(t, testSendTime.Add(2*time.Second), 3, 1),
+	}}
+
+	scanner := NewPcapScanner(source)
+	tradeIDs := scanTradeIDs(t, scanner)
+	expectedIDs := []int64{1, 2, 3, 1, 2, 3}
+	if !reflect.DeepEqual(tradeIDs, expectedIDs) {
+		t.Fatalf("scanned: %v, expected: %v", tradeIDs, expectedIDs)
+	}
+
+	if stats := scanner.Stats(); stats.Gaps != 0 || stats.DuplicateMessages != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
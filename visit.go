@@ -0,0 +1,159 @@
+package iex
+
+import (
+	"errors"
+	"io"
+
+	"github.com/xuforr/go-iex/iextp"
+)
+
+// Visit calls visit with each of the remaining messages from the packet
+// source, in order, until the source returns io.EOF (in which case Visit
+// returns nil) or another error, or visit returns an error.
+//
+// Visit is a faster alternative to calling NextMessage in a loop: messages
+// are decoded into structs that are reused for every message of the same
+// type, so that scanning does not allocate for each segment and message.
+// The message passed to visit is therefore only valid for the duration
+// of the call, and must be copied if it is retained.
+//
+// Duplicate detection, gap recovery, segment filters and Stats apply as for
+// NextMessage, and SegmentHeader and PacketMetadata may be called from visit.
+// However, since messages are visited as they are decoded, the messages of
+// a segment preceding one that cannot be decoded are still visited.
+func (p *PcapScanner) Visit(visit func(msg iextp.Message) error) error {
+	// Visit any messages that were decoded by a previous call to NextMessage.
+	for p.currentMsgIndex < len(p.currentSegment) {
+		msg, _ := p.NextMessage()
+		if err := visit(msg); err != nil {
+			return err
+		}
+	}
+
+	if p.decodesConcurrently() {
+		return p.visitDecoded(visit)
+	}
+
+	if p.reader == nil {
+		p.reader = p.decoder.NewSegmentReader()
+	}
+
+	for {
+		payload, metadata, err := p.nextPayload()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if len(p.segmentFilters) != 0 {
+			var header iextp.SegmentHeader
+			if err := header.Unmarshal(payload); err != nil {
+				if p.skipUndecodable {
+					p.stats.UndecodablePayloads++
+					continue
+				}
+				return err
+			}
+
+			if !matchesSegmentFilters(p.segmentFilters, &header) {
+				p.stats.FilteredSegments++
+				continue
+			}
+		}
+
+		if err := p.reader.Reset(payload); err != nil {
+			if p.skipUndecodable {
+				p.stats.UndecodablePayloads++
+				continue
+			}
+			return err
+		}
+
+		if err := p.visitSegment(metadata, visit); err != nil {
+			if err == errUndecodableMessage {
+				p.stats.UndecodablePayloads++
+				continue
+			}
+			return err
+		}
+	}
+}
+
+// Returned by visitSegment if a message could not be decoded
+// and undecodable payloads are skipped.
+var errUndecodableMessage = errors.New("undecodable message")
+
+// Visit the messages of the segment in p.reader.
+func (p *PcapScanner) visitSegment(metadata PacketMetadata, visit func(msg iextp.Message) error) error {
+	header := p.reader.Header()
+	p.stats.Segments++
+	nDuplicate, gap := p.sequences.check(header)
+	p.stats.DuplicateMessages += int64(nDuplicate)
+
+	segments := p.segments[:0]
+	var recovered []iextp.Message
+	if gap.Count != 0 {
+		recovered, segments = p.handleGap(gap, segments)
+	}
+	p.segments = append(segments, scannedSegment{
+		header:   *header,
+		metadata: metadata,
+		start:    len(recovered),
+	})
+	p.segmentIndex = 0
+	p.currentSegment = nil
+	p.currentMsgIndex = 0
+
+	for i, msg := range recovered {
+		for p.segments[p.segmentIndex+1].start <= i {
+			p.segmentIndex++
+		}
+		p.stats.Messages++
+		if err := visit(msg); err != nil {
+			return err
+		}
+	}
+
+	p.segmentIndex = len(p.segments) - 1
+	if err := p.reader.Skip(nDuplicate); err != nil {
+		return p.undecodable(err)
+	}
+
+	for {
+		msg, err := p.reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return p.undecodable(err)
+		}
+
+		p.stats.Messages++
+		if err := visit(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *PcapScanner) undecodable(err error) error {
+	if p.skipUndecodable {
+		return errUndecodableMessage
+	}
+	return err
+}
+
+// Visit the messages of segments decoded concurrently by the packet source.
+func (p *PcapScanner) visitDecoded(visit func(msg iextp.Message) error) error {
+	for {
+		msg, err := p.NextMessage()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := visit(msg); err != nil {
+			return err
+		}
+	}
+}
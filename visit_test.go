@@ -0,0 +1,289 @@
+package iex
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/xuforr/go-iex/iextp"
+	"github.com/xuforr/go-iex/iextp/deep"
+)
+
+func visitTradeIDs(t *testing.T, scanner *PcapScanner) []int64 {
+	var result []int64
+	err := scanner.Visit(func(msg iextp.Message) error {
+		result = append(result, msg.(*deep.TradeReportMessage).TradeID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestPcapScanner_Visit(t *testing.T) {
+	source := &payloadSource{[][]byte{
+		makeTestSegment(t, 1, 2),
+		makeTestSegment(t, 2, 2), // Duplicate 2
+		makeTestSegment(t, 8, 2), // Missing 4-7
+	}}
+	recoverer := &testRecoverer{
+		payloads: [][]byte{makeTestSegment(t, 4, 2), makeTestSegment(t, 6, 2)},
+	}
+
+	scanner := NewPcapScanner(source)
+	scanner.SetGapRecoverer(recoverer)
+	var sequences []int64
+	err := scanner.Visit(func(msg iextp.Message) error {
+		header := scanner.SegmentHeader()
+		trade := msg.(*deep.TradeReportMessage)
+		// Each test segment starts with the trade whose ID is its sequence number.
+		if trade.TradeID < header.FirstMessageSequenceNumber ||
+			trade.TradeID >= header.FirstMessageSequenceNumber+int64(header.MessageCount) {
+			t.Fatalf("trade %v visited with segment header %+v", trade.TradeID, header)
+		}
+		sequences = append(sequences, trade.TradeID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []int64{1, 2, 3, 4, 5, 6, 7, 8, 9}; !reflect.DeepEqual(sequences, expected) {
+		t.Fatalf("visited: %v, expected: %v", sequences, expected)
+	}
+
+	stats := scanner.Stats()
+	if stats.Messages != 9 || stats.DuplicateMessages != 1 || stats.RecoveredMessages != 4 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestPcapScanner_VisitAfterNextMessage(t *testing.T) {
+	scanner := NewPcapScanner(&payloadSource{[][]byte{
+		makeTestSegment(t, 1, 3),
+		makeTestSegment(t, 4, 1),
+	}})
+
+	if _, err := scanner.NextMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if tradeIDs := visitTradeIDs(t, scanner); !reflect.DeepEqual(tradeIDs, []int64{2, 3, 4}) {
+		t.Fatalf("visited: %v", tradeIDs)
+	}
+}
+
+func TestPcapScanner_VisitError(t *testing.T) {
+	scanner := NewPcapScanner(&payloadSource{[][]byte{makeTestSegment(t, 1, 3)}})
+	errStop := errors.New("stop")
+	n := 0
+	err := scanner.Visit(func(msg iextp.Message) error {
+		n++
+		return errStop
+	})
+	if err != errStop || n != 1 {
+		t.Fatalf("expected visit to stop after 1 message with %v, got %v after %v", errStop, err, n)
+	}
+}
+
+func TestPcapScanner_VisitSkipUndecodable(t *testing.T) {
+	scanner := NewPcapScanner(makeMixedSource(t))
+	if err := scanner.Visit(func(iextp.Message) error { return nil }); err == nil {
+		t.Fatal("expected error decoding unrelated traffic")
+	}
+
+	scanner = NewPcapScanner(makeMixedSource(t))
+	scanner.SetSkipUndecodable(true)
+	scanner.SetSegmentFilters(MatchChannel(deep.ChannelID))
+	n := 0
+	if err := scanner.Visit(func(iextp.Message) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if stats := scanner.Stats(); n != 3 || stats.UndecodablePayloads != 2 {
+		t.Fatalf("visited %v messages, stats: %+v", n, stats)
+	}
+}
+
+// Read all payloads from the given test pcap file into memory.
+func readTestPayloads(tb testing.TB, filename string) [][]byte {
+	f, err := os.Open(filepath.Join("testdata", filename))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+
+	packetDataSource, err := NewPcapDataSource(f)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var payloads [][]byte
+	for {
+		payload, err := packetDataSource.NextPayload()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return payloads
+		} else if err != nil {
+			tb.Fatal(err)
+		}
+
+		payloads = append(payloads, append([]byte(nil), payload...))
+	}
+}
+
+func TestPcapScanner_VisitMatchesNextMessage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping pcap test in short mode.")
+	}
+
+	for _, filename := range []string{"DEEP10.pcap.gz", "TOPS16.pcapng.gz"} {
+		t.Run(filename, func(t *testing.T) {
+			payloads := readTestPayloads(t, filename)
+			scanner := NewPcapScanner(&payloadSource{payloads})
+			visitor := NewPcapScanner(&payloadSource{payloads})
+
+			err := visitor.Visit(func(msg iextp.Message) error {
+				expected, err := scanner.NextMessage()
+				if err != nil {
+					return err
+				}
+
+				if reflect.TypeOf(msg) != reflect.TypeOf(expected) {
+					t.Fatalf("visited %T, expected %T", msg, expected)
+				}
+				buf, err := msg.(iextp.Marshaler).Marshal()
+				if err != nil {
+					return err
+				}
+				expectedBuf, err := expected.(iextp.Marshaler).Marshal()
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(buf, expectedBuf) {
+					t.Fatalf("visited: %v, expected: %v", msg, expected)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := scanner.NextMessage(); err != io.EOF {
+				t.Fatalf("expected all messages to be visited, got %v", err)
+			}
+			if visitor.Stats() != scanner.Stats() {
+				t.Fatalf("stats: %+v, expected: %+v", visitor.Stats(), scanner.Stats())
+			}
+		})
+	}
+}
+
+func TestPcapScanner_VisitAllocs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping pcap test in short mode.")
+	}
+
+	payloads := readTestPayloads(t, "DEEP10.pcap.gz")
+	// Warm up the symbol cache.
+	scanner := NewPcapScanner(&payloadSource{payloads})
+	if err := scanner.Visit(func(iextp.Message) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &payloadSource{}
+	scanner = NewPcapScanner(source)
+	// Allocations per full pass over the pcap.
+	allocs := testing.AllocsPerRun(1, func() {
+		source.payloads = payloads
+		if err := scanner.Visit(func(iextp.Message) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Session restarts and segment bookkeeping may allocate,
+	// but decoding should not allocate for each message.
+	if allocs > float64(len(payloads))/100 {
+		t.Fatalf("%v allocations to visit %v segments", allocs, len(payloads))
+	}
+}
+
+func benchmarkPcapScanner(b *testing.B, filename string, visit bool) {
+	payloads := readTestPayloads(b, filename)
+	var nBytes int64
+	for _, payload := range payloads {
+		nBytes += int64(len(payload))
+	}
+
+	b.SetBytes(nBytes)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		scanner := NewPcapScanner(&payloadSource{payloads})
+		if visit {
+			if err := scanner.Visit(func(iextp.Message) error { return nil }); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+
+		for {
+			if _, err := scanner.NextMessage(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkPcapScanner_NextMessage_DEEP10(b *testing.B) {
+	benchmarkPcapScanner(b, "DEEP10.pcap.gz", false)
+}
+
+func BenchmarkPcapScanner_Visit_DEEP10(b *testing.B) {
+	benchmarkPcapScanner(b, "DEEP10.pcap.gz", true)
+}
+
+func BenchmarkPcapScanner_NextMessage_TOPS16(b *testing.B) {
+	benchmarkPcapScanner(b, "TOPS16.pcapng.gz", false)
+}
+
+func BenchmarkPcapScanner_Visit_TOPS16(b *testing.B) {
+	benchmarkPcapScanner(b, "TOPS16.pcapng.gz", true)
+}
+
+// Benchmark decoding directly from the compressed pcap file,
+// including packet capture parsing.
+func BenchmarkPcapScanner_VisitFile_DEEP10(b *testing.B) {
+	f, err := os.Open(filepath.Join("testdata", "DEEP10.pcap.gz"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(stat.Size())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		packetDataSource, err := NewPcapDataSource(f)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		scanner := NewPcapScanner(packetDataSource)
+		err = scanner.Visit(func(iextp.Message) error { return nil })
+		if err != nil && err != io.ErrUnexpectedEOF {
+			b.Fatal(err)
+		}
+	}
+}